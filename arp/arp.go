@@ -2,6 +2,7 @@ package arp
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"github.com/arcpop/network/ethernet"
 	"github.com/arcpop/network/netdev"
@@ -33,14 +34,34 @@ type Header struct {
 	targetProtoAddr net.IP
 }
 
-//Start starts the arp layer
+//Start starts the arp layer on the default cache
 func Start() {
-	ethernet.ArpIn = in
-	arpCache = make(map[uint32]*arpCacheEntry)
-	go arpTicker()
+	ethernet.Default.ArpIn = Default.In
+	Default.Start(context.Background())
 }
 
-func in(pkt *ethernet.Layer2Packet) {
+//Stop stops the default cache
+func Stop() {
+	Default.Stop()
+}
+
+//Start starts aging the cache entries until ctx is done or Stop is called
+func (c *Cache) Start(ctx context.Context) {
+	ctx, c.cancel = context.WithCancel(ctx)
+	c.workers.Add(1)
+	go c.arpTicker(ctx)
+}
+
+//Stop stops aging the cache entries and waits for the worker to exit
+func (c *Cache) Stop() {
+	if c.cancel != nil {
+		c.cancel()
+	}
+	c.workers.Wait()
+}
+
+//In handles a received arp packet, it is meant to be set as ethernet.Layer.ArpIn
+func (c *Cache) In(pkt *ethernet.Layer2Packet) {
 	
 	if len(pkt.Data) < HeaderLength {
 		log.Println("Arp: Packet too short!")
@@ -65,7 +86,7 @@ func in(pkt *ethernet.Layer2Packet) {
 	}
 	
 	arpPkt := &packet{dev: pkt.Dev, ethHdr: pkt.L2Header, arpHdr: hdr}
-	go handlePacket(arpPkt)
+	go c.handlePacket(arpPkt)
 }
 
 func arpRequest(targetIP net.IP, dev netdev.Interface) {
@@ -80,13 +101,14 @@ func arpRequest(targetIP net.IP, dev netdev.Interface) {
 	arpPkt[5] = 4
 	binary.BigEndian.PutUint16(arpPkt[6:8], 1)
 	copy(arpPkt[8:14], dev.GetHardwareAddress())
-	copy(arpPkt[14:18], dev.GetIPv4Address())
+	copy(arpPkt[14:18], netdev.IPv4SourceAddress(dev, targetIP))
 	copy(arpPkt[18:24], BroadcastMACAddress)
 	copy(arpPkt[24:28], targetIP)
 	dev.TxPacket(buf)
 }
 
-func arpReply(targetIP net.IP, targetMAC net.HardwareAddr,dev netdev.Interface) {
+//arpReply answers a request for srcIP, which is one of the addresses of dev.
+func arpReply(srcIP, targetIP net.IP, targetMAC net.HardwareAddr,dev netdev.Interface) {
 	buf := make([]byte, HeaderLength+ethernet.HeaderLength)
 	copy(buf[0:6], targetMAC)
 	copy(buf[6:12], dev.GetHardwareAddress())
@@ -98,28 +120,28 @@ func arpReply(targetIP net.IP, targetMAC net.HardwareAddr,dev netdev.Interface)
 	arpPkt[5] = 4
 	binary.BigEndian.PutUint16(arpPkt[6:8], 2)
 	copy(arpPkt[8:14], dev.GetHardwareAddress())
-	copy(arpPkt[14:18], dev.GetIPv4Address())
+	copy(arpPkt[14:18], srcIP)
 	copy(arpPkt[18:24], targetMAC)
 	copy(arpPkt[24:28], targetIP)
 	dev.TxPacket(buf)
 }
 
-func handlePacket(arpPkt *packet) {
+func (c *Cache) handlePacket(arpPkt *packet) {
 	if arpPkt.arpHdr.opcode == 1 {
 		if arpPkt.arpHdr.targetProtoAddr.IsMulticast() {
 			log.Println("Arp: Dropping an ipv4 multicast address packet")
 			return
 		}
-		//Request, check if for this device's IP address.
-		if bytes.Compare(arpPkt.arpHdr.targetProtoAddr, arpPkt.dev.GetIPv4Address()) == 0 {
-			arpReply(arpPkt.arpHdr.srcProtoAddr, arpPkt.arpHdr.srcHWAddr, arpPkt.dev)
+		//Request, check if for one of this device's IP addresses.
+		if netdev.HasIPv4Address(arpPkt.dev, arpPkt.arpHdr.targetProtoAddr) {
+			arpReply(arpPkt.arpHdr.targetProtoAddr, arpPkt.arpHdr.srcProtoAddr, arpPkt.arpHdr.srcHWAddr, arpPkt.dev)
 		} 
 		
 	} 
 	
 		
 	//We update also from arp requests since this improves our cache
-	cacheUpdate(arpPkt.dev, arpPkt.arpHdr.srcProtoAddr, arpPkt.arpHdr.srcHWAddr)
+	c.cacheUpdate(arpPkt.dev, arpPkt.arpHdr.srcProtoAddr, arpPkt.arpHdr.srcHWAddr)
 }
 
 func parseArpHeader(pkt []byte) *Header {
@@ -9,6 +9,7 @@ import (
 	"log"
 	"github.com/arcpop/network/util"
 	"encoding/binary"
+	"context"
 )
 
 var (
@@ -35,16 +36,33 @@ type arpCacheEntry struct {
     queuedPackets chan []byte
 }
 
-var (
+//Cache is the arp cache of one stack.
+type Cache struct {
     arpCache map[uint32] *arpCacheEntry
     arpCacheLock sync.RWMutex
-)
+    
+    cancel context.CancelFunc
+    workers sync.WaitGroup
+}
 
-//SetMACAndSend should be used by ipv4 layer to send packets. They get the destination mac assigned automatically.
+//Default is the cache used by the package level functions.
+var Default = NewCache()
+
+//NewCache creates an empty arp cache, Start has to be called to age its entries.
+func NewCache() *Cache {
+    return &Cache{ arpCache: make(map[uint32]*arpCacheEntry) }
+}
+
+//SetMACAndSend sends the packet using the default cache.
 func SetMACAndSend(dev netdev.Interface, pkt []byte, targetIP net.IP) {
-    arpCacheLock.Lock()
+    Default.SetMACAndSend(dev, pkt, targetIP)
+}
+
+//SetMACAndSend should be used by ipv4 layer to send packets. They get the destination mac assigned automatically.
+func (c *Cache) SetMACAndSend(dev netdev.Interface, pkt []byte, targetIP net.IP) {
+    c.arpCacheLock.Lock()
     ip32 := util.IPToUint32(targetIP)
-    e, ok := arpCache[ip32]
+    e, ok := c.arpCache[ip32]
     if !ok {
         e = &arpCacheEntry{
             dev: dev,
@@ -54,18 +72,28 @@ func SetMACAndSend(dev netdev.Interface, pkt []byte, targetIP net.IP) {
             queuedPackets: make(chan []byte, 1024),
         }
         e.queuedPackets <- pkt
-        arpCache[ip32] = e
-        arpCacheLock.Unlock()
+        c.arpCache[ip32] = e
+        c.arpCacheLock.Unlock()
         go arpRequest(targetIP, dev)
         return
     }
-    arpCacheLock.Unlock()
+    if e.state == waiting {
+        //The request is still pending, the packet is sent once the reply arrives
+        select {
+            case e.queuedPackets <- pkt:
+            default:
+                log.Println("Arp: Queue full, dropping packet.")
+        }
+        c.arpCacheLock.Unlock()
+        return
+    }
+    c.arpCacheLock.Unlock()
     copy(pkt[0:6], e.mac)
     copy(pkt[6:12], e.dev.GetHardwareAddress())
     binary.BigEndian.PutUint16(pkt[12:14], 0x0800)
     e.dev.TxPacket(pkt)
 }
-func arpCacheInsert(dev netdev.Interface, ip net.IP, mac net.HardwareAddr)  {
+func (c *Cache) arpCacheInsert(dev netdev.Interface, ip net.IP, mac net.HardwareAddr)  {
     ip32 := util.IPToUint32(ip)
     ae := & arpCacheEntry{
         state: resolved,
@@ -74,67 +102,72 @@ func arpCacheInsert(dev netdev.Interface, ip net.IP, mac net.HardwareAddr)  {
         ttl: DefaultTTL,
     }
     copy(ae.mac, mac)
-    arpCacheLock.Lock()
-    oldEntry, ok := arpCache[ip32]
-    arpCache[ip32] = ae
-    arpCacheLock.Unlock()
-    if ok {
-        go sendQueuedPackets(oldEntry)
+    c.arpCacheLock.Lock()
+    oldEntry, ok := c.arpCache[ip32]
+    c.arpCache[ip32] = ae
+    c.arpCacheLock.Unlock()
+    if ok && oldEntry.state == waiting {
+        go sendQueuedPackets(oldEntry, ae)
     }
 }
 func PassiveLearn(iface netdev.Interface, ip net.IP, mac net.HardwareAddr)  {
+    Default.PassiveLearn(iface, ip, mac)
+}
+
+func (c *Cache) PassiveLearn(iface netdev.Interface, ip net.IP, mac net.HardwareAddr)  {
     ip32 := util.IPToUint32(ip)
-    arpCacheLock.Lock()
-    e, ok := arpCache[ip32]
+    c.arpCacheLock.Lock()
+    e, ok := c.arpCache[ip32]
     if !ok {
-        arpCacheLock.Unlock()
+        c.arpCacheLock.Unlock()
         return
     }
     if e.state == waiting {
-        arpCacheLock.Unlock()
-        go arpCacheInsert(iface, ip, mac)
+        c.arpCacheLock.Unlock()
+        go c.arpCacheInsert(iface, ip, mac)
         return
     }
     //Check if there was some left over wrong entry
     if bytes.Compare(mac, e.mac) != 0 {
-        delete(arpCache, ip32)
-        arpCacheLock.Unlock()
-        go arpCacheInsert(iface, ip, mac)
+        delete(c.arpCache, ip32)
+        c.arpCacheLock.Unlock()
+        go c.arpCacheInsert(iface, ip, mac)
         return
     }
     e.ttl = DefaultTTL
-    arpCacheLock.Unlock()
+    c.arpCacheLock.Unlock()
 }
 
-func cacheUpdate(dev netdev.Interface, ip net.IP, mac net.HardwareAddr) {
+func (c *Cache) cacheUpdate(dev netdev.Interface, ip net.IP, mac net.HardwareAddr) {
     ip32 := util.IPToUint32(ip)
-    arpCacheLock.Lock()
-    e, ok := arpCache[ip32]
+    c.arpCacheLock.Lock()
+    e, ok := c.arpCache[ip32]
     if !ok || e.state == waiting {
-        arpCacheLock.Unlock()
-        arpCacheInsert(dev, ip, mac)
+        c.arpCacheLock.Unlock()
+        c.arpCacheInsert(dev, ip, mac)
         return
     }
     //Check if there was some left over wrong entry
     if bytes.Compare(mac, e.mac) != 0 {
-        delete(arpCache, ip32)
-        arpCacheLock.Unlock()
-        arpCacheInsert(dev, ip, mac)
+        delete(c.arpCache, ip32)
+        c.arpCacheLock.Unlock()
+        c.arpCacheInsert(dev, ip, mac)
         return
     }
     e.ttl = DefaultTTL
-    arpCacheLock.Unlock()
+    c.arpCacheLock.Unlock()
 }
 
-func sendQueuedPackets(e *arpCacheEntry) {
+//sendQueuedPackets sends the packets queued on the waiting entry to the address of the resolved entry.
+func sendQueuedPackets(e, resolved *arpCacheEntry) {
     if e.queuedPackets != nil {
         for {
             select {
                 case pkt := <- e.queuedPackets:
-                    copy(pkt[0:6], e.mac)
-                    copy(pkt[6:12], e.dev.GetHardwareAddress())
+                    copy(pkt[0:6], resolved.mac)
+                    copy(pkt[6:12], resolved.dev.GetHardwareAddress())
                     binary.BigEndian.PutUint16(pkt[12:14], 0x0800)
-                    e.dev.TxPacket(pkt)
+                    resolved.dev.TxPacket(pkt)
                 default:
                     close(e.queuedPackets)
                     return
@@ -159,11 +192,18 @@ func dropQueuedPackets(e *arpCacheEntry) {
     }
 }
 
-func arpTicker() {
+func (c *Cache) arpTicker(ctx context.Context) {
+    defer c.workers.Done()
     tckr := time.NewTicker(time.Second)
-    for _ = range tckr.C {
-        arpCacheLock.Lock()
-        for k,v := range arpCache {
+    defer tckr.Stop()
+    for {
+        select {
+            case <- ctx.Done():
+                return
+            case <- tckr.C:
+        }
+        c.arpCacheLock.Lock()
+        for k,v := range c.arpCache {
             v.ttl--
             if v.ttl <= 0 {
                 v.retries--
@@ -171,22 +211,26 @@ func arpTicker() {
                     if v.state == waiting {
                         dropQueuedPackets(v)
                     }
-                    delete(arpCache, k)
+                    delete(c.arpCache, k)
                 } else {
                     v.ttl = Timeout
                     arpRequest(util.ToIP(k), v.dev)
                 }
             }
         }
-        arpCacheLock.Unlock()
+        c.arpCacheLock.Unlock()
     }
 }
 
 func GetCacheAsString() string {
+    return Default.GetCacheAsString()
+}
+
+func (c *Cache) GetCacheAsString() string {
     res := "IP - MAC\n"
-    arpCacheLock.RLock()
-    defer arpCacheLock.RUnlock()
-    for i, e := range arpCache {
+    c.arpCacheLock.RLock()
+    defer c.arpCacheLock.RUnlock()
+    for i, e := range c.arpCache {
         res += util.ToIP(i).String() + " - " + e.mac.String() + "\n"
     }
     return res
@@ -198,11 +242,16 @@ func QueryIP(ip, dev string, retries int) bool {
     if iface == nil || ipaddr == nil {
         return false
     }
+    return Default.QueryIP(ipaddr, iface, retries)
+}
+
+//QueryIP sends an arp request for ipaddr on iface unless it is already cached or pending.
+func (c *Cache) QueryIP(ipaddr net.IP, iface netdev.Interface, retries int) bool {
     ip32 := util.IPToUint32(ipaddr)
-    arpCacheLock.Lock()
-    _, ok := arpCache[ip32]
+    c.arpCacheLock.Lock()
+    _, ok := c.arpCache[ip32]
     if ok {
-        arpCacheLock.Unlock()
+        c.arpCacheLock.Unlock()
         return true
     }
     e := &arpCacheEntry{
@@ -212,8 +261,8 @@ func QueryIP(ip, dev string, retries int) bool {
         retries: retries,
         queuedPackets: make(chan []byte, 1024),
     }
-    arpCache[ip32] = e
-    arpCacheLock.Unlock()
+    c.arpCache[ip32] = e
+    c.arpCacheLock.Unlock()
     arpRequest(ipaddr, iface)
     return true
 }
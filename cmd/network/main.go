@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+    "github.com/arcpop/network"
+    "github.com/arcpop/network/netdev"
+    "github.com/arcpop/network/shell"
+	"log"
+	"net"
+)
+
+func main() {
+    s := network.NewStack()
+    s.Start(context.Background())
+    defer s.Stop()
+    err := s.AddInterface(netdev.OpenLoopback("lo"))
+    if err != nil {
+        log.Println(err)
+        return
+    }
+    eth1, err := netdev.OpenRawSocket("eth1")
+    if err != nil {
+        log.Println(err)
+        return
+    }
+    err = s.AddInterface(eth1)
+    if err != nil {
+        log.Println(err)
+        return
+    }
+    s.IPv4.ConfigureInterfaceAddress("eth1", net.IPNet{ IP:net.IP{192, 168, 56, 101}, Mask: net.IPMask{255, 255, 255, 0}})
+    shell.Run(s)
+}
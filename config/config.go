@@ -1,6 +1,7 @@
 package config
 
 import (
+	"time"
 )
 
 var Arp struct {
@@ -20,11 +21,61 @@ var Device struct {
     TxQueueWorkers int
 }
 
+var IPv4 struct {
+    DefaultTTL int
+    //Forwarding routes packets which are not addressed to this host towards their destination
+    Forwarding bool
+    //AcceptSourceRoute accepts packets with a loose or strict source route option, otherwise they are dropped
+    AcceptSourceRoute bool
+    //SendRedirects lets a forwarding host tell senders about a better first hop on their subnet
+    SendRedirects bool
+    //PathMTUDiscovery sets the DontFragment bit on tcp segments to learn the mtu of the path (RFC 1191)
+    PathMTUDiscovery bool
+    //PathMTUTimeout is the time after which a learned path mtu is forgotten and larger packets are tried again
+    PathMTUTimeout time.Duration
+    //MinPathMTU is the smallest path mtu accepted from fragmentation needed messages
+    MinPathMTU int
+    //ReassemblyTimeout is the time the fragments of a datagram may take to arrive
+    ReassemblyTimeout time.Duration
+    //ReassemblyMaxMemory limits the memory in bytes taken by datagrams in reassembly, further fragments are dropped
+    ReassemblyMaxMemory int
+}
+
+var IPv6 struct {
+    DefaultHopLimit int
+    //DupAddrDetectTransmits is the number of solicitations sent to detect a duplicate address, 0 disables the detection
+    DupAddrDetectTransmits int
+    //StableSecret selects stable privacy interface identifiers (RFC 7217) instead of EUI-64 ones when set
+    StableSecret []byte
+    //PathMTUTimeout is the time after which a path mtu learned from packet too big messages is forgotten
+    PathMTUTimeout time.Duration
+    //ReassemblyTimeout is the time the fragments of a packet may take to arrive (RFC 8200 section 4.5)
+    ReassemblyTimeout time.Duration
+    //ReassemblyMaxMemory limits the memory in bytes taken by packets in reassembly, further fragments are dropped
+    ReassemblyMaxMemory int
+}
+
 var UDP struct {
+    NumberOfQueueWorkers int
     RecvQueueSize int
     ConnectionRecvQueueSize int
 }
 
+var TCP struct {
+    NumberOfQueueWorkers int
+    RecvQueueSize int
+    SendBufferSize int
+    RecvBufferSize int
+    AcceptBacklog int
+    MaxRetransmissions int
+    InitialRTO time.Duration
+    MinRTO time.Duration
+    MaxRTO time.Duration
+    MSL time.Duration
+    //FinTimeout is the time a closed connection waits in FIN-WAIT-2 for the FIN of the peer before it is dropped
+    FinTimeout time.Duration
+}
+
 func init()  {
     Device.RxQueueSize = 1024
     Device.TxQueueSize = 1024
@@ -38,6 +89,33 @@ func init()  {
     Arp.NumberOfQueueWorkers = 1
     Arp.RxQueueSize = 1024
     
+    IPv4.DefaultTTL = 64
+    IPv4.SendRedirects = true
+    IPv4.PathMTUDiscovery = true
+    IPv4.PathMTUTimeout = 10 * time.Minute
+    IPv4.MinPathMTU = 552
+    IPv4.ReassemblyTimeout = 30 * time.Second
+    IPv4.ReassemblyMaxMemory = 4 * 1024 * 1024
+    
+    IPv6.DefaultHopLimit = 64
+    IPv6.DupAddrDetectTransmits = 1
+    IPv6.PathMTUTimeout = 10 * time.Minute
+    IPv6.ReassemblyTimeout = 60 * time.Second
+    IPv6.ReassemblyMaxMemory = 4 * 1024 * 1024
+    
+    UDP.NumberOfQueueWorkers = 1
     UDP.RecvQueueSize = 512
     UDP.ConnectionRecvQueueSize = 512
+    
+    TCP.NumberOfQueueWorkers = 1
+    TCP.RecvQueueSize = 1024
+    TCP.SendBufferSize = 64 * 1024
+    TCP.RecvBufferSize = 0xFFFF
+    TCP.AcceptBacklog = 128
+    TCP.MaxRetransmissions = 15
+    TCP.InitialRTO = time.Second
+    TCP.MinRTO = time.Second
+    TCP.MaxRTO = 60 * time.Second
+    TCP.MSL = 30 * time.Second
+    TCP.FinTimeout = 60 * time.Second
 }
\ No newline at end of file
@@ -3,4 +3,5 @@ package conn
 type Conn interface {
     Read(b []byte) (int, error)
     Write(b []byte) (int, error)
+    Close() error
 }
\ No newline at end of file
@@ -8,6 +8,7 @@ import (
 	"log"
 	"net"
 	"github.com/arcpop/network/config"
+	"sync"
 )
 
 const (
@@ -17,6 +18,14 @@ const (
 )
 
 var (
+	BroadcastMACAddress = net.HardwareAddr{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+	
+	//Default is the layer used by the package level Start function.
+	Default = &Layer{}
+)
+
+//Layer dispatches received frames of one stack to its upper layers.
+type Layer struct {
 	//IPv4In should be defined by ipv4 layer to receive packets
 	IPv4In func (*Layer2Packet)
 	//IPv6In should be defined by ipv6 layer to receive packets
@@ -24,8 +33,8 @@ var (
 	//ArpIn should be defined by arp layer to receive packets
 	ArpIn func (*Layer2Packet)
 	
-	BroadcastMACAddress = net.HardwareAddr{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
-)
+	workers sync.WaitGroup
+}
 
 //Layer2Packet represents a Layer 2 packet with ethernet header information
 type Layer2Packet struct {
@@ -50,13 +59,30 @@ type Header struct {
 	DataOffset   int
 }
 
-//Start starts receiving ethernet frames from the specified NetDev.
+//Start starts receiving ethernet frames from the specified NetDev on the default layer.
 func Start(dev netdev.Interface) {
+	Default.Start(dev)
+}
+
+//Stop waits for the workers of the default layer.
+func Stop() {
+	Default.Stop()
+}
+
+//Start starts receiving ethernet frames from the specified NetDev.
+//The workers run until the NetDev is closed.
+func (l *Layer) Start(dev netdev.Interface) {
 	for i := 0; i < config.Ethernet.NumberOfQueueWorkers; i++ {
-		go ethernetRx(dev)
+		l.workers.Add(1)
+		go l.ethernetRx(dev)
 	}
 }
 
+//Stop waits until the workers of all started NetDevs returned, the NetDevs have to be closed first.
+func (l *Layer) Stop() {
+	l.workers.Wait()
+}
+
 func ethHdr(p []byte) *Header {
 	if len(p) < 14 {
 		return nil
@@ -73,10 +99,15 @@ func macAddrCmp(a, b net.HardwareAddr) bool {
 	return bytes.Compare(a, b) == 0
 }
 
-func ethernetRx(dev netdev.Interface) {
+func (l *Layer) ethernetRx(dev netdev.Interface) {
+	defer l.workers.Done()
 	log.Println("Ethernet: Worker waiting for packets on Interface", dev.GetName())
 	for {
 		pkt := dev.RxPacket()
+		if pkt == nil {
+			log.Println("Ethernet: Interface", dev.GetName(), "closed, worker stopping")
+			return
+		}
 		hdr := ethHdr(pkt)
 		if hdr == nil {
 			log.Println("Ethernet: Malformed ethernet packet (too short)")
@@ -94,27 +125,36 @@ func ethernetRx(dev netdev.Interface) {
 				packet.PacketType = PacketTypeBroadcast
 			} else {
 				packet.PacketType = PacketTypeMulticast
-				continue //Drop that
+				//Only ipv6 uses multicast, it filters the groups itself
+				if hdr.EthernetType != 0x86DD {
+					continue
+				}
 			}
 		}
 		
 		
 		switch hdr.EthernetType {
 		case 0x0800:
-			if !macAddrCmp(hdr.DstMAC, dev.GetHardwareAddress()) {
+			if (packet.PacketType != PacketTypeBroadcast && !macAddrCmp(hdr.DstMAC, dev.GetHardwareAddress())) || l.IPv4In == nil {
 				continue
 			}
-			IPv4In(packet)
+			l.IPv4In(packet)
 			continue
 		case 0x86DD:
-			if !macAddrCmp(hdr.DstMAC, dev.GetHardwareAddress()) {
+			if packet.PacketType != PacketTypeMulticast && !macAddrCmp(hdr.DstMAC, dev.GetHardwareAddress()) {
+				continue
+			}
+			if l.IPv6In == nil {
 				continue
 			}
-			IPv6In(packet)
+			l.IPv6In(packet)
 			continue
 
 		case 0x0806:
-			ArpIn(packet)
+			if l.ArpIn == nil {
+				continue
+			}
+			l.ArpIn(packet)
 			continue
 		default:
 			log.Println("Ethernet: Received unclassified packet!")
@@ -2,18 +2,25 @@ package ip
 
 
 const (
+    IPPROTO_HOPOPTS = 0
     IPPROTO_ICMP = 1
     IPPROTO_TCP = 6
     IPPROTO_UDP = 17
+    IPPROTO_ROUTING = 43
+    IPPROTO_FRAGMENT = 44
+    IPPROTO_ICMPV6 = 58
+    IPPROTO_NONE = 59
+    IPPROTO_DSTOPTS = 60
 )
 const (
     ICMPTypeEchoReply = 0
     ICMPCodeEchoReply = 0
     
     ICMPTypeDestinationUnreachable = 3
-    ICMPCodeNetUnreachable = 1
-    ICMPCodeHostUnreachable = 2
-    ICMPCodeProtocolUnreachable = 3
+    ICMPCodeNetUnreachable = 0
+    ICMPCodeHostUnreachable = 1
+    ICMPCodeProtocolUnreachable = 2
+    ICMPCodePortUnreachable = 3
     ICMPCodeFragmentationNeeded = 4
     ICMPCodeSourceRouteFailed = 5
     ICMPCodeDestinationNetworkUnknown = 6
@@ -29,7 +36,7 @@ const (
     ICMPTypeEcho = 8
     ICMPCodeEcho = 0
     
-    //ICMPv6
+    //Router discovery (RFC 1256), ipv6 uses the ICMPv6 types below
     ICMPTypeRouterAdvertisement = 9
     ICMPTypeRouterSolicitation = 10
     
@@ -50,6 +57,43 @@ const (
     
 )
 
+//ICMPv6 (RFC 4443) uses its own type and code numbers
+const (
+    ICMPv6TypeDestinationUnreachable = 1
+    ICMPv6CodeNoRoute = 0
+    ICMPv6CodeAdministrativelyProhibited = 1
+    ICMPv6CodeBeyondScope = 2
+    ICMPv6CodeAddressUnreachable = 3
+    ICMPv6CodePortUnreachable = 4
+    ICMPv6CodeSourcePolicyFailed = 5
+    ICMPv6CodeRejectRoute = 6
+    
+    ICMPv6TypePacketTooBig = 2
+    ICMPv6CodePacketTooBig = 0
+    
+    ICMPv6TypeTimeExceeded = 3
+    ICMPv6CodeHopLimitExceeded = 0
+    ICMPv6CodeFragmentReassemblyTimeout = 1
+    
+    ICMPv6TypeParameterProblem = 4
+    ICMPv6CodeErroneousHeaderField = 0
+    ICMPv6CodeUnrecognizedNextHeader = 1
+    ICMPv6CodeUnrecognizedOption = 2
+    
+    ICMPv6TypeEchoRequest = 128
+    ICMPv6CodeEchoRequest = 0
+    
+    ICMPv6TypeEchoReply = 129
+    ICMPv6CodeEchoReply = 0
+    
+    //Neighbor discovery (RFC 4861)
+    ICMPv6TypeRouterSolicitation = 133
+    ICMPv6TypeRouterAdvertisement = 134
+    ICMPv6TypeNeighborSolicitation = 135
+    ICMPv6TypeNeighborAdvertisement = 136
+    ICMPv6TypeRedirect = 137
+)
+
 func InternetChecksum(pkt []byte) uint16 {
     var csum uint32
     i := 0;
@@ -0,0 +1,190 @@
+package ipv4
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"github.com/arcpop/network/config"
+	"github.com/arcpop/network/ethernet"
+	"github.com/arcpop/network/ip"
+	"github.com/arcpop/network/netdev"
+)
+
+//isForUs returns true if dst is one of the addresses of this host, the broadcast address of one of
+//its subnets, the limited broadcast address or a multicast address (RFC 1122 section 3.3.6).
+//Like on linux every address counts no matter which interface received the packet.
+func (l *Layer) isForUs(dst net.IP) bool {
+    if dst.Equal(net.IPv4bcast) || dst.IsMulticast() || dst.IsLoopback() {
+        return true
+    }
+    for _, dev := range l.interfaces.Interfaces() {
+        for _, a := range dev.GetIPv4Addresses() {
+            if a.IP.Equal(dst) || (a.PrefixLength < 31 && a.Broadcast().Equal(dst)) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+//isLocalAddress returns true if ip is a loopback address or an address of one of the interfaces,
+//which are the addresses packets of this host are sent from.
+func (l *Layer) isLocalAddress(ip net.IP) bool {
+    if ip.IsLoopback() {
+        return true
+    }
+    for _, dev := range l.interfaces.Interfaces() {
+        for _, a := range dev.GetIPv4Addresses() {
+            if a.IP.Equal(ip) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+func IsBroadcast(dst net.IP) bool {
+    return Default.IsBroadcast(dst)
+}
+
+//IsBroadcast returns true if dst is the limited broadcast address or the directed broadcast address
+//of one of the subnets of this host.
+func (l *Layer) IsBroadcast(dst net.IP) bool {
+    if dst.Equal(net.IPv4bcast) {
+        return true
+    }
+    for _, dev := range l.interfaces.Interfaces() {
+        if isBroadcastFor(dev, dst) {
+            return true
+        }
+    }
+    return false
+}
+
+//isBroadcastFor returns true if dst is the limited broadcast address or the broadcast address of a subnet of dev,
+//packets to them are sent to the link layer broadcast address of dev.
+func isBroadcastFor(dev netdev.Interface, dst net.IP) bool {
+    if dst.Equal(net.IPv4bcast) {
+        return true
+    }
+    for _, a := range dev.GetIPv4Addresses() {
+        if a.PrefixLength < 31 && a.Broadcast().Equal(dst) {
+            return true
+        }
+    }
+    return false
+}
+
+//forwardable returns false for addresses which must not be forwarded (RFC 1812 section 5.3.7, RFC 3927 section 2.7).
+func forwardable(addr net.IP) bool {
+    return !addr.IsUnspecified() && !addr.IsLoopback() && !addr.IsMulticast() &&
+        !addr.Equal(net.IPv4bcast) && !addr.IsLinkLocalUnicast()
+}
+
+//forward sends a packet received on in which is not addressed to this host on towards its destination
+//(RFC 1812 section 5.2). packet holds the ip header and the data described by hdr.
+//Source routed packets addressed to this host are sent on to the next address of their route.
+func (l *Layer) forward(in netdev.Interface, hdr *Header, packet []byte) {
+    if !forwardable(hdr.SourceIP) {
+        atomic.AddUint64(&l.stats.InHdrErrors, 1)
+        return
+    }
+    if !forwardable(hdr.TargetIP) {
+        atomic.AddUint64(&l.stats.InAddrErrors, 1)
+        return
+    }
+    data := packet[int(hdr.headerLength) << 2:]
+    if hdr.TTL <= 1 {
+        atomic.AddUint64(&l.stats.InHdrErrors, 1)
+        l.SendTimeExceeded(ip.ICMPCodeTTLExceededInTransmit, hdr, data)
+        return
+    }
+    atomic.AddUint64(&l.stats.ForwDatagrams, 1)
+    fwd := *hdr
+    var route *Option
+    routed := false
+    if len(hdr.Options) != 0 {
+        fwd.Options = copyOptions(hdr.Options)
+        route = sourceRoute(fwd.Options)
+        if route != nil && l.isForUs(hdr.TargetIP) {
+            fwd.TargetIP = net.IP(append([]byte(nil), route.routeSlot()...))
+            routed = true
+            if !forwardable(fwd.TargetIP) {
+                atomic.AddUint64(&l.stats.InAddrErrors, 1)
+                return
+            }
+        }
+    }
+    q := &RouteQuery{ Dst: fwd.TargetIP, Src: hdr.SourceIP, InIface: in, TOS: hdr.TOS, Protocol: hdr.Protocol }
+    q.SrcPort, q.DstPort = flowPorts(hdr, data)
+    entry, err := l.RouteLookup(q)
+    if err != nil {
+        atomic.AddUint64(&l.stats.OutNoRoutes, 1)
+        l.SendDestinationUnreachable(ip.ICMPCodeNetUnreachable, hdr, data)
+        return
+    }
+    nextHop := entry.nextHop(fwd.TargetIP)
+    //A strict source route has to reach the next address without passing another router (RFC 791 section 3.1)
+    if route != nil && route.Type == OptionStrictSourceRoute && entry.flags & FlagGateway != 0 {
+        l.SendDestinationUnreachable(ip.ICMPCodeSourceRouteFailed, hdr, data)
+        return
+    }
+    //The sender is told about the better first hop on its own subnet, the packet is still forwarded (RFC 1812 section 5.2.7.2)
+    if entry.Iface == in && route == nil && config.IPv4.SendRedirects {
+        for _, a := range in.GetIPv4Addresses() {
+            if a.Contains(hdr.SourceIP) && a.Contains(nextHop) {
+                l.sendRedirect(ip.ICMPCodeRedirectHost, nextHop, hdr, data)
+                break
+            }
+        }
+    }
+    length := len(packet)
+    if len(fwd.Options) != 0 {
+        if bad := l.forwardOptions(fwd.Options, netdev.IPv4SourceAddress(entry.Iface, nextHop), routed); bad >= 0 {
+            atomic.AddUint64(&l.stats.InHdrErrors, 1)
+            l.sendParameterProblem(bad, hdr, packet[:int(hdr.headerLength) << 2], data)
+            return
+        }
+        length = fwd.length() + len(data)
+    }
+    if length > entry.Iface.GetMTU() {
+        if hdr.DontFragment {
+            atomic.AddUint64(&l.stats.FragFails, 1)
+            l.SendFragmentationNeeded(entry.Iface.GetMTU(), hdr, data)
+            return
+        }
+        l.forwardPacket(entry, &fwd, data)
+        return
+    }
+    //Packets with options are sent with their updated header
+    if len(fwd.Options) != 0 {
+        l.forwardPacket(entry, &fwd, data)
+        return
+    }
+    pkt := make([]byte, ethernet.HeaderLength + len(packet))
+    copy(pkt[ethernet.HeaderLength:], packet)
+    decrementTTL(pkt[ethernet.HeaderLength:])
+    l.arp.SetMACAndSend(entry.Iface, pkt, nextHop)
+}
+
+//forwardPacket sends the packet with the header hdr through the route like Send, which writes the header and
+//splits the packet into fragments fitting into the mtu of the next hop. Learned path mtus are only used for packets of this host.
+func (l *Layer) forwardPacket(entry *RoutingEntry, hdr *Header, data []byte) {
+    p := AllocatePacket(len(data))
+    copy(p.ProtocolData, data)
+    fwd := *hdr
+    fwd.TTL--
+    p.IPHeader = &fwd
+    l.sendRoute(entry, p, entry.Iface.GetMTU())
+}
+
+//decrementTTL decrements the ttl of the header in buf and updates its checksum
+//incrementally (RFC 1624 section 3), the ttl is the high byte of the 16 bit word at offset 8.
+func decrementTTL(buf []byte) {
+    old := binary.BigEndian.Uint16(buf[8:10])
+    buf[8]--
+    sum := uint32(^binary.BigEndian.Uint16(buf[10:12])) + uint32(^old) + uint32(binary.BigEndian.Uint16(buf[8:10]))
+    sum = (sum & 0xFFFF) + (sum >> 16)
+    sum = (sum & 0xFFFF) + (sum >> 16)
+    binary.BigEndian.PutUint16(buf[10:12], ^uint16(sum))
+}
@@ -2,8 +2,20 @@ package ipv4
 
 
 import (
+	"bytes"
+	"context"
 	"log"
+	"sync/atomic"
 	"time"
+	"github.com/arcpop/network/config"
+	"github.com/arcpop/network/ip"
+)
+
+const (
+    //maxDatagramLength is the largest ipv4 datagram including its header
+    maxDatagramLength = 0xFFFF
+    //fragmentEntryOverhead is the memory accounted for a datagram in reassembly besides its data
+    fragmentEntryOverhead = 256
 )
 
 type fragmentationKey struct {
@@ -13,131 +25,289 @@ type fragmentationKey struct {
     protocol byte
 }
 
-type fragmentationData struct {
-    offset uint32
-    length uint32
+type fragment struct {
+    key fragmentationKey
+    hdr *Header
     data []byte
-    lastFragment bool
 }
 
+//hole is a range of the datagram which did not arrive yet, last is inclusive (RFC 815 section 3).
+type hole struct {
+    first, last int
+}
 
-func checkInsertFragment(current *fragmentationData, parts *[]*fragmentationData) (complete, collides bool) {
-    prev := &fragmentationData {}
-    inserted := false
-    for i := 0; i < len(*parts); i++ {
-        
-        v := (*parts)[i]
-        
-        currentStart := prev.offset + prev.length
-        
-        
-        if !inserted {
-            //Current matches at this position
-            if current.offset == currentStart {
-                if v.offset < current.offset + current.length {
-                    return false, true
-                }
-                after := (*parts)[i:]
-                *parts = append(append((*parts)[:i], current), after...)
-                inserted = true
-                prev = current
-                i++
-                continue
-            }
-        } else {
-            //Check if complete
-            if v.offset > currentStart {
-                return false, false
-            }
-        }
-        prev = v
-    }
-    
-    currentStart := prev.offset + prev.length
-    if current.offset >= currentStart {
-        *parts = append(*parts, current)
-        inserted = true
-        prev = current
+type fragmentMapEntry struct {
+    //holes is sorted, it ends with a hole up to the maximum length until the last fragment arrived
+    holes []hole
+    data []byte
+    //length is the length of the data once the last fragment arrived and -1 before
+    length int
+    //first is the header of the fragment with offset 0, nil until it arrived
+    first *Header
+    //dropped is set once overlapping or inconsistent fragments were received, the entry discards
+    //the remaining fragments of the datagram until it times out (RFC 5722 section 4)
+    dropped bool
+    started time.Time
+}
+
+//ReassemblyStats counts the outcome of the reassembly of fragmented datagrams.
+type ReassemblyStats struct {
+    //Reassembled counts the datagrams which were reassembled
+    Reassembled uint64
+    //Timeouts counts the datagrams whose fragments did not arrive in time
+    Timeouts uint64
+    //Overlaps counts the datagrams dropped because of overlapping fragments
+    Overlaps uint64
+    //Inconsistent counts the datagrams dropped because their fragments disagreed about the length
+    Inconsistent uint64
+    //Oversized counts the datagrams dropped because a fragment reaches beyond the maximum datagram length
+    Oversized uint64
+    //MemoryLimit counts the fragments dropped because the reassembly memory was exhausted, their datagram
+    //is counted as timed out unless the fragment is sent again
+    MemoryLimit uint64
+}
+
+func GetReassemblyStats() ReassemblyStats {
+    return Default.ReassemblyStats()
+}
+
+//ReassemblyStats returns the counters of the reassembly.
+func (l *Layer) ReassemblyStats() ReassemblyStats {
+    s := &l.reassemblyStats
+    return ReassemblyStats{
+        Reassembled: atomic.LoadUint64(&s.Reassembled),
+        Timeouts: atomic.LoadUint64(&s.Timeouts),
+        Overlaps: atomic.LoadUint64(&s.Overlaps),
+        Inconsistent: atomic.LoadUint64(&s.Inconsistent),
+        Oversized: atomic.LoadUint64(&s.Oversized),
+        MemoryLimit: atomic.LoadUint64(&s.MemoryLimit),
     }
-    
-    return prev.lastFragment, !inserted
 }
 
-func reassembleFragmented(hdr *Header, protocolData []byte) {
+func (l *Layer) reassembleFragmented(hdr *Header, protocolData []byte) {
     k := fragmentationKey {
         id: hdr.Identification,
         protocol: hdr.Protocol,
     }
     copy(k.dstIP[:], hdr.TargetIP)
     copy(k.srcIP[:], hdr.SourceIP)
-    frag := &fragmentationData{
-        offset: uint32(hdr.FragmentOffset) << 3,
-        length: uint32(len(protocolData)),
-        data: protocolData,
-        lastFragment: !hdr.MoreFragments,
+    atomic.AddUint64(&l.stats.ReasmReqds, 1)
+    select {
+    case l.fragmentationQueue <- &fragment{ key: k, hdr: hdr, data: protocolData }:
+    case <- l.done:
     }
-    fragmentationQueue <- &fragment{key: k, frag: frag}
 }
 
-type fragment struct {
-    key fragmentationKey
-    frag *fragmentationData
+//insertResult is the outcome of adding a fragment to an entry
+type insertResult int
+
+const (
+    fragmentInserted insertResult = iota
+    fragmentDuplicate
+    fragmentOverlaps
+    fragmentInconsistent
+)
+
+//insert copies the fragment into the hole of the entry it fills (RFC 815 section 3). Fragments which were received
+//already are ignored, ones overlapping other fragments or contradicting the length of the datagram are rejected.
+func (e *fragmentMapEntry) insert(first int, data []byte, more bool) insertResult {
+    end := first + len(data)
+    //All fragments but the last one carry a non-zero multiple of 8 bytes
+    if more && (len(data) == 0 || len(data) % 8 != 0) {
+        return fragmentInconsistent
+    }
+    if e.length >= 0 && (end > e.length || (!more && end != e.length)) {
+        return fragmentInconsistent
+    }
+    i := 0
+    for i < len(e.holes) && e.holes[i].last < first {
+        i++
+    }
+    if i == len(e.holes) || (e.holes[i].first >= end && len(data) != 0) {
+        //Everything was received already, only an exact copy is harmless
+        if end <= len(e.data) && bytes.Equal(e.data[first:end], data) && (more || e.length == end) {
+            return fragmentDuplicate
+        }
+        return fragmentOverlaps
+    }
+    h := e.holes[i]
+    if first < h.first || (end - 1 > h.last && len(data) != 0) {
+        return fragmentOverlaps
+    }
+    if !more {
+        //No data may have arrived behind the end of the datagram, so the fragment has to fall into the last hole
+        if h.last != maxDatagramLength {
+            return fragmentInconsistent
+        }
+        e.length = end
+    }
+    //Replace the hole by the parts the fragment leaves open
+    var rest []hole
+    if first > h.first {
+        rest = append(rest, hole{ h.first, first - 1 })
+    }
+    if end <= h.last && (more || e.length < 0) {
+        rest = append(rest, hole{ end, h.last })
+    }
+    holes := append([]hole{}, e.holes[:i]...)
+    holes = append(holes, rest...)
+    e.holes = append(holes, e.holes[i + 1:]...)
+    if end > len(e.data) {
+        e.data = e.data[:end]
+    }
+    copy(e.data[first:], data)
+    return fragmentInserted
 }
-type fragmentMapEntry struct {
-    parts []*fragmentationData
-    lastUpdated time.Time
+
+//grow makes room for the data up to end and returns the additional memory, the buffer doubles
+//so datagrams arriving in order are not copied for every fragment.
+func (e *fragmentMapEntry) grow(end int) int {
+    if end <= cap(e.data) {
+        return 0
+    }
+    size := 2 * cap(e.data)
+    if size < end {
+        size = end
+    }
+    if size > maxDatagramLength {
+        size = maxDatagramLength
+    }
+    if e.length >= 0 {
+        size = e.length
+    }
+    buf := make([]byte, len(e.data), size)
+    copy(buf, e.data)
+    added := size - cap(e.data)
+    e.data = buf
+    return added
 }
 
-var fragmentationQueue chan *fragment
-var fragmentedPackets map[fragmentationKey] *fragmentMapEntry
+//release frees the data of the entry and returns the memory it took.
+func (e *fragmentMapEntry) release() int {
+    freed := cap(e.data)
+    e.data = nil
+    e.holes = nil
+    return freed
+}
 
-func fragmentationReassemblyWorker() {
-    ticker := time.NewTicker(time.Second * 5)
-    fragmentedPackets = make(map[fragmentationKey] *fragmentMapEntry)
+func (l *Layer) fragmentationReassemblyWorker(ctx context.Context) {
+    defer l.workers.Done()
+    ticker := time.NewTicker(time.Second)
+    defer ticker.Stop()
+    l.fragmentedPackets = make(map[fragmentationKey] *fragmentMapEntry)
+    //memory is the memory taken by the entries, it is only used by this worker
+    memory := 0
     for {
         select {
-        case c := <- fragmentationQueue:
-            parts, ok := fragmentedPackets[c.key]
+        case <- ctx.Done():
+            return
+        case c := <- l.fragmentationQueue:
+            first := int(c.hdr.FragmentOffset) << 3
+            end := first + len(c.data)
+            e, ok := l.fragmentedPackets[c.key]
+            if ok && e.dropped {
+                continue
+            }
+            //A datagram exceeding the maximum length is dropped, the ping of death. The entry is kept
+            //to discard the remaining fragments like for overlaps
+            if int(c.hdr.headerLength) << 2 + end > maxDatagramLength {
+                if !ok {
+                    if memory + fragmentEntryOverhead > config.IPv4.ReassemblyMaxMemory {
+                        atomic.AddUint64(&l.reassemblyStats.MemoryLimit, 1)
+                        continue
+                    }
+                    e = &fragmentMapEntry{ length: -1, started: time.Now() }
+                    l.fragmentedPackets[c.key] = e
+                    memory += fragmentEntryOverhead
+                }
+                log.Println("IPv4: Fragment exceeds the maximum datagram length, dropping datagram.")
+                atomic.AddUint64(&l.reassemblyStats.Oversized, 1)
+                memory -= e.release()
+                e.dropped = true
+                continue
+            }
+            needed := 0
             if !ok {
-                e := &fragmentMapEntry{
-                    parts: []*fragmentationData{c.frag},
-                    lastUpdated: time.Now(),
+                needed += fragmentEntryOverhead
+                e = &fragmentMapEntry{
+                    holes: []hole{ { 0, maxDatagramLength } },
+                    length: -1,
+                    started: time.Now(),
                 }
-                fragmentedPackets[c.key] = e
-            } else {
-                complete, collides := checkInsertFragment(c.frag, &(parts.parts))
-                fragmentedPackets[c.key] = parts
-                if collides {
-                    log.Println("IPv4: Fragment collides with other received fragments, dropping.")
-                } else if complete {
-                    needed := 0
-                    for _, f := range parts.parts {
-                        needed += len(f.data)
-                    }
-                    data := make([]byte, needed)
-                    offset := 0
-                    for _, f := range parts.parts {
-                        copy(data[offset:], f.data)
-                        offset += len(f.data)
-                    }
-                    delete(fragmentedPackets, c.key)
-                    hdr := &Header{
-                        SourceIP: c.key.srcIP[:],
-                        TargetIP: c.key.dstIP[:],
-                        TotalLength: 20 + uint16(offset),
-                        Identification: c.key.id,
-                        Protocol: c.key.protocol,
-                    }
-                    go deliverToProtocols(hdr, data)
+            }
+            if end > cap(e.data) {
+                //Estimate the growth without touching the entry in case the fragment is dropped
+                size := 2 * cap(e.data)
+                if size < end {
+                    size = end
+                }
+                if size > maxDatagramLength {
+                    size = maxDatagramLength
                 }
+                needed += size - cap(e.data)
             }
-        case _ = <- ticker.C:
-            lastAllowedTime := time.Now().Add(-1 * time.Minute)
-            for k,v := range fragmentedPackets {
-                if v.lastUpdated.Before(lastAllowedTime) {
-                    delete(fragmentedPackets, k)
+            if memory + needed > config.IPv4.ReassemblyMaxMemory {
+                atomic.AddUint64(&l.reassemblyStats.MemoryLimit, 1)
+                continue
+            }
+            if !ok {
+                l.fragmentedPackets[c.key] = e
+                memory += fragmentEntryOverhead
+            }
+            memory += e.grow(end)
+            switch e.insert(first, c.data, c.hdr.MoreFragments) {
+            case fragmentDuplicate:
+                continue
+            case fragmentOverlaps:
+                log.Println("IPv4: Fragment overlaps with other received fragments, dropping datagram.")
+                atomic.AddUint64(&l.reassemblyStats.Overlaps, 1)
+                memory -= e.release()
+                e.dropped = true
+                continue
+            case fragmentInconsistent:
+                log.Println("IPv4: Fragment contradicts the length of the datagram, dropping datagram.")
+                atomic.AddUint64(&l.reassemblyStats.Inconsistent, 1)
+                memory -= e.release()
+                e.dropped = true
+                continue
+            }
+            if first == 0 {
+                hdr := *c.hdr
+                e.first = &hdr
+            }
+            if len(e.holes) != 0 {
+                continue
+            }
+            delete(l.fragmentedPackets, c.key)
+            memory -= fragmentEntryOverhead
+            data := e.data
+            memory -= e.release()
+            atomic.AddUint64(&l.reassemblyStats.Reassembled, 1)
+            hdr := *e.first
+            hdr.MoreFragments = false
+            hdr.TotalLength = uint16(int(hdr.headerLength) << 2 + len(data))
+            l.deliverToProtocols(&hdr, data)
+        case now := <- ticker.C:
+            for k, e := range l.fragmentedPackets {
+                if now.Sub(e.started) < config.IPv4.ReassemblyTimeout {
+                    continue
                 }
+                delete(l.fragmentedPackets, k)
+                memory -= fragmentEntryOverhead
+                if e.dropped {
+                    continue
+                }
+                atomic.AddUint64(&l.reassemblyStats.Timeouts, 1)
+                //The time exceeded message is only sent if the first fragment arrived (RFC 792)
+                if e.first != nil {
+                    n := len(e.data)
+                    if n > 8 {
+                        n = 8
+                    }
+                    l.SendTimeExceeded(ip.ICMPCodeFragmentReassemblyTimeout, e.first, e.data[:n])
+                }
+                memory -= e.release()
             }
         }
     }
-}
\ No newline at end of file
+}
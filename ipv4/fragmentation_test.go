@@ -0,0 +1,193 @@
+package ipv4
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+	"github.com/arcpop/network/arp"
+	"github.com/arcpop/network/config"
+	"github.com/arcpop/network/netdev"
+)
+
+const testProtocol = 253
+
+//captureProtocol hands the delivered packets to the test.
+type captureProtocol chan []byte
+
+func (c captureProtocol) IPv4In(header *Header, data []byte) {
+    c <- append([]byte(nil), data...)
+}
+
+func newTestLayer(t *testing.T) (*Layer, captureProtocol) {
+    l := NewLayer(arp.NewCache(), netdev.NewList())
+    c := make(captureProtocol, 16)
+    l.RegisterProtocol(testProtocol, c)
+    l.Start(context.Background())
+    t.Cleanup(l.Stop)
+    return l, c
+}
+
+//waitReassemblyStats waits until the worker reached the expected counters or a second passed.
+func waitReassemblyStats(l *Layer, want ReassemblyStats) ReassemblyStats {
+    deadline := time.Now().Add(time.Second)
+    for {
+        s := l.ReassemblyStats()
+        if s == want || time.Now().After(deadline) {
+            return s
+        }
+        time.Sleep(5 * time.Millisecond)
+    }
+}
+
+type testFragment struct {
+    offset, length int
+    more bool
+}
+
+func TestReassembly(t *testing.T) {
+    timeout, maxMemory := config.IPv4.ReassemblyTimeout, config.IPv4.ReassemblyMaxMemory
+    defer func() {
+        config.IPv4.ReassemblyTimeout, config.IPv4.ReassemblyMaxMemory = timeout, maxMemory
+    }()
+    config.IPv4.ReassemblyTimeout = 100 * time.Millisecond
+    payload := make([]byte, maxDatagramLength)
+    for i := range payload {
+        payload[i] = byte(i % 251)
+    }
+    tests := []struct {
+        name string
+        fragments []testFragment
+        maxMemory int
+        //wait lets the entries time out before the counters are checked
+        wait bool
+        delivered int
+        stats ReassemblyStats
+        fails uint64
+    }{
+        {
+            name: "in order",
+            fragments: []testFragment{ { 0, 16, true }, { 16, 16, true }, { 32, 8, false } },
+            delivered: 40,
+            stats: ReassemblyStats{ Reassembled: 1 },
+        },
+        {
+            name: "out of order",
+            fragments: []testFragment{ { 32, 8, false }, { 0, 16, true }, { 16, 16, true } },
+            delivered: 40,
+            stats: ReassemblyStats{ Reassembled: 1 },
+        },
+        {
+            name: "last fragment in the middle",
+            fragments: []testFragment{ { 16, 16, true }, { 32, 5, false }, { 0, 16, true } },
+            delivered: 37,
+            stats: ReassemblyStats{ Reassembled: 1 },
+        },
+        {
+            name: "duplicate",
+            fragments: []testFragment{ { 0, 16, true }, { 0, 16, true }, { 16, 8, false }, { 16, 8, false } },
+            delivered: 24,
+            stats: ReassemblyStats{ Reassembled: 1 },
+        },
+        {
+            name: "overlapping",
+            fragments: []testFragment{ { 0, 16, true }, { 8, 16, true }, { 24, 8, false } },
+            stats: ReassemblyStats{ Overlaps: 1 },
+            fails: 1,
+        },
+        {
+            name: "overlapping counted once",
+            fragments: []testFragment{ { 0, 16, true }, { 8, 16, true }, { 0, 24, true }, { 24, 8, false } },
+            wait: true,
+            stats: ReassemblyStats{ Overlaps: 1 },
+            fails: 1,
+        },
+        {
+            name: "inconsistent length",
+            fragments: []testFragment{ { 16, 8, false }, { 0, 32, true } },
+            stats: ReassemblyStats{ Inconsistent: 1 },
+            fails: 1,
+        },
+        {
+            name: "oversized",
+            fragments: []testFragment{ { 0, 16, true }, { 65512, 16, false }, { 16, 16, true } },
+            wait: true,
+            stats: ReassemblyStats{ Oversized: 1 },
+            fails: 1,
+        },
+        {
+            name: "memory limit",
+            fragments: []testFragment{ { 0, 16, true }, { 16, 16, true }, { 32, 64, false } },
+            maxMemory: fragmentEntryOverhead + 32,
+            stats: ReassemblyStats{ MemoryLimit: 1 },
+        },
+        {
+            name: "memory limit times out",
+            fragments: []testFragment{ { 0, 16, true }, { 16, 16, true }, { 32, 64, false } },
+            maxMemory: fragmentEntryOverhead + 32,
+            wait: true,
+            stats: ReassemblyStats{ MemoryLimit: 1, Timeouts: 1 },
+            fails: 1,
+        },
+        {
+            name: "timeout",
+            fragments: []testFragment{ { 0, 16, true }, { 32, 8, false } },
+            wait: true,
+            stats: ReassemblyStats{ Timeouts: 1 },
+            fails: 1,
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            config.IPv4.ReassemblyMaxMemory = maxMemory
+            if tt.maxMemory != 0 {
+                config.IPv4.ReassemblyMaxMemory = tt.maxMemory
+            }
+            l, c := newTestLayer(t)
+            for _, f := range tt.fragments {
+                hdr := &Header{
+                    headerLength: 5,
+                    Identification: 0x1234,
+                    FragmentOffset: uint16(f.offset >> 3),
+                    MoreFragments: f.more,
+                    TTL: 64,
+                    Protocol: testProtocol,
+                    SourceIP: net.IPv4(192, 0, 2, 1).To4(),
+                    TargetIP: net.IPv4(192, 0, 2, 2).To4(),
+                }
+                l.reassembleFragmented(hdr, append([]byte(nil), payload[f.offset:f.offset + f.length]...))
+            }
+            if tt.wait {
+                //The worker checks the timeouts once a second
+                time.Sleep(config.IPv4.ReassemblyTimeout + 1500 * time.Millisecond)
+            }
+            if s := waitReassemblyStats(l, tt.stats); s != tt.stats {
+                t.Errorf("reassembly stats %+v, want %+v", s, tt.stats)
+            }
+            stats := l.Stats()
+            if stats.ReasmReqds != uint64(len(tt.fragments)) {
+                t.Errorf("ReasmReqds %d, want %d", stats.ReasmReqds, len(tt.fragments))
+            }
+            if stats.ReasmOKs != tt.stats.Reassembled {
+                t.Errorf("ReasmOKs %d, want %d", stats.ReasmOKs, tt.stats.Reassembled)
+            }
+            if stats.ReasmFails != tt.fails {
+                t.Errorf("ReasmFails %d, want %d", stats.ReasmFails, tt.fails)
+            }
+            select {
+            case data := <- c:
+                if tt.delivered == 0 {
+                    t.Fatalf("delivered %d bytes, want nothing", len(data))
+                }
+                if !bytes.Equal(data, payload[:tt.delivered]) {
+                    t.Errorf("delivered %d bytes which differ from the %d sent", len(data), tt.delivered)
+                }
+            default:
+                if tt.delivered != 0 {
+                    t.Errorf("nothing delivered, want %d bytes", tt.delivered)
+                }
+            }
+        })
+    }
+}
@@ -5,6 +5,10 @@ import (
 	"github.com/arcpop/network/ip"
 	"log"
 	"math/rand"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"github.com/arcpop/network/util"
 )
 
 
@@ -15,7 +19,66 @@ type ICMPPacket struct {
     Data []byte
 }
 
-func SendICMPPacket(icmpType, icmpCode byte, header *Header, data []byte)  {
+//ICMPError is a received icmp error message, Source is the host or router which sent it.
+//It unwraps to the errno the linux stack reports for the same message.
+type ICMPError struct {
+    Type, Code byte
+    Source net.IP
+    //MTU is the mtu of the next hop reported by fragmentation needed messages, 0 if the router did not report it
+    MTU uint32
+}
+
+func (e *ICMPError) Error() string {
+    return e.Errno().Error()
+}
+
+func (e *ICMPError) Unwrap() error {
+    return e.Errno()
+}
+
+//Errno maps the message like icmp_err_convert of the linux kernel.
+func (e *ICMPError) Errno() syscall.Errno {
+    switch e.Type {
+    case ip.ICMPTypeDestinationUnreachable:
+        switch e.Code {
+        case ip.ICMPCodeNetUnreachable, ip.ICMPCodeDestinationNetworkUnknown:
+            return syscall.ENETUNREACH
+        case ip.ICMPCodeProtocolUnreachable:
+            return syscall.ENOPROTOOPT
+        case ip.ICMPCodePortUnreachable:
+            return syscall.ECONNREFUSED
+        case ip.ICMPCodeFragmentationNeeded:
+            return syscall.EMSGSIZE
+        case ip.ICMPCodeSourceRouteFailed:
+            return syscall.EOPNOTSUPP
+        case ip.ICMPCodeDestinationHostUnknown:
+            return syscall.EHOSTDOWN
+        }
+        return syscall.EHOSTUNREACH
+    case ip.ICMPTypeParameterProblem:
+        return syscall.EPROTO
+    }
+    return syscall.EHOSTUNREACH
+}
+
+//Hard returns true for errors which abort a connection attempt (RFC 1122 section 4.2.3.9).
+func (e *ICMPError) Hard() bool {
+    if e.Type != ip.ICMPTypeDestinationUnreachable {
+        return false
+    }
+    switch e.Code {
+    case ip.ICMPCodeProtocolUnreachable, ip.ICMPCodePortUnreachable, ip.ICMPCodeFragmentationNeeded:
+        return true
+    }
+    return false
+}
+
+func SendICMPPacket(icmpType, icmpCode byte, header *Header, data []byte) error {
+    return Default.SendICMPPacket(icmpType, icmpCode, header, data)
+}
+
+//SendICMPPacket sends an icmp message, data is everything following the checksum field.
+func (l *Layer) SendICMPPacket(icmpType, icmpCode byte, header *Header, data []byte) error {
     p := AllocatePacket(len(data) + 4)
     pkt := p.ProtocolData
     p.IPHeader = header
@@ -24,35 +87,117 @@ func SendICMPPacket(icmpType, icmpCode byte, header *Header, data []byte)  {
     copy(pkt[4:], data)
     csum := ip.InternetChecksum(pkt)
     binary.BigEndian.PutUint16(pkt[2:4], csum)
-    Send(p)
+    return l.Send(p)
 }
 
-func toICMP(pkt []byte) *ICMPPacket {
-    csum := ip.InternetChecksum(pkt)
-    p := &ICMPPacket{
+//SendDestinationUnreachable answers the packet described by hdr and data with an icmp
+//destination unreachable message carrying the original header and the first 8 bytes of data.
+func (l *Layer) SendDestinationUnreachable(code byte, hdr *Header, data []byte) {
+    l.sendICMPError(ip.ICMPTypeDestinationUnreachable, code, 0, hdr, data)
+}
+
+//SendFragmentationNeeded tells the source of the packet described by hdr and data that it
+//has to be fragmented to fit into the mtu of the next hop (RFC 1191 section 4).
+func (l *Layer) SendFragmentationNeeded(mtu int, hdr *Header, data []byte) {
+    l.sendICMPError(ip.ICMPTypeDestinationUnreachable, ip.ICMPCodeFragmentationNeeded, uint32(mtu & 0xFFFF), hdr, data)
+}
+
+func (l *Layer) SendTimeExceeded(code byte, hdr *Header, data []byte) {
+    l.sendICMPError(ip.ICMPTypeTimeExceeded, code, 0, hdr, data)
+}
+
+//sendRedirect tells the source of the packet described by hdr and data to use gateway for its destination.
+func (l *Layer) sendRedirect(code byte, gateway net.IP, hdr *Header, data []byte) {
+    l.sendICMPError(ip.ICMPTypeRedirect, code, util.IPToUint32(gateway), hdr, data)
+}
+
+//sendParameterProblem tells the source of the packet that the byte at pointer of its header is invalid,
+//header is the header as it was received so the pointer refers to the same bytes.
+func (l *Layer) sendParameterProblem(pointer int, hdr *Header, header, data []byte) {
+    l.sendICMPErrorHeader(ip.ICMPTypeParameterProblem, ip.ICMPCodePointerIndicatesProblem, uint32(pointer) << 24, hdr, header, data)
+}
+
+//sendICMPError sends an error message with the 4 bytes following the checksum set to param.
+func (l *Layer) sendICMPError(icmpType, icmpCode byte, param uint32, hdr *Header, data []byte) {
+    orig := *hdr
+    header := make([]byte, orig.length())
+    orig.put(header)
+    l.sendICMPErrorHeader(icmpType, icmpCode, param, hdr, header, data)
+}
+
+//sendICMPErrorHeader sends an error message about the packet described by hdr carrying header and the first 8 bytes of data.
+//No error is sent about icmp errors, broadcast or multicast packets, non-first fragments
+//and packets whose source does not identify a single host (RFC 1122 section 3.2.2).
+func (l *Layer) sendICMPErrorHeader(icmpType, icmpCode byte, param uint32, hdr *Header, header, data []byte) {
+    if hdr.TargetIP.IsMulticast() || l.IsBroadcast(hdr.TargetIP) || hdr.FragmentOffset != 0 {
+        return
+    }
+    if hdr.SourceIP.IsUnspecified() || hdr.SourceIP.IsMulticast() || hdr.SourceIP.Equal(net.IPv4bcast) {
+        return
+    }
+    if hdr.Protocol == ip.IPPROTO_ICMP && (len(data) == 0 || isICMPError(data[0])) {
+        return
+    }
+    n := len(data)
+    if n > 8 {
+        n = 8
+    }
+    body := make([]byte, 4 + len(header) + n)
+    binary.BigEndian.PutUint32(body[0:4], param)
+    copy(body[4:], header)
+    copy(body[4 + len(header):], data[:n])
+    reply := &Header{
+        TargetIP: hdr.SourceIP,
+        Identification: uint16(rand.Uint32() & 0xFFFF),
+        TTL: 64,
+        Protocol: ip.IPPROTO_ICMP,
+    }
+    go l.SendICMPPacket(icmpType, icmpCode, reply, body)
+}
+
+func isICMPError(icmpType byte) bool {
+    switch icmpType {
+    case ip.ICMPTypeDestinationUnreachable, ip.ICMPTypeRedirect, ip.ICMPTypeTimeExceeded, ip.ICMPTypeParameterProblem:
+        return true
+    }
+    return false
+}
+
+//toICMP parses an icmp message, nil is returned for messages which are truncated or have a bad checksum.
+func (l *Layer) toICMP(pkt []byte) *ICMPPacket {
+    if len(pkt) < 4 {
+        log.Println("IPv4: ICMP Packet too short.")
+        atomic.AddUint64(&l.stats.ICMPInErrors, 1)
+        return nil
+    }
+    if csum := ip.InternetChecksum(pkt); csum != 0 {
+        log.Println("IPv4: ICMP Packet checksum mismatch: ", pkt[0], pkt[1], csum, binary.BigEndian.Uint16(pkt[2:4]))
+        atomic.AddUint64(&l.stats.ICMPInErrors, 1)
+        return nil
+    }
+    return &ICMPPacket{
         Type: pkt[0],
         Code: pkt[1],
         Data: pkt[4:],
     }
-    if csum != 0 {
-        log.Println("IPv4: ICMP Packet checksum mismatch: ", p.Type, p.Code, csum, binary.BigEndian.Uint16(pkt[2:4]))
-        return p
-    }
-    return p
 }
 
 type ICMP struct {
-    
+    layer *Layer
 }
 
-func (*ICMP) IPv4In(header *Header, pkt[]byte)  {
-    icmpPkt := toICMP(pkt)
+func (i *ICMP) IPv4In(header *Header, pkt[]byte)  {
+    icmpPkt := i.layer.toICMP(pkt)
     if icmpPkt == nil {
         return
     }
     srcIP := header.SourceIP
     switch (icmpPkt.Type) {
     case ip.ICMPTypeEcho:
+        //Echo requests to broadcast and multicast addresses are ignored like on linux (RFC 1122 section 3.2.2.6)
+        if header.TargetIP.IsMulticast() || i.layer.IsBroadcast(header.TargetIP) {
+            return
+        }
         if srcIP.IsGlobalUnicast() {
             hdr := &Header{}
             hdr.SourceIP = header.TargetIP
@@ -60,9 +205,12 @@ func (*ICMP) IPv4In(header *Header, pkt[]byte)  {
             hdr.Identification = uint16(rand.Uint32() & 0xFFFF)
             hdr.TTL = 128
             hdr.Protocol = ip.IPPROTO_ICMP
-            go SendICMPPacket(ip.ICMPTypeEchoReply, ip.ICMPCodeEchoReply, hdr, icmpPkt.Data)
+            hdr.Options = i.layer.echoOptions(header, header.TargetIP)
+            go i.layer.SendICMPPacket(ip.ICMPTypeEchoReply, ip.ICMPCodeEchoReply, hdr, icmpPkt.Data)
             return
         }
+    case ip.ICMPTypeEchoReply:
+        i.layer.echoReply(header, icmpPkt)
     default:
         
     }
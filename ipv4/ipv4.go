@@ -5,6 +5,12 @@ import (
 	"net"
 	"github.com/arcpop/network/ip"
 	"errors"
+	"sync"
+	"context"
+	"encoding/binary"
+	"math/rand"
+	"github.com/arcpop/network/arp"
+	"github.com/arcpop/network/netdev"
 )
 
 const (
@@ -14,10 +20,21 @@ var (
     ErrPacketTooBig = errors.New("Packet needs fragmenting but DontFragment bit is set!")
     ErrInterfaceNotFound = errors.New("Interface not found")
     ErrPacketNotRoutable = errors.New("Packet is not routable!")
+    ErrRouteNotFound = errors.New("No such route!")
+    ErrInvalidRoute = errors.New("Invalid route!")
+    ErrRuleNotFound = errors.New("No such rule!")
+    ErrInvalidRule = errors.New("Invalid rule!")
+    ErrTableNotFound = errors.New("No such routing table!")
+    ErrInvalidOptions = errors.New("Invalid ipv4 options!")
 )
 type L3Packet struct {
     IPHeader *Header
     ProtocolData []byte
+    //Mark is matched by the routing rules, it is not sent
+    Mark uint32
+    //Iface is the interface a packet to the limited broadcast address is sent through. If it is nil the packet
+    //leaves through the interface owning its source address or the one of the route to the broadcast address.
+    Iface netdev.Interface
     packetData []byte
 }
 type Header struct {
@@ -33,15 +50,108 @@ type Header struct {
     Checksum uint16
     TargetIP net.IP
     SourceIP net.IP
+    //Options follow the fixed part of the header, it is padded to a multiple of 4 bytes when sent
+    Options []Option
 }
 
+//Layer is the ipv4 layer of one stack, it owns the routing table and the registered protocols.
+type Layer struct {
+    arp *arp.Cache
+    interfaces *netdev.List
+    
+    //routingTables holds the routes of every table, the rules select the table used for a packet
+    routingTables map[int]*routeTrie
+    rules []Rule
+    tableNames map[string]int
+    routingTableLock sync.RWMutex
+    //multipathSeed keys the flow hash so hosts do not all pick the same paths
+    multipathSeed uint32
+    
+    supportedProtocolsLock sync.RWMutex
+    supportedProtocols map[byte] Protocol
+    
+    fragmentationQueue chan *fragment
+    fragmentedPackets map[fragmentationKey] *fragmentMapEntry
+    reassemblyStats ReassemblyStats
+    stats Statistics
+    
+    //pathMTUs holds the mtus learned through path mtu discovery by destination
+    pathMTULock sync.Mutex
+    pathMTUs map[[4]byte] *pathMTUEntry
+    
+    pingsLock sync.Mutex
+    pings map[pingKey]*pendingPing
+    
+    done <-chan struct{}
+    cancel context.CancelFunc
+    workers sync.WaitGroup
+}
+
+//Default is the layer used by the package level functions.
+var Default = NewLayer(arp.Default, netdev.Default)
+
+//NewLayer creates an ipv4 layer resolving addresses through arpCache and looking up interfaces in interfaces.
+func NewLayer(arpCache *arp.Cache, interfaces *netdev.List) *Layer {
+    l := &Layer{
+        arp: arpCache,
+        interfaces: interfaces,
+        supportedProtocols: make(map[byte]Protocol),
+        fragmentationQueue: make(chan *fragment),
+        pings: make(map[pingKey]*pendingPing),
+        pathMTUs: make(map[[4]byte] *pathMTUEntry),
+        routingTables: make(map[int]*routeTrie),
+        rules: defaultRules(),
+        tableNames: defaultTableNames(),
+        multipathSeed: rand.Uint32(),
+    }
+    l.RegisterProtocol(ip.IPPROTO_ICMP, &ICMP{layer: l})
+    return l
+}
+
+//Start starts the default layer and connects it to the default ethernet layer.
 func Start()  {
-    fragmentationQueue = make(chan *fragment)
-    go fragmentationReassemblyWorker()
-    ethernet.IPv4In = in
-    supportedProtocols = make(map[byte]Protocol)
-    initRoutingTable()
-    supportedProtocolsLock.Lock()
-    supportedProtocols[ip.IPPROTO_ICMP] = &ICMP{}
-    supportedProtocolsLock.Unlock()
-}
\ No newline at end of file
+    ethernet.Default.IPv4In = Default.In
+    Default.Start(context.Background())
+}
+
+//Stop stops the default layer.
+func Stop()  {
+    Default.Stop()
+}
+
+//Start starts the workers of the layer, they run until ctx is done or Stop is called.
+func (l *Layer) Start(ctx context.Context)  {
+    ctx, l.cancel = context.WithCancel(ctx)
+    l.done = ctx.Done()
+    l.workers.Add(2)
+    go l.fragmentationReassemblyWorker(ctx)
+    go l.pathMTUWorker(ctx)
+    l.initRoutingTable()
+}
+
+//Stop stops the workers of the layer and waits for them to exit.
+func (l *Layer) Stop()  {
+    if l.cancel != nil {
+        l.cancel()
+    }
+    l.workers.Wait()
+}
+
+//RegisterProtocol installs the handler for an ip protocol number, replacing any previous one.
+func (l *Layer) RegisterProtocol(protocol byte, p Protocol) {
+    l.supportedProtocolsLock.Lock()
+    l.supportedProtocols[protocol] = p
+    l.supportedProtocolsLock.Unlock()
+}
+
+//PseudoHeaderChecksum computes the internet checksum over data prefixed with the
+//ipv4 pseudo header used by udp and tcp.
+func PseudoHeaderChecksum(src, dst net.IP, protocol byte, data []byte) uint16 {
+    buf := make([]byte, 12 + len(data))
+    copy(buf[0:4], src.To4())
+    copy(buf[4:8], dst.To4())
+    buf[9] = protocol
+    binary.BigEndian.PutUint16(buf[10:12], uint16(len(data)))
+    copy(buf[12:], data)
+    return ip.InternetChecksum(buf)
+}
@@ -1,72 +1,181 @@
 package ipv4
 
 import (
+	"github.com/arcpop/network/config"
 	"github.com/arcpop/network/ethernet"
 	"log"
-	"sync"
 	"github.com/arcpop/network/ip"
 	"encoding/binary"
+	"net"
+	"sync/atomic"
 )
 
 
 
-func in(pkt *ethernet.Layer2Packet)  {
+//In handles a received ipv4 packet, it is meant to be set as ethernet.Layer.IPv4In.
+//The packet is validated as required by RFC 1122 section 3.2.1, every drop is counted in the statistics.
+func (l *Layer) In(pkt *ethernet.Layer2Packet)  {
+    atomic.AddUint64(&l.stats.InReceives, 1)
+    if len(pkt.Data) < HeaderLength {
+        log.Println("IPv4: Packet too short.")
+        atomic.AddUint64(&l.stats.InTruncatedPkts, 1)
+        return
+    }
     hdr := parseHeader(pkt.Data)
     if hdr == nil {
+        atomic.AddUint64(&l.stats.InHdrErrors, 1)
+        return
+    }
+    headerSize := int(hdr.headerLength) << 2
+    if int(hdr.TotalLength) < headerSize {
+        log.Println("IPv4: Total length shorter than the header.")
+        atomic.AddUint64(&l.stats.InHdrErrors, 1)
+        return
+    }
+    //The frame may be longer than the packet because of link layer padding
+    if int(hdr.TotalLength) > len(pkt.Data) {
+        log.Println("IPv4: Packet truncated.")
+        atomic.AddUint64(&l.stats.InTruncatedPkts, 1)
         return
     }
     isFragmented := (hdr.MoreFragments || (hdr.FragmentOffset != 0))
     if hdr.DontFragment && isFragmented {
         log.Println("IPv4: Invalid header fields for fragmentation.")
+        atomic.AddUint64(&l.stats.InHdrErrors, 1)
+        return
+    }
+    if !l.validSource(pkt.Dev, hdr.SourceIP) {
+        log.Println("IPv4: Martian source address", hdr.SourceIP, "dropping.")
+        atomic.AddUint64(&l.stats.InHdrErrors, 1)
+        return
+    }
+    if !validDestination(pkt.Dev, hdr.TargetIP) {
+        log.Println("IPv4: Invalid destination address", hdr.TargetIP, "dropping.")
+        atomic.AddUint64(&l.stats.InAddrErrors, 1)
+        return
+    }
+    //Packets received as link layer broadcast have to be addressed to a broadcast or multicast address (RFC 1122 section 3.3.6)
+    if pkt.PacketType != ethernet.PacketTypeUnicast && !l.IsBroadcast(hdr.TargetIP) && !hdr.TargetIP.IsMulticast() {
+        atomic.AddUint64(&l.stats.InAddrErrors, 1)
         return
     }
-    headerSize := int(hdr.headerLength) << 2
     protocolData := pkt.Data[headerSize:int(hdr.TotalLength)]
+    options, bad := parseOptions(pkt.Data[HeaderLength:headerSize])
+    if bad >= 0 {
+        log.Println("IPv4: Malformed options, dropping.")
+        atomic.AddUint64(&l.stats.InHdrErrors, 1)
+        l.sendParameterProblem(HeaderLength + bad, hdr, pkt.Data[:headerSize], protocolData)
+        return
+    }
+    hdr.Options = options
+    route := sourceRoute(options)
+    if route != nil && !config.IPv4.AcceptSourceRoute {
+        log.Println("IPv4: Source routed packet, dropping.")
+        atomic.AddUint64(&l.stats.InDiscards, 1)
+        return
+    }
+    //A source routed packet addressed to this host continues to the next address of its route
+    if !l.isForUs(hdr.TargetIP) || (route != nil && route.routeSlot() != nil) {
+        if !config.IPv4.Forwarding {
+            atomic.AddUint64(&l.stats.InAddrErrors, 1)
+            return
+        }
+        l.forward(pkt.Dev, hdr, pkt.Data[:int(hdr.TotalLength)])
+        return
+    }
     if isFragmented {
-        reassembleFragmented(hdr, protocolData)
+        l.reassembleFragmented(hdr, protocolData)
         return
     }
-    deliverToProtocols(hdr, protocolData)
+    l.deliverToProtocols(hdr, protocolData)
 }
 
-//Send icmp error to all protocols, the responsible one should act upon receiving it
-func protocolsCheckForICMPError(hdr *Header, icmpPkt *ICMPPacket) {
-    
+//Hand the icmp error to the protocol which sent the original packet if it implements ErrorHandler
+func (l *Layer) protocolsCheckForICMPError(hdr *Header, icmpPkt *ICMPPacket) {
+    //The message carries 4 bytes of type specific data, the original header and at least 8 bytes of its data
+    if len(icmpPkt.Data) < 4 + HeaderLength {
+        return
+    }
+    embedded := icmpPkt.Data[4:]
+    headerSize := int(embedded[0] & 0xF) << 2
+    if headerSize < HeaderLength || len(embedded) < headerSize + 8 {
+        log.Println("IPv4: ICMP error message too short.")
+        return
+    }
+    orig := parseHeader(embedded)
+    if orig == nil {
+        return
+    }
+    //Errors about packets which were not sent by this host are forged
+    if !l.isLocalAddress(orig.SourceIP) {
+        log.Println("IPv4: ICMP error for a packet from", orig.SourceIP, "which is not ours.")
+        return
+    }
+    orig.Options, _ = parseOptions(embedded[HeaderLength:headerSize])
+    var mtu uint32
+    if icmpPkt.Type == ip.ICMPTypeDestinationUnreachable && icmpPkt.Code == ip.ICMPCodeFragmentationNeeded {
+        mtu = uint32(binary.BigEndian.Uint16(icmpPkt.Data[2:4]))
+    }
+    l.supportedProtocolsLock.RLock()
+    proto, ok := l.supportedProtocols[orig.Protocol]
+    l.supportedProtocolsLock.RUnlock()
+    if !ok {
+        return
+    }
+    eh, ok := proto.(ErrorHandler)
+    if !ok {
+        return
+    }
+    err := &ICMPError{
+        Type: icmpPkt.Type,
+        Code: icmpPkt.Code,
+        Source: make(net.IP, 4),
+        MTU: mtu,
+    }
+    copy(err.Source, hdr.SourceIP)
+    eh.IPv4Error(err, orig, embedded[headerSize:])
 }
 
 type Protocol interface {
     IPv4In(header *Header, data []byte)
 }
 
-var (
-    supportedProtocolsLock sync.RWMutex
-    supportedProtocols map[byte] Protocol
-)
+//ErrorHandler is implemented by protocols which want to learn about icmp errors caused by their packets.
+//original is the header of the packet which caused the error and data holds at least its first 8 bytes.
+//A fragmentation needed message only changes the path mtu if the handler calls UpdatePathMTU.
+type ErrorHandler interface {
+    IPv4Error(err *ICMPError, original *Header, data []byte)
+}
 
 //Here we deliver the ip packets to their corresponding protocol
-func deliverToProtocols(hdr *Header, protocolData []byte)  {
+func (l *Layer) deliverToProtocols(hdr *Header, protocolData []byte)  {
     
     if hdr.Protocol == ip.IPPROTO_ICMP {
         dstIP := hdr.TargetIP
         if !dstIP.IsGlobalUnicast() {
             log.Println("IPv4: ICMP Message possibly for broadcast or multicast source, dropping.")
         }
-        icmpPkt := toICMP(protocolData)
+        icmpPkt := l.toICMP(protocolData)
         if icmpPkt == nil {
             return
         }
-        if icmpPkt.Type == ip.ICMPTypeDestinationUnreachable {
-            go protocolsCheckForICMPError(hdr, icmpPkt)
+        switch icmpPkt.Type {
+        case ip.ICMPTypeDestinationUnreachable, ip.ICMPTypeTimeExceeded, ip.ICMPTypeParameterProblem:
+            atomic.AddUint64(&l.stats.InDelivers, 1)
+            go l.protocolsCheckForICMPError(hdr, icmpPkt)
             return
         }
     }
-    supportedProtocolsLock.RLock()
-    proto, ok := supportedProtocols[hdr.Protocol]
-    supportedProtocolsLock.RUnlock()
+    l.supportedProtocolsLock.RLock()
+    proto, ok := l.supportedProtocols[hdr.Protocol]
+    l.supportedProtocolsLock.RUnlock()
     if !ok {
         log.Println("IPv4: Packet with unsupported protocol: ", hdr.Protocol)
+        atomic.AddUint64(&l.stats.InUnknownProtos, 1)
+        l.SendDestinationUnreachable(ip.ICMPCodeProtocolUnreachable, hdr, protocolData)
         return
     }
+    atomic.AddUint64(&l.stats.InDelivers, 1)
     proto.IPv4In(hdr, protocolData)
 }
 
@@ -79,7 +188,12 @@ func parseHeader(buf []byte) *Header {
         log.Println("IPv4: Invalid version")
         return nil
     }
-    csum := ip.InternetChecksum(buf[0:(int(buf[0] & 0xF)) << 2])
+    headerSize := int(buf[0] & 0xF) << 2
+    if headerSize < HeaderLength || len(buf) < headerSize {
+        log.Println("IPv4: Invalid header length")
+        return nil
+    }
+    csum := ip.InternetChecksum(buf[0:headerSize])
     if csum != 0 {
         log.Println("IPv4: Corrupted packet header")
         return nil
@@ -2,15 +2,19 @@ package ipv4
 
 import (
 	"encoding/binary"
+	"net"
+	"sync/atomic"
 	"github.com/arcpop/network/ip"
 	"github.com/arcpop/network/ethernet"
-	"github.com/arcpop/network/util"
-	"github.com/arcpop/network/arp"
+	"github.com/arcpop/network/netdev"
 )
 
 
+//put writes the header with its options to buf, the header length is set from the options.
 func (h *Header) put(buf []byte) {
-    buf[0] = (4 << 4) | 5
+    length := h.length()
+    h.headerLength = byte(length >> 2)
+    buf[0] = (4 << 4) | h.headerLength
     buf[1] = h.TOS
     binary.BigEndian.PutUint16(buf[2:], h.TotalLength)
     binary.BigEndian.PutUint16(buf[4:], h.Identification)
@@ -28,7 +32,8 @@ func (h *Header) put(buf []byte) {
     buf[11] = 0
     copy(buf[12:16], h.SourceIP)
     copy(buf[16:20], h.TargetIP)
-    checksum := ip.InternetChecksum(buf[0:(int(buf[0] & 0xF)) << 2])
+    putOptions(buf[HeaderLength:length], h.Options)
+    checksum := ip.InternetChecksum(buf[0:length])
     binary.BigEndian.PutUint16(buf[10:], checksum)
 }
 
@@ -36,55 +41,125 @@ func AllocatePacket(size int) *L3Packet {
     pkt := make([]byte, size + HeaderLength + ethernet.HeaderLength)
     return &L3Packet{ packetData: pkt, ProtocolData: pkt[HeaderLength + ethernet.HeaderLength:]}
 }
+//Send sends the packet through the default layer.
 func Send(p *L3Packet) error {
+    return Default.Send(p)
+}
+
+//Send routes the packet with the rules matching its header and mark and sends it, fragmenting it if necessary.
+func (l *Layer) Send(p *L3Packet) error {
     header := p.IPHeader
-    pkt := p.packetData
-    entry, err := RoutingGetRoute(header.TargetIP)
+    atomic.AddUint64(&l.stats.OutRequests, 1)
+    if !validOptions(header.Options) {
+        atomic.AddUint64(&l.stats.OutDiscards, 1)
+        return ErrInvalidOptions
+    }
+    if header.TargetIP.Equal(net.IPv4bcast) {
+        if iface := l.broadcastInterface(p); iface != nil {
+            return l.sendRoute(&RoutingEntry{ Iface: iface }, p, iface.GetMTU())
+        }
+    }
+    q := &RouteQuery{ Dst: header.TargetIP, Src: header.SourceIP, TOS: header.TOS, Mark: p.Mark, Protocol: header.Protocol }
+    q.SrcPort, q.DstPort = flowPorts(header, p.ProtocolData)
+    entry, err := l.RouteLookup(q)
     if err != nil {
+        atomic.AddUint64(&l.stats.OutNoRoutes, 1)
         return err
     }
-    header.SourceIP = entry.Iface.GetIPv4Address()
-    ProtoData := p.ProtocolData
-    mtu := entry.Iface.GetMTU()
-    offset := 0
-    blockSize := ((mtu - HeaderLength) >> 3) << 3
-    header.TotalLength = uint16(len(ProtoData) + HeaderLength)
-    //Check if we need to fragment this packet
-    if int(header.TotalLength) > mtu {
-        if header.DontFragment {
-            return ErrPacketTooBig
+    //The limited broadcast address is always on the link, even if the route to it leads through a gateway
+    if header.TargetIP.Equal(net.IPv4bcast) {
+        entry = &RoutingEntry{ Iface: entry.Iface }
+    }
+    return l.sendRoute(entry, p, l.pathMTU(header.TargetIP, entry.Iface.GetMTU()))
+}
+
+//broadcastInterface returns the interface a packet to the limited broadcast address is sent through
+//if it is chosen without a route, see L3Packet.Iface.
+func (l *Layer) broadcastInterface(p *L3Packet) netdev.Interface {
+    if p.Iface != nil {
+        return p.Iface
+    }
+    src := p.IPHeader.SourceIP
+    if src == nil || src.IsUnspecified() {
+        return nil
+    }
+    for _, dev := range l.interfaces.Interfaces() {
+        if netdev.HasIPv4Address(dev, src) {
+            return dev
         }
-        for len(ProtoData[offset:]) + HeaderLength > mtu {
-            fragHeader := *header
-            fragHeader.MoreFragments = true
-            fragHeader.FragmentOffset = uint16(offset >> 3)
-            fragHeader.TotalLength = uint16(HeaderLength + blockSize)
-            p := make([]byte, blockSize + HeaderLength + ethernet.HeaderLength)
-            
-            fragHeader.put(p[ethernet.HeaderLength:])
-            copy(p[ethernet.HeaderLength + HeaderLength:], ProtoData[offset:])
-            
-            if (entry.flags & FlagGateway) != 0 {
-                arp.SetMACAndSend(entry.Iface, p, util.ToIP(entry.gateway))
-            } else {
-                arp.SetMACAndSend(entry.Iface, p, header.TargetIP)
-            }
-            offset += blockSize
+    }
+    return nil
+}
+
+//output sends the packet to the next hop, broadcasts are sent to the link layer broadcast address
+//instead of resolving the next hop (RFC 1122 section 3.3.6).
+func (l *Layer) output(dev netdev.Interface, pkt []byte, nextHop net.IP, broadcast bool) {
+    if !broadcast {
+        l.arp.SetMACAndSend(dev, pkt, nextHop)
+        return
+    }
+    copy(pkt[0:6], ethernet.BroadcastMACAddress)
+    copy(pkt[6:12], dev.GetHardwareAddress())
+    binary.BigEndian.PutUint16(pkt[12:14], 0x0800)
+    dev.TxPacket(pkt)
+}
+
+//sendRoute sends the packet through the route entry, it is fragmented to fit into mtu.
+func (l *Layer) sendRoute(entry *RoutingEntry, p *L3Packet, mtu int) error {
+    header := p.IPHeader
+    nextHop := entry.nextHop(header.TargetIP)
+    broadcast := isBroadcastFor(entry.Iface, nextHop)
+    if header.SourceIP == nil || header.SourceIP.IsUnspecified() {
+        header.SourceIP = netdev.IPv4SourceAddress(entry.Iface, nextHop)
+    }
+    data := p.ProtocolData
+    headerLength := header.length()
+    header.TotalLength = uint16(headerLength + len(data))
+    if headerLength + len(data) <= mtu {
+        pkt := p.packetData
+        //AllocatePacket only leaves room for a header without options
+        if headerLength != HeaderLength || pkt == nil {
+            pkt = make([]byte, ethernet.HeaderLength + headerLength + len(data))
+            copy(pkt[ethernet.HeaderLength + headerLength:], data)
         }
-        rest := len(ProtoData[offset:])
-        header.TotalLength = uint16(rest + HeaderLength)
-        header.FragmentOffset = uint16(offset >> 3)
-        pkt = pkt[0:rest + HeaderLength + ethernet.HeaderLength]
+        header.put(pkt[ethernet.HeaderLength:])
+        l.output(entry.Iface, pkt, nextHop, broadcast)
+        return nil
     }
-    
-    header.put(pkt[ethernet.HeaderLength:])
-    copy(pkt[ethernet.HeaderLength + HeaderLength:], ProtoData[offset:])
-    if (entry.flags & FlagGateway) != 0 {
-        arp.SetMACAndSend(entry.Iface, pkt, util.ToIP(entry.gateway))
-    } else {
-        arp.SetMACAndSend(entry.Iface, pkt, header.TargetIP)
+    if header.DontFragment {
+        atomic.AddUint64(&l.stats.FragFails, 1)
+        return ErrPacketTooBig
     }
-    
+    //Options without the copied flag are only sent in the first fragment (RFC 791 section 3.2)
+    rest := *header
+    rest.Options = copiedOptions(header.Options)
+    //Forwarded fragments are split relative to their own offset
+    baseOffset := header.FragmentOffset
+    for offset := 0; offset < len(data); {
+        fragHeader := rest
+        if offset == 0 {
+            fragHeader = *header
+        }
+        fragHeaderLength := fragHeader.length()
+        n := len(data) - offset
+        if fragHeaderLength + n > mtu {
+            n = ((mtu - fragHeaderLength) >> 3) << 3
+            fragHeader.MoreFragments = true
+        }
+        //The header leaves no room for a single block of data, only the first fragment can hit this
+        if n <= 0 {
+            atomic.AddUint64(&l.stats.FragFails, 1)
+            return ErrPacketTooBig
+        }
+        fragHeader.FragmentOffset = baseOffset + uint16(offset >> 3)
+        fragHeader.TotalLength = uint16(fragHeaderLength + n)
+        pkt := make([]byte, ethernet.HeaderLength + fragHeaderLength + n)
+        fragHeader.put(pkt[ethernet.HeaderLength:])
+        copy(pkt[ethernet.HeaderLength + fragHeaderLength:], data[offset:offset + n])
+        l.output(entry.Iface, pkt, nextHop, broadcast)
+        atomic.AddUint64(&l.stats.FragCreates, 1)
+        offset += n
+    }
+    atomic.AddUint64(&l.stats.FragOKs, 1)
     return nil
 }
-
@@ -2,7 +2,6 @@ package ipv4
 
 import (
 	"net"
-    "sync"
 	"github.com/arcpop/network/netdev"
 	"github.com/arcpop/network/util"
 )
@@ -10,10 +9,15 @@ import (
 type RoutingEntry struct {
     netmask uint32
     network uint32
+    prefixLength int
     gateway uint32
     metric int
     flags int
     Iface netdev.Interface
+    weight int
+    //paths holds the next hops of a multipath route, the route itself describes the first one
+    paths []*RoutingEntry
+    totalWeight int
 }
 
 const (
@@ -21,7 +25,6 @@ const (
     MetricMin = 1
     MetricDefault = 1024
     MetricMax = 1 << 20
-    metricOverMax = MetricMax + 1
 )
 
 const (
@@ -30,92 +33,223 @@ const (
 )
 
 
-var (
-    routingTable []*RoutingEntry
-    routingTableLock sync.RWMutex
-)
-
 func RouteAddNet(from net.IPNet, gateway net.IP, metric, flags int, dev netdev.Interface) {
-    ip32 := util.IPToUint32(from.IP)
-    nm32 := util.IPToUint32(from.Mask)
+    Default.RouteAddNet(from, gateway, metric, flags, dev)
+}
+
+//RouteAddNet adds the route to the main table.
+func (l *Layer) RouteAddNet(from net.IPNet, gateway net.IP, metric, flags int, dev netdev.Interface) {
+    l.RouteAddTable(TableMain, from, gateway, metric, flags, dev)
+}
+
+func RouteAddTable(table int, from net.IPNet, gateway net.IP, metric, flags int, dev netdev.Interface) {
+    Default.RouteAddTable(table, from, gateway, metric, flags, dev)
+}
+
+//RouteAddTable adds the route to the table, which is created if it did not exist.
+func (l *Layer) RouteAddTable(table int, from net.IPNet, gateway net.IP, metric, flags int, dev netdev.Interface) {
+    ip32 := util.IPToUint32(from.IP.To4())
+    ones, _ := from.Mask.Size()
+    nm32 := prefixMask(ones)
     var gw32 uint32
     if gateway != nil {
-        gw32 = util.IPToUint32(gateway)
+        gw32 = util.IPToUint32(gateway.To4())
         flags |= FlagGateway
     }
     e := &RoutingEntry{
         netmask: nm32,
-        network: ip32,
+        network: ip32 & nm32,
+        prefixLength: ones,
         gateway: gw32,
         metric: metric,
         flags: flags,
         Iface: dev,
     }
     
-    routingTableLock.Lock()
-    routingTable = append(routingTable, e)
-    routingTableLock.Unlock()
+    l.routingTableLock.Lock()
+    l.table(table).insert(e)
+    l.routingTableLock.Unlock()
+}
+
+//table returns the table with the id and creates it if it does not exist, routingTableLock has to be held.
+func (l *Layer) table(id int) *routeTrie {
+    t := l.routingTables[id]
+    if t == nil {
+        t = &routeTrie{}
+        l.routingTables[id] = t
+    }
+    return t
 }
 
 func RouteAddHost(host net.IP, gateway net.IP, metric, flags int, dev netdev.Interface) {
-    RouteAddNet(net.IPNet{ IP: host, Mask: []byte{0xFF, 0xFF, 0xFF, 0xFF}}, gateway, metric, flags | FlagHost, dev)
+    Default.RouteAddHost(host, gateway, metric, flags, dev)
+}
+
+func (l *Layer) RouteAddHost(host net.IP, gateway net.IP, metric, flags int, dev netdev.Interface) {
+    l.RouteAddNet(net.IPNet{ IP: host, Mask: []byte{0xFF, 0xFF, 0xFF, 0xFF}}, gateway, metric, flags | FlagHost, dev)
 }
 
 func RouteDeleteInterface(iface netdev.Interface)  {
-    routingTableLock.Lock()
-    for k := 0; k < len(routingTable); k++ {
-        v := routingTable[k]
-        if v.Iface == iface {
-            if k == len(routingTable) - 1 {
-                routingTable = routingTable[:k]
-            } else {
-                routingTable = append(routingTable[:k], routingTable[k + 1:]...)
-            }
-        }
+    Default.RouteDeleteInterface(iface)
+}
+
+//RouteDeleteInterface removes the routes through iface from all tables, multipath routes only lose their paths through it.
+func (l *Layer) RouteDeleteInterface(iface netdev.Interface)  {
+    l.routingTableLock.Lock()
+    for _, t := range l.routingTables {
+        t.removeAll(func(e *RoutingEntry) bool {
+            return e.removePaths(func(p *RoutingEntry) bool {
+                return p.Iface == iface
+            })
+        })
     }
-    routingTableLock.Unlock()
+    l.routingTableLock.Unlock()
 }
 
+func RouteDeleteNet(to net.IPNet, gateway net.IP, dev netdev.Interface) error {
+    return Default.RouteDeleteNet(to, gateway, dev)
+}
 
-func RoutingGetRoute(targetIP net.IP) (*RoutingEntry, error) {
-    ip32 := util.IPToUint32(targetIP)
-    routingTableLock.RLock()
-    defer routingTableLock.RUnlock()
-    
-    var bestRoute *RoutingEntry
-    bestMetric := metricOverMax
-    for _, e := range routingTable {
-        if (e.network & e.netmask) == (ip32 & e.netmask) {
-            if bestMetric > e.metric {
-                bestRoute = e
-                bestMetric = e.metric
+//RouteDeleteNet removes the routes to the prefix from the main table.
+func (l *Layer) RouteDeleteNet(to net.IPNet, gateway net.IP, dev netdev.Interface) error {
+    return l.RouteDeleteTable(TableMain, to, gateway, dev)
+}
+
+func RouteDeleteTable(table int, to net.IPNet, gateway net.IP, dev netdev.Interface) error {
+    return Default.RouteDeleteTable(table, to, gateway, dev)
+}
+
+//RouteDeleteTable removes the routes to the prefix to from the table, a nil gateway or dev matches every gateway or interface.
+//Only the matching paths of multipath routes are removed. ErrRouteNotFound is returned if no route was removed.
+func (l *Layer) RouteDeleteTable(table int, to net.IPNet, gateway net.IP, dev netdev.Interface) error {
+    ones, _ := to.Mask.Size()
+    var gw32 uint32
+    if gateway != nil {
+        gw32 = util.IPToUint32(gateway.To4())
+    }
+    l.routingTableLock.Lock()
+    removed, shrunk := 0, 0
+    if t := l.routingTables[table]; t != nil {
+        removed = t.remove(util.IPToUint32(to.IP.To4()), ones, func(e *RoutingEntry) bool {
+            matched := false
+            empty := e.removePaths(func(p *RoutingEntry) bool {
+                match := (gateway == nil || ((p.flags & FlagGateway) != 0 && p.gateway == gw32)) && (dev == nil || p.Iface == dev)
+                matched = matched || match
+                return match
+            })
+            if matched && !empty {
+                shrunk++
             }
-        }
+            return empty
+        })
     }
-    if bestMetric == metricOverMax {
-        return nil, ErrPacketNotRoutable
+    l.routingTableLock.Unlock()
+    if removed + shrunk == 0 {
+        return ErrRouteNotFound
     }
-    
-    return bestRoute, nil
+    return nil
+}
+
+
+func RoutingGetRoute(targetIP net.IP) (*RoutingEntry, error) {
+    return Default.RoutingGetRoute(targetIP)
+}
+
+//RoutingGetRoute returns the route to targetIP for a packet of this host which has no source address yet.
+func (l *Layer) RoutingGetRoute(targetIP net.IP) (*RoutingEntry, error) {
+    return l.RouteLookup(&RouteQuery{ Dst: targetIP })
 }
 
 func ConfigureInterfaceAddress(ifname string, address net.IPNet) error {
-    iface := netdev.InterfaceByName(ifname)
+    return Default.ConfigureInterfaceAddress(ifname, address)
+}
+
+//ConfigureInterfaceAddress adds the address to the interface together with the route to it in the local table
+//and the route to its subnet in the main table, other addresses of the interface are kept.
+func (l *Layer) ConfigureInterfaceAddress(ifname string, address net.IPNet) error {
+    iface := l.interfaces.InterfaceByName(ifname)
     if iface == nil {
         return ErrInterfaceNotFound
     }
-    
-    currentIP := iface.GetIPv4Address()
-    if currentIP.IsGlobalUnicast() {
-        RouteDeleteInterface(iface)
+    ones, _ := address.Mask.Size()
+    iface.AddIPv4Address(netdev.IPv4Address{ IP: address.IP, PrefixLength: ones })
+    host := net.IPNet{ IP: address.IP, Mask: net.CIDRMask(32, 32) }
+    subnet := net.IPNet{ IP: address.IP.Mask(address.Mask), Mask: address.Mask }
+    l.routeDelete(TableLocal, host, iface)
+    l.RouteAddTable(TableLocal, host, nil, MetricLocalhost, FlagHost, iface)
+    l.routeDelete(TableMain, subnet, iface)
+    l.RouteAddNet(subnet, nil, MetricMin, 0, iface)
+    return nil
+}
+
+func RemoveInterfaceAddress(ifname string, address net.IPNet) error {
+    return Default.RemoveInterfaceAddress(ifname, address)
+}
+
+//RemoveInterfaceAddress removes the address from the interface together with the route to it,
+//the route to its subnet is removed with the last address in the subnet.
+func (l *Layer) RemoveInterfaceAddress(ifname string, address net.IPNet) error {
+    iface := l.interfaces.InterfaceByName(ifname)
+    if iface == nil {
+        return ErrInterfaceNotFound
     }
-    
-    iface.SetIPv4Address(address.IP, net.IP(address.Mask))
-    RouteAddHost(address.IP, nil, 0, 0, iface)
-    RouteAddNet(address, nil, 1, 0, iface)
+    iface.RemoveIPv4Address(address.IP)
+    l.routeDelete(TableLocal, net.IPNet{ IP: address.IP, Mask: net.CIDRMask(32, 32) }, iface)
+    ones, _ := address.Mask.Size()
+    for _, a := range iface.GetIPv4Addresses() {
+        if a.PrefixLength == ones && a.Contains(address.IP) {
+            return nil
+        }
+    }
+    l.routeDelete(TableMain, net.IPNet{ IP: address.IP.Mask(address.Mask), Mask: address.Mask }, iface)
     return nil
 }
 
-func initRoutingTable() {
+//routeDelete removes the routes of dev to the network which have no gateway from the table.
+func (l *Layer) routeDelete(table int, network net.IPNet, dev netdev.Interface) {
+    ones, _ := network.Mask.Size()
+    l.routingTableLock.Lock()
+    if t := l.routingTables[table]; t != nil {
+        t.remove(util.IPToUint32(network.IP.To4()), ones, func(e *RoutingEntry) bool {
+            return e.removePaths(func(p *RoutingEntry) bool {
+                return p.Iface == dev && (p.flags & FlagGateway) == 0
+            })
+        })
+    }
+    l.routingTableLock.Unlock()
+}
+
+//nextHop returns the gateway of the route or dst if it is directly connected.
+func (e *RoutingEntry) nextHop(dst net.IP) net.IP {
+    if (e.flags & FlagGateway) != 0 {
+        return util.ToIP(e.gateway)
+    }
+    return dst
+}
+
+func SourceAddress(dst net.IP) (net.IP, error) {
+    return Default.SourceAddress(dst)
+}
+
+//SourceAddress returns the address packets to dst are sent from, it is the one on the subnet of the next hop if possible.
+func (l *Layer) SourceAddress(dst net.IP) (net.IP, error) {
+    return l.SourceAddressFor(&RouteQuery{ Dst: dst })
+}
+
+func SourceAddressFor(q *RouteQuery) (net.IP, error) {
+    return Default.SourceAddressFor(q)
+}
+
+//SourceAddressFor returns the address the packets of the flow described by q are sent from, the protocol
+//and ports should be set so the path of the flow is used if the route has several.
+func (l *Layer) SourceAddressFor(q *RouteQuery) (net.IP, error) {
+    entry, err := l.RouteLookup(q)
+    if err != nil {
+        return nil, err
+    }
+    return netdev.IPv4SourceAddress(entry.Iface, entry.nextHop(q.Dst)), nil
+}
+
+func (l *Layer) initRoutingTable() {
     
 }
\ No newline at end of file
@@ -0,0 +1,143 @@
+package ipv4
+
+import (
+	"encoding/binary"
+	"net"
+	"github.com/arcpop/network/ip"
+	"github.com/arcpop/network/netdev"
+	"github.com/arcpop/network/util"
+)
+
+//NextHop is one of the paths of a multipath route.
+type NextHop struct {
+    //Gateway is nil if the destination is directly connected to Iface
+    Gateway net.IP
+    Iface netdev.Interface
+    //Weight is the share of the flows taking this path relative to the other paths, 0 counts as 1
+    Weight int
+}
+
+func RouteAddMultipath(table int, to net.IPNet, metric int, hops []NextHop) error {
+    return Default.RouteAddMultipath(table, to, metric, hops)
+}
+
+//RouteAddMultipath adds a route to the table which spreads the flows to the prefix over the next hops.
+//All packets of a flow take the same path so they are not reordered.
+func (l *Layer) RouteAddMultipath(table int, to net.IPNet, metric int, hops []NextHop) error {
+    if len(hops) == 0 || to.IP.To4() == nil {
+        return ErrInvalidRoute
+    }
+    ones, _ := to.Mask.Size()
+    nm32 := prefixMask(ones)
+    ip32 := util.IPToUint32(to.IP.To4()) & nm32
+    e := &RoutingEntry{
+        netmask: nm32,
+        network: ip32,
+        prefixLength: ones,
+        metric: metric,
+    }
+    paths := make([]*RoutingEntry, 0, len(hops))
+    for _, h := range hops {
+        if h.Iface == nil || h.Weight < 0 || (h.Gateway != nil && h.Gateway.To4() == nil) {
+            return ErrInvalidRoute
+        }
+        path := &RoutingEntry{
+            netmask: nm32,
+            network: ip32,
+            prefixLength: ones,
+            metric: metric,
+            Iface: h.Iface,
+            weight: h.Weight,
+        }
+        if path.weight == 0 {
+            path.weight = 1
+        }
+        if h.Gateway != nil {
+            path.gateway = util.IPToUint32(h.Gateway.To4())
+            path.flags |= FlagGateway
+        }
+        paths = append(paths, path)
+    }
+    e.setPaths(paths)
+    l.routingTableLock.Lock()
+    l.table(table).insert(e)
+    l.routingTableLock.Unlock()
+    return nil
+}
+
+//setPaths replaces the paths of a multipath route, the first path stands in for the route where no flow is known.
+func (e *RoutingEntry) setPaths(paths []*RoutingEntry) {
+    e.paths = paths
+    e.totalWeight = 0
+    for _, p := range paths {
+        e.totalWeight += p.weight
+    }
+    if len(paths) != 0 {
+        e.Iface = paths[0].Iface
+        e.gateway = paths[0].gateway
+        e.flags = paths[0].flags
+    }
+}
+
+//removePaths removes the paths for which match returns true, it returns true if no path is left.
+//A route with a single path is its own path.
+func (e *RoutingEntry) removePaths(match func(*RoutingEntry) bool) bool {
+    if len(e.paths) == 0 {
+        return match(e)
+    }
+    paths := make([]*RoutingEntry, 0, len(e.paths))
+    for _, p := range e.paths {
+        if !match(p) {
+            paths = append(paths, p)
+        }
+    }
+    if len(paths) == len(e.paths) {
+        return false
+    }
+    e.setPaths(paths)
+    return len(paths) == 0
+}
+
+//selectPath picks the path of the flow with the hash, every path owns a range of hash values sized by its weight
+//so changing one path only moves the flows of its neighbours (hash-threshold, RFC 2992).
+func (e *RoutingEntry) selectPath(hash uint32) *RoutingEntry {
+    if len(e.paths) == 0 {
+        return e
+    }
+    threshold := int(uint64(hash) * uint64(e.totalWeight) >> 32)
+    for _, p := range e.paths {
+        if threshold < p.weight {
+            return p
+        }
+        threshold -= p.weight
+    }
+    return e.paths[len(e.paths) - 1]
+}
+
+//flowHash hashes the addresses, protocol and ports of the flow with FNV-1a keyed by the seed of the layer.
+//Packets of this host are hashed without their source address, it is only chosen once the path is known.
+func (l *Layer) flowHash(q *RouteQuery) uint32 {
+    var buf [13]byte
+    copy(buf[0:4], q.Dst.To4())
+    if q.InIface != nil && q.Src != nil {
+        copy(buf[4:8], q.Src.To4())
+    }
+    buf[8] = q.Protocol
+    binary.BigEndian.PutUint16(buf[9:11], q.SrcPort)
+    binary.BigEndian.PutUint16(buf[11:13], q.DstPort)
+    h := uint32(2166136261) ^ l.multipathSeed
+    for _, b := range buf {
+        h ^= uint32(b)
+        h *= 16777619
+    }
+    return h
+}
+
+//flowPorts returns the ports of tcp and udp packets, fragments only carry them in the first fragment
+//so no ports are used for them to keep all fragments of a packet on one path.
+func flowPorts(hdr *Header, data []byte) (uint16, uint16) {
+    if (hdr.Protocol != ip.IPPROTO_TCP && hdr.Protocol != ip.IPPROTO_UDP) || hdr.MoreFragments || hdr.FragmentOffset != 0 || len(data) < 4 {
+        return 0, 0
+    }
+    return binary.BigEndian.Uint16(data[0:2]), binary.BigEndian.Uint16(data[2:4])
+}
@@ -0,0 +1,41 @@
+package ipv4
+
+import (
+	"net"
+	"testing"
+	"github.com/arcpop/network/netdev"
+)
+
+func TestRouteAddMultipath(t *testing.T) {
+    a, b, err := netdev.OpenPipe(netdev.PipeConfig{ Name: "a" }, netdev.PipeConfig{ Name: "b" })
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer a.Close()
+    defer b.Close()
+    l := NewLayer(nil, netdev.NewList())
+    hops := []NextHop{ { Gateway: net.IPv4(10, 0, 0, 1), Iface: a, Weight: 2 }, { Iface: b } }
+    _, v6, _ := net.ParseCIDR("2001:db8::/32")
+    if err := l.RouteAddMultipath(TableMain, *v6, MetricDefault, hops); err != ErrInvalidRoute {
+        t.Errorf("ipv6 prefix returned %v, want %v", err, ErrInvalidRoute)
+    }
+    _, to, _ := net.ParseCIDR("192.0.2.0/24")
+    if err := l.RouteAddMultipath(TableMain, *to, MetricDefault, nil); err != ErrInvalidRoute {
+        t.Errorf("route without hops returned %v, want %v", err, ErrInvalidRoute)
+    }
+    if err := l.RouteAddMultipath(TableMain, *to, MetricDefault, hops); err != nil {
+        t.Fatal(err)
+    }
+    e := l.table(TableMain).lookup(0xC0000201)
+    if e == nil || len(e.paths) != 2 || e.totalWeight != 3 {
+        t.Fatalf("route %+v", e)
+    }
+    for i, p := range e.paths {
+        if len(p.paths) != 0 || p.network != 0xC0000200 || p.prefixLength != 24 || p.metric != MetricDefault {
+            t.Errorf("path %d is %+v", i, p)
+        }
+    }
+    if e.paths[0].flags & FlagGateway == 0 || e.paths[1].flags & FlagGateway != 0 || e.paths[1].weight != 1 {
+        t.Errorf("paths %+v and %+v", e.paths[0], e.paths[1])
+    }
+}
@@ -0,0 +1,351 @@
+package ipv4
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+const (
+    //Options of the ipv4 header (RFC 791 section 3.1), the high bit of the type is the copied flag
+    OptionEndOfList = 0
+    OptionNOP = 1
+    OptionRecordRoute = 7
+    OptionTimestamp = 68
+    OptionLooseSourceRoute = 131
+    OptionStrictSourceRoute = 137
+    //OptionRouterAlert is defined in RFC 2113
+    OptionRouterAlert = 148
+
+    //Flags of the timestamp option selecting what is recorded
+    TimestampOnly = 0
+    TimestampAndAddress = 1
+    TimestampPrespecified = 3
+
+    //MaxOptionsLength is the most option bytes fitting into the header
+    MaxOptionsLength = 40
+
+    optionCopied = 0x80
+)
+
+//Option is an option of the ipv4 header, Data is the content following the type and length fields.
+//End of list and no operation options consist of the type alone and have no Data.
+type Option struct {
+    Type byte
+    Data []byte
+}
+
+//Copied returns true for options which are copied into every fragment, the others are only sent in the first one.
+func (o *Option) Copied() bool {
+    return o.Type & optionCopied != 0
+}
+
+func (o *Option) length() int {
+    if o.Type == OptionEndOfList || o.Type == OptionNOP {
+        return 1
+    }
+    return 2 + len(o.Data)
+}
+
+//RecordRouteOption returns a record route option with room for n addresses.
+func RecordRouteOption(n int) Option {
+    data := make([]byte, 1 + 4 * n)
+    data[0] = 4
+    return Option{ Type: OptionRecordRoute, Data: data }
+}
+
+//TimestampOption returns a timestamp option with room for n timestamps, with TimestampAndAddress
+//every timestamp is preceded by the address of the host which recorded it.
+func TimestampOption(flag byte, n int) Option {
+    size := 4
+    if flag != TimestampOnly {
+        size = 8
+    }
+    data := make([]byte, 2 + size * n)
+    data[0] = 5
+    data[1] = flag
+    return Option{ Type: OptionTimestamp, Data: data }
+}
+
+//PrespecifiedTimestampOption returns a timestamp option which only the hosts are asked to fill in.
+func PrespecifiedTimestampOption(hosts []net.IP) Option {
+    o := TimestampOption(TimestampPrespecified, len(hosts))
+    for i, h := range hosts {
+        copy(o.Data[2 + 8 * i:], h.To4())
+    }
+    return o
+}
+
+//SourceRouteOption returns a loose or strict source route option. The header has to be addressed to the
+//first hop, route lists the following hops and ends with the final destination.
+func SourceRouteOption(strict bool, route []net.IP) Option {
+    o := Option{ Type: OptionLooseSourceRoute, Data: make([]byte, 1 + 4 * len(route)) }
+    if strict {
+        o.Type = OptionStrictSourceRoute
+    }
+    o.Data[0] = 4
+    for i, r := range route {
+        copy(o.Data[1 + 4 * i:], r.To4())
+    }
+    return o
+}
+
+//RouterAlertOption returns the router alert option asking every router on the path to examine the packet.
+func RouterAlertOption() Option {
+    return Option{ Type: OptionRouterAlert, Data: []byte{ 0, 0 } }
+}
+
+//Option returns the first option of type t and whether the header carries one.
+func (h *Header) Option(t byte) (Option, bool) {
+    for _, o := range h.Options {
+        if o.Type == t {
+            return o, true
+        }
+    }
+    return Option{}, false
+}
+
+//length returns the length of the header including the options padded to a multiple of 4 bytes.
+func (h *Header) length() int {
+    n := 0
+    for i := range h.Options {
+        n += h.Options[i].length()
+    }
+    return HeaderLength + (n + 3) &^ 3
+}
+
+//validOptions checks that the options can be sent.
+func validOptions(options []Option) bool {
+    n := 0
+    for i := range options {
+        o := &options[i]
+        if (o.Type == OptionEndOfList || o.Type == OptionNOP) && len(o.Data) != 0 {
+            return false
+        }
+        n += o.length()
+    }
+    return n <= MaxOptionsLength
+}
+
+//putOptions writes the options to buf and fills the rest of it with end of list options.
+func putOptions(buf []byte, options []Option) {
+    offset := 0
+    for i := range options {
+        o := &options[i]
+        buf[offset] = o.Type
+        if o.length() > 1 {
+            buf[offset + 1] = byte(o.length())
+            copy(buf[offset + 2:], o.Data)
+        }
+        offset += o.length()
+    }
+    for ; offset < len(buf); offset++ {
+        buf[offset] = OptionEndOfList
+    }
+}
+
+//parseOptions decodes the options following the fixed part of the header, no operation options are kept
+//so the options are written back at the same offsets. For malformed options the offset of the offending
+//byte within buf is returned for an icmp parameter problem message, otherwise -1.
+func parseOptions(buf []byte) ([]Option, int) {
+    var options []Option
+    var seen [256]bool
+    for i := 0; i < len(buf); {
+        t := buf[i]
+        if t == OptionEndOfList {
+            break
+        }
+        if t == OptionNOP {
+            options = append(options, Option{ Type: OptionNOP })
+            i++
+            continue
+        }
+        if i + 1 >= len(buf) {
+            return nil, i
+        }
+        length := int(buf[i + 1])
+        if length < 2 || i + length > len(buf) {
+            return nil, i + 1
+        }
+        data := buf[i + 2:i + length]
+        switch t {
+        case OptionRecordRoute, OptionLooseSourceRoute, OptionStrictSourceRoute:
+            if length < 3 {
+                return nil, i + 1
+            }
+            //The pointer has to point to an address slot which fits into the option
+            ptr := int(data[0])
+            if ptr < 4 || (ptr <= length && ptr + 3 > length) {
+                return nil, i + 2
+            }
+            if seen[t] || (t != OptionRecordRoute && (seen[OptionLooseSourceRoute] || seen[OptionStrictSourceRoute])) {
+                return nil, i
+            }
+        case OptionTimestamp:
+            if length < 4 {
+                return nil, i + 1
+            }
+            size := 4
+            switch data[1] & 0xF {
+            case TimestampOnly:
+            case TimestampAndAddress, TimestampPrespecified:
+                size = 8
+            default:
+                return nil, i + 3
+            }
+            ptr := int(data[0])
+            if ptr < 5 || (ptr <= length && ptr + size - 1 > length) {
+                return nil, i + 2
+            }
+            if seen[t] {
+                return nil, i
+            }
+        case OptionRouterAlert:
+            if length != 4 {
+                return nil, i + 1
+            }
+        }
+        seen[t] = true
+        options = append(options, Option{ Type: t, Data: data })
+        i += length
+    }
+    return options, -1
+}
+
+//copyOptions returns a deep copy of the options so they can be changed without touching the received packet.
+func copyOptions(options []Option) []Option {
+    res := make([]Option, len(options))
+    for i, o := range options {
+        res[i] = Option{ Type: o.Type, Data: append([]byte(nil), o.Data...) }
+    }
+    return res
+}
+
+//copiedOptions returns the options which are sent in every fragment (RFC 791 section 3.2).
+func copiedOptions(options []Option) []Option {
+    var res []Option
+    for i := range options {
+        if options[i].Copied() {
+            res = append(res, options[i])
+        }
+    }
+    return res
+}
+
+//optionOffset returns the offset of the option at index i from the start of the header.
+func optionOffset(options []Option, i int) int {
+    offset := HeaderLength
+    for j := 0; j < i; j++ {
+        offset += options[j].length()
+    }
+    return offset
+}
+
+//sourceRoute returns the loose or strict source route option of the options or nil.
+func sourceRoute(options []Option) *Option {
+    for i := range options {
+        if options[i].Type == OptionLooseSourceRoute || options[i].Type == OptionStrictSourceRoute {
+            return &options[i]
+        }
+    }
+    return nil
+}
+
+//routeSlot returns the address slot the pointer of a record route or source route option points to,
+//it is nil once the route is complete.
+func (o *Option) routeSlot() []byte {
+    ptr := int(o.Data[0])
+    if ptr > o.length() {
+        return nil
+    }
+    return o.Data[ptr - 3:ptr + 1]
+}
+
+//recordAddress stores addr in the current slot of a record route or source route option and advances the pointer.
+func (o *Option) recordAddress(addr net.IP) {
+    slot := o.routeSlot()
+    if slot == nil {
+        return
+    }
+    copy(slot, addr.To4())
+    o.Data[0] += 4
+}
+
+//timestampNow returns the milliseconds since midnight UT (RFC 791 section 3.1).
+func timestampNow() uint32 {
+    now := time.Now().UTC()
+    y, m, d := now.Date()
+    return uint32(now.Sub(time.Date(y, m, d, 0, 0, 0, 0, time.UTC)) / time.Millisecond)
+}
+
+//recordTimestamp adds the timestamp of this host with the address addr to a timestamp option. If the
+//option is full its overflow counter is incremented, false is returned once the counter overflows.
+func (l *Layer) recordTimestamp(o *Option, addr net.IP) bool {
+    flag := o.Data[1] & 0xF
+    size := 4
+    if flag != TimestampOnly {
+        size = 8
+    }
+    ptr := int(o.Data[0])
+    if ptr + size - 1 > o.length() {
+        if o.Data[1] >> 4 == 0xF {
+            return false
+        }
+        o.Data[1] += 0x10
+        return true
+    }
+    slot := o.Data[ptr - 3:ptr - 3 + size]
+    switch flag {
+    case TimestampAndAddress:
+        copy(slot[0:4], addr.To4())
+    case TimestampPrespecified:
+        if !net.IP(slot[0:4]).Equal(addr) && !l.isForUs(net.IP(slot[0:4])) {
+            return true
+        }
+    }
+    binary.BigEndian.PutUint32(slot[size - 4:], timestampNow())
+    o.Data[0] += byte(size)
+    return true
+}
+
+//forwardOptions updates the options of a forwarded packet leaving through the interface with the address addr,
+//routed is true if the packet reached an address of its source route. The offset of an option which can not
+//be updated is returned for an icmp parameter problem message, otherwise -1.
+func (l *Layer) forwardOptions(options []Option, addr net.IP, routed bool) int {
+    for i := range options {
+        o := &options[i]
+        switch o.Type {
+        case OptionRecordRoute:
+            o.recordAddress(addr)
+        case OptionLooseSourceRoute, OptionStrictSourceRoute:
+            if routed {
+                o.recordAddress(addr)
+            }
+        case OptionTimestamp:
+            if !l.recordTimestamp(o, addr) {
+                return optionOffset(options, i) + 3
+            }
+        }
+    }
+    return -1
+}
+
+//echoOptions returns the record route and timestamp options of an echo request updated with the address addr
+//of this host, they are sent back with the echo reply (RFC 1122 section 3.2.2.6).
+func (l *Layer) echoOptions(request *Header, addr net.IP) []Option {
+    var options []Option
+    for _, o := range request.Options {
+        switch o.Type {
+        case OptionRecordRoute, OptionTimestamp:
+            options = append(options, Option{ Type: o.Type, Data: append([]byte(nil), o.Data...) })
+        }
+    }
+    for i := range options {
+        if options[i].Type == OptionRecordRoute {
+            options[i].recordAddress(addr)
+        } else {
+            l.recordTimestamp(&options[i], addr)
+        }
+    }
+    return options
+}
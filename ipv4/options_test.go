@@ -0,0 +1,191 @@
+package ipv4
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"github.com/arcpop/network/ethernet"
+	"github.com/arcpop/network/netdev"
+)
+
+func TestParseOptionsMalformed(t *testing.T) {
+    tests := []struct {
+        name string
+        options []byte
+        //bad is the offset of the offending byte within the options
+        bad int
+    }{
+        { "type without length", []byte{ OptionRecordRoute }, 0 },
+        { "length below 2", []byte{ OptionRecordRoute, 1, 0, 0 }, 1 },
+        { "length beyond options", []byte{ OptionRecordRoute, 8, 4, 0 }, 1 },
+        { "length after nop", []byte{ OptionNOP, OptionRecordRoute, 9, 4 }, 2 },
+        { "record route without pointer", []byte{ OptionRecordRoute, 2, 0, 0 }, 1 },
+        { "record route pointer below 4", []byte{ OptionRecordRoute, 7, 3, 0, 0, 0, 0, 0 }, 2 },
+        { "record route pointer into slot", []byte{ OptionRecordRoute, 7, 5, 0, 0, 0, 0, 0 }, 2 },
+        { "duplicate record route", []byte{ OptionRecordRoute, 3, 4, OptionRecordRoute, 3, 4, 0, 0 }, 3 },
+        { "loose and strict source route", []byte{
+            OptionLooseSourceRoute, 7, 4, 192, 0, 2, 1,
+            OptionStrictSourceRoute, 7, 4, 192, 0, 2, 2,
+            0, 0 }, 7 },
+        { "timestamp too short", []byte{ OptionTimestamp, 3, 5, 0 }, 1 },
+        { "timestamp unknown flag", []byte{ OptionTimestamp, 8, 5, 2, 0, 0, 0, 0 }, 3 },
+        { "timestamp pointer below 5", []byte{ OptionTimestamp, 8, 4, TimestampOnly, 0, 0, 0, 0 }, 2 },
+        { "timestamp pointer into slot", []byte{ OptionTimestamp, 8, 5, TimestampAndAddress, 0, 0, 0, 0 }, 2 },
+        { "duplicate timestamp", []byte{ OptionTimestamp, 4, 5, 0, OptionTimestamp, 4, 5, 0 }, 4 },
+        { "router alert length", []byte{ OptionRouterAlert, 3, 0, 0 }, 1 },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            options, bad := parseOptions(tt.options)
+            if bad != tt.bad {
+                t.Errorf("bad offset %d, want %d", bad, tt.bad)
+            }
+            if options != nil {
+                t.Errorf("returned options %v for malformed options", options)
+            }
+        })
+    }
+}
+
+func TestParseOptions(t *testing.T) {
+    buf := []byte{
+        OptionNOP,
+        OptionRecordRoute, 7, 8, 192, 0, 2, 1,
+        OptionRouterAlert, 4, 0, 0,
+        OptionEndOfList, OptionRecordRoute, 0, 0,
+    }
+    options, bad := parseOptions(buf)
+    if bad != -1 {
+        t.Fatalf("bad offset %d for valid options", bad)
+    }
+    if len(options) != 3 || options[0].Type != OptionNOP || options[1].Type != OptionRecordRoute || options[2].Type != OptionRouterAlert {
+        t.Fatalf("parsed %v", options)
+    }
+    if !bytes.Equal(options[1].Data, buf[3:8]) {
+        t.Errorf("record route data %v, want %v", options[1].Data, buf[3:8])
+    }
+    if optionOffset(options, 2) != HeaderLength + 8 {
+        t.Errorf("router alert at offset %d, want %d", optionOffset(options, 2), HeaderLength + 8)
+    }
+    out := make([]byte, len(buf))
+    putOptions(out, options)
+    if !bytes.Equal(out[:12], buf[:12]) {
+        t.Errorf("options written as %v, want %v", out[:12], buf[:12])
+    }
+}
+
+func TestRecordRouteFull(t *testing.T) {
+    l := NewLayer(nil, netdev.NewList())
+    hops := []net.IP{ net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2), net.IPv4(192, 0, 2, 3) }
+    options := []Option{ RecordRouteOption(2) }
+    for _, h := range hops {
+        if bad := l.forwardOptions(options, h, false); bad != -1 {
+            t.Fatalf("forwarding through %v failed at offset %d", h, bad)
+        }
+    }
+    o := options[0]
+    if o.Data[0] != 12 {
+        t.Errorf("pointer %d, want 12 past the last slot", o.Data[0])
+    }
+    if !net.IP(o.Data[1:5]).Equal(hops[0]) || !net.IP(o.Data[5:9]).Equal(hops[1]) {
+        t.Errorf("recorded %v, want %v and %v", o.Data[1:], hops[0], hops[1])
+    }
+    //A full option is still valid and is echoed unchanged
+    buf := make([]byte, 12)
+    putOptions(buf, options)
+    parsed, bad := parseOptions(buf)
+    if bad != -1 || len(parsed) != 1 {
+        t.Fatalf("full record route parsed as %v with bad offset %d", parsed, bad)
+    }
+    echoed := l.echoOptions(&Header{ Options: parsed }, hops[2])
+    if len(echoed) != 1 || !bytes.Equal(echoed[0].Data, o.Data) {
+        t.Errorf("echoed %v, want %v", echoed, o.Data)
+    }
+}
+
+func TestTimestampOverflow(t *testing.T) {
+    l := NewLayer(nil, netdev.NewList())
+    addr := net.IPv4(192, 0, 2, 1)
+    options := []Option{ { Type: OptionNOP }, TimestampOption(TimestampOnly, 1) }
+    if bad := l.forwardOptions(options, addr, false); bad != -1 {
+        t.Fatalf("recording the first timestamp failed at offset %d", bad)
+    }
+    o := options[1]
+    if o.Data[0] != 9 || o.Data[1] >> 4 != 0 {
+        t.Fatalf("pointer %d and overflow %d after the first timestamp", o.Data[0], o.Data[1] >> 4)
+    }
+    for i := 1; i <= 0xF; i++ {
+        if bad := l.forwardOptions(options, addr, false); bad != -1 {
+            t.Fatalf("overflow %d failed at offset %d", i, bad)
+        }
+        if int(o.Data[1] >> 4) != i {
+            t.Fatalf("overflow counter %d, want %d", o.Data[1] >> 4, i)
+        }
+    }
+    //The counter overflows itself, the pointer refers to the overflow and flags byte
+    if bad := l.forwardOptions(options, addr, false); bad != HeaderLength + 1 + 3 {
+        t.Errorf("bad offset %d, want %d", bad, HeaderLength + 1 + 3)
+    }
+    if o.Data[1] >> 4 != 0xF || o.Data[1] & 0xF != TimestampOnly || o.Data[0] != 9 {
+        t.Errorf("option changed to %v after the overflow", o.Data)
+    }
+}
+
+func TestFragmentOptions(t *testing.T) {
+    l, _ := newTestLayer(t)
+    a, b, err := netdev.OpenPipe(netdev.PipeConfig{ Name: "a", MTU: 576 }, netdev.PipeConfig{ Name: "b", MTU: 576 })
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer a.Close()
+    defer b.Close()
+    data := make([]byte, 1400)
+    for i := range data {
+        data[i] = byte(i)
+    }
+    p := AllocatePacket(len(data))
+    copy(p.ProtocolData, data)
+    p.Iface = a
+    p.IPHeader = &Header{
+        TTL: 1,
+        Protocol: testProtocol,
+        SourceIP: net.IPv4(192, 0, 2, 1).To4(),
+        TargetIP: net.IPv4bcast,
+        Options: []Option{ RecordRouteOption(3), RouterAlertOption() },
+    }
+    if err := l.Send(p); err != nil {
+        t.Fatal(err)
+    }
+    var received []byte
+    for i := 0; len(received) < len(data); i++ {
+        frame := b.RxPacket()
+        hdr := parseHeader(frame[ethernet.HeaderLength:])
+        if hdr == nil {
+            t.Fatalf("fragment %d has an invalid header", i)
+        }
+        headerSize := int(hdr.headerLength) << 2
+        if int(hdr.TotalLength) > 576 {
+            t.Errorf("fragment %d is %d bytes long", i, hdr.TotalLength)
+        }
+        options, bad := parseOptions(frame[ethernet.HeaderLength + HeaderLength:ethernet.HeaderLength + headerSize])
+        if bad != -1 {
+            t.Fatalf("fragment %d has malformed options at %d", i, bad)
+        }
+        _, rr := (&Header{ Options: options }).Option(OptionRecordRoute)
+        _, ra := (&Header{ Options: options }).Option(OptionRouterAlert)
+        //Record route is only sent in the first fragment, router alert has the copied flag
+        if rr != (i == 0) || !ra {
+            t.Errorf("fragment %d carries the options %v", i, options)
+        }
+        if int(hdr.FragmentOffset) << 3 != len(received) {
+            t.Fatalf("fragment %d at offset %d, want %d", i, int(hdr.FragmentOffset) << 3, len(received))
+        }
+        received = append(received, frame[ethernet.HeaderLength + headerSize:ethernet.HeaderLength + int(hdr.TotalLength)]...)
+        if hdr.MoreFragments != (len(received) < len(data)) {
+            t.Errorf("fragment %d has more fragments %v", i, hdr.MoreFragments)
+        }
+    }
+    if !bytes.Equal(received, data) {
+        t.Errorf("fragments carry different data")
+    }
+}
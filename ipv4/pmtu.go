@@ -0,0 +1,136 @@
+package ipv4
+
+import (
+	"context"
+	"net"
+	"time"
+	"github.com/arcpop/network/config"
+)
+
+//mtuPlateaus are the common mtus of RFC 1191 section 7, they are used to guess the mtu of
+//the next hop if a router does not report it.
+var mtuPlateaus = []int{ 32000, 17914, 8166, 4352, 2002, 1492, 1006, 508, 296, 68 }
+
+//minimumMTU is the smallest mtu every link has to support (RFC 791)
+const minimumMTU = 68
+
+type pathMTUEntry struct {
+    mtu int
+    //locked is set if the reported mtu was below MinPathMTU, packets to the destination are then
+    //sent without the DontFragment bit so they can be fragmented further
+    locked bool
+    expires time.Time
+}
+
+func PathMTU(dst net.IP) (int, error) {
+    return Default.PathMTU(dst)
+}
+
+//PathMTU returns the largest packet which can be sent to dst without being fragmented, it is the mtu
+//learned through path mtu discovery or the mtu of the interface towards dst.
+func (l *Layer) PathMTU(dst net.IP) (int, error) {
+    entry, err := l.RoutingGetRoute(dst)
+    if err != nil {
+        return 0, err
+    }
+    return l.pathMTU(dst, entry.Iface.GetMTU()), nil
+}
+
+func PathMTUDiscovery(dst net.IP) bool {
+    return Default.PathMTUDiscovery(dst)
+}
+
+//PathMTUDiscovery returns true if packets to dst should be sent with the DontFragment bit set to discover
+//the mtu of the path. It is false if the discovery is disabled or the path mtu was raised to MinPathMTU,
+//like linux does for paths below min_pmtu.
+func (l *Layer) PathMTUDiscovery(dst net.IP) bool {
+    if !config.IPv4.PathMTUDiscovery {
+        return false
+    }
+    var key [4]byte
+    copy(key[:], dst.To4())
+    l.pathMTULock.Lock()
+    defer l.pathMTULock.Unlock()
+    e, ok := l.pathMTUs[key]
+    return !ok || !e.locked || time.Now().After(e.expires)
+}
+
+//pathMTU returns the learned mtu of the path to dst if it is smaller than mtu, the mtu of the first hop.
+func (l *Layer) pathMTU(dst net.IP, mtu int) int {
+    var key [4]byte
+    copy(key[:], dst.To4())
+    l.pathMTULock.Lock()
+    defer l.pathMTULock.Unlock()
+    e, ok := l.pathMTUs[key]
+    if !ok {
+        return mtu
+    }
+    if time.Now().After(e.expires) {
+        delete(l.pathMTUs, key)
+        return mtu
+    }
+    if e.mtu < mtu {
+        return e.mtu
+    }
+    return mtu
+}
+
+func UpdatePathMTU(original *Header, nextHopMTU int) {
+    Default.UpdatePathMTU(original, nextHopMTU)
+}
+
+//UpdatePathMTU handles a fragmentation needed message for the packet with the original header (RFC 1191 section 6.1).
+//nextHopMTU is 0 if the router did not report it, the mtu is then guessed from the length of the packet.
+//The learned mtu only ever shrinks until it expires, it is locked once it was raised to MinPathMTU.
+//The layer does not trust the message itself, the protocol which sent the packet calls this once it
+//checked that the packet belongs to one of its flows, e.g. that a tcp segment is in flight (RFC 5927 section 7).
+func (l *Layer) UpdatePathMTU(original *Header, nextHopMTU int) {
+    if !original.DontFragment {
+        return
+    }
+    length := int(original.TotalLength)
+    if nextHopMTU < minimumMTU || nextHopMTU >= length {
+        nextHopMTU = minimumMTU
+        for _, p := range mtuPlateaus {
+            if p < length {
+                nextHopMTU = p
+                break
+            }
+        }
+    }
+    locked := nextHopMTU < config.IPv4.MinPathMTU
+    if locked {
+        nextHopMTU = config.IPv4.MinPathMTU
+    }
+    var key [4]byte
+    copy(key[:], original.TargetIP.To4())
+    now := time.Now()
+    l.pathMTULock.Lock()
+    defer l.pathMTULock.Unlock()
+    e, ok := l.pathMTUs[key]
+    if ok && now.Before(e.expires) && e.mtu <= nextHopMTU && (e.locked || !locked) {
+        return
+    }
+    l.pathMTUs[key] = &pathMTUEntry{ mtu: nextHopMTU, locked: locked, expires: now.Add(config.IPv4.PathMTUTimeout) }
+}
+
+//pathMTUWorker removes expired path mtus, the paths are then tried with the mtu of the interface again (RFC 1191 section 6.3).
+func (l *Layer) pathMTUWorker(ctx context.Context) {
+    defer l.workers.Done()
+    ticker := time.NewTicker(time.Minute)
+    defer ticker.Stop()
+    for {
+        select {
+        case <- ctx.Done():
+            return
+        case now := <- ticker.C:
+            l.pathMTULock.Lock()
+            for k, e := range l.pathMTUs {
+                if now.After(e.expires) {
+                    delete(l.pathMTUs, k)
+                }
+            }
+            l.pathMTULock.Unlock()
+        }
+    }
+}
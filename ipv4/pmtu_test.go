@@ -0,0 +1,42 @@
+package ipv4
+
+import (
+	"net"
+	"testing"
+	"github.com/arcpop/network/config"
+	"github.com/arcpop/network/netdev"
+)
+
+func TestPathMTULocked(t *testing.T) {
+    l := NewLayer(nil, netdev.NewList())
+    dst := net.IPv4(192, 0, 2, 1).To4()
+    other := net.IPv4(192, 0, 2, 2).To4()
+    original := &Header{ DontFragment: true, TotalLength: 1500, TargetIP: dst }
+    l.UpdatePathMTU(original, 1400)
+    if mtu := l.pathMTU(dst, 1500); mtu != 1400 {
+        t.Errorf("path mtu %d, want 1400", mtu)
+    }
+    if !l.PathMTUDiscovery(dst) {
+        t.Errorf("discovery disabled after a path mtu above the minimum")
+    }
+    //A path below the minimum is raised to it and further packets are fragmented on the way
+    original.TotalLength = 1400
+    l.UpdatePathMTU(original, 300)
+    if mtu := l.pathMTU(dst, 1500); mtu != config.IPv4.MinPathMTU {
+        t.Errorf("path mtu %d, want %d", mtu, config.IPv4.MinPathMTU)
+    }
+    if l.PathMTUDiscovery(dst) {
+        t.Errorf("discovery enabled after the path mtu was raised to the minimum")
+    }
+    if !l.PathMTUDiscovery(other) {
+        t.Errorf("discovery disabled for another destination")
+    }
+    enabled := config.IPv4.PathMTUDiscovery
+    defer func() {
+        config.IPv4.PathMTUDiscovery = enabled
+    }()
+    config.IPv4.PathMTUDiscovery = false
+    if l.PathMTUDiscovery(other) {
+        t.Errorf("discovery enabled although it is configured off")
+    }
+}
@@ -0,0 +1,233 @@
+package ipv4
+
+import (
+	"net"
+	"strconv"
+	"github.com/arcpop/network/netdev"
+	"github.com/arcpop/network/util"
+)
+
+const (
+    //Well known routing tables, the numbers are the ones used by linux
+    TableDefault = 253
+    TableMain = 254
+    TableLocal = 255
+
+    //Priorities of the rules every layer starts with
+    RulePriorityLocal = 0
+    RulePriorityMain = 32766
+    RulePriorityDefault = 32767
+)
+
+//Rule selects the routing table for the packets it matches, like the rules of linux (ip rule).
+//The rules are tried in the order of their priority until a table has a route to the destination.
+type Rule struct {
+    Priority int
+    //Src and Dst match the source and destination address of the packet, a nil IP matches every address.
+    //Packets which have no source address yet only match rules without Src.
+    Src, Dst net.IPNet
+    //InIface matches forwarded packets received on the interface, nil matches every packet
+    InIface netdev.Interface
+    //TOS matches the type of service byte without the ecn bits, 0 matches every packet
+    TOS byte
+    //Mark matches packets whose mark masked by Mask equals Mark, a zero Mask compares the whole mark
+    Mark, Mask uint32
+    Table int
+}
+
+//RouteQuery describes the packet a route is looked up for.
+type RouteQuery struct {
+    Dst net.IP
+    //Src is nil if the source address is not chosen yet
+    Src net.IP
+    //InIface is the interface a forwarded packet was received on, it is nil for packets of this host
+    InIface netdev.Interface
+    TOS byte
+    Mark uint32
+    //Protocol and the ports of tcp and udp select the path of multipath routes
+    Protocol byte
+    SrcPort, DstPort uint16
+}
+
+func defaultRules() []Rule {
+    return []Rule{
+        { Priority: RulePriorityLocal, Table: TableLocal },
+        { Priority: RulePriorityMain, Table: TableMain },
+        { Priority: RulePriorityDefault, Table: TableDefault },
+    }
+}
+
+func defaultTableNames() map[string]int {
+    return map[string]int{
+        "default": TableDefault,
+        "main": TableMain,
+        "local": TableLocal,
+    }
+}
+
+func (r *Rule) matches(q *RouteQuery) bool {
+    if r.Src.IP != nil && (q.Src == nil || !r.Src.Contains(q.Src)) {
+        return false
+    }
+    if r.Dst.IP != nil && !r.Dst.Contains(q.Dst) {
+        return false
+    }
+    if r.InIface != nil && r.InIface != q.InIface {
+        return false
+    }
+    if r.TOS != 0 && r.TOS != q.TOS &^ 3 {
+        return false
+    }
+    mask := r.Mask
+    if mask == 0 && r.Mark != 0 {
+        mask = 0xFFFFFFFF
+    }
+    return q.Mark & mask == r.Mark
+}
+
+func sameIPNet(a, b net.IPNet) bool {
+    if a.IP == nil || b.IP == nil {
+        return a.IP == nil && b.IP == nil
+    }
+    return a.IP.Equal(b.IP) && a.Mask.String() == b.Mask.String()
+}
+
+//normalize clears the host bits of the prefixes so rules compare equal no matter how they were written.
+func (r *Rule) normalize() {
+    if r.Src.IP != nil {
+        r.Src = net.IPNet{ IP: r.Src.IP.Mask(r.Src.Mask), Mask: r.Src.Mask }
+    }
+    if r.Dst.IP != nil {
+        r.Dst = net.IPNet{ IP: r.Dst.IP.Mask(r.Dst.Mask), Mask: r.Dst.Mask }
+    }
+}
+
+func (r *Rule) equal(o *Rule) bool {
+    return r.Priority == o.Priority && r.Table == o.Table && sameIPNet(r.Src, o.Src) && sameIPNet(r.Dst, o.Dst) &&
+        r.InIface == o.InIface && r.TOS == o.TOS && r.Mark == o.Mark && r.Mask == o.Mask
+}
+
+func AddRule(r Rule) error {
+    return Default.AddRule(r)
+}
+
+//AddRule adds the rule behind the existing rules of the same priority.
+func (l *Layer) AddRule(r Rule) error {
+    if r.Priority < 0 || r.Table <= 0 || (r.Mark & ^r.Mask != 0 && r.Mask != 0) {
+        return ErrInvalidRule
+    }
+    r.normalize()
+    l.routingTableLock.Lock()
+    defer l.routingTableLock.Unlock()
+    i := len(l.rules)
+    for i > 0 && l.rules[i - 1].Priority > r.Priority {
+        i--
+    }
+    l.rules = append(l.rules, Rule{})
+    copy(l.rules[i + 1:], l.rules[i:])
+    l.rules[i] = r
+    return nil
+}
+
+func DeleteRule(r Rule) error {
+    return Default.DeleteRule(r)
+}
+
+//DeleteRule removes the first rule equal to r, ErrRuleNotFound is returned if there is none.
+func (l *Layer) DeleteRule(r Rule) error {
+    r.normalize()
+    l.routingTableLock.Lock()
+    defer l.routingTableLock.Unlock()
+    for i := range l.rules {
+        if l.rules[i].equal(&r) {
+            l.rules = append(l.rules[:i], l.rules[i + 1:]...)
+            return nil
+        }
+    }
+    return ErrRuleNotFound
+}
+
+func Rules() []Rule {
+    return Default.Rules()
+}
+
+//Rules returns the rules in the order they are tried.
+func (l *Layer) Rules() []Rule {
+    l.routingTableLock.RLock()
+    defer l.routingTableLock.RUnlock()
+    res := make([]Rule, len(l.rules))
+    copy(res, l.rules)
+    return res
+}
+
+func NameTable(name string, table int) error {
+    return Default.NameTable(name, table)
+}
+
+//NameTable gives the table a name which TableByName resolves, like an entry of /etc/iproute2/rt_tables.
+func (l *Layer) NameTable(name string, table int) error {
+    if table <= 0 {
+        return ErrInvalidRule
+    }
+    l.routingTableLock.Lock()
+    l.tableNames[name] = table
+    l.routingTableLock.Unlock()
+    return nil
+}
+
+func TableByName(name string) (int, error) {
+    return Default.TableByName(name)
+}
+
+//TableByName returns the number of the table named name, a decimal number is taken as it is.
+func (l *Layer) TableByName(name string) (int, error) {
+    l.routingTableLock.RLock()
+    table, ok := l.tableNames[name]
+    l.routingTableLock.RUnlock()
+    if ok {
+        return table, nil
+    }
+    table, err := strconv.Atoi(name)
+    if err != nil || table <= 0 {
+        return 0, ErrTableNotFound
+    }
+    return table, nil
+}
+
+func RouteLookup(q *RouteQuery) (*RoutingEntry, error) {
+    return Default.RouteLookup(q)
+}
+
+//RouteLookup returns the route for the packet described by q from the table of the first matching rule
+//which has a route to the destination, within a table the longest prefix and then the metric decide.
+//For multipath routes the path of the flow is returned.
+func (l *Layer) RouteLookup(q *RouteQuery) (*RoutingEntry, error) {
+    dst := q.Dst.To4()
+    if dst == nil {
+        return nil, ErrPacketNotRoutable
+    }
+    query := *q
+    query.Dst = dst
+    if query.Src != nil && (query.Src.To4() == nil || query.Src.IsUnspecified()) {
+        query.Src = nil
+    }
+    ip32 := util.IPToUint32(dst)
+    l.routingTableLock.RLock()
+    defer l.routingTableLock.RUnlock()
+    for i := range l.rules {
+        if !l.rules[i].matches(&query) {
+            continue
+        }
+        t := l.routingTables[l.rules[i].Table]
+        if t == nil {
+            continue
+        }
+        if e := t.lookup(ip32); e != nil {
+            if len(e.paths) != 0 {
+                return e.selectPath(l.flowHash(&query)), nil
+            }
+            return e, nil
+        }
+    }
+    return nil, ErrPacketNotRoutable
+}
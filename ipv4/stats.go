@@ -0,0 +1,127 @@
+package ipv4
+
+import (
+	"net"
+	"sync/atomic"
+	"github.com/arcpop/network/netdev"
+)
+
+//Statistics counts the packets handled by a layer, the counters are the ones of the ip group
+//of MIB-II (RFC 1213) with the additions of RFC 4293.
+type Statistics struct {
+    //InReceives counts all received packets including the ones dropped because of errors
+    InReceives uint64
+    //InHdrErrors counts packets dropped because of a malformed header or options, a martian source address
+    //or an expired ttl
+    InHdrErrors uint64
+    //InTruncatedPkts counts packets dropped because the frame is shorter than their header or total length
+    InTruncatedPkts uint64
+    //InAddrErrors counts packets dropped because their destination is not accepted by this host,
+    //this includes packets for other hosts while forwarding is off
+    InAddrErrors uint64
+    //InUnknownProtos counts packets for this host with a protocol no handler is registered for
+    InUnknownProtos uint64
+    //InDiscards counts valid packets which were dropped anyway, like source routed ones which are not accepted
+    InDiscards uint64
+    //InDelivers counts packets handed to the protocols
+    InDelivers uint64
+    //ForwDatagrams counts packets which were forwarded towards another host
+    ForwDatagrams uint64
+    //OutRequests counts packets of the protocols of this host passed to Send
+    OutRequests uint64
+    //OutDiscards counts packets of this host which could not be sent, like those with invalid options
+    OutDiscards uint64
+    //OutNoRoutes counts sent and forwarded packets for which no route was found
+    OutNoRoutes uint64
+    //ReasmReqds counts received fragments
+    ReasmReqds uint64
+    //ReasmOKs counts reassembled packets
+    ReasmOKs uint64
+    //ReasmFails counts the datagrams whose reassembly failed, see ReassemblyStats for the reasons
+    ReasmFails uint64
+    //FragOKs counts packets which were fragmented
+    FragOKs uint64
+    //FragFails counts packets which needed fragmenting but had the DontFragment bit set
+    FragFails uint64
+    //FragCreates counts the fragments created
+    FragCreates uint64
+    //ICMPInErrors counts received icmp messages which are truncated or have a bad checksum,
+    //it is icmpInErrors of the icmp group
+    ICMPInErrors uint64
+}
+
+func Stats() Statistics {
+    return Default.Stats()
+}
+
+//Stats returns a snapshot of the counters of the layer.
+func (l *Layer) Stats() Statistics {
+    s := &l.stats
+    r := l.ReassemblyStats()
+    return Statistics{
+        InReceives: atomic.LoadUint64(&s.InReceives),
+        InHdrErrors: atomic.LoadUint64(&s.InHdrErrors),
+        InTruncatedPkts: atomic.LoadUint64(&s.InTruncatedPkts),
+        InAddrErrors: atomic.LoadUint64(&s.InAddrErrors),
+        InUnknownProtos: atomic.LoadUint64(&s.InUnknownProtos),
+        InDiscards: atomic.LoadUint64(&s.InDiscards),
+        InDelivers: atomic.LoadUint64(&s.InDelivers),
+        ForwDatagrams: atomic.LoadUint64(&s.ForwDatagrams),
+        OutRequests: atomic.LoadUint64(&s.OutRequests),
+        OutDiscards: atomic.LoadUint64(&s.OutDiscards),
+        OutNoRoutes: atomic.LoadUint64(&s.OutNoRoutes),
+        ReasmReqds: atomic.LoadUint64(&s.ReasmReqds),
+        ReasmOKs: r.Reassembled,
+        ReasmFails: r.Timeouts + r.Overlaps + r.Inconsistent + r.Oversized,
+        FragOKs: atomic.LoadUint64(&s.FragOKs),
+        FragFails: atomic.LoadUint64(&s.FragFails),
+        FragCreates: atomic.LoadUint64(&s.FragCreates),
+        ICMPInErrors: atomic.LoadUint64(&s.ICMPInErrors),
+    }
+}
+
+//isLoopback returns true for loopback interfaces, they own the loopback address.
+func isLoopback(dev netdev.Interface) bool {
+    for _, a := range dev.GetIPv4Addresses() {
+        if a.IP.IsLoopback() {
+            return true
+        }
+    }
+    return false
+}
+
+//validSource returns false for martian source addresses no packet may be received from (RFC 1122 section 3.2.1.3,
+//RFC 1812 section 5.3.7). The unspecified address is valid, hosts use it while they learn their address.
+//Loopback addresses and the addresses of this host are only valid on loopback interfaces.
+func (l *Layer) validSource(in netdev.Interface, src net.IP) bool {
+    if src.IsUnspecified() {
+        return true
+    }
+    if src[0] == 0 || src[0] >= 240 || src.IsMulticast() {
+        return false
+    }
+    loopback := isLoopback(in)
+    if src.IsLoopback() {
+        return loopback
+    }
+    for _, dev := range l.interfaces.Interfaces() {
+        for _, a := range dev.GetIPv4Addresses() {
+            if a.PrefixLength < 31 && a.Broadcast().Equal(src) {
+                return false
+            }
+            if a.IP.Equal(src) && !loopback {
+                return false
+            }
+        }
+    }
+    return true
+}
+
+//validDestination returns false for destination addresses no packet may be received for,
+//loopback addresses are only valid on loopback interfaces.
+func validDestination(in netdev.Interface, dst net.IP) bool {
+    if dst[0] == 0 || (dst[0] >= 240 && !dst.Equal(net.IPv4bcast)) {
+        return false
+    }
+    return !dst.IsLoopback() || isLoopback(in)
+}
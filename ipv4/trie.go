@@ -0,0 +1,155 @@
+package ipv4
+
+import (
+	"math/bits"
+)
+
+//routeTrie is a path compressed binary trie of routes, a lookup visits at most one node per
+//prefix bit no matter how many routes there are. Every node without routes has two children.
+type routeTrie struct {
+    root *trieNode
+}
+
+type trieNode struct {
+    network uint32
+    prefixLength int
+    //routes to the prefix of the node, sorted by metric
+    routes []*RoutingEntry
+    children [2]*trieNode
+}
+
+func prefixMask(prefixLength int) uint32 {
+    return ^uint32(0) << uint(32 - prefixLength)
+}
+
+//bit returns the bit of ip at index i, counting from the most significant bit.
+func bit(ip uint32, i int) int {
+    return int(ip >> uint(31 - i)) & 1
+}
+
+func (n *trieNode) contains(ip uint32) bool {
+    return (ip ^ n.network) & prefixMask(n.prefixLength) == 0
+}
+
+//insert adds the route, routes with the same prefix are kept in the order of their metric.
+func (t *routeTrie) insert(e *RoutingEntry) {
+    slot := &t.root
+    for {
+        node := *slot
+        if node == nil {
+            *slot = &trieNode{ network: e.network, prefixLength: e.prefixLength, routes: []*RoutingEntry{ e } }
+            return
+        }
+        common := bits.LeadingZeros32(node.network ^ e.network)
+        if common > node.prefixLength {
+            common = node.prefixLength
+        }
+        if common > e.prefixLength {
+            common = e.prefixLength
+        }
+        if common == node.prefixLength {
+            if node.prefixLength == e.prefixLength {
+                node.addRoute(e)
+                return
+            }
+            slot = &node.children[bit(e.network, node.prefixLength)]
+            continue
+        }
+        //The route branches off above node, a new node for the common prefix takes its place
+        parent := &trieNode{ network: e.network & prefixMask(common), prefixLength: common }
+        parent.children[bit(node.network, common)] = node
+        if common == e.prefixLength {
+            parent.routes = []*RoutingEntry{ e }
+        } else {
+            parent.children[bit(e.network, common)] = &trieNode{ network: e.network, prefixLength: e.prefixLength, routes: []*RoutingEntry{ e } }
+        }
+        *slot = parent
+        return
+    }
+}
+
+func (n *trieNode) addRoute(e *RoutingEntry) {
+    i := len(n.routes)
+    for i > 0 && n.routes[i - 1].metric > e.metric {
+        i--
+    }
+    n.routes = append(n.routes, nil)
+    copy(n.routes[i + 1:], n.routes[i:])
+    n.routes[i] = e
+}
+
+//lookup returns the route with the lowest metric among the ones with the longest prefix containing ip.
+func (t *routeTrie) lookup(ip uint32) *RoutingEntry {
+    var best *RoutingEntry
+    node := t.root
+    for node != nil && node.contains(ip) {
+        if len(node.routes) != 0 {
+            best = node.routes[0]
+        }
+        if node.prefixLength == 32 {
+            break
+        }
+        node = node.children[bit(ip, node.prefixLength)]
+    }
+    return best
+}
+
+//remove removes the routes to the prefix for which match returns true and returns how many were removed.
+func (t *routeTrie) remove(network uint32, prefixLength int, match func(*RoutingEntry) bool) int {
+    return removeFrom(&t.root, network & prefixMask(prefixLength), prefixLength, match)
+}
+
+func removeFrom(slot **trieNode, network uint32, prefixLength int, match func(*RoutingEntry) bool) int {
+    node := *slot
+    if node == nil || node.prefixLength > prefixLength || !node.contains(network) {
+        return 0
+    }
+    removed := 0
+    if node.prefixLength == prefixLength {
+        removed = node.removeRoutes(match)
+    } else {
+        removed = removeFrom(&node.children[bit(network, node.prefixLength)], network, prefixLength, match)
+    }
+    compact(slot)
+    return removed
+}
+
+//removeAll removes the routes of all prefixes for which match returns true.
+func (t *routeTrie) removeAll(match func(*RoutingEntry) bool) int {
+    return removeAllFrom(&t.root, match)
+}
+
+func removeAllFrom(slot **trieNode, match func(*RoutingEntry) bool) int {
+    node := *slot
+    if node == nil {
+        return 0
+    }
+    removed := removeAllFrom(&node.children[0], match) + removeAllFrom(&node.children[1], match) + node.removeRoutes(match)
+    compact(slot)
+    return removed
+}
+
+func (n *trieNode) removeRoutes(match func(*RoutingEntry) bool) int {
+    routes := make([]*RoutingEntry, 0, len(n.routes))
+    for _, e := range n.routes {
+        if !match(e) {
+            routes = append(routes, e)
+        }
+    }
+    removed := len(n.routes) - len(routes)
+    n.routes = routes
+    return removed
+}
+
+//compact replaces the node in slot by its child if it lost its routes and does not branch anymore.
+func compact(slot **trieNode) {
+    node := *slot
+    if len(node.routes) != 0 {
+        return
+    }
+    if node.children[0] == nil {
+        *slot = node.children[1]
+    } else if node.children[1] == nil {
+        *slot = node.children[0]
+    }
+}
@@ -0,0 +1,238 @@
+package ipv4
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+	"github.com/arcpop/network/util"
+)
+
+//trieRoute is a route of the tests, a metric of -1 matches all routes of the prefix when removing.
+type trieRoute struct {
+    prefix string
+    metric int
+}
+
+func (r trieRoute) entry(t *testing.T) *RoutingEntry {
+    _, n, err := net.ParseCIDR(r.prefix)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ones, _ := n.Mask.Size()
+    return &RoutingEntry{
+        network: util.IPToUint32(n.IP.To4()),
+        netmask: prefixMask(ones),
+        prefixLength: ones,
+        metric: r.metric,
+    }
+}
+
+func routeName(e *RoutingEntry) string {
+    if e == nil {
+        return "none"
+    }
+    return fmt.Sprintf("%v/%d@%d", util.ToIP(e.network), e.prefixLength, e.metric)
+}
+
+func TestRouteTrie(t *testing.T) {
+    overlapping := []trieRoute{
+        { "10.1.2.3/32", 1 }, { "10.1.0.0/16", 1 }, { "10.128.0.0/9", 1 },
+        { "0.0.0.0/0", 1 }, { "10.0.0.0/8", 1 }, { "10.1.2.0/24", 1 },
+    }
+    tests := []struct {
+        name string
+        insert []trieRoute
+        remove []trieRoute
+        removed int
+        //lookups maps addresses to the expected route
+        lookups map[string]string
+    }{
+        {
+            name: "empty",
+            lookups: map[string]string{ "10.0.0.1": "none", "0.0.0.0": "none" },
+        },
+        {
+            name: "default route",
+            insert: []trieRoute{ { "0.0.0.0/0", 1 } },
+            lookups: map[string]string{
+                "0.0.0.0": "0.0.0.0/0@1",
+                "10.0.0.1": "0.0.0.0/0@1",
+                "255.255.255.255": "0.0.0.0/0@1",
+            },
+        },
+        {
+            name: "host route",
+            insert: []trieRoute{ { "192.0.2.1/32", 1 } },
+            lookups: map[string]string{
+                "192.0.2.1": "192.0.2.1/32@1",
+                "192.0.2.0": "none",
+                "192.0.2.2": "none",
+                "64.0.2.1": "none",
+            },
+        },
+        {
+            name: "host routes at both ends",
+            insert: []trieRoute{ { "255.255.255.255/32", 1 }, { "0.0.0.0/32", 1 }, { "0.0.0.0/0", 1 } },
+            lookups: map[string]string{
+                "255.255.255.255": "255.255.255.255/32@1",
+                "255.255.255.254": "0.0.0.0/0@1",
+                "0.0.0.0": "0.0.0.0/32@1",
+                "0.0.0.1": "0.0.0.0/0@1",
+            },
+        },
+        {
+            name: "overlapping prefixes",
+            insert: overlapping,
+            lookups: map[string]string{
+                "10.1.2.3": "10.1.2.3/32@1",
+                "10.1.2.4": "10.1.2.0/24@1",
+                "10.1.3.1": "10.1.0.0/16@1",
+                "10.2.0.1": "10.0.0.0/8@1",
+                "10.200.0.1": "10.128.0.0/9@1",
+                "11.0.0.1": "0.0.0.0/0@1",
+            },
+        },
+        {
+            name: "siblings without common route",
+            insert: []trieRoute{ { "10.1.0.0/16", 1 }, { "10.2.0.0/16", 1 } },
+            lookups: map[string]string{
+                "10.1.0.1": "10.1.0.0/16@1",
+                "10.2.0.1": "10.2.0.0/16@1",
+                "10.3.0.1": "none",
+            },
+        },
+        {
+            name: "lowest metric",
+            insert: []trieRoute{ { "10.0.0.0/8", 20 }, { "10.0.0.0/8", 5 }, { "10.0.0.0/8", 10 } },
+            lookups: map[string]string{ "10.0.0.1": "10.0.0.0/8@5" },
+        },
+        {
+            name: "delete lowest metric",
+            insert: []trieRoute{ { "10.0.0.0/8", 20 }, { "10.0.0.0/8", 5 } },
+            remove: []trieRoute{ { "10.0.0.0/8", 5 } },
+            removed: 1,
+            lookups: map[string]string{ "10.0.0.1": "10.0.0.0/8@20" },
+        },
+        {
+            name: "delete then lookup",
+            insert: overlapping,
+            remove: []trieRoute{ { "10.1.0.0/16", -1 }, { "10.1.2.0/24", -1 } },
+            removed: 2,
+            lookups: map[string]string{
+                "10.1.2.3": "10.1.2.3/32@1",
+                "10.1.2.4": "10.0.0.0/8@1",
+                "10.1.3.1": "10.0.0.0/8@1",
+                "10.200.0.1": "10.128.0.0/9@1",
+            },
+        },
+        {
+            name: "delete default and host route",
+            insert: overlapping,
+            remove: []trieRoute{ { "0.0.0.0/0", -1 }, { "10.1.2.3/32", -1 } },
+            removed: 2,
+            lookups: map[string]string{
+                "10.1.2.3": "10.1.2.0/24@1",
+                "11.0.0.1": "none",
+            },
+        },
+        {
+            name: "delete missing prefix",
+            insert: overlapping,
+            remove: []trieRoute{ { "10.1.2.0/23", -1 }, { "10.0.0.0/8", 7 }, { "172.16.0.0/12", -1 } },
+            removed: 0,
+            lookups: map[string]string{
+                "10.1.2.4": "10.1.2.0/24@1",
+                "10.1.3.1": "10.1.0.0/16@1",
+            },
+        },
+        {
+            name: "delete everything",
+            insert: overlapping,
+            remove: overlapping,
+            removed: len(overlapping),
+            lookups: map[string]string{ "10.1.2.3": "none", "11.0.0.1": "none" },
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            trie := &routeTrie{}
+            for _, r := range tt.insert {
+                trie.insert(r.entry(t))
+            }
+            removed := 0
+            for _, r := range tt.remove {
+                e := r.entry(t)
+                metric := r.metric
+                removed += trie.remove(e.network, e.prefixLength, func(e *RoutingEntry) bool {
+                    return metric < 0 || e.metric == metric
+                })
+            }
+            if removed != tt.removed {
+                t.Errorf("removed %d routes, want %d", removed, tt.removed)
+            }
+            if len(tt.remove) != 0 && tt.removed == len(tt.insert) && trie.root != nil {
+                t.Errorf("trie keeps nodes after all routes were removed")
+            }
+            for addr, want := range tt.lookups {
+                if got := routeName(trie.lookup(util.IPToUint32(net.ParseIP(addr).To4()))); got != want {
+                    t.Errorf("lookup %s returned %s, want %s", addr, got, want)
+                }
+            }
+        })
+    }
+}
+
+//TestRouteTrieRandom compares the trie with a linear search over random routes while they are removed again.
+func TestRouteTrieRandom(t *testing.T) {
+    r := rand.New(rand.NewSource(1))
+    trie := &routeTrie{}
+    var routes []*RoutingEntry
+    for i := 0; i < 500; i++ {
+        //Short prefixes below 10.0.0.0/8 make sure the routes overlap
+        length := 8 + r.Intn(25)
+        e := &RoutingEntry{ prefixLength: length, netmask: prefixMask(length), metric: r.Intn(4) }
+        e.network = (10 << 24 | r.Uint32() & 0xFF0F0F0F) & e.netmask
+        routes = append(routes, e)
+        trie.insert(e)
+    }
+    linear := func(ip uint32) *RoutingEntry {
+        var best *RoutingEntry
+        for _, e := range routes {
+            if ip & e.netmask != e.network {
+                continue
+            }
+            if best == nil || e.prefixLength > best.prefixLength || (e.prefixLength == best.prefixLength && e.metric < best.metric) {
+                best = e
+            }
+        }
+        return best
+    }
+    check := func() {
+        for i := 0; i < 200; i++ {
+            ip := 10 << 24 | r.Uint32() & 0xFF0F0F0F
+            if i % 2 == 0 && len(routes) != 0 {
+                ip = routes[r.Intn(len(routes))].network | r.Uint32() & 1
+            }
+            got, want := trie.lookup(ip), linear(ip)
+            if (got == nil) != (want == nil) || (got != nil && (got.network != want.network || got.prefixLength != want.prefixLength || got.metric != want.metric)) {
+                t.Fatalf("lookup %v returned %s, want %s", util.ToIP(ip), routeName(got), routeName(want))
+            }
+        }
+    }
+    check()
+    for len(routes) != 0 {
+        i := r.Intn(len(routes))
+        e := routes[i]
+        routes = append(routes[:i], routes[i + 1:]...)
+        if trie.remove(e.network, e.prefixLength, func(x *RoutingEntry) bool { return x == e }) != 1 {
+            t.Fatalf("removing %s failed", routeName(e))
+        }
+        if len(routes) % 50 == 0 {
+            check()
+        }
+    }
+    if trie.root != nil {
+        t.Errorf("trie keeps nodes after all routes were removed")
+    }
+}
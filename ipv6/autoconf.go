@@ -0,0 +1,276 @@
+package ipv6
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"log"
+	"math/bits"
+	"net"
+	"time"
+	"github.com/arcpop/network/config"
+	"github.com/arcpop/network/netdev"
+)
+
+//IdgenRetries is the number of new stable privacy addresses tried after a duplicate was detected (RFC 7217 section 6).
+const IdgenRetries = 3
+
+//twoHours protects the valid lifetime of autoconfigured addresses from spoofed advertisements (RFC 4862 section 5.5.3).
+const twoHours = 2 * time.Hour
+
+var linkLocalPrefix = net.ParseIP("fe80::")
+
+//dadState is the duplicate address detection running for a tentative address.
+type dadState struct {
+    dev netdev.Interface
+    addr netdev.IPv6Address
+    //counter is the DAD_Counter of the stable privacy address (RFC 7217 section 5)
+    counter int
+    remaining int
+    timer time.Time
+}
+
+//interfaceIdentifier returns the lower 64 bits of an address in prefix, the stable privacy identifier
+//if config.IPv6.StableSecret is set and the modified EUI-64 identifier (RFC 4291 appendix A) otherwise.
+func interfaceIdentifier(dev netdev.Interface, prefix net.IP, counter int) []byte {
+    if config.IPv6.StableSecret != nil {
+        h := sha256.New()
+        h.Write(prefix.To16()[:8])
+        h.Write([]byte(dev.GetName()))
+        h.Write([]byte{ byte(counter) })
+        h.Write(config.IPv6.StableSecret)
+        return h.Sum(nil)[:8]
+    }
+    mac := dev.GetHardwareAddress()
+    return []byte{ mac[0] ^ 0x02, mac[1], mac[2], 0xFF, 0xFE, mac[3], mac[4], mac[5] }
+}
+
+func formAddress(prefix net.IP, iid []byte) net.IP {
+    addr := make(net.IP, 16)
+    copy(addr[:8], prefix.To16()[:8])
+    copy(addr[8:], iid)
+    return addr
+}
+
+func lifetimeEnd(now time.Time, lifetime uint32) time.Time {
+    if lifetime == infiniteLifetime {
+        return time.Time{}
+    }
+    return now.Add(time.Duration(lifetime) * time.Second)
+}
+
+func Autoconfigure(dev netdev.Interface) {
+    Default.Autoconfigure(dev)
+}
+
+//Autoconfigure assigns dev a link local address, routers are solicited once it proved to be unique (RFC 4862 section 5.3).
+//Links which cannot carry MinMTU bytes are left without ipv6.
+func (l *Layer) Autoconfigure(dev netdev.Interface) {
+    if dev.GetHardwareAddress() == nil || dev.GetMTU() < MinMTU {
+        return
+    }
+    l.RouteAddNet(net.IPNet{ IP: linkLocalPrefix, Mask: net.CIDRMask(64, 128) }, nil, MetricDefault, 0, dev)
+    addr := netdev.IPv6Address{
+        IP: formAddress(linkLocalPrefix, interfaceIdentifier(dev, linkLocalPrefix, 0)),
+        PrefixLength: 64,
+        Autoconfigured: true,
+    }
+    l.addAddress(dev, addr, 0)
+}
+
+//addAddress assigns the address to dev, it stays tentative until duplicate address detection finished.
+func (l *Layer) addAddress(dev netdev.Interface, addr netdev.IPv6Address, counter int) {
+    host := net.IPNet{ IP: addr.IP, Mask: net.CIDRMask(128, 128) }
+    addr.Tentative = config.IPv6.DupAddrDetectTransmits > 0
+    dev.AddIPv6Address(addr)
+    l.routeDeleteOnLink(host, dev)
+    l.RouteAddHost(addr.IP, nil, MetricLocalhost, 0, dev)
+    if !addr.Tentative {
+        l.addressReady(dev, addr.IP)
+        return
+    }
+    l.neighborsLock.Lock()
+    l.dads[neighborKey(addr.IP)] = &dadState{
+        dev: dev,
+        addr: addr,
+        counter: counter,
+        remaining: config.IPv6.DupAddrDetectTransmits,
+        timer: time.Now(),
+    }
+    l.neighborsLock.Unlock()
+}
+
+func (l *Layer) removeAddress(dev netdev.Interface, ip net.IP) {
+    dev.RemoveIPv6Address(ip)
+    l.routeDeleteOnLink(net.IPNet{ IP: ip, Mask: net.CIDRMask(128, 128) }, dev)
+    l.neighborsLock.Lock()
+    delete(l.dads, neighborKey(ip))
+    l.neighborsLock.Unlock()
+}
+
+//addressReady is called once an address can be used.
+func (l *Layer) addressReady(dev netdev.Interface, ip net.IP) {
+    if ip.IsLinkLocalUnicast() {
+        l.SolicitRouters(dev)
+    }
+}
+
+//dadComplete clears the tentative flag after no other node claimed the address.
+func (l *Layer) dadComplete(d *dadState) {
+    found := false
+    l.addressLock.Lock()
+    for _, a := range d.dev.GetIPv6Addresses() {
+        if a.IP.Equal(d.addr.IP) && a.Tentative {
+            a.Tentative = false
+            d.dev.AddIPv6Address(a)
+            found = true
+        }
+    }
+    l.addressLock.Unlock()
+    if found {
+        l.addressReady(d.dev, d.addr.IP)
+    }
+}
+
+//dadFailed removes the tentative address ip which is used by another node, stable privacy
+//addresses are replaced by the next identifier (RFC 7217 section 6).
+func (l *Layer) dadFailed(dev netdev.Interface, ip net.IP) {
+    l.neighborsLock.Lock()
+    d, ok := l.dads[neighborKey(ip)]
+    l.neighborsLock.Unlock()
+    if !ok {
+        return
+    }
+    log.Println("IPv6: Duplicate address", ip, "detected on", dev.GetName())
+    l.removeAddress(dev, ip)
+    if d.addr.Autoconfigured && config.IPv6.StableSecret != nil && d.counter < IdgenRetries {
+        prefix := d.addr.IP.Mask(net.CIDRMask(64, 128))
+        addr := d.addr
+        addr.IP = formAddress(prefix, interfaceIdentifier(dev, prefix, d.counter + 1))
+        l.addAddress(dev, addr, d.counter + 1)
+    }
+}
+
+//autoconfPrefix forms an address from a prefix advertised by a router or updates the lifetimes
+//of the address formed from it earlier (RFC 4862 section 5.5.3).
+func (l *Layer) autoconfPrefix(dev netdev.Interface, prefix net.IP, prefixLength int, valid, preferred uint32) {
+    if preferred > valid {
+        return
+    }
+    if prefixLength != 64 {
+        log.Println("IPv6: Can not autoconfigure prefix", prefix, "with length", prefixLength)
+        return
+    }
+    now := time.Now()
+    validUntil := lifetimeEnd(now, valid)
+    l.addressLock.Lock()
+    defer l.addressLock.Unlock()
+    for _, a := range dev.GetIPv6Addresses() {
+        if !a.Autoconfigured || !bytes.Equal(a.IP[:8], prefix.To16()[:8]) {
+            continue
+        }
+        a.PreferredUntil = lifetimeEnd(now, preferred)
+        if valid == infiniteLifetime || time.Duration(valid) * time.Second > twoHours ||
+            (!a.ValidUntil.IsZero() && validUntil.After(a.ValidUntil)) {
+            a.ValidUntil = validUntil
+        } else if a.ValidUntil.IsZero() || a.ValidUntil.Sub(now) > twoHours {
+            a.ValidUntil = now.Add(twoHours)
+        }
+        dev.AddIPv6Address(a)
+        return
+    }
+    if valid == 0 {
+        return
+    }
+    addr := netdev.IPv6Address{
+        IP: formAddress(prefix, interfaceIdentifier(dev, prefix, 0)),
+        PrefixLength: prefixLength,
+        Autoconfigured: true,
+        ValidUntil: validUntil,
+        PreferredUntil: lifetimeEnd(now, preferred),
+    }
+    l.addAddress(dev, addr, 0)
+}
+
+//addressExpire removes the addresses whose valid lifetime ended before now.
+func (l *Layer) addressExpire(now time.Time) {
+    for _, dev := range l.interfaces.Interfaces() {
+        for _, a := range dev.GetIPv6Addresses() {
+            if !a.ValidUntil.IsZero() && !now.Before(a.ValidUntil) {
+                log.Println("IPv6: Address", a.IP, "on", dev.GetName(), "expired")
+                l.removeAddress(dev, a.IP)
+            }
+        }
+    }
+}
+
+//findAddress returns the address ip of dev or nil if dev does not have it.
+func findAddress(dev netdev.Interface, ip net.IP) *netdev.IPv6Address {
+    addrs := dev.GetIPv6Addresses()
+    for i := range addrs {
+        if addrs[i].IP.Equal(ip) {
+            return &addrs[i]
+        }
+    }
+    return nil
+}
+
+//selectSource picks the source address for dst among the usable addresses of dev using
+//the rules 1, 2, 3 and 8 of RFC 6724 section 5, it returns nil if dev has none.
+func selectSource(dev netdev.Interface, dst net.IP) net.IP {
+    now := time.Now()
+    addrs := dev.GetIPv6Addresses()
+    var best *netdev.IPv6Address
+    for i := range addrs {
+        if addrs[i].Tentative {
+            continue
+        }
+        if best == nil || betterSource(&addrs[i], best, dst, now) {
+            best = &addrs[i]
+        }
+    }
+    if best == nil {
+        return nil
+    }
+    return best.IP
+}
+
+func betterSource(a, b *netdev.IPv6Address, dst net.IP, now time.Time) bool {
+    if a.IP.Equal(dst) != b.IP.Equal(dst) {
+        return a.IP.Equal(dst)
+    }
+    sa, sb, sd := scope(a.IP), scope(b.IP), scope(dst)
+    if sa < sb {
+        return sa >= sd
+    }
+    if sb < sa {
+        return sb < sd
+    }
+    if a.Deprecated(now) != b.Deprecated(now) {
+        return !a.Deprecated(now)
+    }
+    return commonPrefixLength(a.IP, dst) > commonPrefixLength(b.IP, dst)
+}
+
+//scope returns the scope of an address as defined for multicast addresses (RFC 4291 section 2.7).
+func scope(ip net.IP) int {
+    ip = ip.To16()
+    if ip.IsMulticast() {
+        return int(ip[1] & 0x0F)
+    }
+    if ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+        return 2
+    }
+    return 14
+}
+
+func commonPrefixLength(a, b net.IP) int {
+    a, b = a.To16(), b.To16()
+    n := 0
+    for i := 0; i < 16; i++ {
+        if a[i] != b[i] {
+            return n + bits.LeadingZeros8(a[i] ^ b[i])
+        }
+        n += 8
+    }
+    return n
+}
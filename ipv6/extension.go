@@ -0,0 +1,239 @@
+package ipv6
+
+import (
+	"errors"
+	"log"
+	"github.com/arcpop/network/ip"
+	"github.com/arcpop/network/netdev"
+)
+
+const (
+    //Options of the hop-by-hop and destination options headers (RFC 8200 section 4.2)
+    OptionPad1 = 0
+    OptionPadN = 1
+    //OptionRouterAlert is defined in RFC 2711
+    OptionRouterAlert = 5
+
+    //fragmentHeaderLength is the fixed length of the fragment header
+    fragmentHeaderLength = 8
+)
+
+var (
+    ErrInvalidExtensionHeader = errors.New("Invalid extension header!")
+)
+
+//ExtensionHeader is an extension header between the ipv6 header and the upper layer protocol (RFC 8200 section 4).
+//Data is the content following the next header and length fields, its length plus 2 is a multiple of 8.
+type ExtensionHeader struct {
+    Type byte
+    Data []byte
+}
+
+//Option is a type-length-value encoded option of a hop-by-hop or destination options header.
+type Option struct {
+    Type byte
+    Data []byte
+}
+
+//OptionsHeader encodes the options as a hop-by-hop or destination options header of type t
+//and pads it to a multiple of 8 bytes.
+func OptionsHeader(t byte, options []Option) ExtensionHeader {
+    data := []byte{}
+    for _, o := range options {
+        if o.Type == OptionPad1 {
+            data = append(data, OptionPad1)
+            continue
+        }
+        data = append(data, o.Type, byte(len(o.Data)))
+        data = append(data, o.Data...)
+    }
+    pad := 7 - (len(data) + 1) % 8
+    if pad == 1 {
+        data = append(data, OptionPad1)
+    } else if pad > 1 {
+        data = append(data, OptionPadN, byte(pad - 2))
+        data = append(data, make([]byte, pad - 2)...)
+    }
+    return ExtensionHeader{ Type: t, Data: data }
+}
+
+//Options decodes the options of a hop-by-hop or destination options header, padding is left out.
+func (e *ExtensionHeader) Options() ([]Option, error) {
+    var options []Option
+    for i := 0; i < len(e.Data); {
+        if e.Data[i] == OptionPad1 {
+            i++
+            continue
+        }
+        if i + 1 >= len(e.Data) || i + 2 + int(e.Data[i + 1]) > len(e.Data) {
+            return nil, ErrInvalidExtensionHeader
+        }
+        if e.Data[i] != OptionPadN {
+            options = append(options, Option{ Type: e.Data[i], Data: e.Data[i + 2:i + 2 + int(e.Data[i + 1])] })
+        }
+        i += 2 + int(e.Data[i + 1])
+    }
+    return options, nil
+}
+
+func (e *ExtensionHeader) length() int {
+    return 2 + len(e.Data)
+}
+
+//valid checks that the header can be sent, fragment headers are only generated by the layer itself.
+func (e *ExtensionHeader) valid() bool {
+    switch e.Type {
+    case ip.IPPROTO_HOPOPTS, ip.IPPROTO_ROUTING, ip.IPPROTO_DSTOPTS:
+    default:
+        return false
+    }
+    return e.length() % 8 == 0 && e.length() <= 256 * 8
+}
+
+//putExtensionHeaders writes the headers chained in order, the last one names nextHeader.
+func putExtensionHeaders(buf []byte, exts []ExtensionHeader, nextHeader byte) {
+    offset := 0
+    for i := range exts {
+        if i + 1 < len(exts) {
+            buf[offset] = exts[i + 1].Type
+        } else {
+            buf[offset] = nextHeader
+        }
+        buf[offset + 1] = byte(exts[i].length() / 8 - 1)
+        copy(buf[offset + 2:], exts[i].Data)
+        offset += exts[i].length()
+    }
+}
+
+//isExtensionHeader returns true for the next header values this layer processes itself.
+func isExtensionHeader(nextHeader byte) bool {
+    switch nextHeader {
+    case ip.IPPROTO_HOPOPTS, ip.IPPROTO_ROUTING, ip.IPPROTO_FRAGMENT, ip.IPPROTO_DSTOPTS:
+        return true
+    }
+    return false
+}
+
+//extensionHeaderLength returns the length of the extension header at the start of buf or -1 if buf is too short.
+func extensionHeaderLength(nextHeader byte, buf []byte) int {
+    if nextHeader == ip.IPPROTO_FRAGMENT {
+        if len(buf) < fragmentHeaderLength {
+            return -1
+        }
+        return fragmentHeaderLength
+    }
+    if len(buf) < 2 || len(buf) < (int(buf[1]) + 1) * 8 {
+        return -1
+    }
+    return (int(buf[1]) + 1) * 8
+}
+
+//skipExtensionHeaders returns the upper layer protocol of the packet with the headers in buf and the offset
+//of its data. It is used for the packets carried by icmp errors, which are not processed.
+func skipExtensionHeaders(nextHeader byte, buf []byte) (byte, int, bool) {
+    offset := 0
+    for isExtensionHeader(nextHeader) {
+        length := extensionHeaderLength(nextHeader, buf[offset:])
+        if length < 0 {
+            return 0, 0, false
+        }
+        nextHeader = buf[offset]
+        offset += length
+    }
+    return nextHeader, offset, true
+}
+
+//processExtensionHeaders walks the extension headers of packet, which starts with the ipv6 header, beginning with
+//the one at offset which is named by the field at nextHeaderOffset (RFC 8200 section 4.1). The packet is handed to
+//the reassembly or the upper layer protocol once the headers in front of it were processed. dev is nil for
+//reassembled packets, they never carry neighbor discovery messages (RFC 6980 section 5).
+func (l *Layer) processExtensionHeaders(dev netdev.Interface, hdr *Header, packet []byte, offset, nextHeaderOffset int) {
+    for {
+        nextHeader := packet[nextHeaderOffset]
+        if nextHeader == ip.IPPROTO_NONE {
+            return
+        }
+        if !isExtensionHeader(nextHeader) {
+            hdr.NextHeader = nextHeader
+            data := packet[offset:]
+            if dev != nil && nextHeader == ip.IPPROTO_ICMPV6 && l.ndIn(dev, hdr, data) {
+                return
+            }
+            l.deliverToProtocols(hdr, data)
+            return
+        }
+        //The hop-by-hop options header is only allowed directly after the ipv6 header
+        if nextHeader == ip.IPPROTO_HOPOPTS && nextHeaderOffset != 6 {
+            l.sendParameterProblemPacket(ip.ICMPv6CodeUnrecognizedNextHeader, nextHeaderOffset, hdr, packet)
+            return
+        }
+        length := extensionHeaderLength(nextHeader, packet[offset:])
+        if length < 0 {
+            log.Println("IPv6: Truncated extension header, dropping.")
+            return
+        }
+        switch nextHeader {
+        case ip.IPPROTO_HOPOPTS, ip.IPPROTO_DSTOPTS:
+            if !l.processOptions(hdr, packet, offset, length) {
+                return
+            }
+        case ip.IPPROTO_ROUTING:
+            //No routing type is supported, the header is only ignored once no segments are left
+            if packet[offset + 3] != 0 {
+                l.sendParameterProblemPacket(ip.ICMPv6CodeErroneousHeaderField, offset + 2, hdr, packet)
+                return
+            }
+        case ip.IPPROTO_FRAGMENT:
+            //The fragment header occurs at most once (RFC 8200 section 4.1), reassembled packets are
+            //processed by the reassembly worker which must not queue fragments to itself
+            if dev == nil {
+                log.Println("IPv6: Fragment header in reassembled packet, dropping.")
+                return
+            }
+            if !l.fragmentIn(hdr, packet, offset, nextHeaderOffset) {
+                return
+            }
+            //An atomic fragment is processed like a packet without fragment header (RFC 6946)
+            nextHeaderOffset = offset
+            offset += length
+            continue
+        }
+        hdr.ExtensionHeaders = append(hdr.ExtensionHeaders, ExtensionHeader{ Type: nextHeader, Data: packet[offset + 2:offset + length] })
+        nextHeaderOffset = offset
+        offset += length
+    }
+}
+
+//processOptions handles the options of the header at offset, the packet is discarded if false is returned.
+//Unrecognized options are treated as their two highest order bits demand (RFC 8200 section 4.2).
+func (l *Layer) processOptions(hdr *Header, packet []byte, offset, length int) bool {
+    for i := offset + 2; i < offset + length; {
+        t := packet[i]
+        if t == OptionPad1 {
+            i++
+            continue
+        }
+        if i + 1 >= offset + length || i + 2 + int(packet[i + 1]) > offset + length {
+            log.Println("IPv6: Malformed option, dropping.")
+            return false
+        }
+        switch t {
+        case OptionPadN, OptionRouterAlert:
+        default:
+            switch t >> 6 {
+            case 1:
+                return false
+            case 2:
+                l.sendParameterProblemPacket(ip.ICMPv6CodeUnrecognizedOption, i, hdr, packet)
+                return false
+            case 3:
+                if !hdr.TargetIP.IsMulticast() {
+                    l.sendParameterProblemPacket(ip.ICMPv6CodeUnrecognizedOption, i, hdr, packet)
+                }
+                return false
+            }
+        }
+        i += 2 + int(packet[i + 1])
+    }
+    return true
+}
@@ -0,0 +1,96 @@
+package ipv6
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+	"github.com/arcpop/network/ip"
+	"github.com/arcpop/network/netdev"
+)
+
+func TestProcessOptions(t *testing.T) {
+    withoutDAD(t)
+    a, b, err := netdev.OpenPipe(netdev.PipeConfig{ Name: "a" }, netdev.PipeConfig{ Name: "b" })
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer b.Close()
+    l := newPipeLayer(t, a)
+    if err := l.ConfigureInterfaceAddress("a", net.IPNet{ IP: net.ParseIP("fd00::1"), Mask: net.CIDRMask(64, 128) }); err != nil {
+        t.Fatal(err)
+    }
+    peer := net.ParseIP("fd00::2")
+    l.AddNeighbor(peer, b.GetHardwareAddress(), a)
+    received := capture(b)
+
+    unknown := func(t byte) Option {
+        return Option{ Type: t, Data: []byte{ 0, 0 } }
+    }
+    first := HeaderLength + 2
+    tests := []struct {
+        name string
+        ext ExtensionHeader
+        multicast bool
+        accept bool
+        //pointer is the offset reported by the parameter problem message or -1 if none is sent
+        pointer int
+    }{
+        { "padding and router alert", OptionsHeader(ip.IPPROTO_HOPOPTS, []Option{ { Type: OptionPad1 }, { Type: OptionRouterAlert, Data: []byte{ 0, 0 } } }), false, true, -1 },
+        { "skip", OptionsHeader(ip.IPPROTO_HOPOPTS, []Option{ unknown(0x1E) }), false, true, -1 },
+        { "discard", OptionsHeader(ip.IPPROTO_HOPOPTS, []Option{ unknown(0x5E) }), false, false, -1 },
+        { "discard and report", OptionsHeader(ip.IPPROTO_DSTOPTS, []Option{ unknown(0x9E) }), false, false, first },
+        { "discard and report to multicast", OptionsHeader(ip.IPPROTO_DSTOPTS, []Option{ unknown(0x9E) }), true, false, first },
+        { "discard and report unicast", OptionsHeader(ip.IPPROTO_HOPOPTS, []Option{ unknown(0xDE) }), false, false, first },
+        { "discard without report to multicast", OptionsHeader(ip.IPPROTO_HOPOPTS, []Option{ unknown(0xDE) }), true, false, -1 },
+        { "report after skipped option", OptionsHeader(ip.IPPROTO_HOPOPTS, []Option{ unknown(0x1E), unknown(0x9E) }), false, false, first + 4 },
+        { "length beyond header", ExtensionHeader{ Type: ip.IPPROTO_HOPOPTS, Data: []byte{ 0x1E, 5, 0, 0, 0, 0 } }, false, false, -1 },
+        { "type without length", ExtensionHeader{ Type: ip.IPPROTO_HOPOPTS, Data: []byte{ OptionPadN, 3, 0, 0, 0, 0x1E } }, false, false, -1 },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            hdr := &Header{
+                PayloadLength: uint16(tt.ext.length()),
+                NextHeader: ip.IPPROTO_NONE,
+                ExtensionHeaders: []ExtensionHeader{ tt.ext },
+                HopLimit: 64,
+                SourceIP: peer,
+                TargetIP: net.ParseIP("fd00::1"),
+            }
+            if tt.multicast {
+                hdr.TargetIP = AllNodesMulticast
+            }
+            packet := make([]byte, hdr.length())
+            hdr.put(packet)
+            if accept := l.processOptions(hdr, packet, HeaderLength, tt.ext.length()); accept != tt.accept {
+                t.Errorf("accepted %v, want %v", accept, tt.accept)
+            }
+            //The errors are sent asynchronously, give the absent ones a moment to show up
+            timeout := 50 * time.Millisecond
+            if tt.pointer >= 0 {
+                timeout = time.Second
+            }
+            reply := receive(received, timeout)
+            if tt.pointer < 0 {
+                if reply != nil {
+                    t.Errorf("sent %v, want no error", reply)
+                }
+                return
+            }
+            if reply == nil {
+                t.Fatalf("no parameter problem was sent")
+            }
+            rh := parseHeader(reply)
+            if rh == nil || rh.NextHeader != ip.IPPROTO_ICMPV6 || !rh.TargetIP.Equal(peer) || len(reply) < HeaderLength + 8 {
+                t.Fatalf("sent %v, want an icmp error to %v", reply, peer)
+            }
+            icmp := reply[HeaderLength:]
+            if icmp[0] != ip.ICMPv6TypeParameterProblem || icmp[1] != ip.ICMPv6CodeUnrecognizedOption {
+                t.Errorf("sent type %d code %d, want a parameter problem about an unrecognized option", icmp[0], icmp[1])
+            }
+            if pointer := int(binary.BigEndian.Uint32(icmp[4:8])); pointer != tt.pointer {
+                t.Errorf("pointer %d, want %d", pointer, tt.pointer)
+            }
+        })
+    }
+}
@@ -0,0 +1,304 @@
+package ipv6
+
+import (
+	"context"
+	"encoding/binary"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+	"github.com/arcpop/network/config"
+	"github.com/arcpop/network/ethernet"
+	"github.com/arcpop/network/ip"
+	"github.com/arcpop/network/netdev"
+)
+
+//fragmentEntryOverhead is the memory accounted for a packet in reassembly besides its fragments
+const fragmentEntryOverhead = 256
+
+type fragmentationKey struct {
+    srcIP [16]byte
+    dstIP [16]byte
+    id uint32
+}
+
+type fragmentationData struct {
+    offset int
+    data []byte
+    lastFragment bool
+}
+
+//firstFragment is the fragment with offset 0, its headers in front of the fragment header are the ones of the reassembled packet.
+type firstFragment struct {
+    hdr *Header
+    packet []byte
+    //fragmentOffset is the offset of the fragment header and nextHeaderOffset the one of the field naming it
+    fragmentOffset, nextHeaderOffset int
+}
+
+type fragment struct {
+    key fragmentationKey
+    frag *fragmentationData
+    first *firstFragment
+}
+
+type fragmentMapEntry struct {
+    //parts is sorted by offset and free of overlaps
+    parts []*fragmentationData
+    first *firstFragment
+    //length is the length of the fragmentable part once the last fragment arrived and -1 before
+    length int
+    received int
+    //memory is the memory accounted for the entry
+    memory int
+    started time.Time
+}
+
+//ReassemblyStats counts the outcome of the reassembly of fragmented packets.
+type ReassemblyStats struct {
+    //Reassembled counts the packets which were reassembled
+    Reassembled uint64
+    //Timeouts counts the packets whose fragments did not arrive in time
+    Timeouts uint64
+    //Overlaps counts the packets dropped because of overlapping fragments or fragments disagreeing about the length
+    Overlaps uint64
+    //MemoryLimit counts the fragments dropped because the reassembly memory was exhausted
+    MemoryLimit uint64
+}
+
+func GetReassemblyStats() ReassemblyStats {
+    return Default.ReassemblyStats()
+}
+
+//ReassemblyStats returns the counters of the reassembly.
+func (l *Layer) ReassemblyStats() ReassemblyStats {
+    s := &l.reassemblyStats
+    return ReassemblyStats{
+        Reassembled: atomic.LoadUint64(&s.Reassembled),
+        Timeouts: atomic.LoadUint64(&s.Timeouts),
+        Overlaps: atomic.LoadUint64(&s.Overlaps),
+        MemoryLimit: atomic.LoadUint64(&s.MemoryLimit),
+    }
+}
+
+//fragmentIn checks the fragment header at offset and queues the fragment for reassembly.
+//It returns true for atomic fragments, which are processed without reassembly.
+func (l *Layer) fragmentIn(hdr *Header, packet []byte, offset, nextHeaderOffset int) bool {
+    fragOffset := int(binary.BigEndian.Uint16(packet[offset + 2:offset + 4]) &^ 7)
+    more := packet[offset + 3] & 1 != 0
+    data := packet[offset + fragmentHeaderLength:]
+    if fragOffset == 0 && !more {
+        return true
+    }
+    //All fragments but the last one carry a multiple of 8 bytes
+    if more && len(data) % 8 != 0 {
+        l.sendParameterProblemPacket(ip.ICMPv6CodeErroneousHeaderField, 4, hdr, packet)
+        return false
+    }
+    if fragOffset + len(data) > 0xFFFF {
+        l.sendParameterProblemPacket(ip.ICMPv6CodeErroneousHeaderField, offset + 2, hdr, packet)
+        return false
+    }
+    k := fragmentationKey{
+        id: binary.BigEndian.Uint32(packet[offset + 4:offset + 8]),
+    }
+    copy(k.srcIP[:], hdr.SourceIP)
+    copy(k.dstIP[:], hdr.TargetIP)
+    f := &fragment{
+        key: k,
+        frag: &fragmentationData{
+            offset: fragOffset,
+            data: data,
+            lastFragment: !more,
+        },
+    }
+    if fragOffset == 0 {
+        f.first = &firstFragment{ hdr: hdr, packet: packet, fragmentOffset: offset, nextHeaderOffset: nextHeaderOffset }
+    } else {
+        //The data is copied so the fragment does not keep the whole receive buffer
+        f.frag.data = append([]byte(nil), data...)
+    }
+    select {
+    case l.fragmentationQueue <- f:
+    case <- l.done:
+    }
+    return false
+}
+
+//insertFragment adds the fragment to the entry, false is returned if it overlaps with another fragment
+//or contradicts the length of the packet. Exact duplicates are ignored.
+func insertFragment(e *fragmentMapEntry, frag *fragmentationData) bool {
+    end := frag.offset + len(frag.data)
+    if frag.lastFragment {
+        if (e.length >= 0 && e.length != end) || (len(e.parts) != 0 && e.parts[len(e.parts) - 1].offset + len(e.parts[len(e.parts) - 1].data) > end) {
+            return false
+        }
+        e.length = end
+    } else if e.length >= 0 && end > e.length {
+        return false
+    }
+    i := 0
+    for i < len(e.parts) && e.parts[i].offset < frag.offset {
+        i++
+    }
+    if i < len(e.parts) && e.parts[i].offset == frag.offset && len(e.parts[i].data) == len(frag.data) {
+        return true
+    }
+    if (i > 0 && e.parts[i - 1].offset + len(e.parts[i - 1].data) > frag.offset) ||
+        (i < len(e.parts) && end > e.parts[i].offset) {
+        return false
+    }
+    e.parts = append(e.parts, nil)
+    copy(e.parts[i + 1:], e.parts[i:])
+    e.parts[i] = frag
+    e.received += len(frag.data)
+    return true
+}
+
+//reassemble builds the packet from the complete entry, it consists of the headers of the first fragment
+//which precede the fragment header followed by the fragmentable parts.
+func (l *Layer) reassemble(e *fragmentMapEntry) {
+    first := e.first
+    packet := make([]byte, first.fragmentOffset + e.length)
+    copy(packet, first.packet[:first.fragmentOffset])
+    packet[first.nextHeaderOffset] = first.packet[first.fragmentOffset]
+    binary.BigEndian.PutUint16(packet[4:6], uint16(len(packet) - HeaderLength))
+    for _, f := range e.parts {
+        copy(packet[first.fragmentOffset + f.offset:], f.data)
+    }
+    hdr := parseHeader(packet)
+    if hdr == nil {
+        return
+    }
+    hdr.ExtensionHeaders = first.hdr.ExtensionHeaders
+    l.processExtensionHeaders(nil, hdr, packet, first.fragmentOffset, first.nextHeaderOffset)
+}
+
+//fragmentMemory returns the memory accounted for the fragment, the first fragment keeps the whole receive buffer
+//carrying it because its headers are needed for the reassembled packet.
+func fragmentMemory(c *fragment) int {
+    if c.first != nil {
+        return cap(c.first.packet)
+    }
+    return cap(c.frag.data)
+}
+
+func (l *Layer) fragmentationReassemblyWorker(ctx context.Context) {
+    defer l.workers.Done()
+    ticker := time.NewTicker(time.Second)
+    defer ticker.Stop()
+    l.fragmentedPackets = make(map[fragmentationKey] *fragmentMapEntry)
+    //memory is the memory taken by the entries, it is only used by this worker
+    memory := 0
+    for {
+        select {
+        case <- ctx.Done():
+            return
+        case c := <- l.fragmentationQueue:
+            e, ok := l.fragmentedPackets[c.key]
+            needed := fragmentMemory(c)
+            if !ok {
+                needed += fragmentEntryOverhead
+            }
+            if memory + needed > config.IPv6.ReassemblyMaxMemory {
+                atomic.AddUint64(&l.reassemblyStats.MemoryLimit, 1)
+                continue
+            }
+            if !ok {
+                e = &fragmentMapEntry{
+                    length: -1,
+                    started: time.Now(),
+                }
+                l.fragmentedPackets[c.key] = e
+            }
+            //Overlapping fragments discard the whole packet (RFC 5722)
+            received := e.received
+            if !insertFragment(e, c.frag) {
+                log.Println("IPv6: Fragment overlaps with other received fragments, dropping packet.")
+                atomic.AddUint64(&l.reassemblyStats.Overlaps, 1)
+                delete(l.fragmentedPackets, c.key)
+                memory -= e.memory
+                continue
+            }
+            if !ok {
+                e.memory += fragmentEntryOverhead
+                memory += fragmentEntryOverhead
+            }
+            //Duplicates are not kept
+            if e.received != received {
+                if c.first != nil {
+                    e.first = c.first
+                }
+                e.memory += fragmentMemory(c)
+                memory += fragmentMemory(c)
+            }
+            if e.first != nil && e.received == e.length {
+                delete(l.fragmentedPackets, c.key)
+                memory -= e.memory
+                atomic.AddUint64(&l.reassemblyStats.Reassembled, 1)
+                l.reassemble(e)
+            }
+        case now := <- ticker.C:
+            for k, e := range l.fragmentedPackets {
+                if now.Sub(e.started) < config.IPv6.ReassemblyTimeout {
+                    continue
+                }
+                delete(l.fragmentedPackets, k)
+                memory -= e.memory
+                atomic.AddUint64(&l.reassemblyStats.Timeouts, 1)
+                //The time exceeded message is only sent if the first fragment arrived
+                if e.first != nil {
+                    l.sendICMPErrorPacket(ip.ICMPv6TypeTimeExceeded, ip.ICMPv6CodeFragmentReassemblyTimeout, 0, e.first.hdr, e.first.packet)
+                }
+            }
+        }
+    }
+}
+
+//sendFragmented splits the packet into fragments fitting into mtu, the mtu of the path (RFC 8200 section 4.5).
+//The hop-by-hop and routing headers and the destination options in front of a routing header
+//are repeated in every fragment, the remaining extension headers are fragmented with the data.
+func (l *Layer) sendFragmented(dev netdev.Interface, mtu int, header *Header, data []byte, nextHop net.IP) error {
+    exts := header.ExtensionHeaders
+    split := 0
+    for i := range exts {
+        if exts[i].Type == ip.IPPROTO_HOPOPTS || exts[i].Type == ip.IPPROTO_ROUTING {
+            split = i + 1
+        }
+    }
+    rest := Header{ ExtensionHeaders: exts[split:] }
+    fragmentable := make([]byte, rest.length() - HeaderLength + len(data))
+    putExtensionHeaders(fragmentable, exts[split:], header.NextHeader)
+    copy(fragmentable[rest.length() - HeaderLength:], data)
+    nextHeader := header.NextHeader
+    if split < len(exts) {
+        nextHeader = exts[split].Type
+    }
+    fragHeader := *header
+    fragHeader.ExtensionHeaders = exts[:split]
+    fragHeader.NextHeader = ip.IPPROTO_FRAGMENT
+    unfragmentable := fragHeader.length()
+    blockSize := ((mtu - unfragmentable - fragmentHeaderLength) >> 3) << 3
+    if blockSize <= 0 {
+        return ErrPacketTooBig
+    }
+    id := atomic.AddUint32(&l.fragmentID, 1)
+    for offset := 0; offset < len(fragmentable); offset += blockSize {
+        n := len(fragmentable) - offset
+        more := uint16(0)
+        if n > blockSize {
+            n = blockSize
+            more = 1
+        }
+        pkt := make([]byte, ethernet.HeaderLength + unfragmentable + fragmentHeaderLength + n)
+        fragHeader.PayloadLength = uint16(unfragmentable - HeaderLength + fragmentHeaderLength + n)
+        fragHeader.put(pkt[ethernet.HeaderLength:])
+        buf := pkt[ethernet.HeaderLength + unfragmentable:]
+        buf[0] = nextHeader
+        binary.BigEndian.PutUint16(buf[2:4], uint16(offset) | more)
+        binary.BigEndian.PutUint32(buf[4:8], id)
+        copy(buf[fragmentHeaderLength:], fragmentable[offset:offset + n])
+        l.transmit(dev, pkt, nextHop)
+    }
+    return nil
+}
@@ -0,0 +1,167 @@
+package ipv6
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"github.com/arcpop/network/ethernet"
+	"github.com/arcpop/network/ip"
+	"github.com/arcpop/network/netdev"
+)
+
+type testFragment struct {
+    offset, length int
+    last bool
+}
+
+func TestInsertFragment(t *testing.T) {
+    tests := []struct {
+        name string
+        //fragments are inserted in order, all but the last one are accepted
+        fragments []testFragment
+        accept bool
+        parts int
+        received int
+        //length is checked for accepted fragments only
+        length int
+    }{
+        { "in order", []testFragment{ { 0, 16, false }, { 16, 16, false }, { 32, 8, true } }, true, 3, 40, 40 },
+        { "reversed", []testFragment{ { 32, 8, true }, { 16, 16, false }, { 0, 16, false } }, true, 3, 40, 40 },
+        { "duplicate", []testFragment{ { 0, 16, false }, { 16, 8, false }, { 0, 16, false } }, true, 2, 24, -1 },
+        { "duplicate last fragment", []testFragment{ { 16, 8, true }, { 16, 8, true } }, true, 1, 8, 24 },
+        { "overlaps previous", []testFragment{ { 0, 16, false }, { 8, 16, false } }, false, 1, 16, 0 },
+        { "overlaps next", []testFragment{ { 16, 16, false }, { 8, 16, false } }, false, 1, 16, 0 },
+        { "same offset other length", []testFragment{ { 0, 16, false }, { 0, 8, false } }, false, 1, 16, 0 },
+        { "contained", []testFragment{ { 0, 32, false }, { 8, 8, false } }, false, 1, 32, 0 },
+        { "covers two", []testFragment{ { 8, 8, false }, { 24, 8, false }, { 0, 40, false } }, false, 2, 16, 0 },
+        { "last fragment before data", []testFragment{ { 16, 16, false }, { 0, 8, true } }, false, 1, 16, 0 },
+        { "fragment beyond length", []testFragment{ { 0, 8, true }, { 8, 8, false } }, false, 1, 8, 0 },
+        { "second last fragment", []testFragment{ { 16, 8, true }, { 24, 8, true } }, false, 1, 8, 0 },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            e := &fragmentMapEntry{ length: -1 }
+            var accept bool
+            for i, f := range tt.fragments {
+                accept = insertFragment(e, &fragmentationData{ offset: f.offset, data: make([]byte, f.length), lastFragment: f.last })
+                if i < len(tt.fragments) - 1 && !accept {
+                    t.Fatalf("fragment %d was rejected", i)
+                }
+            }
+            if accept != tt.accept {
+                t.Errorf("accepted %v, want %v", accept, tt.accept)
+            }
+            if len(e.parts) != tt.parts || e.received != tt.received {
+                t.Errorf("%d parts with %d bytes, want %d with %d bytes", len(e.parts), e.received, tt.parts, tt.received)
+            }
+            if accept && e.length != tt.length {
+                t.Errorf("length %d, want %d", e.length, tt.length)
+            }
+            for i := 1; i < len(e.parts); i++ {
+                if e.parts[i - 1].offset + len(e.parts[i - 1].data) > e.parts[i].offset {
+                    t.Errorf("part %d overlaps part %d", i - 1, i)
+                }
+            }
+        })
+    }
+}
+
+func TestSendFragmented(t *testing.T) {
+    a, b, err := netdev.OpenPipe(netdev.PipeConfig{ Name: "a" }, netdev.PipeConfig{ Name: "b" })
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer a.Close()
+    defer b.Close()
+    l := NewLayer(netdev.NewList())
+    nextHop := net.ParseIP("fd00::2")
+    l.AddNeighbor(nextHop, b.GetHardwareAddress(), a)
+    data := make([]byte, 3000)
+    for i := range data {
+        data[i] = byte(i % 251)
+    }
+    hopByHop := OptionsHeader(ip.IPPROTO_HOPOPTS, []Option{ { Type: OptionRouterAlert, Data: []byte{ 0, 0 } } })
+    dstOpts := OptionsHeader(ip.IPPROTO_DSTOPTS, []Option{ { Type: 0x1E, Data: []byte{ 1, 2, 3, 4 } } })
+    routing := ExtensionHeader{ Type: ip.IPPROTO_ROUTING, Data: make([]byte, 6) }
+    tests := []struct {
+        name string
+        mtu int
+        exts []ExtensionHeader
+        //repeated is the number of extension headers sent in every fragment, unfragmentable their length plus the ipv6 header
+        repeated int
+        unfragmentable int
+        //sizes are the lengths of the fragmentable parts of the fragments
+        sizes []int
+    }{
+        { "minimum mtu", MinMTU, nil, 0, HeaderLength, []int{ 1232, 1232, 536 } },
+        { "block size rounded down", 1500, nil, 0, HeaderLength, []int{ 1448, 1448, 104 } },
+        { "hop-by-hop repeated, destination options fragmented", 1500, []ExtensionHeader{ hopByHop, dstOpts }, 1, HeaderLength + 8, []int{ 1440, 1440, 128 } },
+        { "headers up to routing repeated", MinMTU, []ExtensionHeader{ hopByHop, dstOpts, routing, dstOpts }, 3, HeaderLength + 24, []int{ 1208, 1208, 592 } },
+        { "no room for data", MinMTU, []ExtensionHeader{ { Type: ip.IPPROTO_HOPOPTS, Data: make([]byte, MinMTU - HeaderLength - 2) } }, 1, MinMTU, nil },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            header := &Header{
+                NextHeader: ip.IPPROTO_UDP,
+                ExtensionHeaders: tt.exts,
+                HopLimit: 64,
+                SourceIP: net.ParseIP("fd00::1"),
+                TargetIP: nextHop,
+            }
+            sent, _, _ := a.GetTxStats()
+            err := l.sendFragmented(a, tt.mtu, header, data, nextHop)
+            if tt.sizes == nil {
+                if err != ErrPacketTooBig {
+                    t.Errorf("returned %v, want %v", err, ErrPacketTooBig)
+                }
+                if now, _, _ := a.GetTxStats(); now != sent {
+                    t.Errorf("sent %d fragments without room for data", now - sent)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            rest := &Header{ ExtensionHeaders: tt.exts[tt.repeated:] }
+            want := make([]byte, rest.length() - HeaderLength)
+            putExtensionHeaders(want, rest.ExtensionHeaders, header.NextHeader)
+            want = append(want, data...)
+            var fragmentable, unfragmentable []byte
+            var id uint32
+            for i, size := range tt.sizes {
+                frame := b.RxPacket()
+                pkt := frame[ethernet.HeaderLength:]
+                hdr := parseHeader(pkt)
+                if hdr == nil {
+                    t.Fatalf("fragment %d has an invalid header", i)
+                }
+                if len(pkt) > tt.mtu {
+                    t.Errorf("fragment %d is %d bytes long", i, len(pkt))
+                }
+                if len(pkt) != tt.unfragmentable + fragmentHeaderLength + size {
+                    t.Fatalf("fragment %d is %d bytes long, want %d", i, len(pkt), tt.unfragmentable + fragmentHeaderLength + size)
+                }
+                if i == 0 {
+                    unfragmentable = append([]byte(nil), pkt[HeaderLength:tt.unfragmentable]...)
+                    id = binary.BigEndian.Uint32(pkt[tt.unfragmentable + 4:])
+                } else if !bytes.Equal(pkt[HeaderLength:tt.unfragmentable], unfragmentable) {
+                    t.Errorf("fragment %d repeats other headers", i)
+                }
+                frag := pkt[tt.unfragmentable:]
+                offset := int(binary.BigEndian.Uint16(frag[2:4]) &^ 7)
+                more := frag[3] & 1 != 0
+                if offset != len(fragmentable) || more != (i < len(tt.sizes) - 1) {
+                    t.Errorf("fragment %d at offset %d with more fragments %v", i, offset, more)
+                }
+                if binary.BigEndian.Uint32(frag[4:8]) != id {
+                    t.Errorf("fragment %d has the identification %d, want %d", i, binary.BigEndian.Uint32(frag[4:8]), id)
+                }
+                fragmentable = append(fragmentable, frag[fragmentHeaderLength:]...)
+            }
+            if !bytes.Equal(fragmentable, want) {
+                t.Errorf("fragments carry different data")
+            }
+        })
+    }
+}
@@ -0,0 +1,244 @@
+package ipv6
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"syscall"
+	"time"
+	"github.com/arcpop/network/config"
+	"github.com/arcpop/network/ip"
+)
+
+const (
+    //icmpErrorBurst and icmpErrorInterval limit the rate of sent error messages (RFC 4443 section 2.4 f)
+    icmpErrorBurst = 10
+    icmpErrorInterval = 100 * time.Millisecond
+
+    //maxICMPErrorData is the part of the original packet, its header included, which fits into an error without exceeding the minimum mtu
+    maxICMPErrorData = MinMTU - HeaderLength - 8
+)
+
+type ICMPPacket struct {
+    Type byte
+    Code byte
+    Checksum uint16
+    Data []byte
+}
+
+//ICMPError is a received icmpv6 error message, Source is the host or router which sent it.
+//It unwraps to the errno the linux stack reports for the same message.
+type ICMPError struct {
+    Type, Code byte
+    Source net.IP
+    //MTU is the mtu of the next hop reported by a packet too big message
+    MTU uint32
+    //Pointer is the offset of the problem in the original packet reported by a parameter problem message
+    Pointer uint32
+}
+
+func (e *ICMPError) Error() string {
+    return e.Errno().Error()
+}
+
+func (e *ICMPError) Unwrap() error {
+    return e.Errno()
+}
+
+//Errno maps the message like icmpv6_err_convert of the linux kernel.
+func (e *ICMPError) Errno() syscall.Errno {
+    switch e.Type {
+    case ip.ICMPv6TypeDestinationUnreachable:
+        switch e.Code {
+        case ip.ICMPv6CodeNoRoute:
+            return syscall.ENETUNREACH
+        case ip.ICMPv6CodeAdministrativelyProhibited, ip.ICMPv6CodeSourcePolicyFailed, ip.ICMPv6CodeRejectRoute:
+            return syscall.EACCES
+        case ip.ICMPv6CodeBeyondScope, ip.ICMPv6CodeAddressUnreachable:
+            return syscall.EHOSTUNREACH
+        case ip.ICMPv6CodePortUnreachable:
+            return syscall.ECONNREFUSED
+        }
+    case ip.ICMPv6TypePacketTooBig:
+        return syscall.EMSGSIZE
+    case ip.ICMPv6TypeTimeExceeded:
+        return syscall.EHOSTUNREACH
+    }
+    return syscall.EPROTO
+}
+
+//Hard returns true for errors which abort a connection attempt, like the fatal flag of the linux kernel.
+func (e *ICMPError) Hard() bool {
+    switch e.Type {
+    case ip.ICMPv6TypeDestinationUnreachable:
+        switch e.Code {
+        case ip.ICMPv6CodeNoRoute, ip.ICMPv6CodeBeyondScope, ip.ICMPv6CodeAddressUnreachable:
+            return false
+        }
+        return true
+    case ip.ICMPv6TypeParameterProblem:
+        return true
+    }
+    return false
+}
+
+func SendICMPPacket(icmpType, icmpCode byte, header *Header, data []byte) error {
+    return Default.SendICMPPacket(icmpType, icmpCode, header, data)
+}
+
+//SendICMPPacket sends an icmpv6 message, data is everything following the checksum field.
+//An unspecified source address is replaced by the address the message is sent from since the checksum covers it.
+func (l *Layer) SendICMPPacket(icmpType, icmpCode byte, header *Header, data []byte) error {
+    if header.SourceIP == nil || header.SourceIP.IsUnspecified() {
+        src, err := l.SourceAddress(header.TargetIP)
+        if err != nil {
+            return err
+        }
+        header.SourceIP = src
+    }
+    header.NextHeader = ip.IPPROTO_ICMPV6
+    p := AllocatePacket(len(data) + 4)
+    pkt := p.ProtocolData
+    p.IPHeader = header
+    pkt[0] = icmpType
+    pkt[1] = icmpCode
+    copy(pkt[4:], data)
+    binary.BigEndian.PutUint16(pkt[2:4], PseudoHeaderChecksum(header.SourceIP, header.TargetIP, ip.IPPROTO_ICMPV6, pkt))
+    return l.Send(p)
+}
+
+//SendDestinationUnreachable answers the packet described by hdr and data with a destination unreachable message.
+func (l *Layer) SendDestinationUnreachable(code byte, hdr *Header, data []byte) {
+    l.sendICMPError(ip.ICMPv6TypeDestinationUnreachable, code, 0, hdr, data)
+}
+
+func (l *Layer) SendTimeExceeded(code byte, hdr *Header, data []byte) {
+    l.sendICMPError(ip.ICMPv6TypeTimeExceeded, code, 0, hdr, data)
+}
+
+//SendParameterProblem reports the problem at offset pointer of the packet described by hdr and data,
+//the offset counts from the start of the ipv6 header.
+func (l *Layer) SendParameterProblem(code byte, pointer uint32, hdr *Header, data []byte) {
+    l.sendICMPError(ip.ICMPv6TypeParameterProblem, code, pointer, hdr, data)
+}
+
+//sendICMPError sends an error message about the packet described by hdr and data.
+//No error is sent about icmp error messages (RFC 4443 section 2.4 e).
+func (l *Layer) sendICMPError(icmpType, icmpCode byte, param uint32, hdr *Header, data []byte) {
+    if hdr.NextHeader == ip.IPPROTO_ICMPV6 && (len(data) == 0 || data[0] < ip.ICMPv6TypeEchoRequest) {
+        return
+    }
+    packet := make([]byte, hdr.length() + len(data))
+    hdr.put(packet)
+    copy(packet[hdr.length():], data)
+    l.sendICMPErrorPacket(icmpType, icmpCode, param, hdr, packet)
+}
+
+//sendParameterProblemPacket reports the problem at offset pointer of packet, which starts with the ipv6 header.
+func (l *Layer) sendParameterProblemPacket(code byte, pointer int, hdr *Header, packet []byte) {
+    l.sendICMPErrorPacket(ip.ICMPv6TypeParameterProblem, code, uint32(pointer), hdr, packet)
+}
+
+//sendICMPErrorPacket sends an error message carrying as much of packet as fits into the minimum mtu, packet
+//starts with the ipv6 header described by hdr. No error is sent in the remaining cases forbidden by
+//RFC 4443 section 2.4 e and while the rate limit is exceeded.
+func (l *Layer) sendICMPErrorPacket(icmpType, icmpCode byte, param uint32, hdr *Header, packet []byte) {
+    if hdr.SourceIP.IsUnspecified() || hdr.SourceIP.IsMulticast() {
+        return
+    }
+    if hdr.TargetIP.IsMulticast() && icmpType != ip.ICMPv6TypePacketTooBig &&
+        !(icmpType == ip.ICMPv6TypeParameterProblem && icmpCode == ip.ICMPv6CodeUnrecognizedOption) {
+        return
+    }
+    if !l.icmpErrorAllowed() {
+        return
+    }
+    n := len(packet)
+    if n > maxICMPErrorData {
+        n = maxICMPErrorData
+    }
+    body := make([]byte, 4 + n)
+    binary.BigEndian.PutUint32(body[0:4], param)
+    copy(body[4:], packet[:n])
+    reply := &Header{
+        TargetIP: make(net.IP, 16),
+        HopLimit: byte(config.IPv6.DefaultHopLimit),
+    }
+    copy(reply.TargetIP, hdr.SourceIP)
+    go l.SendICMPPacket(icmpType, icmpCode, reply, body)
+}
+
+//icmpErrorAllowed takes a token from the bucket limiting the error messages.
+func (l *Layer) icmpErrorAllowed() bool {
+    l.icmpErrorLock.Lock()
+    defer l.icmpErrorLock.Unlock()
+    now := time.Now()
+    l.icmpErrorTokens += float64(now.Sub(l.icmpErrorLast)) / float64(icmpErrorInterval)
+    l.icmpErrorLast = now
+    if l.icmpErrorTokens > icmpErrorBurst {
+        l.icmpErrorTokens = icmpErrorBurst
+    }
+    if l.icmpErrorTokens < 1 {
+        return false
+    }
+    l.icmpErrorTokens--
+    return true
+}
+
+type ICMP struct {
+    layer *Layer
+}
+
+//IPv6Error learns the path mtu from a packet too big message about one of the pending echo requests.
+func (i *ICMP) IPv6Error(err *ICMPError, original *Header, data []byte) {
+    if err.Type == ip.ICMPv6TypePacketTooBig && i.layer.pingPending(original.TargetIP, data) {
+        i.layer.UpdatePathMTU(original.TargetIP, int(err.MTU))
+    }
+}
+
+func (i *ICMP) IPv6In(header *Header, pkt []byte) {
+    if len(pkt) < 4 {
+        log.Println("IPv6: ICMP Packet too short.")
+        return
+    }
+    if PseudoHeaderChecksum(header.SourceIP, header.TargetIP, ip.IPPROTO_ICMPV6, pkt) != 0 {
+        log.Println("IPv6: ICMP Packet checksum mismatch: ", pkt[0], pkt[1])
+        return
+    }
+    icmpPkt := &ICMPPacket{
+        Type: pkt[0],
+        Code: pkt[1],
+        Checksum: binary.BigEndian.Uint16(pkt[2:4]),
+        Data: pkt[4:],
+    }
+    switch icmpPkt.Type {
+    case ip.ICMPv6TypeEchoRequest:
+        i.layer.echoRequest(header, icmpPkt)
+    case ip.ICMPv6TypeEchoReply:
+        i.layer.echoReply(header, icmpPkt)
+    default:
+        //Unknown error messages are passed up as well, unknown informational messages are discarded (RFC 4443 section 2.4)
+        if icmpPkt.Type < ip.ICMPv6TypeEchoRequest {
+            i.layer.protocolsCheckForICMPError(header, icmpPkt)
+        }
+    }
+}
+
+func (l *Layer) echoRequest(header *Header, icmpPkt *ICMPPacket) {
+    if header.SourceIP.IsUnspecified() {
+        return
+    }
+    hdr := &Header{
+        TargetIP: make(net.IP, 16),
+        HopLimit: byte(config.IPv6.DefaultHopLimit),
+    }
+    copy(hdr.TargetIP, header.SourceIP)
+    //Replies to multicast requests are sent from a unicast address (RFC 4443 section 4.2)
+    if !header.TargetIP.IsMulticast() {
+        hdr.SourceIP = make(net.IP, 16)
+        copy(hdr.SourceIP, header.TargetIP)
+    }
+    data := make([]byte, len(icmpPkt.Data))
+    copy(data, icmpPkt.Data)
+    go l.SendICMPPacket(ip.ICMPv6TypeEchoReply, ip.ICMPv6CodeEchoReply, hdr, data)
+}
@@ -1,9 +1,186 @@
+//Package ipv6 represents the ipv6 layer (RFC 8200) of the network stack.
 package ipv6
 
 import (
+	"context"
+	"encoding/binary"
 	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+	"github.com/arcpop/network/ethernet"
+	"github.com/arcpop/network/ip"
+	"github.com/arcpop/network/netdev"
+)
+
+const (
+    HeaderLength = 40
+
+    //MinMTU is the smallest link mtu every ipv6 link has to support
+    MinMTU = 1280
 )
 
 var (
     ErrNotImplemented = errors.New("IPv6 is not yet implemented!")
-)
\ No newline at end of file
+    ErrPacketTooBig = errors.New("Packet exceeds the maximum payload length!")
+    ErrInterfaceNotFound = errors.New("Interface not found")
+    ErrPacketNotRoutable = errors.New("Packet is not routable!")
+    ErrNoSourceAddress = errors.New("No usable source address on the interface!")
+    ErrLinkMTUTooSmall = errors.New("The link mtu is below the ipv6 minimum!")
+)
+
+var (
+    //AllNodesMulticast is the link local all nodes group every interface is member of
+    AllNodesMulticast = net.ParseIP("ff02::1")
+    //AllRoutersMulticast is the link local all routers group
+    AllRoutersMulticast = net.ParseIP("ff02::2")
+)
+
+type L3Packet struct {
+    IPHeader *Header
+    ProtocolData []byte
+    packetData []byte
+}
+
+//Header is the ipv6 header with the extension headers following it, NextHeader is the upper layer protocol
+//which follows the last extension header.
+type Header struct {
+    TrafficClass byte
+    FlowLabel uint32
+    PayloadLength uint16
+    NextHeader byte
+    ExtensionHeaders []ExtensionHeader
+    HopLimit byte
+    SourceIP net.IP
+    TargetIP net.IP
+}
+
+//Layer is the ipv6 layer of one stack, it owns the routing table, the neighbor cache and the registered protocols.
+type Layer struct {
+    interfaces *netdev.List
+
+    routingTable []*RoutingEntry
+    routingTableLock sync.RWMutex
+
+    //neighborsLock also guards the router solicitations, the duplicate address detections
+    //and the link parameters learned from routers
+    neighbors map[[16]byte]*neighborEntry
+    neighborsLock sync.RWMutex
+    solicitations map[netdev.Interface]*routerSolicitation
+    dads map[[16]byte]*dadState
+    baseReachableTime time.Duration
+    reachableTime time.Duration
+    retransTimer time.Duration
+
+    //addressLock serializes the updates of the interface addresses
+    addressLock sync.Mutex
+
+    supportedProtocolsLock sync.RWMutex
+    supportedProtocols map[byte] Protocol
+
+    pingsLock sync.Mutex
+    pings map[pingKey]*pendingPing
+
+    icmpErrorLock sync.Mutex
+    icmpErrorTokens float64
+    icmpErrorLast time.Time
+
+    fragmentationQueue chan *fragment
+    fragmentedPackets map[fragmentationKey] *fragmentMapEntry
+    reassemblyStats ReassemblyStats
+    //fragmentID is the identification of the last packet fragmented by this layer
+    fragmentID uint32
+
+    //pathMTUs holds the mtus learned from packet too big messages by destination
+    pathMTULock sync.Mutex
+    pathMTUs map[[16]byte] *pathMTUEntry
+
+    done <-chan struct{}
+    cancel context.CancelFunc
+    workers sync.WaitGroup
+}
+
+//Default is the layer used by the package level functions.
+var Default = NewLayer(netdev.Default)
+
+//NewLayer creates an ipv6 layer looking up interfaces in interfaces.
+func NewLayer(interfaces *netdev.List) *Layer {
+    l := &Layer{
+        interfaces: interfaces,
+        neighbors: make(map[[16]byte]*neighborEntry),
+        solicitations: make(map[netdev.Interface]*routerSolicitation),
+        dads: make(map[[16]byte]*dadState),
+        retransTimer: RetransTimer,
+        supportedProtocols: make(map[byte]Protocol),
+        pings: make(map[pingKey]*pendingPing),
+        fragmentationQueue: make(chan *fragment),
+        fragmentID: rand.Uint32(),
+        pathMTUs: make(map[[16]byte] *pathMTUEntry),
+    }
+    l.setReachableTime(ReachableTime)
+    l.RegisterProtocol(ip.IPPROTO_ICMPV6, &ICMP{layer: l})
+    return l
+}
+
+//Start starts the default layer and connects it to the default ethernet layer.
+func Start()  {
+    ethernet.Default.IPv6In = Default.In
+    Default.Start(context.Background())
+}
+
+//Stop stops the default layer.
+func Stop()  {
+    Default.Stop()
+}
+
+//Start starts the workers of the layer, they run until ctx is done or Stop is called.
+func (l *Layer) Start(ctx context.Context)  {
+    ctx, l.cancel = context.WithCancel(ctx)
+    l.done = ctx.Done()
+    l.workers.Add(3)
+    go l.ndTicker(ctx)
+    go l.fragmentationReassemblyWorker(ctx)
+    go l.pathMTUWorker(ctx)
+}
+
+//Stop stops the workers of the layer and waits for them to exit.
+func (l *Layer) Stop()  {
+    if l.cancel != nil {
+        l.cancel()
+    }
+    l.workers.Wait()
+}
+
+//RegisterProtocol installs the handler for a next header value, replacing any previous one.
+func (l *Layer) RegisterProtocol(nextHeader byte, p Protocol) {
+    l.supportedProtocolsLock.Lock()
+    l.supportedProtocols[nextHeader] = p
+    l.supportedProtocolsLock.Unlock()
+}
+
+//PseudoHeaderChecksum computes the internet checksum over data prefixed with the
+//ipv6 pseudo header (RFC 8200 section 8.1) used by udp, tcp and icmpv6.
+func PseudoHeaderChecksum(src, dst net.IP, nextHeader byte, data []byte) uint16 {
+    buf := make([]byte, 40 + len(data))
+    copy(buf[0:16], src.To16())
+    copy(buf[16:32], dst.To16())
+    binary.BigEndian.PutUint32(buf[32:36], uint32(len(data)))
+    buf[39] = nextHeader
+    copy(buf[40:], data)
+    return ip.InternetChecksum(buf)
+}
+
+//SolicitedNodeMulticast returns the solicited node group of an address (RFC 4291 section 2.7.1).
+func SolicitedNodeMulticast(addr net.IP) net.IP {
+    group := net.ParseIP("ff02::1:ff00:0")
+    copy(group[13:], addr.To16()[13:])
+    return group
+}
+
+//MulticastMAC returns the ethernet address a multicast group is mapped to (RFC 2464 section 7).
+func MulticastMAC(group net.IP) net.HardwareAddr {
+    mac := net.HardwareAddr{0x33, 0x33, 0, 0, 0, 0}
+    copy(mac[2:], group.To16()[12:])
+    return mac
+}
@@ -0,0 +1,172 @@
+package ipv6
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"github.com/arcpop/network/ethernet"
+	"github.com/arcpop/network/ip"
+	"github.com/arcpop/network/netdev"
+)
+
+type Protocol interface {
+    IPv6In(header *Header, data []byte)
+}
+
+//ErrorHandler is implemented by protocols which want to learn about icmpv6 errors caused by their packets.
+//original is the header of the packet which caused the error and data holds the part of its payload carried by the error.
+//A packet too big message only changes the path mtu if the handler calls UpdatePathMTU.
+type ErrorHandler interface {
+    IPv6Error(err *ICMPError, original *Header, data []byte)
+}
+
+//In handles a received ipv6 packet, it is meant to be set as ethernet.Layer.IPv6In
+func (l *Layer) In(pkt *ethernet.Layer2Packet)  {
+    hdr := parseHeader(pkt.Data)
+    if hdr == nil {
+        return
+    }
+    if !l.isForUs(pkt.Dev, hdr.TargetIP) {
+        return
+    }
+    //Never accept packets claiming to come from a multicast address (RFC 4291 section 2.7)
+    if hdr.SourceIP.IsMulticast() {
+        log.Println("IPv6: Multicast source address, dropping.")
+        return
+    }
+    l.processExtensionHeaders(pkt.Dev, hdr, pkt.Data[:HeaderLength + int(hdr.PayloadLength)], HeaderLength, 6)
+}
+
+//isForUs returns true if dst is an address of the interface or a group the interface is member of.
+//Tentative addresses only receive on their solicited node group to detect duplicates.
+func (l *Layer) isForUs(iface netdev.Interface, dst net.IP) bool {
+    if dst.Equal(AllNodesMulticast) {
+        return true
+    }
+    for _, a := range iface.GetIPv6Addresses() {
+        if dst.IsMulticast() {
+            if dst.Equal(SolicitedNodeMulticast(a.IP)) {
+                return true
+            }
+        } else if !a.Tentative && dst.Equal(a.IP) {
+            return true
+        }
+    }
+    return false
+}
+
+//isLocalAddress returns true if addr is the loopback address or an address of one of the interfaces.
+func (l *Layer) isLocalAddress(addr net.IP) bool {
+    if addr.IsLoopback() {
+        return true
+    }
+    for _, dev := range l.interfaces.Interfaces() {
+        for _, a := range dev.GetIPv6Addresses() {
+            if a.IP.Equal(addr) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+//Here we deliver the ip packets to their corresponding protocol
+func (l *Layer) deliverToProtocols(hdr *Header, protocolData []byte)  {
+    l.supportedProtocolsLock.RLock()
+    proto, ok := l.supportedProtocols[hdr.NextHeader]
+    l.supportedProtocolsLock.RUnlock()
+    if !ok {
+        log.Println("IPv6: Packet with unsupported next header: ", hdr.NextHeader)
+        //The pointer is the offset of the next header field naming the protocol (RFC 8200 section 4)
+        pointer := 6
+        if n := len(hdr.ExtensionHeaders); n != 0 {
+            pointer = hdr.length() - hdr.ExtensionHeaders[n - 1].length()
+        }
+        l.SendParameterProblem(ip.ICMPv6CodeUnrecognizedNextHeader, uint32(pointer), hdr, protocolData)
+        return
+    }
+    proto.IPv6In(hdr, protocolData)
+}
+
+//Hand the icmp error to the protocol which sent the original packet if it implements ErrorHandler
+func (l *Layer) protocolsCheckForICMPError(hdr *Header, icmpPkt *ICMPPacket) {
+    //The message carries 4 bytes of type specific data followed by as much of the original packet as possible
+    if len(icmpPkt.Data) < 4 + HeaderLength {
+        log.Println("IPv6: ICMP error message too short.")
+        return
+    }
+    embedded := icmpPkt.Data[4:]
+    orig := parseHeaderFields(embedded)
+    if orig == nil {
+        return
+    }
+    nextHeader, offset, ok := skipExtensionHeaders(orig.NextHeader, embedded[HeaderLength:])
+    if !ok {
+        return
+    }
+    orig.NextHeader = nextHeader
+    //Errors about packets which were not sent by this host are forged
+    if !l.isLocalAddress(orig.SourceIP) {
+        log.Println("IPv6: ICMP error for a packet from", orig.SourceIP, "which is not ours.")
+        return
+    }
+    l.supportedProtocolsLock.RLock()
+    proto, ok := l.supportedProtocols[orig.NextHeader]
+    l.supportedProtocolsLock.RUnlock()
+    if !ok {
+        return
+    }
+    eh, ok := proto.(ErrorHandler)
+    if !ok {
+        return
+    }
+    err := &ICMPError{
+        Type: icmpPkt.Type,
+        Code: icmpPkt.Code,
+        Source: make(net.IP, 16),
+    }
+    copy(err.Source, hdr.SourceIP)
+    switch icmpPkt.Type {
+    case ip.ICMPv6TypePacketTooBig:
+        err.MTU = binary.BigEndian.Uint32(icmpPkt.Data[0:4])
+    case ip.ICMPv6TypeParameterProblem:
+        err.Pointer = binary.BigEndian.Uint32(icmpPkt.Data[0:4])
+    }
+    eh.IPv6Error(err, orig, embedded[HeaderLength + offset:])
+}
+
+func parseHeader(buf []byte) *Header {
+    h := parseHeaderFields(buf)
+    if h == nil {
+        return nil
+    }
+    if HeaderLength + int(h.PayloadLength) > len(buf) {
+        log.Println("IPv6: Payload length exceeds the packet")
+        return nil
+    }
+    return h
+}
+
+//parseHeaderFields parses the header without checking the payload length, it is used for
+//the truncated packets carried by icmp errors.
+func parseHeaderFields(buf []byte) *Header {
+    if len(buf) < HeaderLength {
+        return nil
+    }
+    version := buf[0] >> 4
+    if version != 6 {
+        log.Println("IPv6: Invalid version")
+        return nil
+    }
+    vtf := binary.BigEndian.Uint32(buf[0:4])
+    h := &Header{
+        TrafficClass: byte(vtf >> 20),
+        FlowLabel: vtf & 0xFFFFF,
+        PayloadLength: binary.BigEndian.Uint16(buf[4:6]),
+        NextHeader: buf[6],
+        HopLimit: buf[7],
+        SourceIP: net.IP(buf[8:24]),
+        TargetIP: net.IP(buf[24:40]),
+    }
+    return h
+}
@@ -0,0 +1,102 @@
+package ipv6
+
+import (
+	"encoding/binary"
+	"net"
+	"github.com/arcpop/network/ethernet"
+)
+
+//put writes the header followed by its extension headers.
+func (h *Header) put(buf []byte) {
+    vtf := (uint32(6) << 28) | (uint32(h.TrafficClass) << 20) | (h.FlowLabel & 0xFFFFF)
+    binary.BigEndian.PutUint32(buf[0:4], vtf)
+    binary.BigEndian.PutUint16(buf[4:6], h.PayloadLength)
+    buf[6] = h.NextHeader
+    if len(h.ExtensionHeaders) != 0 {
+        buf[6] = h.ExtensionHeaders[0].Type
+    }
+    buf[7] = h.HopLimit
+    copy(buf[8:24], h.SourceIP.To16())
+    copy(buf[24:40], h.TargetIP.To16())
+    putExtensionHeaders(buf[HeaderLength:], h.ExtensionHeaders, h.NextHeader)
+}
+
+//length returns the length of the header including the extension headers.
+func (h *Header) length() int {
+    n := HeaderLength
+    for i := range h.ExtensionHeaders {
+        n += h.ExtensionHeaders[i].length()
+    }
+    return n
+}
+
+func AllocatePacket(size int) *L3Packet {
+    pkt := make([]byte, size + HeaderLength + ethernet.HeaderLength)
+    return &L3Packet{ packetData: pkt, ProtocolData: pkt[HeaderLength + ethernet.HeaderLength:]}
+}
+
+func SourceAddress(dst net.IP) (net.IP, error) {
+    return Default.SourceAddress(dst)
+}
+
+//SourceAddress returns the address a packet to dst is sent from, it is the best address of the outgoing interface.
+func (l *Layer) SourceAddress(dst net.IP) (net.IP, error) {
+    entry, err := l.RoutingGetRoute(dst)
+    if err != nil {
+        return nil, err
+    }
+    src := selectSource(entry.Iface, dst)
+    if src == nil {
+        return nil, ErrNoSourceAddress
+    }
+    return src, nil
+}
+
+//Send sends the packet through the default layer.
+func Send(p *L3Packet) error {
+    return Default.Send(p)
+}
+
+//Send routes the packet and transmits it to the next hop, an unspecified source address
+//is replaced by the best address of the outgoing interface. Packets exceeding the mtu of
+//the path are fragmented.
+func (l *Layer) Send(p *L3Packet) error {
+    header := p.IPHeader
+    entry, err := l.RoutingGetRoute(header.TargetIP)
+    if err != nil {
+        return err
+    }
+    if header.SourceIP == nil || header.SourceIP.IsUnspecified() {
+        header.SourceIP = selectSource(entry.Iface, header.TargetIP)
+        if header.SourceIP == nil {
+            return ErrNoSourceAddress
+        }
+    }
+    for i := range header.ExtensionHeaders {
+        if !header.ExtensionHeaders[i].valid() {
+            return ErrInvalidExtensionHeader
+        }
+    }
+    headerLength := header.length()
+    if headerLength - HeaderLength + len(p.ProtocolData) > 0xFFFF {
+        return ErrPacketTooBig
+    }
+    header.PayloadLength = uint16(headerLength - HeaderLength + len(p.ProtocolData))
+    nextHop := header.TargetIP
+    if entry.gateway != nil {
+        nextHop = entry.gateway
+    }
+    mtu := l.pathMTU(header.TargetIP, entry.Iface.GetMTU())
+    if headerLength + len(p.ProtocolData) > mtu {
+        return l.sendFragmented(entry.Iface, mtu, header, p.ProtocolData, nextHop)
+    }
+
+    pkt := p.packetData
+    if headerLength != HeaderLength {
+        pkt = make([]byte, ethernet.HeaderLength + headerLength + len(p.ProtocolData))
+        copy(pkt[ethernet.HeaderLength + headerLength:], p.ProtocolData)
+    }
+    header.put(pkt[ethernet.HeaderLength:])
+    l.transmit(entry.Iface, pkt, nextHop)
+    return nil
+}
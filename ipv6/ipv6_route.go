@@ -0,0 +1,229 @@
+package ipv6
+
+import (
+	"net"
+	"time"
+	"github.com/arcpop/network/netdev"
+)
+
+type RoutingEntry struct {
+    network net.IP
+    prefixLength int
+    gateway net.IP
+    metric int
+    flags int
+    //expires is the end of the lifetime of a learned route, it is zero for routes without limit
+    expires time.Time
+    Iface netdev.Interface
+}
+
+const (
+    MetricLocalhost = 0
+    MetricMin = 1
+    MetricDefault = 1024
+    MetricMax = 1 << 20
+)
+
+const (
+    FlagHost = 1 << iota
+    FlagGateway = 1 << iota
+    //FlagDynamic marks routes learned from router advertisements
+    FlagDynamic = 1 << iota
+)
+
+//Gateway returns the next hop of the route or nil if the destination is on link.
+func (e *RoutingEntry) Gateway() net.IP {
+    return e.gateway
+}
+
+//Prefix returns the destination network of the route.
+func (e *RoutingEntry) Prefix() net.IPNet {
+    return net.IPNet{ IP: e.network, Mask: net.CIDRMask(e.prefixLength, 128) }
+}
+
+func (e *RoutingEntry) matches(ip net.IP) bool {
+    return e.network.Equal(ip.To16().Mask(net.CIDRMask(e.prefixLength, 128)))
+}
+
+func RouteAddNet(to net.IPNet, gateway net.IP, metric, flags int, dev netdev.Interface) {
+    Default.RouteAddNet(to, gateway, metric, flags, dev)
+}
+
+func (l *Layer) RouteAddNet(to net.IPNet, gateway net.IP, metric, flags int, dev netdev.Interface) {
+    e := newRoutingEntry(to, gateway, metric, flags, dev)
+    l.routingTableLock.Lock()
+    l.routingTable = append(l.routingTable, e)
+    l.routingTableLock.Unlock()
+}
+
+func newRoutingEntry(to net.IPNet, gateway net.IP, metric, flags int, dev netdev.Interface) *RoutingEntry {
+    ones, _ := to.Mask.Size()
+    e := &RoutingEntry{
+        network: make(net.IP, 16),
+        prefixLength: ones,
+        metric: metric,
+        flags: flags,
+        Iface: dev,
+    }
+    copy(e.network, to.IP.To16().Mask(net.CIDRMask(ones, 128)))
+    if gateway != nil {
+        e.gateway = make(net.IP, 16)
+        copy(e.gateway, gateway.To16())
+        e.flags |= FlagGateway
+    }
+    return e
+}
+
+func RouteAddHost(host net.IP, gateway net.IP, metric, flags int, dev netdev.Interface) {
+    Default.RouteAddHost(host, gateway, metric, flags, dev)
+}
+
+func (l *Layer) RouteAddHost(host net.IP, gateway net.IP, metric, flags int, dev netdev.Interface) {
+    l.RouteAddNet(net.IPNet{ IP: host, Mask: net.CIDRMask(128, 128) }, gateway, metric, flags | FlagHost, dev)
+}
+
+//routeRefresh adds the learned route or extends its lifetime, a lifetime of zero never expires.
+//Manually added routes to the same network are left alone.
+func (l *Layer) routeRefresh(to net.IPNet, gateway net.IP, dev netdev.Interface, lifetime time.Duration) {
+    var expires time.Time
+    if lifetime != 0 {
+        expires = time.Now().Add(lifetime)
+    }
+    l.routingTableLock.Lock()
+    for _, e := range l.routingTable {
+        if e.same(to, gateway, dev) {
+            if e.flags & FlagDynamic != 0 {
+                e.expires = expires
+            }
+            l.routingTableLock.Unlock()
+            return
+        }
+    }
+    e := newRoutingEntry(to, gateway, MetricDefault, FlagDynamic, dev)
+    e.expires = expires
+    l.routingTable = append(l.routingTable, e)
+    l.routingTableLock.Unlock()
+}
+
+//routeDelete removes the learned route to the network through gateway.
+func (l *Layer) routeDelete(to net.IPNet, gateway net.IP, dev netdev.Interface) {
+    l.routingTableLock.Lock()
+    table := l.routingTable[:0]
+    for _, e := range l.routingTable {
+        if e.flags & FlagDynamic == 0 || !e.same(to, gateway, dev) {
+            table = append(table, e)
+        }
+    }
+    l.routingTable = table
+    l.routingTableLock.Unlock()
+}
+
+//routeDeleteOnLink removes the manually added routes to the network on dev which have no gateway.
+func (l *Layer) routeDeleteOnLink(to net.IPNet, dev netdev.Interface) {
+    l.routingTableLock.Lock()
+    table := l.routingTable[:0]
+    for _, e := range l.routingTable {
+        if e.flags & FlagDynamic != 0 || !e.same(to, nil, dev) {
+            table = append(table, e)
+        }
+    }
+    l.routingTable = table
+    l.routingTableLock.Unlock()
+}
+
+//routeExpire removes the learned routes whose lifetime ended before now.
+func (l *Layer) routeExpire(now time.Time) {
+    l.routingTableLock.Lock()
+    table := l.routingTable[:0]
+    for _, e := range l.routingTable {
+        if e.expires.IsZero() || now.Before(e.expires) {
+            table = append(table, e)
+        }
+    }
+    l.routingTable = table
+    l.routingTableLock.Unlock()
+}
+
+func (e *RoutingEntry) same(to net.IPNet, gateway net.IP, dev netdev.Interface) bool {
+    ones, _ := to.Mask.Size()
+    return e.Iface == dev && e.prefixLength == ones && e.gateway.Equal(gateway) &&
+        e.network.Equal(to.IP.To16().Mask(net.CIDRMask(ones, 128)))
+}
+
+func RouteDeleteInterface(iface netdev.Interface)  {
+    Default.RouteDeleteInterface(iface)
+}
+
+func (l *Layer) RouteDeleteInterface(iface netdev.Interface)  {
+    l.routingTableLock.Lock()
+    table := l.routingTable[:0]
+    for _, e := range l.routingTable {
+        if e.Iface != iface {
+            table = append(table, e)
+        }
+    }
+    l.routingTable = table
+    l.routingTableLock.Unlock()
+}
+
+func RoutingGetRoute(targetIP net.IP) (*RoutingEntry, error) {
+    return Default.RoutingGetRoute(targetIP)
+}
+
+//RoutingGetRoute returns the route with the longest prefix matching targetIP,
+//the metric decides between routes of equal prefix length.
+func (l *Layer) RoutingGetRoute(targetIP net.IP) (*RoutingEntry, error) {
+    l.routingTableLock.RLock()
+    defer l.routingTableLock.RUnlock()
+
+    var bestRoute *RoutingEntry
+    for _, e := range l.routingTable {
+        if !e.matches(targetIP) {
+            continue
+        }
+        if bestRoute == nil || e.prefixLength > bestRoute.prefixLength ||
+            (e.prefixLength == bestRoute.prefixLength && e.metric < bestRoute.metric) {
+            bestRoute = e
+        }
+    }
+    if bestRoute == nil {
+        return nil, ErrPacketNotRoutable
+    }
+    return bestRoute, nil
+}
+
+func ConfigureInterfaceAddress(ifname string, address net.IPNet) error {
+    return Default.ConfigureInterfaceAddress(ifname, address)
+}
+
+//ConfigureInterfaceAddress adds the address to the interface together with the routes to it and its prefix,
+//the address is usable once duplicate address detection finished.
+func (l *Layer) ConfigureInterfaceAddress(ifname string, address net.IPNet) error {
+    iface := l.interfaces.InterfaceByName(ifname)
+    if iface == nil {
+        return ErrInterfaceNotFound
+    }
+    if iface.GetMTU() < MinMTU {
+        return ErrLinkMTUTooSmall
+    }
+    ones, _ := address.Mask.Size()
+    l.addAddress(iface, netdev.IPv6Address{ IP: address.IP.To16(), PrefixLength: ones }, 0)
+    l.routeDeleteOnLink(address, iface)
+    l.RouteAddNet(address, nil, MetricMin, 0, iface)
+    return nil
+}
+
+func RemoveInterfaceAddress(ifname string, address net.IPNet) error {
+    return Default.RemoveInterfaceAddress(ifname, address)
+}
+
+//RemoveInterfaceAddress removes the address from the interface together with the routes to it and its prefix.
+func (l *Layer) RemoveInterfaceAddress(ifname string, address net.IPNet) error {
+    iface := l.interfaces.InterfaceByName(ifname)
+    if iface == nil {
+        return ErrInterfaceNotFound
+    }
+    l.removeAddress(iface, address.IP)
+    l.routeDeleteOnLink(address, iface)
+    return nil
+}
@@ -0,0 +1,116 @@
+package ipv6
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+	"github.com/arcpop/network/config"
+	"github.com/arcpop/network/ethernet"
+	"github.com/arcpop/network/ip"
+	"github.com/arcpop/network/netdev"
+)
+
+//newPipeLayer starts a layer with its own ethernet layer receiving from dev, dev is closed when the test ends.
+func newPipeLayer(t *testing.T, dev netdev.Interface) *Layer {
+    list := netdev.NewList()
+    if err := list.Add(dev); err != nil {
+        t.Fatal(err)
+    }
+    l := NewLayer(list)
+    l.Start(context.Background())
+    e := &ethernet.Layer{ IPv6In: l.In }
+    e.Start(dev)
+    t.Cleanup(func() {
+        dev.Close()
+        e.Stop()
+        l.Stop()
+    })
+    return l
+}
+
+//withoutDAD makes the addresses configured by the test usable right away.
+func withoutDAD(t *testing.T) {
+    transmits := config.IPv6.DupAddrDetectTransmits
+    config.IPv6.DupAddrDetectTransmits = 0
+    t.Cleanup(func() {
+        config.IPv6.DupAddrDetectTransmits = transmits
+    })
+}
+
+//capture hands the ipv6 packets received on dev to the test until dev is closed.
+func capture(dev netdev.Interface) chan []byte {
+    c := make(chan []byte, 64)
+    go func() {
+        defer close(c)
+        for {
+            frame := dev.RxPacket()
+            if frame == nil {
+                return
+            }
+            if len(frame) > ethernet.HeaderLength && binary.BigEndian.Uint16(frame[12:14]) == 0x86DD {
+                c <- frame[ethernet.HeaderLength:]
+            }
+        }
+    }()
+    return c
+}
+
+//receive returns the next captured packet or nil if none arrived within timeout.
+func receive(c chan []byte, timeout time.Duration) []byte {
+    select {
+        case pkt := <- c:
+            return pkt
+        case <- time.After(timeout):
+            return nil
+    }
+}
+
+func TestParseHeader(t *testing.T) {
+    src, dst := net.ParseIP("fd00::1"), net.ParseIP("fd00::2")
+    tests := []struct {
+        name string
+        length int
+        payloadLength uint16
+        version byte
+        valid bool
+    }{
+        { "valid", HeaderLength + 8, 8, 6, true },
+        { "without payload", HeaderLength, 0, 6, true },
+        { "padded frame", HeaderLength + 8, 4, 6, true },
+        { "too short", HeaderLength - 1, 0, 6, false },
+        { "version 4", HeaderLength + 8, 8, 4, false },
+        { "payload length beyond packet", HeaderLength + 8, 9, 6, false },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            h := &Header{
+                TrafficClass: 0xA5,
+                FlowLabel: 0x12345,
+                PayloadLength: tt.payloadLength,
+                NextHeader: ip.IPPROTO_UDP,
+                HopLimit: 64,
+                SourceIP: src,
+                TargetIP: dst,
+            }
+            buf := make([]byte, HeaderLength + 8)
+            h.put(buf)
+            buf[0] = tt.version << 4 | buf[0] & 0xF
+            parsed := parseHeader(buf[:tt.length])
+            if (parsed != nil) != tt.valid {
+                t.Fatalf("parsed %v, want valid %v", parsed, tt.valid)
+            }
+            if parsed == nil {
+                return
+            }
+            if parsed.TrafficClass != h.TrafficClass || parsed.FlowLabel != h.FlowLabel || parsed.PayloadLength != h.PayloadLength ||
+                parsed.NextHeader != h.NextHeader || parsed.HopLimit != h.HopLimit {
+                t.Errorf("parsed %+v, want %+v", parsed, h)
+            }
+            if !parsed.SourceIP.Equal(src) || !parsed.TargetIP.Equal(dst) {
+                t.Errorf("parsed addresses %v and %v, want %v and %v", parsed.SourceIP, parsed.TargetIP, src, dst)
+            }
+        })
+    }
+}
@@ -0,0 +1,309 @@
+package ipv6
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"time"
+	"github.com/arcpop/network/ethernet"
+	"github.com/arcpop/network/ip"
+	"github.com/arcpop/network/netdev"
+)
+
+//Protocol constants of neighbor discovery (RFC 4861 section 10)
+const (
+    MaxRtrSolicitationDelay = time.Second
+    RtrSolicitationInterval = 4 * time.Second
+    MaxRtrSolicitations = 3
+
+    MaxMulticastSolicit = 3
+    MaxUnicastSolicit = 3
+    ReachableTime = 30 * time.Second
+    RetransTimer = time.Second
+    DelayFirstProbeTime = 5 * time.Second
+    MinRandomFactor = 0.5
+    MaxRandomFactor = 1.5
+)
+
+//ndHopLimit is the hop limit of every neighbor discovery message, receivers drop anything else
+//since such a message might have been forwarded by a router.
+const ndHopLimit = 255
+
+const (
+    optSourceLinkLayerAddress = 1
+    optTargetLinkLayerAddress = 2
+    optPrefixInformation = 3
+)
+
+const (
+    flagRouter = 0x80
+    flagSolicited = 0x40
+    flagOverride = 0x20
+
+    flagOnLink = 0x80
+    flagAutonomous = 0x40
+)
+
+//infiniteLifetime is the lifetime value which never expires.
+const infiniteLifetime = 0xFFFFFFFF
+
+type ndOption []byte
+
+//parseNDOptions splits buf into options, it fails on options with length zero (RFC 4861 section 4.6).
+func parseNDOptions(buf []byte) ([]ndOption, bool) {
+    var opts []ndOption
+    for len(buf) > 0 {
+        if len(buf) < 2 || buf[1] == 0 || int(buf[1]) * 8 > len(buf) {
+            return nil, false
+        }
+        n := int(buf[1]) * 8
+        opts = append(opts, ndOption(buf[:n]))
+        buf = buf[n:]
+    }
+    return opts, true
+}
+
+func linkLayerAddressOption(opts []ndOption, typ byte) net.HardwareAddr {
+    for _, o := range opts {
+        if o[0] == typ && len(o) == 8 {
+            return net.HardwareAddr(o[2:8])
+        }
+    }
+    return nil
+}
+
+func putLinkLayerAddressOption(buf []byte, typ byte, mac net.HardwareAddr) {
+    buf[0] = typ
+    buf[1] = 1
+    copy(buf[2:8], mac)
+}
+
+//sendICMP fills in the ip header and the checksum of the icmpv6 message msg and sends it from src to dst on dev.
+func (l *Layer) sendICMP(dev netdev.Interface, src, dst net.IP, hopLimit byte, msg []byte) {
+    p := AllocatePacket(len(msg))
+    copy(p.ProtocolData, msg)
+    binary.BigEndian.PutUint16(p.ProtocolData[2:4], PseudoHeaderChecksum(src, dst, ip.IPPROTO_ICMPV6, p.ProtocolData))
+    hdr := &Header{
+        PayloadLength: uint16(len(msg)),
+        NextHeader: ip.IPPROTO_ICMPV6,
+        HopLimit: hopLimit,
+        SourceIP: src,
+        TargetIP: dst,
+    }
+    hdr.put(p.packetData[ethernet.HeaderLength:])
+    l.transmit(dev, p.packetData, dst)
+}
+
+//sendNeighborSolicitation asks for the link layer address of target, either on its solicited node
+//group to resolve the address or directly to probe a cached address.
+func (l *Layer) sendNeighborSolicitation(dev netdev.Interface, target net.IP, unicast bool) {
+    src := selectSource(dev, target)
+    if src == nil {
+        log.Println("IPv6: No address on interface", dev.GetName(), "to solicit", target)
+        return
+    }
+    msg := make([]byte, 32)
+    msg[0] = ip.ICMPv6TypeNeighborSolicitation
+    copy(msg[8:24], target.To16())
+    putLinkLayerAddressOption(msg[24:], optSourceLinkLayerAddress, dev.GetHardwareAddress())
+    dst := target
+    if !unicast {
+        dst = SolicitedNodeMulticast(target)
+    }
+    l.sendICMP(dev, src, dst, ndHopLimit, msg)
+}
+
+func (l *Layer) sendNeighborAdvertisement(dev netdev.Interface, dst, target net.IP, solicited bool) {
+    msg := make([]byte, 32)
+    msg[0] = ip.ICMPv6TypeNeighborAdvertisement
+    msg[4] = flagOverride
+    if solicited {
+        msg[4] |= flagSolicited
+    }
+    copy(msg[8:24], target.To16())
+    putLinkLayerAddressOption(msg[24:], optTargetLinkLayerAddress, dev.GetHardwareAddress())
+    l.sendICMP(dev, target, dst, ndHopLimit, msg)
+}
+
+//sendDuplicateAddressProbe solicits the tentative address target from the unspecified address (RFC 4862 section 5.4.2).
+func (l *Layer) sendDuplicateAddressProbe(dev netdev.Interface, target net.IP) {
+    msg := make([]byte, 24)
+    msg[0] = ip.ICMPv6TypeNeighborSolicitation
+    copy(msg[8:24], target.To16())
+    l.sendICMP(dev, net.IPv6unspecified, SolicitedNodeMulticast(target), ndHopLimit, msg)
+}
+
+//sendRouterSolicitation asks the routers on the link to advertise themselves, the link layer
+//address is only included if the interface has a link local address (RFC 4861 section 4.1).
+func (l *Layer) sendRouterSolicitation(dev netdev.Interface) {
+    src := selectSource(dev, AllRoutersMulticast)
+    msg := make([]byte, 8, 16)
+    msg[0] = ip.ICMPv6TypeRouterSolicitation
+    if src == nil || !src.IsLinkLocalUnicast() {
+        src = net.IPv6unspecified
+    } else {
+        msg = msg[:16]
+        putLinkLayerAddressOption(msg[8:], optSourceLinkLayerAddress, dev.GetHardwareAddress())
+    }
+    l.sendICMP(dev, src, AllRoutersMulticast, ndHopLimit, msg)
+}
+
+//ndIn handles the neighbor discovery messages, it returns false if data is some other icmpv6 message.
+func (l *Layer) ndIn(dev netdev.Interface, hdr *Header, data []byte) bool {
+    if len(data) < 4 {
+        return false
+    }
+    switch data[0] {
+    case ip.ICMPv6TypeRouterSolicitation, ip.ICMPv6TypeRouterAdvertisement,
+        ip.ICMPv6TypeNeighborSolicitation, ip.ICMPv6TypeNeighborAdvertisement, ip.ICMPv6TypeRedirect:
+    default:
+        return false
+    }
+    if hdr.HopLimit != ndHopLimit || data[1] != 0 {
+        log.Println("IPv6: Invalid neighbor discovery message, dropping.")
+        return true
+    }
+    if PseudoHeaderChecksum(hdr.SourceIP, hdr.TargetIP, ip.IPPROTO_ICMPV6, data) != 0 {
+        log.Println("IPv6: Neighbor discovery message with invalid checksum, dropping.")
+        return true
+    }
+    switch data[0] {
+    case ip.ICMPv6TypeNeighborSolicitation:
+        l.neighborSolicitationIn(dev, hdr, data)
+    case ip.ICMPv6TypeNeighborAdvertisement:
+        l.neighborAdvertisementIn(dev, hdr, data)
+    case ip.ICMPv6TypeRouterAdvertisement:
+        l.routerAdvertisementIn(dev, hdr, data)
+    }
+    //Router solicitations are only handled by routers and redirects are not supported
+    return true
+}
+
+func (l *Layer) neighborSolicitationIn(dev netdev.Interface, hdr *Header, data []byte) {
+    if len(data) < 24 {
+        log.Println("IPv6: Neighbor solicitation too short, dropping.")
+        return
+    }
+    target := net.IP(data[8:24])
+    opts, ok := parseNDOptions(data[24:])
+    if !ok || target.IsMulticast() {
+        log.Println("IPv6: Invalid neighbor solicitation, dropping.")
+        return
+    }
+    slla := linkLayerAddressOption(opts, optSourceLinkLayerAddress)
+    dad := hdr.SourceIP.IsUnspecified()
+    if dad && (slla != nil || !hdr.TargetIP.Equal(SolicitedNodeMulticast(target))) {
+        log.Println("IPv6: Invalid duplicate address detection message, dropping.")
+        return
+    }
+    addr := findAddress(dev, target)
+    if addr == nil {
+        return
+    }
+    if addr.Tentative {
+        //Another node is probing the same address, a solicitation from a unicast source is ignored (RFC 4862 section 5.4.3)
+        if dad {
+            l.dadFailed(dev, target)
+        }
+        return
+    }
+    if dad {
+        //Someone wants to use our address, defend it
+        l.sendNeighborAdvertisement(dev, AllNodesMulticast, target, false)
+        return
+    }
+    if slla != nil {
+        l.neighborUpdate(dev, hdr.SourceIP, slla, false)
+    }
+    l.sendNeighborAdvertisement(dev, hdr.SourceIP, target, true)
+}
+
+func (l *Layer) neighborAdvertisementIn(dev netdev.Interface, hdr *Header, data []byte) {
+    if len(data) < 24 {
+        log.Println("IPv6: Neighbor advertisement too short, dropping.")
+        return
+    }
+    flags := data[4]
+    target := net.IP(data[8:24])
+    opts, ok := parseNDOptions(data[24:])
+    if !ok || target.IsMulticast() || (hdr.TargetIP.IsMulticast() && flags & flagSolicited != 0) {
+        log.Println("IPv6: Invalid neighbor advertisement, dropping.")
+        return
+    }
+    if addr := findAddress(dev, target); addr != nil {
+        if addr.Tentative {
+            l.dadFailed(dev, target)
+        } else {
+            log.Println("IPv6: Address", target, "is used by another node on", dev.GetName())
+        }
+        return
+    }
+    tlla := linkLayerAddressOption(opts, optTargetLinkLayerAddress)
+    l.neighborAdvertised(dev, target, tlla, flags & flagRouter != 0, flags & flagSolicited != 0, flags & flagOverride != 0)
+}
+
+//routerAdvertisementIn learns the default router, the on-link prefixes and the link parameters (RFC 4861 section 6.3.4)
+//and forms addresses from the autonomous prefixes.
+func (l *Layer) routerAdvertisementIn(dev netdev.Interface, hdr *Header, data []byte) {
+    if len(data) < 16 {
+        log.Println("IPv6: Router advertisement too short, dropping.")
+        return
+    }
+    opts, ok := parseNDOptions(data[16:])
+    if !ok || !hdr.SourceIP.IsLinkLocalUnicast() {
+        log.Println("IPv6: Invalid router advertisement, dropping.")
+        return
+    }
+    routerLifetime := time.Duration(binary.BigEndian.Uint16(data[6:8])) * time.Second
+    reachableTime := time.Duration(binary.BigEndian.Uint32(data[8:12])) * time.Millisecond
+    retransTimer := time.Duration(binary.BigEndian.Uint32(data[12:16])) * time.Millisecond
+
+    l.neighborsLock.Lock()
+    delete(l.solicitations, dev)
+    if reachableTime != 0 && reachableTime != l.baseReachableTime {
+        l.setReachableTime(reachableTime)
+    }
+    if retransTimer != 0 {
+        l.retransTimer = retransTimer
+    }
+    l.neighborsLock.Unlock()
+
+    router := make(net.IP, 16)
+    copy(router, hdr.SourceIP)
+    l.neighborUpdate(dev, router, linkLayerAddressOption(opts, optSourceLinkLayerAddress), true)
+
+    defaultRoute := net.IPNet{ IP: net.IPv6unspecified, Mask: net.CIDRMask(0, 128) }
+    if routerLifetime == 0 {
+        l.routeDelete(defaultRoute, router, dev)
+    } else {
+        l.routeRefresh(defaultRoute, router, dev, routerLifetime)
+    }
+
+    for _, o := range opts {
+        if o[0] != optPrefixInformation || len(o) != 32 {
+            continue
+        }
+        prefixLength := int(o[2])
+        prefix := net.IP(o[16:32])
+        valid := binary.BigEndian.Uint32(o[4:8])
+        preferred := binary.BigEndian.Uint32(o[8:12])
+        if prefixLength > 128 || prefix.IsLinkLocalUnicast() {
+            continue
+        }
+        if o[3] & flagAutonomous != 0 {
+            l.autoconfPrefix(dev, prefix, prefixLength, valid, preferred)
+        }
+        if o[3] & flagOnLink == 0 {
+            continue
+        }
+        onLink := net.IPNet{ IP: prefix, Mask: net.CIDRMask(prefixLength, 128) }
+        switch valid {
+        case 0:
+            l.routeDelete(onLink, nil, dev)
+        case infiniteLifetime:
+            l.routeRefresh(onLink, nil, dev, 0)
+        default:
+            l.routeRefresh(onLink, nil, dev, time.Duration(valid) * time.Second)
+        }
+    }
+}
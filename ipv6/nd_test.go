@@ -0,0 +1,94 @@
+package ipv6
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+	"github.com/arcpop/network/config"
+	"github.com/arcpop/network/netdev"
+)
+
+//newPipeLayers joins two layers with a pipe, the ends are named a and b.
+func newPipeLayers(t *testing.T) (*Layer, *Layer, netdev.Interface, netdev.Interface) {
+    a, b, err := netdev.OpenPipe(netdev.PipeConfig{ Name: "a" }, netdev.PipeConfig{ Name: "b" })
+    if err != nil {
+        t.Fatal(err)
+    }
+    return newPipeLayer(t, a), newPipeLayer(t, b), a, b
+}
+
+//waitUntil polls cond until it is true or timeout passed.
+func waitUntil(cond func() bool, timeout time.Duration) bool {
+    deadline := time.Now().Add(timeout)
+    for !cond() {
+        if time.Now().After(deadline) {
+            return false
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    return true
+}
+
+func TestDuplicateAddressDetection(t *testing.T) {
+    transmits := config.IPv6.DupAddrDetectTransmits
+    defer func() {
+        config.IPv6.DupAddrDetectTransmits = transmits
+    }()
+    la, lb, a, _ := newPipeLayers(t)
+    unique, duplicate := net.ParseIP("fd00::1"), net.ParseIP("fd00::2")
+    config.IPv6.DupAddrDetectTransmits = 0
+    if err := lb.ConfigureInterfaceAddress("b", net.IPNet{ IP: duplicate, Mask: net.CIDRMask(64, 128) }); err != nil {
+        t.Fatal(err)
+    }
+    config.IPv6.DupAddrDetectTransmits = 1
+    for _, addr := range []net.IP{ unique, duplicate } {
+        if err := la.ConfigureInterfaceAddress("a", net.IPNet{ IP: addr, Mask: net.CIDRMask(64, 128) }); err != nil {
+            t.Fatal(err)
+        }
+        if got := findAddress(a, addr); got == nil || !got.Tentative {
+            t.Fatalf("address %v is %+v, want tentative", addr, got)
+        }
+    }
+    //The peer defends the duplicate address, the unique one is usable after the retransmission timer
+    done := waitUntil(func() bool {
+        u := findAddress(a, unique)
+        return u != nil && !u.Tentative && findAddress(a, duplicate) == nil
+    }, 3 * RetransTimer)
+    if !done {
+        t.Fatalf("addresses after duplicate address detection: %+v", a.GetIPv6Addresses())
+    }
+    if src := selectSource(a, duplicate); !src.Equal(unique) {
+        t.Errorf("source address %v, want %v", src, unique)
+    }
+}
+
+func TestNeighborDiscovery(t *testing.T) {
+    withoutDAD(t)
+    la, lb, a, b := newPipeLayers(t)
+    addrA, addrB := net.ParseIP("fd00::1"), net.ParseIP("fd00::2")
+    if err := la.ConfigureInterfaceAddress("a", net.IPNet{ IP: addrA, Mask: net.CIDRMask(64, 128) }); err != nil {
+        t.Fatal(err)
+    }
+    if err := lb.ConfigureInterfaceAddress("b", net.IPNet{ IP: addrB, Mask: net.CIDRMask(64, 128) }); err != nil {
+        t.Fatal(err)
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), 2 * time.Second)
+    defer cancel()
+    //The echo request waits for the address resolution of the peer
+    r, err := la.Ping(ctx, addrB, 56, 0x4242, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !r.Source.Equal(addrB) || r.ID != 0x4242 || r.Seq != 1 {
+        t.Errorf("reply %+v", r)
+    }
+    //The solicited advertisement makes the peer reachable, the peer learned the solicitor from the source link layer address
+    if entry := addrB.String() + " - " + b.GetHardwareAddress().String() + " - REACHABLE"; !strings.Contains(la.GetNeighborsAsString(), entry) {
+        t.Errorf("neighbor cache lacks %q:\n%s", entry, la.GetNeighborsAsString())
+    }
+    if entry := addrA.String() + " - " + a.GetHardwareAddress().String() + " - "; !strings.Contains(lb.GetNeighborsAsString(), entry) {
+        t.Errorf("neighbor cache of the peer lacks %q:\n%s", entry, lb.GetNeighborsAsString())
+    }
+}
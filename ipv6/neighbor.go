@@ -0,0 +1,382 @@
+package ipv6
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"log"
+	"math/rand"
+	"net"
+	"time"
+	"github.com/arcpop/network/netdev"
+)
+
+//Neighbor cache states (RFC 4861 section 7.3.2), permanent entries are added manually and never expire.
+const (
+    stateIncomplete = iota
+    stateReachable = iota
+    stateStale = iota
+    stateDelay = iota
+    stateProbe = iota
+    statePermanent = iota
+)
+
+var stateNames = []string{"INCOMPLETE", "REACHABLE", "STALE", "DELAY", "PROBE", "PERMANENT"}
+
+//neighborQueueSize is the number of packets queued on an entry while its address is resolved.
+const neighborQueueSize = 64
+
+//ndTick is the granularity of the neighbor discovery timers.
+const ndTick = 100 * time.Millisecond
+
+type neighborEntry struct {
+    mac net.HardwareAddr
+    dev netdev.Interface
+    state int
+    isRouter bool
+    //timer is the time the current state expires, it is zero for states without timeout
+    timer time.Time
+    probes int
+    queuedPackets chan []byte
+}
+
+type routerSolicitation struct {
+    next time.Time
+    sent int
+}
+
+func neighborKey(addr net.IP) [16]byte {
+    var k [16]byte
+    copy(k[:], addr.To16())
+    return k
+}
+
+func AddNeighbor(addr net.IP, mac net.HardwareAddr, dev netdev.Interface) {
+    Default.AddNeighbor(addr, mac, dev)
+}
+
+//AddNeighbor adds a permanent entry mapping addr on dev to the link layer address mac.
+func (l *Layer) AddNeighbor(addr net.IP, mac net.HardwareAddr, dev netdev.Interface) {
+    e := &neighborEntry{ mac: make(net.HardwareAddr, 6), dev: dev, state: statePermanent }
+    copy(e.mac, mac)
+    l.neighborsLock.Lock()
+    old := l.neighbors[neighborKey(addr)]
+    l.neighbors[neighborKey(addr)] = e
+    l.neighborsLock.Unlock()
+    if old != nil && old.queuedPackets != nil {
+        sendQueuedPackets(old.queuedPackets, e)
+    }
+}
+
+func DeleteNeighbor(addr net.IP) {
+    Default.DeleteNeighbor(addr)
+}
+
+func (l *Layer) DeleteNeighbor(addr net.IP) {
+    l.neighborsLock.Lock()
+    delete(l.neighbors, neighborKey(addr))
+    l.neighborsLock.Unlock()
+}
+
+func GetNeighborsAsString() string {
+    return Default.GetNeighborsAsString()
+}
+
+func (l *Layer) GetNeighborsAsString() string {
+    res := "IP - MAC - State - Interface\n"
+    l.neighborsLock.RLock()
+    defer l.neighborsLock.RUnlock()
+    for k, e := range l.neighbors {
+        res += net.IP(k[:]).String() + " - " + e.mac.String() + " - " + stateNames[e.state] + " - " + e.dev.GetName()
+        if e.isRouter {
+            res += " router"
+        }
+        res += "\n"
+    }
+    return res
+}
+
+func SolicitRouters(dev netdev.Interface) {
+    Default.SolicitRouters(dev)
+}
+
+//SolicitRouters sends router solicitations on dev until a router advertisement
+//is received or MaxRtrSolicitations were sent (RFC 4861 section 6.3.7).
+func (l *Layer) SolicitRouters(dev netdev.Interface) {
+    delay := time.Duration(rand.Int63n(int64(MaxRtrSolicitationDelay)))
+    l.neighborsLock.Lock()
+    l.solicitations[dev] = &routerSolicitation{ next: time.Now().Add(delay) }
+    l.neighborsLock.Unlock()
+}
+
+//setReachableTime sets the base reachable time and draws a new random reachable time from it (RFC 4861 section 6.3.2).
+//The caller has to hold neighborsLock.
+func (l *Layer) setReachableTime(base time.Duration) {
+    l.baseReachableTime = base
+    l.reachableTime = time.Duration(float64(base) * (MinRandomFactor + rand.Float64() * (MaxRandomFactor - MinRandomFactor)))
+}
+
+//transmit fills in the ethernet header for nextHop and hands the frame to dev.
+//If the link layer address of nextHop is unknown, the packet is queued and address resolution is started.
+func (l *Layer) transmit(dev netdev.Interface, pkt []byte, nextHop net.IP) {
+    if nextHop.IsMulticast() {
+        output(dev, pkt, MulticastMAC(nextHop))
+        return
+    }
+    key := neighborKey(nextHop)
+    l.neighborsLock.Lock()
+    e, ok := l.neighbors[key]
+    if !ok {
+        e = &neighborEntry{
+            dev: dev,
+            state: stateIncomplete,
+            timer: time.Now().Add(l.retransTimer),
+            probes: 1,
+            queuedPackets: make(chan []byte, neighborQueueSize),
+        }
+        e.queuedPackets <- pkt
+        l.neighbors[key] = e
+        l.neighborsLock.Unlock()
+        l.sendNeighborSolicitation(dev, nextHop, false)
+        return
+    }
+    switch e.state {
+    case stateIncomplete:
+        select {
+            case e.queuedPackets <- pkt:
+            default:
+                log.Println("IPv6: Neighbor queue full, dropping packet.")
+        }
+        l.neighborsLock.Unlock()
+        return
+    case stateStale:
+        //Give upper layers the chance to confirm reachability before probing (RFC 4861 section 7.3.3)
+        e.state = stateDelay
+        e.timer = time.Now().Add(DelayFirstProbeTime)
+    }
+    mac, edev := e.mac, e.dev
+    l.neighborsLock.Unlock()
+    output(edev, pkt, mac)
+}
+
+func output(dev netdev.Interface, pkt []byte, mac net.HardwareAddr) {
+    copy(pkt[0:6], mac)
+    copy(pkt[6:12], dev.GetHardwareAddress())
+    binary.BigEndian.PutUint16(pkt[12:14], 0x86DD)
+    dev.TxPacket(pkt)
+}
+
+//sendQueuedPackets sends the packets queued while resolving the address to the resolved entry.
+func sendQueuedPackets(queue chan []byte, resolved *neighborEntry) {
+    for {
+        select {
+            case pkt := <- queue:
+                output(resolved.dev, pkt, resolved.mac)
+            default:
+                return
+        }
+    }
+}
+
+//neighborUpdate records the link layer address received in a solicitation or router advertisement (RFC 4861 section 7.2.3).
+//If mac is nil only the router flag of an existing entry is updated.
+func (l *Layer) neighborUpdate(dev netdev.Interface, addr net.IP, mac net.HardwareAddr, isRouter bool) {
+    key := neighborKey(addr)
+    var queue chan []byte
+    l.neighborsLock.Lock()
+    e, ok := l.neighbors[key]
+    if !ok {
+        if mac == nil {
+            l.neighborsLock.Unlock()
+            return
+        }
+        e = &neighborEntry{ dev: dev, state: stateStale, mac: make(net.HardwareAddr, 6) }
+        copy(e.mac, mac)
+        l.neighbors[key] = e
+    } else if mac != nil && e.state != statePermanent && (e.state == stateIncomplete || !bytes.Equal(mac, e.mac)) {
+        e.mac = make(net.HardwareAddr, 6)
+        copy(e.mac, mac)
+        e.dev = dev
+        e.state = stateStale
+        e.timer = time.Time{}
+        queue, e.queuedPackets = e.queuedPackets, nil
+    }
+    if isRouter {
+        e.isRouter = true
+    }
+    resolved := *e
+    l.neighborsLock.Unlock()
+    if queue != nil {
+        sendQueuedPackets(queue, &resolved)
+    }
+}
+
+//neighborAdvertised updates the entry of target from a received neighbor advertisement (RFC 4861 section 7.2.5).
+func (l *Layer) neighborAdvertised(dev netdev.Interface, target net.IP, mac net.HardwareAddr, router, solicited, override bool) {
+    key := neighborKey(target)
+    var queue chan []byte
+    l.neighborsLock.Lock()
+    e, ok := l.neighbors[key]
+    if !ok || e.state == statePermanent {
+        l.neighborsLock.Unlock()
+        return
+    }
+    if e.state == stateIncomplete {
+        if mac == nil {
+            l.neighborsLock.Unlock()
+            return
+        }
+        e.mac = make(net.HardwareAddr, 6)
+        copy(e.mac, mac)
+        e.dev = dev
+        queue, e.queuedPackets = e.queuedPackets, nil
+        if solicited {
+            e.state = stateReachable
+            e.timer = time.Now().Add(l.reachableTime)
+        } else {
+            e.state = stateStale
+            e.timer = time.Time{}
+        }
+    } else {
+        changed := mac != nil && !bytes.Equal(mac, e.mac)
+        if changed && !override {
+            //Keep the known address but stop trusting it
+            if e.state == stateReachable {
+                e.state = stateStale
+                e.timer = time.Time{}
+            }
+            l.neighborsLock.Unlock()
+            return
+        }
+        if changed {
+            e.mac = make(net.HardwareAddr, 6)
+            copy(e.mac, mac)
+            e.dev = dev
+        }
+        if solicited {
+            e.state = stateReachable
+            e.timer = time.Now().Add(l.reachableTime)
+        } else if changed {
+            e.state = stateStale
+            e.timer = time.Time{}
+        }
+    }
+    wasRouter := e.isRouter
+    e.isRouter = router
+    resolved := *e
+    l.neighborsLock.Unlock()
+
+    if queue != nil {
+        sendQueuedPackets(queue, &resolved)
+    }
+    if wasRouter && !router {
+        //The neighbor stopped being a router, it must not be used as default router anymore (RFC 4861 section 7.2.5)
+        l.routeDelete(net.IPNet{ IP: net.IPv6unspecified, Mask: net.CIDRMask(0, 128) }, target, dev)
+    }
+}
+
+//ndTicker runs the timers of the neighbor cache, the router solicitations, the duplicate address
+//detections and the lifetimes of learned routes and addresses.
+func (l *Layer) ndTicker(ctx context.Context) {
+    defer l.workers.Done()
+    tckr := time.NewTicker(ndTick)
+    defer tckr.Stop()
+    for {
+        select {
+            case <- ctx.Done():
+                return
+            case now := <- tckr.C:
+                l.ndTimeout(now)
+                l.routeExpire(now)
+                l.addressExpire(now)
+        }
+    }
+}
+
+func (l *Layer) ndTimeout(now time.Time) {
+    type solicitation struct {
+        dev netdev.Interface
+        target net.IP
+        unicast bool
+    }
+    var solicitations []solicitation
+    var routerSolicitations []netdev.Interface
+    var dadProbes, dadCompleted []*dadState
+    dropped := 0
+
+    l.neighborsLock.Lock()
+    for k, e := range l.neighbors {
+        if e.timer.IsZero() || now.Before(e.timer) {
+            continue
+        }
+        target := net.IP(append([]byte(nil), k[:]...))
+        switch e.state {
+        case stateIncomplete:
+            if e.probes >= MaxMulticastSolicit {
+                dropped += len(e.queuedPackets)
+                delete(l.neighbors, k)
+                continue
+            }
+            e.probes++
+            e.timer = now.Add(l.retransTimer)
+            solicitations = append(solicitations, solicitation{ e.dev, target, false })
+        case stateReachable:
+            e.state = stateStale
+            e.timer = time.Time{}
+        case stateDelay:
+            e.state = stateProbe
+            e.probes = 1
+            e.timer = now.Add(l.retransTimer)
+            solicitations = append(solicitations, solicitation{ e.dev, target, true })
+        case stateProbe:
+            if e.probes >= MaxUnicastSolicit {
+                delete(l.neighbors, k)
+                continue
+            }
+            e.probes++
+            e.timer = now.Add(l.retransTimer)
+            solicitations = append(solicitations, solicitation{ e.dev, target, true })
+        }
+    }
+    for dev, rs := range l.solicitations {
+        if now.Before(rs.next) {
+            continue
+        }
+        routerSolicitations = append(routerSolicitations, dev)
+        rs.sent++
+        rs.next = now.Add(RtrSolicitationInterval)
+        if rs.sent >= MaxRtrSolicitations {
+            delete(l.solicitations, dev)
+        }
+    }
+    for k, d := range l.dads {
+        if now.Before(d.timer) {
+            continue
+        }
+        if d.remaining == 0 {
+            delete(l.dads, k)
+            dadCompleted = append(dadCompleted, d)
+            continue
+        }
+        d.remaining--
+        d.timer = now.Add(l.retransTimer)
+        dadProbes = append(dadProbes, d)
+    }
+    l.neighborsLock.Unlock()
+
+    if dropped > 0 {
+        log.Println("IPv6: Dropped ", dropped, " packets due to not resolving the neighbor address.")
+    }
+    for _, s := range solicitations {
+        l.sendNeighborSolicitation(s.dev, s.target, s.unicast)
+    }
+    for _, dev := range routerSolicitations {
+        l.sendRouterSolicitation(dev)
+    }
+    for _, d := range dadProbes {
+        l.sendDuplicateAddressProbe(d.dev, d.addr.IP)
+    }
+    for _, d := range dadCompleted {
+        l.dadComplete(d)
+    }
+}
@@ -0,0 +1,141 @@
+package ipv6
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+	"github.com/arcpop/network/config"
+	"github.com/arcpop/network/ip"
+)
+
+const (
+    //MaxPingSize is the largest echo payload fitting into the payload length of an ipv6 packet
+    MaxPingSize = 0xFFFF - 8
+)
+
+var (
+    ErrInvalidPingSize = errors.New("Invalid ping payload size!")
+    ErrPingInProgress = errors.New("A ping with that identifier and sequence number is already in progress!")
+)
+
+//PingReply describes a received echo reply.
+type PingReply struct {
+    Source net.IP
+    //Size is the length of the icmp message including the 8 byte echo header
+    Size int
+    ID, Seq uint16
+    HopLimit byte
+    RTT time.Duration
+}
+
+type pingKey struct {
+    id, seq uint16
+}
+
+type pendingPing struct {
+    dst net.IP
+    start time.Time
+    reply chan *PingReply
+}
+
+//Ping sends an echo request through the default layer.
+func Ping(ctx context.Context, dst net.IP, size int, id, seq uint16) (*PingReply, error) {
+    return Default.Ping(ctx, dst, size, id, seq)
+}
+
+//Ping sends an echo request with size bytes of payload to dst and waits for the matching
+//echo reply until ctx is done, in which case the error of ctx is returned.
+func (l *Layer) Ping(ctx context.Context, dst net.IP, size int, id, seq uint16) (*PingReply, error) {
+    if dst.To16() == nil || dst.To4() != nil {
+        return nil, ErrPacketNotRoutable
+    }
+    if size < 0 || size > MaxPingSize {
+        return nil, ErrInvalidPingSize
+    }
+    key := pingKey{ id: id, seq: seq }
+    p := &pendingPing{ dst: dst.To16(), start: time.Now(), reply: make(chan *PingReply, 1) }
+    l.pingsLock.Lock()
+    _, ok := l.pings[key]
+    if ok {
+        l.pingsLock.Unlock()
+        return nil, ErrPingInProgress
+    }
+    l.pings[key] = p
+    l.pingsLock.Unlock()
+    defer func() {
+        l.pingsLock.Lock()
+        delete(l.pings, key)
+        l.pingsLock.Unlock()
+    }()
+
+    data := make([]byte, 4 + size)
+    binary.BigEndian.PutUint16(data[0:2], id)
+    binary.BigEndian.PutUint16(data[2:4], seq)
+    for i := 4; i < len(data); i++ {
+        data[i] = byte(i)
+    }
+    hdr := &Header{
+        TargetIP: dst.To16(),
+        HopLimit: byte(config.IPv6.DefaultHopLimit),
+    }
+    err := l.SendICMPPacket(ip.ICMPv6TypeEchoRequest, ip.ICMPv6CodeEchoRequest, hdr, data)
+    if err != nil {
+        return nil, err
+    }
+    select {
+        case r := <- p.reply:
+            return r, nil
+        case <- ctx.Done():
+            return nil, ctx.Err()
+    }
+}
+
+//pingPending returns true if data starts an echo request to dst which is still waiting for its reply.
+func (l *Layer) pingPending(dst net.IP, data []byte) bool {
+    if len(data) < 8 || data[0] != ip.ICMPv6TypeEchoRequest {
+        return false
+    }
+    key := pingKey{
+        id: binary.BigEndian.Uint16(data[4:6]),
+        seq: binary.BigEndian.Uint16(data[6:8]),
+    }
+    l.pingsLock.Lock()
+    defer l.pingsLock.Unlock()
+    p, ok := l.pings[key]
+    return ok && p.dst.Equal(dst)
+}
+
+//echoReply hands a received echo reply to the waiting Ping call.
+func (l *Layer) echoReply(header *Header, icmpPkt *ICMPPacket) {
+    received := time.Now()
+    if len(icmpPkt.Data) < 4 {
+        return
+    }
+    key := pingKey{
+        id: binary.BigEndian.Uint16(icmpPkt.Data[0:2]),
+        seq: binary.BigEndian.Uint16(icmpPkt.Data[2:4]),
+    }
+    l.pingsLock.Lock()
+    defer l.pingsLock.Unlock()
+    p, ok := l.pings[key]
+    //Replies to multicast requests come from the unicast addresses of the members
+    if !ok || (!p.dst.IsMulticast() && !p.dst.Equal(header.SourceIP)) {
+        return
+    }
+    r := &PingReply{
+        Source: make(net.IP, 16),
+        Size: len(icmpPkt.Data) + 4,
+        ID: key.id,
+        Seq: key.seq,
+        HopLimit: header.HopLimit,
+        RTT: received.Sub(p.start),
+    }
+    copy(r.Source, header.SourceIP)
+    select {
+        case p.reply <- r:
+        default:
+            //Duplicate reply
+    }
+}
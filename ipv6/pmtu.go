@@ -0,0 +1,91 @@
+package ipv6
+
+import (
+	"context"
+	"net"
+	"time"
+	"github.com/arcpop/network/config"
+)
+
+type pathMTUEntry struct {
+    mtu int
+    expires time.Time
+}
+
+func PathMTU(dst net.IP) (int, error) {
+    return Default.PathMTU(dst)
+}
+
+//PathMTU returns the largest packet which can be sent to dst without being fragmented, it is the mtu
+//learned from packet too big messages or the mtu of the interface towards dst.
+func (l *Layer) PathMTU(dst net.IP) (int, error) {
+    entry, err := l.RoutingGetRoute(dst)
+    if err != nil {
+        return 0, err
+    }
+    return l.pathMTU(dst, entry.Iface.GetMTU()), nil
+}
+
+//pathMTU returns the learned mtu of the path to dst if it is smaller than mtu, the mtu of the first hop.
+func (l *Layer) pathMTU(dst net.IP, mtu int) int {
+    var key [16]byte
+    copy(key[:], dst.To16())
+    l.pathMTULock.Lock()
+    defer l.pathMTULock.Unlock()
+    e, ok := l.pathMTUs[key]
+    if !ok {
+        return mtu
+    }
+    if time.Now().After(e.expires) {
+        delete(l.pathMTUs, key)
+        return mtu
+    }
+    if e.mtu < mtu {
+        return e.mtu
+    }
+    return mtu
+}
+
+func UpdatePathMTU(dst net.IP, mtu int) {
+    Default.UpdatePathMTU(dst, mtu)
+}
+
+//UpdatePathMTU handles a packet too big message for a packet sent to dst (RFC 8201 section 4). The mtu is never
+//reduced below MinMTU and only ever shrinks until it expires. The layer does not trust the message itself,
+//the protocol which sent the packet calls this once it checked that the packet belongs to one of its flows.
+func (l *Layer) UpdatePathMTU(dst net.IP, mtu int) {
+    if mtu < MinMTU {
+        mtu = MinMTU
+    }
+    var key [16]byte
+    copy(key[:], dst.To16())
+    now := time.Now()
+    l.pathMTULock.Lock()
+    defer l.pathMTULock.Unlock()
+    e, ok := l.pathMTUs[key]
+    if ok && now.Before(e.expires) && e.mtu <= mtu {
+        return
+    }
+    l.pathMTUs[key] = &pathMTUEntry{ mtu: mtu, expires: now.Add(config.IPv6.PathMTUTimeout) }
+}
+
+//pathMTUWorker removes expired path mtus, the paths are then tried with the mtu of the interface again (RFC 8201 section 4).
+func (l *Layer) pathMTUWorker(ctx context.Context) {
+    defer l.workers.Done()
+    ticker := time.NewTicker(time.Minute)
+    defer ticker.Stop()
+    for {
+        select {
+        case <- ctx.Done():
+            return
+        case now := <- ticker.C:
+            l.pathMTULock.Lock()
+            for k, e := range l.pathMTUs {
+                if now.After(e.expires) {
+                    delete(l.pathMTUs, k)
+                }
+            }
+            l.pathMTULock.Unlock()
+        }
+    }
+}
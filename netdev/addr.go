@@ -0,0 +1,198 @@
+package netdev
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//IPv4Address is one of the ipv4 addresses of an interface.
+type IPv4Address struct {
+    IP net.IP
+    PrefixLength int
+    //Secondary is set for addresses added while another address of the same subnet existed, like on linux
+    //the primary address is preferred as source and the oldest secondary is promoted once it is removed.
+    Secondary bool
+}
+
+//Mask returns the netmask of the subnet of the address.
+func (a *IPv4Address) Mask() net.IPMask {
+    return net.CIDRMask(a.PrefixLength, 32)
+}
+
+//Contains returns true if ip is in the subnet of the address.
+func (a *IPv4Address) Contains(ip net.IP) bool {
+    return (&net.IPNet{ IP: a.IP, Mask: a.Mask() }).Contains(ip)
+}
+
+//Broadcast returns the directed broadcast address of the subnet of the address.
+func (a *IPv4Address) Broadcast() net.IP {
+    ip := a.IP.To4()
+    mask := a.Mask()
+    bcast := make(net.IP, 4)
+    for i := range bcast {
+        bcast[i] = ip[i] | ^mask[i]
+    }
+    return bcast
+}
+
+func (a *IPv4Address) sameSubnet(b *IPv4Address) bool {
+    return a.PrefixLength == b.PrefixLength && a.Contains(b.IP)
+}
+
+//IPv6Address is one of the ipv6 addresses of an interface.
+type IPv6Address struct {
+    IP net.IP
+    PrefixLength int
+    //Tentative is set while duplicate address detection runs, the address must not be used until it is cleared
+    Tentative bool
+    //Autoconfigured addresses were formed by stateless address autoconfiguration (RFC 4862)
+    Autoconfigured bool
+    //ValidUntil and PreferredUntil end the lifetimes of the address, zero values never expire.
+    ValidUntil time.Time
+    PreferredUntil time.Time
+}
+
+//Deprecated returns true if the preferred lifetime ended, the address should only be used by existing communication.
+func (a *IPv6Address) Deprecated(now time.Time) bool {
+    return !a.PreferredUntil.IsZero() && !now.Before(a.PreferredUntil)
+}
+
+//addresses holds the layer 3 configuration shared by all ethernet like devices.
+type addresses struct {
+    ipv4Lock sync.RWMutex
+    ipv4 []IPv4Address
+
+    ipv6Lock sync.RWMutex
+    ipv6 []IPv6Address
+}
+
+func (a *addresses) GetIPv4Addresses() []IPv4Address {
+    a.ipv4Lock.RLock()
+    defer a.ipv4Lock.RUnlock()
+    res := make([]IPv4Address, len(a.ipv4))
+    copy(res, a.ipv4)
+    return res
+}
+
+//AddIPv4Address adds the address, it becomes a secondary address if the interface already has one in the same subnet.
+func (a *addresses) AddIPv4Address(addr IPv4Address) {
+    ip := make(net.IP, 4)
+    copy(ip, addr.IP.To4())
+    addr.IP = ip
+    a.ipv4Lock.Lock()
+    defer a.ipv4Lock.Unlock()
+    a.ipv4 = removeIPv4Address(a.ipv4, ip)
+    addr.Secondary = false
+    for i := range a.ipv4 {
+        if a.ipv4[i].sameSubnet(&addr) {
+            addr.Secondary = true
+            break
+        }
+    }
+    a.ipv4 = append(a.ipv4, addr)
+}
+
+func (a *addresses) RemoveIPv4Address(ip net.IP) {
+    a.ipv4Lock.Lock()
+    defer a.ipv4Lock.Unlock()
+    a.ipv4 = removeIPv4Address(a.ipv4, ip)
+}
+
+//removeIPv4Address removes ip from addrs, the oldest secondary address of its subnet is promoted if ip was primary.
+func removeIPv4Address(addrs []IPv4Address, ip net.IP) []IPv4Address {
+    for i := range addrs {
+        if !addrs[i].IP.Equal(ip) {
+            continue
+        }
+        removed := addrs[i]
+        addrs = append(addrs[:i], addrs[i + 1:]...)
+        if !removed.Secondary {
+            for j := range addrs {
+                if addrs[j].sameSubnet(&removed) {
+                    addrs[j].Secondary = false
+                    break
+                }
+            }
+        }
+        return addrs
+    }
+    return addrs
+}
+
+//HasIPv4Address returns true if ip is one of the addresses of iface.
+func HasIPv4Address(iface Interface, ip net.IP) bool {
+    for _, a := range iface.GetIPv4Addresses() {
+        if a.IP.Equal(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+//IPv4SourceAddress returns the address iface uses to reach nextHop, the primary address of the subnet of
+//nextHop if there is one and the first primary address otherwise. An interface without addresses uses
+//0.0.0.0 like a host which is not configured yet (RFC 1122 section 3.2.1.3).
+func IPv4SourceAddress(iface Interface, nextHop net.IP) net.IP {
+    var best net.IP
+    for _, a := range iface.GetIPv4Addresses() {
+        if a.Secondary {
+            continue
+        }
+        if a.Contains(nextHop) {
+            return a.IP
+        }
+        if best == nil {
+            best = a.IP
+        }
+    }
+    if best == nil {
+        return net.IPv4zero.To4()
+    }
+    return best
+}
+
+func (a *addresses) GetIPv6Addresses() []IPv6Address {
+    a.ipv6Lock.RLock()
+    defer a.ipv6Lock.RUnlock()
+    res := make([]IPv6Address, len(a.ipv6))
+    copy(res, a.ipv6)
+    return res
+}
+
+func (a *addresses) AddIPv6Address(addr IPv6Address) {
+    ip := make(net.IP, 16)
+    copy(ip, addr.IP.To16())
+    addr.IP = ip
+    a.ipv6Lock.Lock()
+    defer a.ipv6Lock.Unlock()
+    for i := range a.ipv6 {
+        if a.ipv6[i].IP.Equal(ip) {
+            a.ipv6[i] = addr
+            return
+        }
+    }
+    a.ipv6 = append(a.ipv6, addr)
+}
+
+func (a *addresses) RemoveIPv6Address(ip net.IP) {
+    a.ipv6Lock.Lock()
+    defer a.ipv6Lock.Unlock()
+    for i := range a.ipv6 {
+        if a.ipv6[i].IP.Equal(ip) {
+            a.ipv6 = append(a.ipv6[:i], a.ipv6[i + 1:]...)
+            return
+        }
+    }
+}
+
+//GetTxStats returns a snapshot of the transmit counters.
+func (s *InterfaceStats) GetTxStats() (pkts uint64, bytes uint64, errors uint64) {
+    return atomic.LoadUint64(&s.TxPackets), atomic.LoadUint64(&s.TxBytes), atomic.LoadUint64(&s.TxErrors)
+}
+
+//GetRxStats returns a snapshot of the receive counters.
+func (s *InterfaceStats) GetRxStats() (pkts uint64, bytes uint64, errors uint64) {
+    return atomic.LoadUint64(&s.RxPackets), atomic.LoadUint64(&s.RxBytes), atomic.LoadUint64(&s.RxErrors)
+}
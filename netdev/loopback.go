@@ -1,12 +1,16 @@
 package netdev
 
 import (
+	"sync"
 	"sync/atomic"
     "net"
 )
 
 type loopback struct {
     name string
+    queue chan []byte
+    closedLock sync.RWMutex
+    closed bool
     TxPackets, TxBytes, TxErrors uint64
     RxPackets, RxBytes, RxErrors uint64
 }
@@ -19,27 +23,27 @@ func (*loopback)GetMTU() int {
     return 65535 
 }
 
-func (*loopback)GetIPv4Address() net.IP { 
-    return net.IP{127, 0, 0, 1} 
+func (*loopback)GetIPv4Addresses() []IPv4Address { 
+    return []IPv4Address{ { IP: net.IP{127, 0, 0, 1}, PrefixLength: 8 } } 
 }
 
-func (*loopback)GetIPv4Netmask() net.IP { 
-    return net.IP{255, 0, 0, 0} 
+func (*loopback)AddIPv4Address(addr IPv4Address) { 
+    return 
 }
 
-func (*loopback)SetIPv4Address(ip, netmask net.IP) { 
+func (*loopback)RemoveIPv4Address(ip net.IP) { 
     return 
 }
 
-func (*loopback)GetIPv6Address() net.IP { 
-    return net.IP{0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,1} 
+func (*loopback)GetIPv6Addresses() []IPv6Address { 
+    return []IPv6Address{ { IP: net.IP{0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,1}, PrefixLength: 128 } } 
 }
 
-func (*loopback)GetIPv6Netmask() int { 
-    return 128 
+func (*loopback)AddIPv6Address(addr IPv6Address) { 
+    return 
 }
 
-func (*loopback)SetIPv6Address(ip net.IP, netmask int) { 
+func (*loopback)RemoveIPv6Address(ip net.IP) { 
     return 
 }
 
@@ -53,10 +57,16 @@ func (l *loopback)GetRxStats() (pkts uint64, bytes uint64, errors uint64) {
     return l.RxPackets, l.RxBytes, l.RxErrors
 }
 
-var loopbackQueue = make(chan []byte, 1024)
+//OpenLoopback creates a loopback device which is not registered in any list.
+func OpenLoopback(name string) Interface {
+    return &loopback{ name: name, queue: make(chan []byte, 1024), }
+}
 
 func (l *loopback) RxPacket() []byte {
-    pkt := <- loopbackQueue
+    pkt, ok := <- l.queue
+    if !ok {
+        return nil
+    }
     atomic.AddUint64(&l.RxBytes, uint64(len(pkt)))
     atomic.AddUint64(&l.RxPackets, 1)
     return pkt
@@ -64,8 +74,14 @@ func (l *loopback) RxPacket() []byte {
 
 func (l *loopback) TxPacket(pkt []byte) {
     s := uint64(len(pkt))
+    l.closedLock.RLock()
+    defer l.closedLock.RUnlock()
+    if l.closed {
+        atomic.AddUint64(&l.TxErrors, 1)
+        return
+    }
     select {
-        case loopbackQueue <- pkt:
+        case l.queue <- pkt:
             atomic.AddUint64(&l.TxBytes, s)
             atomic.AddUint64(&l.TxPackets, 1)
         default:
@@ -74,5 +90,10 @@ func (l *loopback) TxPacket(pkt []byte) {
 }
 
 func (l* loopback) Close()  {
-    return
+    l.closedLock.Lock()
+    if !l.closed {
+        l.closed = true
+        close(l.queue)
+    }
+    l.closedLock.Unlock()
 }
\ No newline at end of file
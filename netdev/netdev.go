@@ -5,11 +5,12 @@ import (
 	"sync"
 	"errors"
 	"strconv"
-	"github.com/arcpop/network/util"
-	"bytes"
+	"time"
+	"math/rand"
 )
 
 type Interface interface {
+    //RxPacket blocks until a frame is received, it returns nil once the interface is closed.
     RxPacket() []byte
     TxPacket(pkt []byte)
     
@@ -19,16 +20,21 @@ type Interface interface {
     GetTxStats() (pkts uint64, bytes uint64, errors uint64)
     GetRxStats() (pkts uint64, bytes uint64, errors uint64)
     
-    GetIPv4Address() net.IP
-    GetIPv4Netmask() net.IP
-    SetIPv4Address(ip, netmask net.IP)
+    //GetIPv4Addresses returns a copy of the ipv4 addresses of the interface, primary addresses precede their secondaries.
+    GetIPv4Addresses() []IPv4Address
+    //AddIPv4Address adds the address or changes the prefix length of an existing one.
+    AddIPv4Address(addr IPv4Address)
+    RemoveIPv4Address(ip net.IP)
     
-    GetIPv6Address() net.IP
-    GetIPv6Netmask() int
-    SetIPv6Address(ip net.IP, netmask int)
+    //GetIPv6Addresses returns a copy of the ipv6 addresses of the interface.
+    GetIPv6Addresses() []IPv6Address
+    //AddIPv6Address adds the address or replaces the one with the same IP.
+    AddIPv6Address(addr IPv6Address)
+    RemoveIPv6Address(ip net.IP)
     
     GetHardwareAddress() net.HardwareAddr
     
+    //Close transmits the queued frames, stops all workers of the interface and unblocks RxPacket.
     Close()
 }
 
@@ -38,41 +44,73 @@ type InterfaceStats struct {
 }
 
 var ErrLoopbackAlreadyExists = errors.New("Netdev: Loopback device already exists!")
+var ErrDeviceAlreadyExists = errors.New("Netdev: A device with that name already exists!")
 
-func NewLoopback(name string) (Interface, error) {
-    l := &loopback { name: name, }
-    
-    interfaceListLock.Lock()
-    defer interfaceListLock.Unlock()
-    
-    if loopbackExists {
-        return nil, ErrLoopbackAlreadyExists
-    }
-    
-    loopbackExists = true
-    interfaceList = append(interfaceList, l)
-    return l, nil
+//List is the set of interfaces owned by one stack.
+type List struct {
+    lock sync.RWMutex
+    interfaces []Interface
+    loopbackExists bool
 }
 
-var interfaceListLock sync.RWMutex
-var interfaceList []Interface
-var loopbackExists = false
+//Default is the interface list used by the package level functions.
+var Default = NewList()
 
+//NewList creates an empty interface list.
+func NewList() *List {
+    return &List{}
+}
 
-func ShutdownInterfaces()  {
-    interfaceListLock.Lock()
-    loopbackExists = false
-    for _, v := range interfaceList {
+//Add registers an interface, names have to be unique and only one loopback is allowed.
+func (l *List) Add(iface Interface) error {
+    l.lock.Lock()
+    defer l.lock.Unlock()
+    _, isLoopback := iface.(*loopback)
+    if isLoopback && l.loopbackExists {
+        return ErrLoopbackAlreadyExists
+    }
+    for _, v := range l.interfaces {
+        if v.GetName() == iface.GetName() {
+            return ErrDeviceAlreadyExists
+        }
+    }
+    if isLoopback {
+        l.loopbackExists = true
+    }
+    l.interfaces = append(l.interfaces, iface)
+    return nil
+}
+
+//Remove takes the interface out of the list without closing it.
+func (l *List) Remove(iface Interface) {
+    l.lock.Lock()
+    defer l.lock.Unlock()
+    for i, v := range l.interfaces {
+        if v == iface {
+            if _, isLoopback := iface.(*loopback); isLoopback {
+                l.loopbackExists = false
+            }
+            l.interfaces = append(l.interfaces[:i], l.interfaces[i + 1:]...)
+            return
+        }
+    }
+}
+
+//Shutdown closes all interfaces and empties the list, it returns after all device workers exited.
+func (l *List) Shutdown() {
+    l.lock.Lock()
+    l.loopbackExists = false
+    for _, v := range l.interfaces {
         v.Close()
     }
-    interfaceList = nil
-    interfaceListLock.Unlock()
+    l.interfaces = nil
+    l.lock.Unlock()
 }
 
-func InterfaceByName(name string) Interface {
-    interfaceListLock.RLock()
-    defer interfaceListLock.RUnlock()
-    for _, v := range interfaceList {
+func (l *List) InterfaceByName(name string) Interface {
+    l.lock.RLock()
+    defer l.lock.RUnlock()
+    for _, v := range l.interfaces {
         if v.GetName() == name {
             return v
         }
@@ -80,6 +118,59 @@ func InterfaceByName(name string) Interface {
     return nil
 }
 
+//Interfaces returns a copy of the registered interfaces.
+func (l *List) Interfaces() []Interface {
+    l.lock.RLock()
+    defer l.lock.RUnlock()
+    res := make([]Interface, len(l.interfaces))
+    copy(res, l.interfaces)
+    return res
+}
+
+func (l *List) GetAllInterfaceInfo() string {
+    str := ""
+    for _, i := range l.Interfaces() {
+        str += GetInterfaceInfo(i) + "\n"
+    }
+    return str
+}
+
+//register adds a freshly opened device to the default list and closes it on failure.
+func register(iface Interface, err error) (Interface, error) {
+    if err != nil {
+        return nil, err
+    }
+    err = Default.Add(iface)
+    if err != nil {
+        iface.Close()
+        return nil, err
+    }
+    return iface, nil
+}
+
+//NewLoopback opens a loopback device and adds it to the default list.
+func NewLoopback(name string) (Interface, error) {
+    return register(OpenLoopback(name), nil)
+}
+
+//NewRawSocket opens a raw socket device and adds it to the default list.
+func NewRawSocket(ifname string) (Interface, error) {
+    return register(OpenRawSocket(ifname))
+}
+
+//NewTap opens a TAP device and adds it to the default list.
+func NewTap(ifname string) (Interface, error) {
+    return register(OpenTap(ifname))
+}
+
+func ShutdownInterfaces()  {
+    Default.Shutdown()
+}
+
+func InterfaceByName(name string) Interface {
+    return Default.InterfaceByName(name)
+}
+
 func GetInterfaceInfo(iface Interface) string {
     if iface == nil {
         return ""
@@ -89,14 +180,25 @@ func GetInterfaceInfo(iface Interface) string {
     if hwAddr != nil {
         str += "\tHardware Address: " + hwAddr.String() + "\n"
     }
-    ipv4 := iface.GetIPv4Address()
-    nm := iface.GetIPv4Netmask()
-    if ipv4 != nil && util.IPToUint32(ipv4) != 0 {
-        str += "\tIPv4 Address: " + (&net.IPNet{ IP: ipv4, Mask: net.IPMask(nm)}).String() + "\n"
+    for _, a := range iface.GetIPv4Addresses() {
+        str += "\tIPv4 Address: " + a.IP.String() + "/" + strconv.Itoa(a.PrefixLength)
+        if a.Secondary {
+            str += " secondary"
+        }
+        str += "\n"
     }
-    ipv6 := iface.GetIPv6Address()
-    if ipv6 != nil && bytes.Compare(ipv6, make([]byte, 16)) != 0 {
-        str += "\tIPv6 Address: " + ipv6.String() + "/" + strconv.Itoa(iface.GetIPv6Netmask()) + "\n"
+    for _, a := range iface.GetIPv6Addresses() {
+        str += "\tIPv6 Address: " + a.IP.String() + "/" + strconv.Itoa(a.PrefixLength)
+        if a.Tentative {
+            str += " tentative"
+        }
+        if a.Autoconfigured {
+            str += " autoconf"
+        }
+        if a.Deprecated(time.Now()) {
+            str += " deprecated"
+        }
+        str += "\n"
     }
     str += "\tMTU: " + strconv.Itoa(iface.GetMTU()) + "\n"
     p, b, e := iface.GetTxStats()
@@ -109,11 +211,15 @@ func GetInterfaceInfo(iface Interface) string {
 }
 
 func GetAllInterfaceInfo() string {
-    str := ""
-    interfaceListLock.RLock()
-    for _, i := range interfaceList {
-        str += GetInterfaceInfo(i) + "\n"
+    return Default.GetAllInterfaceInfo()
+}
+
+//randomMACAddress returns a random locally administered unicast MAC address.
+func randomMACAddress() net.HardwareAddr {
+    mac := make(net.HardwareAddr, 6)
+    for i := range mac {
+        mac[i] = byte(rand.Uint32())
     }
-    interfaceListLock.RUnlock()
-    return str
-}
\ No newline at end of file
+    mac[0] = (mac[0] | 0x02) & 0xFE
+    return mac
+}
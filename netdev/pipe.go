@@ -0,0 +1,160 @@
+package netdev
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"github.com/arcpop/network/config"
+)
+
+const (
+    //DefaultPipeMTU is the MTU of a pipe end if none is configured.
+    DefaultPipeMTU = 1500
+    //MinPipeMTU is the smallest MTU of a pipe end, every ipv4 link has to carry 68 byte datagrams (RFC 791).
+    //Links used for ipv6 need at least 1280 bytes (RFC 8200), the ipv6 layer does not configure smaller ones.
+    MinPipeMTU = 68
+)
+
+var ErrMTUTooSmall = errors.New("Netdev: The MTU is below the minimum!")
+
+//PipeConfig configures one end of a pipe. A nil HardwareAddr gets a random
+//locally administered address and a zero MTU gets DefaultPipeMTU.
+type PipeConfig struct {
+    Name string
+    HardwareAddr net.HardwareAddr
+    MTU int
+}
+
+//pipe is one end of a virtual ethernet cable carrying frames in process memory.
+type pipe struct {
+    InterfaceStats
+    addresses
+
+    name string
+    mtu int
+    mac net.HardwareAddr
+    peer *pipe
+
+    closedLock sync.RWMutex
+    closed bool
+    RxQueue chan []byte
+}
+
+//NewPipePair creates two interfaces connected to each other like a crossover cable
+//and adds both to the default list.
+func NewPipePair(nameA, nameB string) (Interface, Interface, error) {
+    return NewPipe(PipeConfig{Name: nameA}, PipeConfig{Name: nameB})
+}
+
+//NewPipe creates two interfaces connected to each other with the given configuration
+//and adds both to the default list.
+func NewPipe(a, b PipeConfig) (Interface, Interface, error) {
+    if a.Name == b.Name {
+        return nil, nil, ErrDeviceAlreadyExists
+    }
+    pa, pb, err := OpenPipe(a, b)
+    if err != nil {
+        return nil, nil, err
+    }
+    _, err = register(pa, nil)
+    if err != nil {
+        pb.Close()
+        return nil, nil, err
+    }
+    _, err = register(pb, nil)
+    if err != nil {
+        Default.Remove(pa)
+        pa.Close()
+        return nil, nil, err
+    }
+    return pa, pb, nil
+}
+
+//OpenPipe creates two connected interfaces which are not registered in any list,
+//so each end can be handed to a different stack. MTUs below MinPipeMTU are rejected.
+func OpenPipe(a, b PipeConfig) (Interface, Interface, error) {
+    if (a.MTU != 0 && a.MTU < MinPipeMTU) || (b.MTU != 0 && b.MTU < MinPipeMTU) {
+        return nil, nil, ErrMTUTooSmall
+    }
+    pa := newPipeEnd(a)
+    pb := newPipeEnd(b)
+    pa.peer = pb
+    pb.peer = pa
+    return pa, pb, nil
+}
+
+func newPipeEnd(c PipeConfig) *pipe {
+    p := &pipe{
+        name: c.Name,
+        mtu: c.MTU,
+        mac: make(net.HardwareAddr, 6),
+        RxQueue: make(chan []byte, config.Device.RxQueueSize),
+    }
+    if p.mtu == 0 {
+        p.mtu = DefaultPipeMTU
+    }
+    if c.HardwareAddr != nil {
+        copy(p.mac, c.HardwareAddr)
+    } else {
+        copy(p.mac, randomMACAddress())
+    }
+    return p
+}
+
+func (p *pipe) RxPacket() []byte {
+    return <- p.RxQueue
+}
+
+//TxPacket copies the frame onto the wire, frames exceeding the MTU or
+//finding the receive queue of the peer full are dropped.
+func (p *pipe) TxPacket(pkt []byte) {
+    s := uint64(len(pkt))
+    if len(pkt) > p.mtu + 14 {
+        atomic.AddUint64(&p.TxErrors, 1)
+        return
+    }
+    frame := make([]byte, len(pkt))
+    copy(frame, pkt)
+
+    peer := p.peer
+    peer.closedLock.RLock()
+    defer peer.closedLock.RUnlock()
+    if peer.closed {
+        atomic.AddUint64(&p.TxErrors, 1)
+        return
+    }
+    select {
+        case peer.RxQueue <- frame:
+            atomic.AddUint64(&p.TxBytes, s)
+            atomic.AddUint64(&p.TxPackets, 1)
+            atomic.AddUint64(&peer.RxBytes, s)
+            atomic.AddUint64(&peer.RxPackets, 1)
+        default:
+            atomic.AddUint64(&p.TxErrors, 1)
+            atomic.AddUint64(&peer.RxErrors, 1)
+    }
+}
+
+func (p *pipe) GetName() string {
+    return p.name
+}
+
+func (p *pipe) GetMTU() int {
+    return p.mtu
+}
+
+func (p *pipe) GetHardwareAddress() net.HardwareAddr {
+    var mac [6]byte
+    copy(mac[:], p.mac)
+    return net.HardwareAddr(mac[:])
+}
+
+func (p *pipe) Close() {
+    p.closedLock.Lock()
+    if !p.closed {
+        p.closed = true
+        close(p.RxQueue)
+    }
+    p.closedLock.Unlock()
+}
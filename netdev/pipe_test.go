@@ -0,0 +1,302 @@
+package netdev_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+	"github.com/arcpop/network"
+	"github.com/arcpop/network/config"
+	"github.com/arcpop/network/ip"
+	"github.com/arcpop/network/ipv6"
+	"github.com/arcpop/network/netdev"
+	"github.com/arcpop/network/udp"
+)
+
+//newPipeStacks joins two stacks with a pipe, the first one owns 10.0.0.1/24 and the second one 10.0.0.2/24.
+func newPipeStacks(t *testing.T) (*network.Stack, *network.Stack, netdev.Interface, netdev.Interface) {
+    a, b, err := netdev.OpenPipe(netdev.PipeConfig{ Name: "eth0" }, netdev.PipeConfig{ Name: "eth0" })
+    if err != nil {
+        t.Fatal(err)
+    }
+    sa, sb := network.NewStack(), network.NewStack()
+    for i, s := range []*network.Stack{ sa, sb } {
+        s.Start(context.Background())
+        t.Cleanup(s.Stop)
+        dev := a
+        if i == 1 {
+            dev = b
+        }
+        if err := s.AddInterface(dev); err != nil {
+            t.Fatal(err)
+        }
+        addr := net.IPNet{ IP: net.IPv4(10, 0, 0, byte(i + 1)).To4(), Mask: net.CIDRMask(24, 32) }
+        if err := s.IPv4.ConfigureInterfaceAddress("eth0", addr); err != nil {
+            t.Fatal(err)
+        }
+    }
+    return sa, sb, a, b
+}
+
+//waitARPEntry waits until the arp cache of s maps ip to the address of dev.
+func waitARPEntry(t *testing.T, s *network.Stack, ip string, dev netdev.Interface) {
+    entry := ip + " - " + dev.GetHardwareAddress().String() + "\n"
+    deadline := time.Now().Add(2 * time.Second)
+    for !strings.Contains(s.ARP.GetCacheAsString(), entry) {
+        if time.Now().After(deadline) {
+            t.Fatalf("arp cache lacks %q:\n%s", entry, s.ARP.GetCacheAsString())
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+}
+
+func TestPipeARP(t *testing.T) {
+    sa, sb, a, b := newPipeStacks(t)
+    sa.ARP.QueryIP(net.IPv4(10, 0, 0, 2).To4(), a, 3)
+    waitARPEntry(t, sa, "10.0.0.2", b)
+    //The peer learns the sender of a request for its own address (RFC 826)
+    waitARPEntry(t, sb, "10.0.0.1", a)
+}
+
+func TestPipePing(t *testing.T) {
+    sa, sb, a, b := newPipeStacks(t)
+    ctx, cancel := context.WithTimeout(context.Background(), 2 * time.Second)
+    defer cancel()
+    r, err := sa.IPv4.Ping(ctx, net.IPv4(10, 0, 0, 2), 56, 0x4242, 7)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !r.Source.Equal(net.IPv4(10, 0, 0, 2)) || r.ID != 0x4242 || r.Seq != 7 || r.Size != 64 {
+        t.Errorf("reply %+v", r)
+    }
+    waitARPEntry(t, sa, "10.0.0.2", b)
+    waitARPEntry(t, sb, "10.0.0.1", a)
+}
+
+func TestPipeUDP(t *testing.T) {
+    sa, sb, _, _ := newPipeStacks(t)
+    server, err := sb.UDP.ListenUDP4(net.IPv4(10, 0, 0, 2), 7000)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer server.Close()
+    c, err := sa.UDP.CreateUDP4(net.IPv4(10, 0, 0, 2), 7000, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    client := c.(*udp.Conn)
+    defer client.Close()
+    deadline := time.Now().Add(2 * time.Second)
+    server.SetDeadline(deadline)
+    client.SetDeadline(deadline)
+
+    request := []byte("ping over the pipe")
+    if _, err := client.Write(request); err != nil {
+        t.Fatal(err)
+    }
+    buf := make([]byte, 1500)
+    n, from, err := server.ReadFrom(buf)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(buf[:n], request) {
+        t.Errorf("server got %q, want %q", buf[:n], request)
+    }
+    if addr, ok := from.(*net.UDPAddr); !ok || !addr.IP.Equal(net.IPv4(10, 0, 0, 1)) || addr.Port != client.LocalAddr().(*net.UDPAddr).Port {
+        t.Errorf("request from %v, want the client at %v", from, client.LocalAddr())
+    }
+
+    reply := bytes.ToUpper(request)
+    if _, err := server.WriteTo(reply, from); err != nil {
+        t.Fatal(err)
+    }
+    n, err = client.Read(buf)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(buf[:n], reply) {
+        t.Errorf("client got %q, want %q", buf[:n], reply)
+    }
+}
+
+//newPipeStacks6 joins two stacks with a pipe like newPipeStacks, the stacks additionally own fd00::1/64 and fd00::2/64.
+func newPipeStacks6(t *testing.T) (*network.Stack, *network.Stack, netdev.Interface, netdev.Interface) {
+    //The addresses are usable right away without duplicate address detection
+    transmits := config.IPv6.DupAddrDetectTransmits
+    config.IPv6.DupAddrDetectTransmits = 0
+    t.Cleanup(func() {
+        config.IPv6.DupAddrDetectTransmits = transmits
+    })
+    sa, sb, a, b := newPipeStacks(t)
+    for i, s := range []*network.Stack{ sa, sb } {
+        addr := net.IPNet{ IP: net.ParseIP(fmt.Sprintf("fd00::%d", i + 1)), Mask: net.CIDRMask(64, 128) }
+        if err := s.IPv6.ConfigureInterfaceAddress("eth0", addr); err != nil {
+            t.Fatal(err)
+        }
+    }
+    return sa, sb, a, b
+}
+
+func TestPipeUDP6(t *testing.T) {
+    sa, sb, _, _ := newPipeStacks6(t)
+    server, err := sb.UDP.ListenUDP6(nil, 7000)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer server.Close()
+    c, err := sa.UDP.CreateUDP6(net.ParseIP("fd00::2"), 7000, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    client := c.(*udp.Conn)
+    defer client.Close()
+    deadline := time.Now().Add(2 * time.Second)
+    server.SetDeadline(deadline)
+    client.SetDeadline(deadline)
+
+    //The datagram exceeds the mtu of the pipe, it is fragmented by the sender and reassembled by the peer
+    request := make([]byte, 4000)
+    for i := range request {
+        request[i] = byte(i * 7)
+    }
+    if _, err := client.Write(request); err != nil {
+        t.Fatal(err)
+    }
+    buf := make([]byte, 0x10000)
+    n, from, err := server.ReadFrom(buf)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(buf[:n], request) {
+        t.Errorf("server got %d bytes, want the %d bytes sent", n, len(request))
+    }
+    if addr, ok := from.(*net.UDPAddr); !ok || !addr.IP.Equal(net.ParseIP("fd00::1")) || addr.Port != client.LocalAddr().(*net.UDPAddr).Port {
+        t.Errorf("request from %v, want the client at %v", from, client.LocalAddr())
+    }
+    if stats := sb.IPv6.ReassemblyStats(); stats.Reassembled != 1 {
+        t.Errorf("reassembly stats %+v", stats)
+    }
+
+    reply := bytes.Repeat([]byte("reply"), 500)
+    if _, err := server.WriteTo(reply, from); err != nil {
+        t.Fatal(err)
+    }
+    n, err = client.Read(buf)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(buf[:n], reply) {
+        t.Errorf("client got %d bytes, want the %d bytes of the reply", n, len(reply))
+    }
+    //IPv4 destinations can not be reached through an ipv6 socket
+    if _, err := server.WriteTo(reply, &net.UDPAddr{ IP: net.IPv4(10, 0, 0, 1), Port: 7000 }); err != udp.ErrInvalidAddress {
+        t.Errorf("writing to an ipv4 address returned %v, want %v", err, udp.ErrInvalidAddress)
+    }
+}
+
+//packetTooBig builds the frame of a packet too big message from fd00::2 to fd00::1 about a udp datagram
+//sent from src and port to fd00::2 port 7000.
+func packetTooBig(to, from netdev.Interface, src net.IP, port int, mtu uint32) []byte {
+    dst := net.ParseIP("fd00::2")
+    body := make([]byte, 8 + ipv6.HeaderLength + udp.HeaderLength)
+    body[0] = ip.ICMPv6TypePacketTooBig
+    binary.BigEndian.PutUint32(body[4:8], mtu)
+    orig := body[8:]
+    orig[0] = 0x60
+    binary.BigEndian.PutUint16(orig[4:6], 1500 - ipv6.HeaderLength)
+    orig[6], orig[7] = ip.IPPROTO_UDP, 64
+    copy(orig[8:24], src)
+    copy(orig[24:40], dst)
+    binary.BigEndian.PutUint16(orig[40:42], uint16(port))
+    binary.BigEndian.PutUint16(orig[42:44], 7000)
+    binary.BigEndian.PutUint16(body[2:4], ipv6.PseudoHeaderChecksum(dst, net.ParseIP("fd00::1"), ip.IPPROTO_ICMPV6, body))
+
+    frame := make([]byte, 14 + ipv6.HeaderLength + len(body))
+    copy(frame[0:6], to.GetHardwareAddress())
+    copy(frame[6:12], from.GetHardwareAddress())
+    binary.BigEndian.PutUint16(frame[12:14], 0x86DD)
+    hdr := frame[14:]
+    hdr[0] = 0x60
+    binary.BigEndian.PutUint16(hdr[4:6], uint16(len(body)))
+    hdr[6], hdr[7] = ip.IPPROTO_ICMPV6, 64
+    copy(hdr[8:24], dst)
+    copy(hdr[24:40], net.ParseIP("fd00::1"))
+    copy(hdr[40:], body)
+    return frame
+}
+
+func TestPipePacketTooBig(t *testing.T) {
+    sa, _, a, b := newPipeStacks6(t)
+    c, err := sa.UDP.ListenUDP6(nil, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer c.Close()
+    port := c.LocalAddr().(*net.UDPAddr).Port
+    dst := net.ParseIP("fd00::2")
+    pathMTU := func() int {
+        mtu, err := sa.IPv6.PathMTU(dst)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return mtu
+    }
+    //Neither a datagram from another host nor one from a port without socket may shrink the path mtu
+    b.TxPacket(packetTooBig(a, b, net.ParseIP("fd00::3"), port, 1300))
+    b.TxPacket(packetTooBig(a, b, net.ParseIP("fd00::1"), port ^ 1, 1300))
+    time.Sleep(100 * time.Millisecond)
+    if mtu := pathMTU(); mtu != 1500 {
+        t.Errorf("path mtu %d after forged messages, want 1500", mtu)
+    }
+    b.TxPacket(packetTooBig(a, b, net.ParseIP("fd00::1"), port, 1300))
+    deadline := time.Now().Add(time.Second)
+    for pathMTU() != 1300 {
+        if time.Now().After(deadline) {
+            t.Fatalf("path mtu %d after a message about a datagram of the socket, want 1300", pathMTU())
+        }
+        time.Sleep(2 * time.Millisecond)
+    }
+}
+
+func TestOpenPipeMTU(t *testing.T) {
+    tests := []struct {
+        mtu int
+        err error
+    }{
+        { 0, nil },
+        { netdev.MinPipeMTU, nil },
+        { 1280, nil },
+        { netdev.MinPipeMTU - 1, netdev.ErrMTUTooSmall },
+        { -1, netdev.ErrMTUTooSmall },
+    }
+    for _, tt := range tests {
+        a, b, err := netdev.OpenPipe(netdev.PipeConfig{ Name: "a", MTU: tt.mtu }, netdev.PipeConfig{ Name: "b" })
+        if err != tt.err {
+            t.Errorf("mtu %d returned %v, want %v", tt.mtu, err, tt.err)
+        }
+        if err == nil {
+            a.Close()
+            b.Close()
+        }
+    }
+}
+
+func TestNewPipeNameTaken(t *testing.T) {
+    a, b, err := netdev.NewPipe(netdev.PipeConfig{ Name: "taken0" }, netdev.PipeConfig{ Name: "taken1" })
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer netdev.Default.Remove(a)
+    defer netdev.Default.Remove(b)
+    //The second end fails to register, the first one may not stay behind
+    if _, _, err := netdev.NewPipe(netdev.PipeConfig{ Name: "free0" }, netdev.PipeConfig{ Name: "taken1" }); err != netdev.ErrDeviceAlreadyExists {
+        t.Fatalf("returned %v, want %v", err, netdev.ErrDeviceAlreadyExists)
+    }
+    if netdev.Default.InterfaceByName("free0") != nil {
+        t.Errorf("first end is still registered")
+    }
+}
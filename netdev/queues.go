@@ -0,0 +1,89 @@
+package netdev
+
+import (
+	"sync"
+	"github.com/arcpop/network/config"
+)
+
+//deviceQueues holds the rx and tx queues of a device backed by a file descriptor
+//and shuts its workers down in order: pending frames are transmitted first, then
+//the receive side is stopped and RxQueue is closed so RxPacket returns nil.
+type deviceQueues struct {
+    RxQueue chan []byte
+    TxQueue chan []byte
+
+    stop chan bool
+    closedLock sync.RWMutex
+    closed bool
+    rxWorkers, txWorkers sync.WaitGroup
+}
+
+func newDeviceQueues() deviceQueues {
+    return deviceQueues{
+        RxQueue: make(chan []byte, config.Device.RxQueueSize),
+        TxQueue: make(chan []byte, config.Device.TxQueueSize),
+        stop: make(chan bool),
+    }
+}
+
+//startWorkers starts the configured number of rx and tx workers.
+func (q *deviceQueues) startWorkers(rx, tx func()) {
+    for i := 0; i < config.Device.RxQueueWorkers; i++ {
+        q.rxWorkers.Add(1)
+        go func() {
+            defer q.rxWorkers.Done()
+            rx()
+        }()
+    }
+    for i := 0; i < config.Device.TxQueueWorkers; i++ {
+        q.txWorkers.Add(1)
+        go func() {
+            defer q.txWorkers.Done()
+            tx()
+        }()
+    }
+}
+
+//RxPacket blocks until a frame was received, it returns nil once the device is closed.
+func (q *deviceQueues) RxPacket() []byte {
+    return <- q.RxQueue
+}
+
+//enqueueRx hands a received frame to the readers, it returns false if the device is shutting down.
+func (q *deviceQueues) enqueueRx(pkt []byte) bool {
+    select {
+        case q.RxQueue <- pkt:
+            return true
+        case <- q.stop:
+            return false
+    }
+}
+
+//enqueueTx queues a frame for transmission, it returns false if the device is closed.
+func (q *deviceQueues) enqueueTx(pkt []byte) bool {
+    q.closedLock.RLock()
+    defer q.closedLock.RUnlock()
+    if q.closed {
+        return false
+    }
+    q.TxQueue <- pkt
+    return true
+}
+
+//shutdown drains the tx queue, calls closeFd to unblock the rx workers and waits for all workers.
+func (q *deviceQueues) shutdown(closeFd func()) {
+    q.closedLock.Lock()
+    if q.closed {
+        q.closedLock.Unlock()
+        return
+    }
+    q.closed = true
+    close(q.TxQueue)
+    q.closedLock.Unlock()
+
+    q.txWorkers.Wait()
+    close(q.stop)
+    closeFd()
+    q.rxWorkers.Wait()
+    close(q.RxQueue)
+}
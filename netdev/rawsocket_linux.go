@@ -7,54 +7,53 @@ import (
     "syscall"
 	"log"
 	"sync/atomic"
-	"sync"
-	"github.com/arcpop/network/config"
-	"errors"
+	"github.com/arcpop/network/util"
+	"os"
 	"unsafe"
 )
 
 type rawsock struct {
-    fd int
-    iface *net.Interface
-    
-    ipv4Lock sync.RWMutex
-    ipv4 net.IP
-    netmaskv4 net.IP
-    
-    ipv6Lock sync.RWMutex
-    ipv6 net.IP
-    netmaskv6 int
-    
-    TxPackets, TxBytes, TxErrors uint64
-    RxPackets, RxBytes, RxErrors uint64
+    InterfaceStats
+    addresses
+    deviceQueues
     
-    RxQueue chan []byte
-    TxQueue chan []byte
+    file *os.File
+    conn syscall.RawConn
+    iface *net.Interface
 }
 
-var ErrDeviceAlreadyExists = errors.New("Rawsocket: A rawsocket implementation for that device already exists!")
-
 type ifrfl struct {
     ifrname [syscall.IFNAMSIZ]byte
     ifrflags int16
+    //struct ifreq is a union of 24 bytes after the name, the kernel copies all of it
+    pad [22]byte
 }
-func ioctl(fd, code int, p uintptr) error {
-    _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(code), p)
+func ioctl(fd int, code, p uintptr) error {
+    _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), code, p)
     if errno == 0 {
         return nil
     }
     return errno
 }
 
-func NewRawSocket(ifname string) (Interface, error) {
-    interfaceListLock.Lock()
-    defer interfaceListLock.Unlock()
-    for _, v := range interfaceList {
-        if v.GetName() == ifname {
-            return nil, ErrDeviceAlreadyExists
-        }
+//setInterfaceUp sets IFF_UP on the named interface if it is not already up.
+func setInterfaceUp(fd int, ifname string) error {
+    ifr := ifrfl{}
+    copy(ifr.ifrname[:], []byte(ifname))
+    ifr.ifrname[syscall.IFNAMSIZ - 1] = 0
+    err := ioctl(fd, syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&ifr)))
+    if err != nil {
+        return err
+    }
+    if (ifr.ifrflags & syscall.IFF_UP) != 0 {
+        return nil
     }
     
+    ifr.ifrflags |= syscall.IFF_UP
+    return ioctl(fd, syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifr)))
+}
+
+func OpenRawSocket(ifname string) (Interface, error) {
     //htons(ETH_P_ALL) = htons(0x0003) = 0x0300
     iface, err := net.InterfaceByName(ifname)
     if err != nil {
@@ -77,41 +76,32 @@ func NewRawSocket(ifname string) (Interface, error) {
         return nil, err
     }
     
-    ifr := ifrfl{}
-    copy(ifr.ifrname[:], []byte(ifname))
-    ifr.ifrname[syscall.IFNAMSIZ - 1] = 0
-    err = ioctl(fd, syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&ifr)))
+    err = setInterfaceUp(fd, ifname)
     if err != nil {
         syscall.Close(fd)
         return nil, err
     }
     
-    ifr.ifrflags |= syscall.IFF_UP
-    
-    copy(ifr.ifrname[:], []byte(ifname))
-    ifr.ifrname[syscall.IFNAMSIZ - 1] = 0
-    err = ioctl(fd, syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifr)))
+    //Let the runtime poller handle the socket so closing it unblocks the rx workers
+    err = syscall.SetNonblock(fd, true)
     if err != nil {
         syscall.Close(fd)
         return nil, err
     }
-    
+    file := os.NewFile(uintptr(fd), "rawsocket:" + ifname)
+    conn, err := file.SyscallConn()
+    if err != nil {
+        file.Close()
+        return nil, err
+    }
     
     rs := &rawsock{ 
-        fd: fd, 
+        deviceQueues: newDeviceQueues(),
+        file: file,
+        conn: conn,
         iface: iface, 
-        RxQueue: make(chan []byte, config.Device.RxQueueSize), 
-        TxQueue: make(chan []byte, config.Device.TxQueueSize),
-    }
-    
-    for i := 0; i < config.Device.RxQueueWorkers; i++ {
-        go rs.rxPacketWorker()
-    }
-    for i := 0; i < config.Device.TxQueueWorkers; i++ {
-        go rs.txPacketWorker()
     }
-    
-    interfaceList = append(interfaceList, rs)
+    rs.startWorkers(rs.rxPacketWorker, rs.txPacketWorker)
     return rs, nil
 }
 
@@ -120,15 +110,20 @@ func (rs *rawsock) rxPacketWorker() {
     for {
         //MTU + ethernet header size
         pkt := make([]byte, rs.iface.MTU + 14)
-        n, _, err := syscall.Recvfrom(rs.fd, pkt, 0)
+        n, err := rs.file.Read(pkt)
         if err != nil {
-            log.Println("RawSocket.Recvfrom: ", err)
+            if util.ChannelClosed(rs.stop) {
+                return
+            }
+            log.Println("RawSocket.Read: ", err)
             atomic.AddUint64(&rs.RxErrors, 1)
             continue
         }
         atomic.AddUint64(&rs.RxPackets, 1)
         atomic.AddUint64(&rs.RxBytes, uint64(n))
-        rs.RxQueue <- pkt[:n]
+        if !rs.enqueueRx(pkt[:n]) {
+            return
+        }
     }
 }
 func (rs *rawsock) txPacketWorker() {
@@ -140,7 +135,14 @@ func (rs *rawsock) txPacketWorker() {
     }
     for pkt := range rs.TxQueue {
         copy(sockaddrll.Addr[0:6], pkt[0:6])
-        err := syscall.Sendto(rs.fd, pkt, 0, sockaddrll)
+        var err error
+        werr := rs.conn.Write(func(fd uintptr) bool {
+            err = syscall.Sendto(int(fd), pkt, 0, sockaddrll)
+            return err != syscall.EAGAIN
+        })
+        if werr != nil {
+            err = werr
+        }
         if err != nil {
             log.Println("RawSocket.Sendto: ", err)
             atomic.AddUint64(&rs.TxErrors, 1)
@@ -151,11 +153,10 @@ func (rs *rawsock) txPacketWorker() {
     }
 }
 
-func (rs *rawsock) RxPacket() []byte {
-    return <- rs.RxQueue
-}
 func (rs *rawsock) TxPacket(pkt []byte) {
-    rs.TxQueue <- pkt
+    if !rs.enqueueTx(pkt) {
+        atomic.AddUint64(&rs.TxErrors, 1)
+    }
 }
 
 func (rs *rawsock) GetName()string {
@@ -166,59 +167,6 @@ func (rs *rawsock) GetMTU() int {
     return rs.iface.MTU
 }
 
-func (rs *rawsock) GetTxStats() (pkts uint64, bytes uint64, errors uint64) {
-    return rs.TxPackets, rs.TxBytes, rs.TxErrors
-}
-
-func (rs *rawsock) GetRxStats() (pkts uint64, bytes uint64, errors uint64) {
-    return rs.RxPackets, rs.RxBytes, rs.RxErrors
-}
-
-func (rs *rawsock) GetIPv4Address() net.IP {
-    var ip [4]byte
-    rs.ipv4Lock.RLock()
-    copy(ip[:], rs.ipv4[:])
-    rs.ipv4Lock.RUnlock()
-    return net.IP(ip[:])
-}
-
-func (rs *rawsock) GetIPv4Netmask() net.IP {
-    var nm [4]byte
-    rs.ipv4Lock.RLock()
-    copy(nm[:], rs.netmaskv4[:])
-    rs.ipv4Lock.RUnlock()
-    return net.IP(nm[:])
-}
-
-func (rs *rawsock) SetIPv4Address(ip, netmask net.IP) {
-    rs.ipv4Lock.Lock()
-    rs.ipv4 = make([]byte, 4)
-    copy(rs.ipv4[:], ip.To4())
-    rs.netmaskv4 = make([]byte, 4)
-    copy(rs.netmaskv4[:], netmask.To4())
-    rs.ipv4Lock.Unlock()
-}
-
-func (rs *rawsock) GetIPv6Address() net.IP {
-    var ip [16]byte
-    rs.ipv6Lock.RLock()
-    copy(ip[:], rs.ipv6[:])
-    rs.ipv6Lock.RUnlock()
-    return net.IP(ip[:])
-}
-
-func (rs *rawsock) GetIPv6Netmask() int {
-    return rs.netmaskv6
-}
-
-func (rs *rawsock) SetIPv6Address(ip net.IP, netmask int) {
-    rs.ipv6Lock.Lock()
-    rs.ipv6 = make([]byte, 16)
-    copy(rs.ipv6, ip)
-    rs.netmaskv6 = netmask
-    rs.ipv6Lock.Unlock()
-}
-
 func (rs *rawsock) GetHardwareAddress() net.HardwareAddr {
     var mac [6]byte
     copy(mac[:], rs.iface.HardwareAddr)
@@ -226,9 +174,9 @@ func (rs *rawsock) GetHardwareAddress() net.HardwareAddr {
 }
 
 
+//Close transmits the queued frames and stops all workers.
 func (rs *rawsock) Close() {
-    close(rs.TxQueue)
-    close(rs.RxQueue)
-    syscall.Close(rs.fd)
-    return
+    rs.shutdown(func() {
+        rs.file.Close()
+    })
 }
\ No newline at end of file
@@ -6,6 +6,6 @@ import (
     "github.com/arcpop/network/util"
 )
 
-func NewRawSocket(ifname string) (Interface, error) {
+func OpenRawSocket(ifname string) (Interface, error) {
     return nil, util.ErrNotImplemented
 }
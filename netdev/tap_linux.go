@@ -0,0 +1,150 @@
+// +build linux
+
+package netdev
+
+import (
+	"net"
+	"syscall"
+	"log"
+	"sync/atomic"
+	"github.com/arcpop/network/util"
+	"os"
+	"unsafe"
+)
+
+type tap struct {
+    InterfaceStats
+    addresses
+    deviceQueues
+
+    file *os.File
+    name string
+    mtu int
+    mac net.HardwareAddr
+}
+
+//OpenTap opens /dev/net/tun and creates or attaches to the TAP interface with the given name.
+//The stack acts as the host at the other end of the virtual wire, so it uses its own
+//randomly generated MAC address and not the one the kernel assigned to the interface.
+func OpenTap(ifname string) (Interface, error) {
+    //Opened non blocking so the runtime poller can unblock the rx workers on close
+    fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR | syscall.O_NONBLOCK | syscall.O_CLOEXEC, 0)
+    if err != nil {
+        return nil, err
+    }
+
+    ifr := ifrfl{}
+    copy(ifr.ifrname[:], []byte(ifname))
+    ifr.ifrname[syscall.IFNAMSIZ - 1] = 0
+    ifr.ifrflags = syscall.IFF_TAP | syscall.IFF_NO_PI
+    err = ioctl(fd, syscall.TUNSETIFF, uintptr(unsafe.Pointer(&ifr)))
+    if err != nil {
+        syscall.Close(fd)
+        return nil, err
+    }
+
+    //The kernel may have picked the name if a pattern like tap%d was given
+    name := string(ifr.ifrname[:clen(ifr.ifrname[:])])
+
+    //A TAP device created ahead of time for our user might already be up,
+    //in that case we don't need CAP_NET_ADMIN.
+    sock, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+    if err != nil {
+        syscall.Close(fd)
+        return nil, err
+    }
+    err = setInterfaceUp(sock, name)
+    syscall.Close(sock)
+    if err != nil {
+        syscall.Close(fd)
+        return nil, err
+    }
+
+    iface, err := net.InterfaceByName(name)
+    if err != nil {
+        syscall.Close(fd)
+        return nil, err
+    }
+
+    t := &tap{
+        deviceQueues: newDeviceQueues(),
+        file: os.NewFile(uintptr(fd), "tap:" + name),
+        name: name,
+        mtu: iface.MTU,
+        mac: randomMACAddress(),
+    }
+    t.startWorkers(t.rxPacketWorker, t.txPacketWorker)
+    return t, nil
+}
+
+func clen(b []byte) int {
+    for i := 0; i < len(b); i++ {
+        if b[i] == 0 {
+            return i
+        }
+    }
+    return len(b)
+}
+
+func (t *tap) rxPacketWorker() {
+    log.Println("Tap: RxWorker starting!")
+    for {
+        //MTU + ethernet header size
+        pkt := make([]byte, t.mtu + 14)
+        n, err := t.file.Read(pkt)
+        if err != nil {
+            if util.ChannelClosed(t.stop) {
+                return
+            }
+            log.Println("Tap.Read: ", err)
+            atomic.AddUint64(&t.RxErrors, 1)
+            continue
+        }
+        atomic.AddUint64(&t.RxPackets, 1)
+        atomic.AddUint64(&t.RxBytes, uint64(n))
+        if !t.enqueueRx(pkt[:n]) {
+            return
+        }
+    }
+}
+
+func (t *tap) txPacketWorker() {
+    log.Println("Tap: TxWorker starting!")
+    for pkt := range t.TxQueue {
+        _, err := t.file.Write(pkt)
+        if err != nil {
+            log.Println("Tap.Write: ", err)
+            atomic.AddUint64(&t.TxErrors, 1)
+            continue
+        }
+        atomic.AddUint64(&t.TxPackets, 1)
+        atomic.AddUint64(&t.TxBytes, uint64(len(pkt)))
+    }
+}
+
+func (t *tap) TxPacket(pkt []byte) {
+    if !t.enqueueTx(pkt) {
+        atomic.AddUint64(&t.TxErrors, 1)
+    }
+}
+
+func (t *tap) GetName() string {
+    return t.name
+}
+
+func (t *tap) GetMTU() int {
+    return t.mtu
+}
+
+func (t *tap) GetHardwareAddress() net.HardwareAddr {
+    var mac [6]byte
+    copy(mac[:], t.mac)
+    return net.HardwareAddr(mac[:])
+}
+
+//Close transmits the queued frames and stops all workers.
+func (t *tap) Close() {
+    t.shutdown(func() {
+        t.file.Close()
+    })
+}
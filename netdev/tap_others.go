@@ -0,0 +1,11 @@
+// +build !linux
+
+package netdev
+
+import (
+    "github.com/arcpop/network/util"
+)
+
+func OpenTap(ifname string) (Interface, error) {
+    return nil, util.ErrNotImplemented
+}
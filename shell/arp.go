@@ -1,8 +1,9 @@
 package shell
 
 import (
-    "github.com/arcpop/network/arp"
+    "github.com/arcpop/network"
 	"fmt"
+	"net"
 	"strconv"
 )
 
@@ -10,10 +11,10 @@ var arpHelp = "arp - Possible commands:\n" +
     "\tarp -> Prints the arp cache\n" + 
     "\tarp query <ip> <interface> [retries] -> Query\n\t\tthe corresponding ip in an arp request\n"
     
-func runArp(args []string)  {
+func runArp(s *network.Stack, args []string)  {
     var err error
     if len(args) < 1 {
-        fmt.Println(arp.GetCacheAsString())
+        fmt.Println(s.ARP.GetCacheAsString())
     } else if args[0] == "help" {
         fmt.Println(arpHelp)
     } else if args[0] == "query" && len(args) >= 3 {
@@ -24,7 +25,13 @@ func runArp(args []string)  {
                 retries = 0
             }
         }
-        arp.QueryIP(args[1], args[2], retries)
+        ip := net.ParseIP(args[1]).To4()
+        iface := s.Interfaces.InterfaceByName(args[2])
+        if ip == nil || iface == nil {
+            fmt.Println(arpHelp)
+            return
+        }
+        s.ARP.QueryIP(ip, iface, retries)
     } else {
         fmt.Println(arpHelp)
     }
@@ -2,25 +2,26 @@ package shell
 
 import (
 	"fmt"
+	"github.com/arcpop/network"
 	"github.com/arcpop/network/netdev"
 	"net"
-	"github.com/arcpop/network/ipv4"
 )
 
 var ifaceHelp = "iface - Possible commands:\n" + 
     "\tiface -> Prints info on all interfaces\n" + 
     "\tiface <interface> -> Prints info on specified interface\n" +
     "\tiface <interface> add [CIDR] -> Adds the specified interface\n" +
-    "\tiface <interface> addr <CIDR> -> Sets address on specified interface,\n\t\taddress should be in CIDR notation\n"
+    "\tiface <interface> addr <CIDR> -> Adds address to specified interface,\n\t\taddress should be in CIDR notation\n" +
+    "\tiface <interface> del <CIDR> -> Removes address from specified interface\n"
 
-func runIface(args []string) {
+func runIface(s *network.Stack, args []string) {
     if len(args) < 1 {
-        fmt.Println(netdev.GetAllInterfaceInfo())
+        fmt.Println(s.Interfaces.GetAllInterfaceInfo())
     } else if args[0] == "help" {
         fmt.Println(ifaceHelp)
     } else if len(args) == 1 { 
         ifacename := args[0]
-        iface := netdev.InterfaceByName(ifacename)
+        iface := s.Interfaces.InterfaceByName(ifacename)
         if iface == nil {
             fmt.Println("No interface with name " + ifacename + "found!")
             return
@@ -30,7 +31,7 @@ func runIface(args []string) {
         ifacename := args[0]
         what := args[1]
         cidr := args[2]
-        if what != "addr" {
+        if what != "addr" && what != "del" {
             fmt.Println(ifaceHelp)
             return
         }
@@ -40,10 +41,17 @@ func runIface(args []string) {
             return
         }
         ip4 := ip.To4()
-        if ip4 != nil {
-            ipv4.ConfigureInterfaceAddress(ifacename, net.IPNet{IP:ip4, Mask: n.Mask})
+        if ip4 != nil && what == "addr" {
+            err = s.IPv4.ConfigureInterfaceAddress(ifacename, net.IPNet{IP:ip4, Mask: n.Mask})
+        } else if ip4 != nil {
+            err = s.IPv4.RemoveInterfaceAddress(ifacename, net.IPNet{IP:ip4, Mask: n.Mask})
+        } else if what == "addr" {
+            err = s.IPv6.ConfigureInterfaceAddress(ifacename, net.IPNet{IP:ip, Mask: n.Mask})
         } else {
-            //Configure ipv6
+            err = s.IPv6.RemoveInterfaceAddress(ifacename, net.IPNet{IP:ip, Mask: n.Mask})
+        }
+        if err != nil {
+            fmt.Println("Failed to configure address: ", err)
         }
     } else {
         fmt.Println(ifaceHelp)
@@ -0,0 +1,36 @@
+package shell
+
+import (
+    "github.com/arcpop/network"
+	"fmt"
+	"net"
+)
+
+var neighHelp = "neigh - Possible commands:\n" + 
+    "\tneigh -> Prints the ipv6 neighbor cache\n" + 
+    "\tneigh add <ip> <mac> <interface> -> Adds a permanent entry\n" + 
+    "\tneigh del <ip> -> Removes the entry of the ip\n"
+    
+func runNeigh(s *network.Stack, args []string)  {
+    if len(args) < 1 {
+        fmt.Println(s.IPv6.GetNeighborsAsString())
+    } else if args[0] == "add" && len(args) >= 4 {
+        ip := net.ParseIP(args[1])
+        mac, err := net.ParseMAC(args[2])
+        iface := s.Interfaces.InterfaceByName(args[3])
+        if ip == nil || ip.To4() != nil || err != nil || iface == nil {
+            fmt.Println(neighHelp)
+            return
+        }
+        s.IPv6.AddNeighbor(ip, mac, iface)
+    } else if args[0] == "del" && len(args) >= 2 {
+        ip := net.ParseIP(args[1])
+        if ip == nil {
+            fmt.Println(neighHelp)
+            return
+        }
+        s.IPv6.DeleteNeighbor(ip)
+    } else {
+        fmt.Println(neighHelp)
+    }
+}
@@ -1,5 +1,144 @@
 package shell
 
-func runPing(args []string)  {
-    
-}
\ No newline at end of file
+import (
+    "github.com/arcpop/network"
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var pingHelp = "ping - Possible commands:\n" +
+    "\tping <ip> [-c count] [-s size] [-i interval] -> Sends count echo requests\n" +
+    "\t\twith size bytes of payload every interval seconds, defaults are 4, 56 and 1\n"
+
+//pingTimeout is how long to wait for each reply
+const pingTimeout = 2 * time.Second
+
+type pingStats struct {
+    lock sync.Mutex
+    transmitted, received int
+    min, max, sum, sumSquares float64
+}
+
+func (p *pingStats) add(rtt float64) {
+    p.lock.Lock()
+    defer p.lock.Unlock()
+    if p.received == 0 || rtt < p.min {
+        p.min = rtt
+    }
+    if rtt > p.max {
+        p.max = rtt
+    }
+    p.received++
+    p.sum += rtt
+    p.sumSquares += rtt * rtt
+}
+
+//pingResult is the part of an ipv4 or ipv6 echo reply which is printed.
+type pingResult struct {
+    size int
+    source net.IP
+    ttl byte
+    seq uint16
+    rtt time.Duration
+}
+
+func ping(s *network.Stack, ctx context.Context, dst net.IP, size int, id, seq uint16) (*pingResult, error) {
+    if dst.To4() != nil {
+        r, err := s.IPv4.Ping(ctx, dst, size, id, seq)
+        if err != nil {
+            return nil, err
+        }
+        return &pingResult{ size: r.Size, source: r.Source, ttl: r.TTL, seq: r.Seq, rtt: r.RTT }, nil
+    }
+    r, err := s.IPv6.Ping(ctx, dst, size, id, seq)
+    if err != nil {
+        return nil, err
+    }
+    return &pingResult{ size: r.Size, source: r.Source, ttl: r.HopLimit, seq: r.Seq, rtt: r.RTT }, nil
+}
+
+func runPing(s *network.Stack, args []string)  {
+    var dst net.IP
+    count, size, interval := 4, 56, 1.0
+    for i := 0; i < len(args); i++ {
+        var err error
+        switch args[i] {
+            case "-c", "-s", "-i":
+                if i + 1 >= len(args) {
+                    fmt.Println(pingHelp)
+                    return
+                }
+                switch args[i] {
+                    case "-c":
+                        count, err = strconv.Atoi(args[i + 1])
+                    case "-s":
+                        size, err = strconv.Atoi(args[i + 1])
+                    case "-i":
+                        interval, err = strconv.ParseFloat(args[i + 1], 64)
+                }
+                i++
+            default:
+                dst = net.ParseIP(args[i])
+        }
+        if err != nil {
+            fmt.Println(pingHelp)
+            return
+        }
+    }
+    if dst == nil || count <= 0 || size < 0 || interval <= 0 {
+        fmt.Println(pingHelp)
+        return
+    }
+
+    headerSize := 28
+    if dst.To4() == nil {
+        headerSize = 48
+    }
+    fmt.Printf("PING %v (%v) %d(%d) bytes of data.\n", dst, dst, size, size + headerSize)
+    id := uint16(rand.Uint32())
+    stats := &pingStats{}
+    var wg sync.WaitGroup
+    start := time.Now()
+    for seq := 1; seq <= count; seq++ {
+        if seq > 1 {
+            time.Sleep(time.Duration(interval * float64(time.Second)))
+        }
+        stats.transmitted++
+        wg.Add(1)
+        go func(seq uint16) {
+            defer wg.Done()
+            ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+            defer cancel()
+            r, err := ping(s, ctx, dst, size, id, seq)
+            if err == context.DeadlineExceeded {
+                return
+            }
+            if err != nil {
+                fmt.Println("ping:", err)
+                return
+            }
+            rtt := float64(r.rtt) / float64(time.Millisecond)
+            stats.add(rtt)
+            fmt.Printf("%d bytes from %v: icmp_seq=%d ttl=%d time=%.3f ms\n", r.size, r.source, r.seq, r.ttl, rtt)
+        }(uint16(seq))
+    }
+    wg.Wait()
+    elapsed := time.Since(start)
+
+    loss := 100 * (stats.transmitted - stats.received) / stats.transmitted
+    fmt.Printf("\n--- %v ping statistics ---\n", dst)
+    fmt.Printf("%d packets transmitted, %d received, %d%% packet loss, time %dms\n",
+        stats.transmitted, stats.received, loss, elapsed / time.Millisecond)
+    if stats.received > 0 {
+        n := float64(stats.received)
+        avg := stats.sum / n
+        mdev := math.Sqrt(math.Max(stats.sumSquares / n - avg * avg, 0))
+        fmt.Printf("rtt min/avg/max/mdev = %.3f/%.3f/%.3f/%.3f ms\n", stats.min, avg, stats.max, mdev)
+    }
+}
@@ -1,5 +1,9 @@
 package shell
 
-func runRoute(args []string)  {
+import (
+    "github.com/arcpop/network"
+)
+
+func runRoute(s *network.Stack, args []string)  {
     
 }
\ No newline at end of file
@@ -1,6 +1,7 @@
 package shell
 
 import (
+    "github.com/arcpop/network"
     "fmt"
 	"strings"
 	"os"
@@ -8,7 +9,7 @@ import (
 )
 
 
-func Run() {
+func Run(s *network.Stack) {
     stdin := bufio.NewReader(os.Stdin)
     for {
         fmt.Print("$ ")
@@ -21,13 +22,15 @@ func Run() {
         
         switch (args[0]) {
             case "ping":
-                runPing(args[1:])
+                runPing(s, args[1:])
             case "route":
-                runRoute(args[1:])
+                runRoute(s, args[1:])
             case "arp":
-                runArp(args[1:])
+                runArp(s, args[1:])
+            case "neigh":
+                runNeigh(s, args[1:])
             case "iface":
-                runIface(args[1:])
+                runIface(s, args[1:])
         }
     }
 }
\ No newline at end of file
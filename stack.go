@@ -0,0 +1,104 @@
+//Package network ties the layers together into a network stack. Several stacks
+//can coexist in one process, each owning its interfaces, arp cache, routing table,
+//protocol handlers and sockets.
+package network
+
+import (
+	"context"
+	"sync"
+	"github.com/arcpop/network/arp"
+	"github.com/arcpop/network/ethernet"
+	"github.com/arcpop/network/ipv4"
+	"github.com/arcpop/network/ipv6"
+	"github.com/arcpop/network/netdev"
+	"github.com/arcpop/network/tcp"
+	"github.com/arcpop/network/udp"
+)
+
+//Stack is one independent instance of the network stack.
+type Stack struct {
+    Interfaces *netdev.List
+    Ethernet *ethernet.Layer
+    ARP *arp.Cache
+    IPv4 *ipv4.Layer
+    IPv6 *ipv6.Layer
+    UDP *udp.Layer
+    TCP *tcp.Layer
+    
+    cancel context.CancelFunc
+    watcher sync.WaitGroup
+}
+
+//NewStack creates a stack with all layers connected to each other, Start has to be called before use.
+func NewStack() *Stack {
+    s := &Stack{
+        Interfaces: netdev.NewList(),
+        Ethernet: &ethernet.Layer{},
+        ARP: arp.NewCache(),
+    }
+    s.IPv4 = ipv4.NewLayer(s.ARP, s.Interfaces)
+    s.IPv6 = ipv6.NewLayer(s.Interfaces)
+    s.UDP = udp.NewLayer(s.IPv4, s.IPv6)
+    s.TCP = tcp.NewLayer(s.IPv4)
+    return s
+}
+
+//Default returns the stack made of the default instances used by the package level functions of each layer.
+func Default() *Stack {
+    return &Stack{
+        Interfaces: netdev.Default,
+        Ethernet: ethernet.Default,
+        ARP: arp.Default,
+        IPv4: ipv4.Default,
+        IPv6: ipv6.Default,
+        UDP: udp.Default,
+        TCP: tcp.Default,
+    }
+}
+
+//Start connects the layers to the ethernet layer and starts their workers.
+//The stack is stopped when ctx is done or Stop is called.
+func (s *Stack) Start(ctx context.Context) {
+    ctx, s.cancel = context.WithCancel(ctx)
+    s.Ethernet.ArpIn = s.ARP.In
+    s.Ethernet.IPv4In = s.IPv4.In
+    s.Ethernet.IPv6In = s.IPv6.In
+    s.ARP.Start(ctx)
+    s.IPv4.Start(ctx)
+    s.IPv6.Start(ctx)
+    s.UDP.Start(ctx)
+    s.TCP.Start(ctx)
+    s.watcher.Add(1)
+    go func() {
+        defer s.watcher.Done()
+        <- ctx.Done()
+        s.Interfaces.Shutdown()
+    }()
+}
+
+//AddInterface hands the interface to the stack, starts receiving frames from it and autoconfigures its ipv6 addresses.
+func (s *Stack) AddInterface(iface netdev.Interface) error {
+    err := s.Interfaces.Add(iface)
+    if err != nil {
+        return err
+    }
+    s.Ethernet.Start(iface)
+    s.IPv6.Autoconfigure(iface)
+    return nil
+}
+
+//Stop stops all layers, closes the interfaces after transmitting their queued frames
+//and returns once every worker of the stack exited.
+func (s *Stack) Stop() {
+    if s.cancel != nil {
+        s.cancel()
+    }
+    s.watcher.Wait()
+    s.Interfaces.Shutdown()
+    s.ARP.Stop()
+    s.IPv4.Stop()
+    s.IPv6.Stop()
+    s.UDP.Stop()
+    s.TCP.Stop()
+    s.Ethernet.Stop()
+}
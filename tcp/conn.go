@@ -0,0 +1,393 @@
+package tcp
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+	"github.com/arcpop/network/config"
+	"github.com/arcpop/network/ipv4"
+	"github.com/arcpop/network/util"
+)
+
+//State is the state of a tcp connection as named in RFC 9293.
+type State int
+
+const (
+    StateClosed State = iota
+    StateListen
+    StateSynSent
+    StateSynReceived
+    StateEstablished
+    StateFinWait1
+    StateFinWait2
+    StateCloseWait
+    StateClosing
+    StateLastAck
+    StateTimeWait
+)
+
+var stateNames = [...]string{
+    "CLOSED", "LISTEN", "SYN-SENT", "SYN-RECEIVED", "ESTABLISHED", "FIN-WAIT-1",
+    "FIN-WAIT-2", "CLOSE-WAIT", "CLOSING", "LAST-ACK", "TIME-WAIT",
+}
+
+func (s State) String() string {
+    if s < 0 || int(s) >= len(stateNames) {
+        return "UNKNOWN"
+    }
+    return stateNames[s]
+}
+
+//outOfOrder is a segment received ahead of rcvNxt waiting for the gap to be filled.
+type outOfOrder struct {
+    data []byte
+    fin bool
+}
+
+//Conn is a tcp connection implementing net.Conn.
+type Conn struct {
+    layer *Layer
+    key connKey
+    localIP, remoteIP net.IP
+    lport, rport uint16
+    listener *Listener
+    //halfOpen is true while the connection takes one of the SYN-RECEIVED slots of the listener
+    halfOpen bool
+
+    lock sync.Mutex
+    state State
+    err error
+    closed bool
+    identification uint16
+
+    //Send sequence space, sendBuf holds the unacknowledged and unsent data starting at sndBufSeq
+    iss uint32
+    sndUna, sndNxt, sndMax uint32
+    sndWnd uint32
+    sndWl1, sndWl2 uint32
+    sndBufSeq uint32
+    sendBuf []byte
+    finQueued bool
+    finSeq uint32
+    sndMSS int
+
+    //mss is advertised to the peer and derived from the mtu of the interface
+    mss int
+
+    //Receive sequence space, recvBuf holds the in order data not yet read
+    irs uint32
+    rcvNxt uint32
+    recvBuf []byte
+    outOfOrder map[uint32]*outOfOrder
+    finReceived bool
+
+    //Retransmission timer state (RFC 6298)
+    rto, srtt, rttvar time.Duration
+    rttTiming bool
+    rttSeq uint32
+    rttStart time.Time
+    retransmits int
+    softError error
+    timer *time.Timer
+    timerGeneration uint64
+
+    readLock, writeLock sync.Mutex
+    readable, writable chan struct{}
+    established chan struct{}
+    done chan struct{}
+    readDeadline, writeDeadline *util.Deadline
+}
+
+var _ net.Conn = (*Conn)(nil)
+
+func newConn(l *Layer, localIP net.IP, localPort uint16, remoteIP net.IP, remotePort uint16) *Conn {
+    c := &Conn{
+        layer: l,
+        key: newConnKey(localIP, localPort, remoteIP, remotePort),
+        localIP: make(net.IP, 4),
+        remoteIP: make(net.IP, 4),
+        lport: localPort,
+        rport: remotePort,
+        mss: DefaultMSS,
+        sndMSS: DefaultMSS,
+        outOfOrder: make(map[uint32]*outOfOrder),
+        rto: config.TCP.InitialRTO,
+        readable: make(chan struct{}, 1),
+        writable: make(chan struct{}, 1),
+        established: make(chan struct{}),
+        done: make(chan struct{}),
+        readDeadline: util.NewDeadline(),
+        writeDeadline: util.NewDeadline(),
+    }
+    copy(c.localIP, localIP.To4())
+    copy(c.remoteIP, remoteIP.To4())
+    return c
+}
+
+//initSendSequence picks a random initial send sequence number, the SYN occupies iss.
+func (c *Conn) initSendSequence() {
+    c.iss = rand.Uint32()
+    c.sndUna = c.iss
+    c.sndNxt = c.iss + 1
+    c.sndMax = c.sndNxt
+    c.sndBufSeq = c.sndNxt
+}
+
+//setPeerMSS limits the segment size to the MSS option of the peers SYN and the known path mtu, lock has to be held.
+func (c *Conn) setPeerMSS(mss uint16) {
+    c.sndMSS = DefaultMSS
+    if mss != 0 {
+        c.sndMSS = int(mss)
+    }
+    if c.sndMSS > c.mss {
+        c.sndMSS = c.mss
+    }
+    mtu, err := c.layer.ipv4.PathMTU(c.remoteIP)
+    if err == nil && c.sndMSS > mtu - ipv4.HeaderLength - HeaderLength {
+        c.sndMSS = mtu - ipv4.HeaderLength - HeaderLength
+    }
+}
+
+func notify(ch chan struct{}) {
+    select {
+        case ch <- struct{}{}:
+        default:
+    }
+}
+
+//State returns the current state of the connection.
+func (c *Conn) State() State {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    return c.state
+}
+
+//rcvWnd returns the receive window to advertise, lock has to be held.
+func (c *Conn) rcvWnd() uint32 {
+    wnd := config.TCP.RecvBufferSize - len(c.recvBuf)
+    if wnd < 0 {
+        return 0
+    }
+    if wnd > 0xFFFF {
+        return 0xFFFF
+    }
+    return uint32(wnd)
+}
+
+//setEstablished moves the connection to ESTABLISHED and wakes up Dial or queues it on the listener, lock has to be held.
+func (c *Conn) setEstablished() {
+    c.state = StateEstablished
+    close(c.established)
+    c.leaveHalfOpen()
+    if c.listener != nil && !c.listener.enqueue(c) {
+        c.sendReset(c.sndNxt)
+        c.terminate(ErrConnectionReset)
+    }
+}
+
+//terminate moves the connection to CLOSED, unregisters it and wakes up all waiters, lock has to be held.
+func (c *Conn) terminate(err error) {
+    if c.state == StateClosed {
+        return
+    }
+    c.state = StateClosed
+    if c.err == nil {
+        c.err = err
+    }
+    c.stopTimer()
+    c.leaveHalfOpen()
+    c.layer.removeConn(c)
+    close(c.done)
+}
+
+//leaveHalfOpen gives the SYN-RECEIVED slot back to the listener, lock has to be held.
+func (c *Conn) leaveHalfOpen() {
+    if c.halfOpen {
+        c.halfOpen = false
+        c.listener.leaveHalfOpen()
+    }
+}
+
+//abort sends a reset to the peer and terminates the connection, lock has to be held.
+func (c *Conn) abort(err error) {
+    switch c.state {
+    case StateSynReceived, StateEstablished, StateFinWait1, StateFinWait2, StateCloseWait:
+        c.sendReset(c.sndNxt)
+    }
+    c.terminate(err)
+}
+
+//Read reads the received data in order, it returns io.EOF once the peer closed its side.
+func (c *Conn) Read(b []byte) (int, error) {
+    c.readLock.Lock()
+    defer c.readLock.Unlock()
+    for {
+        c.lock.Lock()
+        if c.closed {
+            c.lock.Unlock()
+            return 0, net.ErrClosed
+        }
+        if c.err != nil {
+            err := c.err
+            c.lock.Unlock()
+            return 0, err
+        }
+        if len(c.recvBuf) > 0 {
+            before := c.rcvWnd()
+            n := copy(b, c.recvBuf)
+            c.recvBuf = c.recvBuf[n:]
+            if len(c.recvBuf) == 0 {
+                c.recvBuf = nil
+            }
+            //Tell the peer about the opened window if it was too small to send a full segment
+            if before < uint32(c.mss) && c.rcvWnd() >= uint32(c.mss) && c.state != StateClosed {
+                c.sendAck()
+            }
+            c.lock.Unlock()
+            return n, nil
+        }
+        if c.finReceived || c.state == StateClosed {
+            c.lock.Unlock()
+            return 0, io.EOF
+        }
+        c.lock.Unlock()
+        if len(b) == 0 {
+            return 0, nil
+        }
+        select {
+            case <- c.readable:
+            case <- c.done:
+            case <- c.readDeadline.Done():
+                return 0, os.ErrDeadlineExceeded
+        }
+    }
+}
+
+//Write queues b for sending, it blocks while the send buffer is full.
+func (c *Conn) Write(b []byte) (int, error) {
+    c.writeLock.Lock()
+    defer c.writeLock.Unlock()
+    written := 0
+    for {
+        if c.writeDeadline.Exceeded() {
+            return written, os.ErrDeadlineExceeded
+        }
+        c.lock.Lock()
+        if c.closed || c.finQueued {
+            c.lock.Unlock()
+            return written, net.ErrClosed
+        }
+        if c.err != nil {
+            err := c.err
+            c.lock.Unlock()
+            return written, err
+        }
+        if c.state == StateClosed {
+            c.lock.Unlock()
+            return written, net.ErrClosed
+        }
+        space := config.TCP.SendBufferSize - len(c.sendBuf)
+        if space > 0 {
+            n := len(b) - written
+            if n > space {
+                n = space
+            }
+            c.sendBuf = append(c.sendBuf, b[written:written + n]...)
+            written += n
+            c.output()
+        }
+        c.lock.Unlock()
+        if written == len(b) {
+            return written, nil
+        }
+        if space > 0 {
+            continue
+        }
+        select {
+            case <- c.writable:
+            case <- c.done:
+            case <- c.writeDeadline.Done():
+        }
+    }
+}
+
+//queueFin queues a FIN after the buffered data and moves to the given state, lock has to be held.
+func (c *Conn) queueFin(next State) {
+    c.finQueued = true
+    c.finSeq = c.sndBufSeq + uint32(len(c.sendBuf))
+    c.state = next
+    c.output()
+}
+
+//CloseWrite sends a FIN after the buffered data, the connection can still be read from.
+func (c *Conn) CloseWrite() error {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    if c.closed {
+        return net.ErrClosed
+    }
+    if c.finQueued {
+        return nil
+    }
+    switch c.state {
+    case StateSynReceived, StateEstablished:
+        c.queueFin(StateFinWait1)
+    case StateCloseWait:
+        c.queueFin(StateLastAck)
+    }
+    notify(c.writable)
+    return nil
+}
+
+//Close closes the connection, buffered data is still sent before the FIN unless
+//received data was left unread in which case the connection is reset (RFC 2525).
+func (c *Conn) Close() error {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    if c.closed {
+        return net.ErrClosed
+    }
+    c.closed = true
+    if len(c.recvBuf) > 0 || c.state == StateSynSent {
+        c.abort(net.ErrClosed)
+    } else if !c.finQueued {
+        switch c.state {
+        case StateSynReceived, StateEstablished:
+            c.queueFin(StateFinWait1)
+        case StateCloseWait:
+            c.queueFin(StateLastAck)
+        }
+    } else {
+        c.startFinTimer()
+    }
+    notify(c.readable)
+    notify(c.writable)
+    return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+    return &net.TCPAddr{ IP: c.localIP, Port: int(c.lport) }
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+    return &net.TCPAddr{ IP: c.remoteIP, Port: int(c.rport) }
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+    c.readDeadline.Set(t)
+    c.writeDeadline.Set(t)
+    return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+    c.readDeadline.Set(t)
+    return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+    c.writeDeadline.Set(t)
+    return nil
+}
@@ -0,0 +1,138 @@
+package tcp
+
+import (
+	"encoding/binary"
+)
+
+const (
+    //HeaderLength is the length of a tcp header without options
+    HeaderLength = 20
+
+    //DefaultMSS is the maximum segment size assumed if the peer sends no MSS option (RFC 1122)
+    DefaultMSS = 536
+)
+
+const (
+    FlagFIN = 1 << iota
+    FlagSYN = 1 << iota
+    FlagRST = 1 << iota
+    FlagPSH = 1 << iota
+    FlagACK = 1 << iota
+    FlagURG = 1 << iota
+)
+
+const (
+    optionEnd = 0
+    optionNOP = 1
+    optionMSS = 2
+)
+
+//Header represents a tcp header, MSS is zero if the segment carried no MSS option
+type Header struct {
+    SourcePort uint16
+    DestinationPort uint16
+    Seq uint32
+    Ack uint32
+    DataOffset byte
+    Flags byte
+    Window uint16
+    Checksum uint16
+    Urgent uint16
+    MSS uint16
+}
+
+func (h *Header) has(flag byte) bool {
+    return (h.Flags & flag) != 0
+}
+
+func parseHeader(buf []byte) *Header {
+    if len(buf) < HeaderLength {
+        return nil
+    }
+    h := &Header{
+        SourcePort: binary.BigEndian.Uint16(buf[0:2]),
+        DestinationPort: binary.BigEndian.Uint16(buf[2:4]),
+        Seq: binary.BigEndian.Uint32(buf[4:8]),
+        Ack: binary.BigEndian.Uint32(buf[8:12]),
+        DataOffset: buf[12] >> 4,
+        Flags: buf[13] & 0x3F,
+        Window: binary.BigEndian.Uint16(buf[14:16]),
+        Checksum: binary.BigEndian.Uint16(buf[16:18]),
+        Urgent: binary.BigEndian.Uint16(buf[18:20]),
+    }
+    headerSize := int(h.DataOffset) << 2
+    if headerSize < HeaderLength || headerSize > len(buf) {
+        return nil
+    }
+    h.parseOptions(buf[HeaderLength:headerSize])
+    return h
+}
+
+func (h *Header) parseOptions(opts []byte) {
+    for len(opts) > 0 {
+        switch opts[0] {
+        case optionEnd:
+            return
+        case optionNOP:
+            opts = opts[1:]
+            continue
+        }
+        if len(opts) < 2 || opts[1] < 2 || int(opts[1]) > len(opts) {
+            return
+        }
+        if opts[0] == optionMSS && opts[1] == 4 {
+            h.MSS = binary.BigEndian.Uint16(opts[2:4])
+        }
+        opts = opts[opts[1]:]
+    }
+}
+
+//size returns the length of the header including options
+func (h *Header) size() int {
+    if h.MSS != 0 {
+        return HeaderLength + 4
+    }
+    return HeaderLength
+}
+
+//put writes the header with a zero checksum
+func (h *Header) put(buf []byte) {
+    size := h.size()
+    binary.BigEndian.PutUint16(buf[0:2], h.SourcePort)
+    binary.BigEndian.PutUint16(buf[2:4], h.DestinationPort)
+    binary.BigEndian.PutUint32(buf[4:8], h.Seq)
+    binary.BigEndian.PutUint32(buf[8:12], h.Ack)
+    buf[12] = byte(size >> 2) << 4
+    buf[13] = h.Flags
+    binary.BigEndian.PutUint16(buf[14:16], h.Window)
+    buf[16] = 0
+    buf[17] = 0
+    binary.BigEndian.PutUint16(buf[18:20], h.Urgent)
+    if h.MSS != 0 {
+        buf[20] = optionMSS
+        buf[21] = 4
+        binary.BigEndian.PutUint16(buf[22:24], h.MSS)
+    }
+}
+
+//Sequence number comparisons modulo 2^32 (RFC 1982)
+func seqLT(a, b uint32) bool {
+    return int32(a - b) < 0
+}
+
+func seqLEQ(a, b uint32) bool {
+    return int32(a - b) <= 0
+}
+
+func seqGT(a, b uint32) bool {
+    return int32(a - b) > 0
+}
+
+func seqGEQ(a, b uint32) bool {
+    return int32(a - b) >= 0
+}
+
+//seqInWindow returns true if start <= seq < start + size
+func seqInWindow(seq, start, size uint32) bool {
+    return seqGEQ(seq, start) && seqLT(seq, start + size)
+}
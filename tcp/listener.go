@@ -0,0 +1,179 @@
+package tcp
+
+import (
+	"net"
+	"sync"
+	"github.com/arcpop/network/config"
+	"github.com/arcpop/network/ip"
+	"github.com/arcpop/network/ipv4"
+)
+
+//Listener accepts incoming tcp connections and implements net.Listener.
+type Listener struct {
+    layer *Layer
+    localIP net.IP
+    port uint16
+
+    lock sync.Mutex
+    closed bool
+    //halfOpen counts the connections in SYN-RECEIVED, at most AcceptBacklog of them exist at a time
+    halfOpen int
+    acceptQueue chan *Conn
+    done chan struct{}
+}
+
+var _ net.Listener = (*Listener)(nil)
+
+func newListener(l *Layer, localIP net.IP, port uint16) *Listener {
+    ln := &Listener{
+        layer: l,
+        localIP: make(net.IP, 4),
+        port: port,
+        acceptQueue: make(chan *Conn, config.TCP.AcceptBacklog),
+        done: make(chan struct{}),
+    }
+    copy(ln.localIP, localIP)
+    return ln
+}
+
+//segmentArrives handles a segment for the listening port which belongs to no connection.
+func (ln *Listener) segmentArrives(ipHdr *ipv4.Header, hdr *Header) {
+    l := ln.layer
+    if hdr.has(FlagRST) {
+        return
+    }
+    if hdr.has(FlagACK) {
+        l.sendResetFor(ipHdr, hdr, 0)
+        return
+    }
+    if !hdr.has(FlagSYN) {
+        return
+    }
+    ln.lock.Lock()
+    full := ln.closed || len(ln.acceptQueue) == cap(ln.acceptQueue) || ln.halfOpen >= config.TCP.AcceptBacklog
+    if !full {
+        ln.halfOpen++
+    }
+    ln.lock.Unlock()
+    if full {
+        //Let the peer retransmit the SYN, the backlog might drain in between
+        return
+    }
+    route, err := l.ipv4.RouteLookup(&ipv4.RouteQuery{ Dst: ipHdr.SourceIP, Src: ipHdr.TargetIP, Protocol: ip.IPPROTO_TCP, SrcPort: hdr.DestinationPort, DstPort: hdr.SourcePort })
+    if err != nil {
+        ln.leaveHalfOpen()
+        return
+    }
+
+    c := newConn(l, ipHdr.TargetIP, hdr.DestinationPort, ipHdr.SourceIP, hdr.SourcePort)
+    c.listener = ln
+    c.halfOpen = true
+    c.mss = route.Iface.GetMTU() - ipv4.HeaderLength - HeaderLength
+    c.setPeerMSS(hdr.MSS)
+    c.initSendSequence()
+    c.irs = hdr.Seq
+    c.rcvNxt = hdr.Seq + 1
+    c.sndWnd = uint32(hdr.Window)
+    c.sndWl1 = hdr.Seq
+    c.state = StateSynReceived
+
+    l.connsLock.Lock()
+    _, exists := l.conns[c.key]
+    if !exists {
+        l.conns[c.key] = c
+    }
+    l.connsLock.Unlock()
+    if exists {
+        ln.leaveHalfOpen()
+        return
+    }
+    c.lock.Lock()
+    c.sendSynAck()
+    c.startTimer(c.rto)
+    c.lock.Unlock()
+}
+
+//leaveHalfOpen releases the slot of a connection which left SYN-RECEIVED or was never created.
+func (ln *Listener) leaveHalfOpen() {
+    ln.lock.Lock()
+    ln.halfOpen--
+    ln.lock.Unlock()
+}
+
+//enqueue hands an established connection to Accept, it returns false if the listener
+//is closed or the backlog is full.
+func (ln *Listener) enqueue(c *Conn) bool {
+    ln.lock.Lock()
+    defer ln.lock.Unlock()
+    if ln.closed {
+        return false
+    }
+    select {
+        case ln.acceptQueue <- c:
+            return true
+        default:
+            return false
+    }
+}
+
+//Accept waits for the next established connection.
+func (ln *Listener) Accept() (net.Conn, error) {
+    return ln.AcceptTCP()
+}
+
+//AcceptTCP waits for the next established connection and returns it as *Conn.
+func (ln *Listener) AcceptTCP() (*Conn, error) {
+    select {
+        case c := <- ln.acceptQueue:
+            return c, nil
+        case <- ln.done:
+            return nil, net.ErrClosed
+    }
+}
+
+//Close stops listening, connections which were not accepted yet are reset.
+func (ln *Listener) Close() error {
+    ln.lock.Lock()
+    if ln.closed {
+        ln.lock.Unlock()
+        return net.ErrClosed
+    }
+    ln.closed = true
+    close(ln.done)
+    ln.lock.Unlock()
+
+    l := ln.layer
+    l.connsLock.Lock()
+    if l.listeners[ln.port] == ln {
+        delete(l.listeners, ln.port)
+    }
+    pending := make([]*Conn, 0)
+    for _, c := range l.conns {
+        if c.listener == ln {
+            pending = append(pending, c)
+        }
+    }
+    l.connsLock.Unlock()
+
+    for _, c := range pending {
+        c.lock.Lock()
+        if c.state == StateSynReceived {
+            c.abort(net.ErrClosed)
+        }
+        c.lock.Unlock()
+    }
+    for {
+        select {
+            case c := <- ln.acceptQueue:
+                c.lock.Lock()
+                c.abort(net.ErrClosed)
+                c.lock.Unlock()
+            default:
+                return nil
+        }
+    }
+}
+
+func (ln *Listener) Addr() net.Addr {
+    return &net.TCPAddr{ IP: ln.localIP, Port: int(ln.port) }
+}
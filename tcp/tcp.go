@@ -0,0 +1,239 @@
+//Package tcp implements the transmission control protocol (RFC 9293) on top of the ipv4 layer.
+package tcp
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"github.com/arcpop/network/config"
+	"github.com/arcpop/network/ip"
+	"github.com/arcpop/network/ipv4"
+	"github.com/arcpop/network/ipv6"
+)
+
+var (
+    ErrConnectionRefused = errors.New("Connection refused!")
+    ErrConnectionReset = errors.New("Connection reset by peer!")
+    ErrTimeout = errors.New("Connection timed out!")
+    ErrLocalPortAlreadyBound = errors.New("Local port is already bound!")
+    ErrInvalidPort = errors.New("Invalid port!")
+)
+
+const (
+    ephemeralPortFirst = 49152
+    ephemeralPortCount = 0x10000 - ephemeralPortFirst
+)
+
+type connKey struct {
+    localIP, remoteIP [4]byte
+    localPort, remotePort uint16
+}
+
+func newConnKey(localIP net.IP, localPort uint16, remoteIP net.IP, remotePort uint16) connKey {
+    k := connKey{ localPort: localPort, remotePort: remotePort }
+    copy(k.localIP[:], localIP.To4())
+    copy(k.remoteIP[:], remoteIP.To4())
+    return k
+}
+
+//Layer holds the tcp connections and listeners of one stack.
+type Layer struct {
+    ipv4 *ipv4.Layer
+
+    connsLock sync.RWMutex
+    conns map[connKey]*Conn
+    listeners map[uint16]*Listener
+
+    recvQueue chan *ipv4.L3Packet
+
+    cancel context.CancelFunc
+    workers sync.WaitGroup
+}
+
+//Default is the layer used by the package level functions.
+var Default = NewLayer(ipv4.Default)
+
+//NewLayer creates a tcp layer on top of the given ipv4 layer.
+func NewLayer(ip4 *ipv4.Layer) *Layer {
+    l := &Layer{
+        ipv4: ip4,
+        conns: make(map[connKey]*Conn),
+        listeners: make(map[uint16]*Listener),
+        recvQueue: make(chan *ipv4.L3Packet, config.TCP.RecvQueueSize),
+    }
+    ip4.RegisterProtocol(ip.IPPROTO_TCP, l)
+    return l
+}
+
+func Start() {
+    Default.Start(context.Background())
+}
+
+func Stop() {
+    Default.Stop()
+}
+
+//Start starts the receive workers, they run until ctx is done or Stop is called.
+func (l *Layer) Start(ctx context.Context) {
+    ctx, l.cancel = context.WithCancel(ctx)
+    for i := 0; i < config.TCP.NumberOfQueueWorkers; i++ {
+        l.workers.Add(1)
+        go l.tcpRecvWorker(ctx)
+    }
+}
+
+//Stop stops the receive workers, closes all listeners and terminates all connections.
+func (l *Layer) Stop() {
+    if l.cancel != nil {
+        l.cancel()
+    }
+    l.workers.Wait()
+
+    l.connsLock.Lock()
+    listeners := make([]*Listener, 0, len(l.listeners))
+    for _, ln := range l.listeners {
+        listeners = append(listeners, ln)
+    }
+    conns := make([]*Conn, 0, len(l.conns))
+    for _, c := range l.conns {
+        conns = append(conns, c)
+    }
+    l.connsLock.Unlock()
+
+    for _, ln := range listeners {
+        ln.Close()
+    }
+    for _, c := range conns {
+        c.lock.Lock()
+        c.terminate(net.ErrClosed)
+        c.lock.Unlock()
+    }
+}
+
+//Dial opens a connection to remoteIP:remotePort using the default layer.
+func Dial(remoteIP net.IP, remotePort uint16) (*Conn, error) {
+    return Default.Dial(remoteIP, remotePort)
+}
+
+//Listen listens on localIP:port using the default layer.
+func Listen(localIP net.IP, port uint16) (*Listener, error) {
+    return Default.Listen(localIP, port)
+}
+
+//Dial opens a connection to remoteIP:remotePort and waits for the handshake to complete.
+func (l *Layer) Dial(remoteIP net.IP, remotePort uint16) (*Conn, error) {
+    return l.DialContext(context.Background(), remoteIP, remotePort)
+}
+
+//DialContext opens a connection to remoteIP:remotePort, the handshake is aborted when ctx is done.
+func (l *Layer) DialContext(ctx context.Context, remoteIP net.IP, remotePort uint16) (*Conn, error) {
+    if remotePort == 0 {
+        return nil, ErrInvalidPort
+    }
+    ip4 := remoteIP.To4()
+    if ip4 == nil {
+        return nil, ipv6.ErrNotImplemented
+    }
+
+    l.connsLock.Lock()
+    localPort := l.ephemeralPort()
+    //The port is part of the flow which selects the path of multipath routes
+    q := &ipv4.RouteQuery{ Dst: ip4, Protocol: ip.IPPROTO_TCP, SrcPort: localPort, DstPort: remotePort }
+    route, err := l.ipv4.RouteLookup(q)
+    if err != nil {
+        l.connsLock.Unlock()
+        return nil, err
+    }
+    localIP, err := l.ipv4.SourceAddressFor(q)
+    if err != nil {
+        l.connsLock.Unlock()
+        return nil, err
+    }
+    c := newConn(l, localIP, localPort, ip4, remotePort)
+    c.mss = route.Iface.GetMTU() - ipv4.HeaderLength - HeaderLength
+    c.initSendSequence()
+    c.state = StateSynSent
+    l.conns[c.key] = c
+    l.connsLock.Unlock()
+
+    c.lock.Lock()
+    c.sendSyn()
+    c.startTimer(c.rto)
+    c.lock.Unlock()
+
+    select {
+    case <- c.established:
+    case <- c.done:
+    case <- ctx.Done():
+        c.lock.Lock()
+        c.terminate(ctx.Err())
+        c.lock.Unlock()
+    }
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    if c.err != nil {
+        return nil, c.err
+    }
+    return c, nil
+}
+
+//Listen listens for connections on localIP:port, a nil or unspecified localIP accepts
+//connections to all local addresses.
+func (l *Layer) Listen(localIP net.IP, port uint16) (*Listener, error) {
+    if port == 0 {
+        return nil, ErrInvalidPort
+    }
+    if localIP == nil {
+        localIP = net.IPv4zero
+    }
+    ip4 := localIP.To4()
+    if ip4 == nil {
+        return nil, ipv6.ErrNotImplemented
+    }
+    l.connsLock.Lock()
+    defer l.connsLock.Unlock()
+    _, ok := l.listeners[port]
+    if ok {
+        return nil, ErrLocalPortAlreadyBound
+    }
+    ln := newListener(l, ip4, port)
+    l.listeners[port] = ln
+    return ln, nil
+}
+
+//portInUse returns true if a listener or a connection uses the local port, connsLock has to be held.
+func (l *Layer) portInUse(port uint16) bool {
+    _, ok := l.listeners[port]
+    if ok {
+        return true
+    }
+    for k := range l.conns {
+        if k.localPort == port {
+            return true
+        }
+    }
+    return false
+}
+
+//ephemeralPort picks a random unused local port, connsLock has to be held.
+func (l *Layer) ephemeralPort() uint16 {
+    start := rand.Intn(ephemeralPortCount)
+    for i := 0; i < ephemeralPortCount; i++ {
+        port := uint16(ephemeralPortFirst + (start + i) % ephemeralPortCount)
+        if !l.portInUse(port) {
+            return port
+        }
+    }
+    //All ports are taken, share one with a different remote end
+    return uint16(ephemeralPortFirst + start)
+}
+
+func (l *Layer) removeConn(c *Conn) {
+    l.connsLock.Lock()
+    if l.conns[c.key] == c {
+        delete(l.conns, c.key)
+    }
+    l.connsLock.Unlock()
+}
@@ -0,0 +1,418 @@
+package tcp
+
+import (
+	"context"
+	"encoding/binary"
+	"log"
+	"github.com/arcpop/network/config"
+	"github.com/arcpop/network/ip"
+	"github.com/arcpop/network/ipv4"
+)
+
+//IPv4In queues a received segment for the receive workers, it is called by the ipv4 layer.
+func (l *Layer) IPv4In(header *ipv4.Header, data []byte) {
+    select {
+    case l.recvQueue <- &ipv4.L3Packet{IPHeader: header, ProtocolData: data}:
+    default:
+        log.Println("TCP: Receive queue full, dropping segment.")
+    }
+}
+
+func (l *Layer) tcpRecvWorker(ctx context.Context) {
+    defer l.workers.Done()
+    for {
+        select {
+        case <- ctx.Done():
+            return
+        case pkt := <- l.recvQueue:
+            l.in4(pkt.IPHeader, pkt.ProtocolData)
+        }
+    }
+}
+
+func (l *Layer) in4(ipHdr *ipv4.Header, data []byte) {
+    //Segments to broadcast or multicast addresses are dropped without a reset (RFC 1122 section 4.2.3.10)
+    if ipHdr.TargetIP.IsMulticast() || l.ipv4.IsBroadcast(ipHdr.TargetIP) {
+        return
+    }
+    hdr := parseHeader(data)
+    if hdr == nil {
+        log.Println("TCP: Invalid header, dropping.")
+        return
+    }
+    if ipv4.PseudoHeaderChecksum(ipHdr.SourceIP, ipHdr.TargetIP, ip.IPPROTO_TCP, data) != 0 {
+        log.Println("TCP: Checksum mismatch, dropping.")
+        return
+    }
+    payload := data[int(hdr.DataOffset) << 2:]
+
+    key := newConnKey(ipHdr.TargetIP, hdr.DestinationPort, ipHdr.SourceIP, hdr.SourcePort)
+    l.connsLock.RLock()
+    c, ok := l.conns[key]
+    ln, lok := l.listeners[hdr.DestinationPort]
+    l.connsLock.RUnlock()
+    if ok {
+        c.lock.Lock()
+        c.segmentArrives(hdr, payload)
+        c.lock.Unlock()
+        return
+    }
+    if lok && (ln.localIP.IsUnspecified() || ln.localIP.Equal(ipHdr.TargetIP)) {
+        ln.segmentArrives(ipHdr, hdr)
+        return
+    }
+    if !hdr.has(FlagRST) {
+        l.sendResetFor(ipHdr, hdr, segmentLength(hdr, payload))
+    }
+}
+
+//segmentLength returns the amount of sequence space occupied by the segment.
+func segmentLength(hdr *Header, data []byte) uint32 {
+    n := uint32(len(data))
+    if hdr.has(FlagSYN) {
+        n++
+    }
+    if hdr.has(FlagFIN) {
+        n++
+    }
+    return n
+}
+
+//acceptable implements the segment acceptability test of RFC 9293 section 3.10.7.4.
+func (c *Conn) acceptable(seq, segLen uint32) bool {
+    wnd := c.rcvWnd()
+    if segLen == 0 {
+        if wnd == 0 {
+            return seq == c.rcvNxt
+        }
+        return seqInWindow(seq, c.rcvNxt, wnd)
+    }
+    if wnd == 0 {
+        return false
+    }
+    return seqInWindow(seq, c.rcvNxt, wnd) || seqInWindow(seq + segLen - 1, c.rcvNxt, wnd)
+}
+
+//segmentArrives processes a segment for the connection following RFC 9293 section 3.10.7, lock has to be held.
+func (c *Conn) segmentArrives(hdr *Header, data []byte) {
+    switch c.state {
+    case StateClosed:
+        return
+    case StateSynSent:
+        c.synSentArrives(hdr)
+        return
+    }
+    fin := hdr.has(FlagFIN)
+    probed := false
+
+    //A retransmitted SYN means our SYN-ACK got lost
+    if c.state == StateSynReceived && hdr.has(FlagSYN) && !hdr.has(FlagACK) && hdr.Seq == c.irs {
+        c.sendSynAck()
+        return
+    }
+
+    if !c.acceptable(hdr.Seq, segmentLength(hdr, data)) {
+        if c.rcvWnd() == 0 && hdr.Seq == c.rcvNxt {
+            //Zero window: still process the ACK, it may be the answer to a window probe
+            probed = len(data) > 0 || fin
+            data = nil
+            fin = false
+        } else {
+            if !hdr.has(FlagRST) {
+                if fin && c.state == StateTimeWait {
+                    c.startTimer(2 * config.TCP.MSL)
+                }
+                c.sendAck()
+            }
+            return
+        }
+    }
+
+    if hdr.has(FlagRST) {
+        //Only a reset exactly at rcvNxt is accepted, others get a challenge ACK (RFC 5961)
+        if hdr.Seq != c.rcvNxt {
+            c.sendAck()
+            return
+        }
+        if c.state == StateLastAck || c.state == StateClosing || c.state == StateTimeWait {
+            c.terminate(nil)
+        } else {
+            c.terminate(ErrConnectionReset)
+        }
+        return
+    }
+
+    if hdr.has(FlagSYN) {
+        c.sendAck()
+        return
+    }
+
+    if !hdr.has(FlagACK) {
+        return
+    }
+
+    if c.state == StateSynReceived {
+        if !seqGT(hdr.Ack, c.sndUna) || seqGT(hdr.Ack, c.sndMax) {
+            c.sendReset(hdr.Ack)
+            return
+        }
+        c.sndWnd = uint32(hdr.Window)
+        c.sndWl1 = hdr.Seq
+        c.sndWl2 = hdr.Ack
+        c.updateRTO(hdr.Ack)
+        c.sndUna = hdr.Ack
+        c.retransmits = 0
+        c.stopTimer()
+        c.setEstablished()
+        if c.state == StateClosed {
+            return
+        }
+    }
+
+    if seqGT(hdr.Ack, c.sndMax) {
+        c.sendAck()
+        return
+    }
+    c.processAck(hdr)
+
+    finAcked := c.finQueued && seqGT(c.sndUna, c.finSeq)
+    switch c.state {
+    case StateFinWait1:
+        if finAcked {
+            c.state = StateFinWait2
+            c.startFinTimer()
+        }
+    case StateClosing:
+        if finAcked {
+            c.enterTimeWait()
+        }
+        return
+    case StateLastAck:
+        if finAcked {
+            c.terminate(nil)
+        }
+        return
+    }
+
+    if probed {
+        c.sendAck()
+        return
+    }
+    c.processData(hdr.Seq, data, fin)
+}
+
+//synSentArrives handles the answer to our SYN, lock has to be held.
+func (c *Conn) synSentArrives(hdr *Header) {
+    if hdr.has(FlagACK) && (seqLEQ(hdr.Ack, c.iss) || seqGT(hdr.Ack, c.sndMax)) {
+        if !hdr.has(FlagRST) {
+            c.sendReset(hdr.Ack)
+        }
+        return
+    }
+    if hdr.has(FlagRST) {
+        if hdr.has(FlagACK) {
+            c.terminate(ErrConnectionRefused)
+        }
+        return
+    }
+    if !hdr.has(FlagSYN) {
+        return
+    }
+    c.irs = hdr.Seq
+    c.rcvNxt = hdr.Seq + 1
+    c.setPeerMSS(hdr.MSS)
+    c.sndWnd = uint32(hdr.Window)
+    c.sndWl1 = hdr.Seq
+    c.sndWl2 = hdr.Ack
+    if !hdr.has(FlagACK) {
+        //Simultaneous open
+        c.state = StateSynReceived
+        c.sendSynAck()
+        return
+    }
+    c.updateRTO(hdr.Ack)
+    c.sndUna = hdr.Ack
+    c.retransmits = 0
+    c.stopTimer()
+    c.setEstablished()
+    c.sendAck()
+}
+
+//processAck releases acknowledged data and updates the send window, lock has to be held.
+func (c *Conn) processAck(hdr *Header) {
+    ack := hdr.Ack
+    if seqGT(ack, c.sndUna) {
+        c.updateRTO(ack)
+        acked := int(ack - c.sndBufSeq)
+        if acked > len(c.sendBuf) {
+            //The FIN got acknowledged as well
+            acked = len(c.sendBuf)
+        }
+        c.sendBuf = c.sendBuf[acked:]
+        c.sndBufSeq += uint32(acked)
+        c.sndUna = ack
+        if seqLT(c.sndNxt, c.sndUna) {
+            c.sndNxt = c.sndUna
+        }
+        c.retransmits = 0
+        c.softError = nil
+        if c.sndUna == c.sndMax {
+            c.stopTimer()
+        } else {
+            c.startTimer(c.rto)
+        }
+        notify(c.writable)
+    }
+    if seqLT(c.sndWl1, hdr.Seq) || (c.sndWl1 == hdr.Seq && seqLEQ(c.sndWl2, ack)) {
+        c.sndWnd = uint32(hdr.Window)
+        c.sndWl1 = hdr.Seq
+        c.sndWl2 = ack
+    }
+    //The peer is alive and answers our window probes
+    if c.sndWnd == 0 && ack == c.sndUna {
+        c.retransmits = 0
+    }
+    c.output()
+}
+
+//processData queues the segment text for reading and handles the FIN, lock has to be held.
+func (c *Conn) processData(seq uint32, data []byte, fin bool) {
+    switch c.state {
+    case StateEstablished, StateFinWait1, StateFinWait2:
+    default:
+        return
+    }
+    if len(data) == 0 && !fin {
+        return
+    }
+    //Trim what we already have and what does not fit into the window
+    if seqLT(seq, c.rcvNxt) {
+        skip := int(c.rcvNxt - seq)
+        if skip > len(data) {
+            data = nil
+            fin = false
+        } else {
+            data = data[skip:]
+        }
+        seq = c.rcvNxt
+    }
+    room := int(c.rcvWnd()) - int(seq - c.rcvNxt)
+    if room < 0 {
+        room = 0
+    }
+    if len(data) > room {
+        data = data[:room]
+        fin = false
+    }
+
+    if seq != c.rcvNxt {
+        if len(data) > 0 || fin {
+            old, ok := c.outOfOrder[seq]
+            if !ok || len(old.data) < len(data) {
+                seg := &outOfOrder{ data: make([]byte, len(data)), fin: fin }
+                copy(seg.data, data)
+                c.outOfOrder[seq] = seg
+            }
+        }
+        //Duplicate ACK tells the peer about the gap
+        c.sendAck()
+        return
+    }
+    c.recvBuf = append(c.recvBuf, data...)
+    c.rcvNxt += uint32(len(data))
+    if !fin {
+        fin = c.pullOutOfOrder()
+    }
+    if fin {
+        c.rcvNxt++
+        c.finReceived = true
+        c.outOfOrder = make(map[uint32]*outOfOrder)
+        switch c.state {
+        case StateEstablished:
+            c.state = StateCloseWait
+        case StateFinWait1:
+            c.state = StateClosing
+        case StateFinWait2:
+            c.enterTimeWait()
+        }
+    }
+    c.sendAck()
+    notify(c.readable)
+}
+
+//pullOutOfOrder appends the queued segments which are now in order, it returns true if
+//the FIN was reached. Lock has to be held.
+func (c *Conn) pullOutOfOrder() bool {
+    progress := true
+    for progress {
+        progress = false
+        for seq, seg := range c.outOfOrder {
+            if seqGT(seq, c.rcvNxt) {
+                continue
+            }
+            delete(c.outOfOrder, seq)
+            progress = true
+            end := seq + uint32(len(seg.data))
+            if seqGT(end, c.rcvNxt) {
+                c.recvBuf = append(c.recvBuf, seg.data[c.rcvNxt - seq:]...)
+                c.rcvNxt = end
+            }
+            if seg.fin && end == c.rcvNxt {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+//startFinTimer limits the time a connection which was closed by the application waits in FIN-WAIT-2,
+//otherwise a peer which never sends its FIN keeps it forever. Lock has to be held.
+func (c *Conn) startFinTimer() {
+    if c.closed && c.state == StateFinWait2 {
+        c.startTimer(config.TCP.FinTimeout)
+    }
+}
+
+//enterTimeWait keeps the connection around for twice the maximum segment lifetime, lock has to be held.
+func (c *Conn) enterTimeWait() {
+    c.state = StateTimeWait
+    c.startTimer(2 * config.TCP.MSL)
+    notify(c.readable)
+}
+
+//IPv4Error handles an icmp error caused by one of our segments, it is called by the ipv4 layer.
+//Hard errors abort a connection attempt, soft errors are reported if the connection times out (RFC 1122 section 4.2.3.9).
+func (l *Layer) IPv4Error(err *ipv4.ICMPError, original *ipv4.Header, data []byte) {
+    if len(data) < 8 {
+        return
+    }
+    hdr := &Header{
+        SourcePort: binary.BigEndian.Uint16(data[0:2]),
+        DestinationPort: binary.BigEndian.Uint16(data[2:4]),
+        Seq: binary.BigEndian.Uint32(data[4:8]),
+    }
+    key := newConnKey(original.SourceIP, hdr.SourcePort, original.TargetIP, hdr.DestinationPort)
+    l.connsLock.RLock()
+    c, ok := l.conns[key]
+    l.connsLock.RUnlock()
+    if !ok {
+        return
+    }
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    //Only accept errors for data in flight so blind attackers can not reset connections (RFC 5927)
+    if !seqGEQ(hdr.Seq, c.sndUna) || !seqLT(hdr.Seq, c.sndMax) {
+        return
+    }
+    //The mtu is only learned from messages about segments in flight, so blind attackers can not shrink it
+    if err.Type == ip.ICMPTypeDestinationUnreachable && err.Code == ip.ICMPCodeFragmentationNeeded {
+        l.ipv4.UpdatePathMTU(original, int(err.MTU))
+        c.pathMTUChanged()
+        return
+    }
+    if c.state == StateSynSent && err.Hard() {
+        c.terminate(err)
+        return
+    }
+    c.softError = err
+}
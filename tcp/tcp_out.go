@@ -0,0 +1,295 @@
+package tcp
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"time"
+	"github.com/arcpop/network/config"
+	"github.com/arcpop/network/ip"
+	"github.com/arcpop/network/ipv4"
+)
+
+//clockGranularity is the G of RFC 6298
+const clockGranularity = 10 * time.Millisecond
+
+//send4 builds the tcp segment including the checksum over the ipv4 pseudo header and sends it.
+func (l *Layer) send4(srcIP, dstIP net.IP, hdr *Header, id uint16, payload []byte) error {
+    size := hdr.size()
+    pkt := ipv4.AllocatePacket(size + len(payload))
+    hdr.put(pkt.ProtocolData)
+    copy(pkt.ProtocolData[size:], payload)
+    csum := ipv4.PseudoHeaderChecksum(srcIP, dstIP, ip.IPPROTO_TCP, pkt.ProtocolData)
+    binary.BigEndian.PutUint16(pkt.ProtocolData[16:18], csum)
+    pkt.IPHeader = &ipv4.Header{
+        TargetIP: dstIP,
+        SourceIP: srcIP,
+        Identification: id,
+        TTL: byte(config.IPv4.DefaultTTL),
+        Protocol: ip.IPPROTO_TCP,
+        DontFragment: l.ipv4.PathMTUDiscovery(dstIP),
+    }
+    return l.ipv4.Send(pkt)
+}
+
+//sendResetFor answers a segment which belongs to no connection (RFC 9293 3.10.7.1).
+func (l *Layer) sendResetFor(ipHdr *ipv4.Header, hdr *Header, segLen uint32) {
+    rst := &Header{
+        SourcePort: hdr.DestinationPort,
+        DestinationPort: hdr.SourcePort,
+    }
+    if hdr.has(FlagACK) {
+        rst.Seq = hdr.Ack
+        rst.Flags = FlagRST
+    } else {
+        rst.Ack = hdr.Seq + segLen
+        rst.Flags = FlagRST | FlagACK
+    }
+    l.send4(ipHdr.TargetIP, ipHdr.SourceIP, rst, uint16(rand.Uint32()), nil)
+}
+
+//sendSegment sends a segment of the connection acknowledging rcvNxt, lock has to be held.
+func (c *Conn) sendSegment(flags byte, seq uint32, data []byte) {
+    hdr := &Header{
+        SourcePort: c.lport,
+        DestinationPort: c.rport,
+        Seq: seq,
+        Flags: flags,
+        Window: uint16(c.rcvWnd()),
+    }
+    if (flags & FlagACK) != 0 {
+        hdr.Ack = c.rcvNxt
+    }
+    if (flags & FlagSYN) != 0 {
+        hdr.MSS = uint16(c.mss)
+    }
+    c.layer.send4(c.localIP, c.remoteIP, hdr, c.identification, data)
+    c.identification++
+}
+
+func (c *Conn) sendAck() {
+    c.sendSegment(FlagACK, c.sndNxt, nil)
+}
+
+func (c *Conn) sendReset(seq uint32) {
+    c.sendSegment(FlagRST, seq, nil)
+}
+
+func (c *Conn) sendSyn() {
+    if c.retransmits == 0 {
+        c.startRTTMeasurement(c.iss + 1)
+    }
+    c.sendSegment(FlagSYN, c.iss, nil)
+}
+
+func (c *Conn) sendSynAck() {
+    if c.retransmits == 0 {
+        c.startRTTMeasurement(c.iss + 1)
+    }
+    c.sendSegment(FlagSYN | FlagACK, c.iss, nil)
+}
+
+//synchronized returns true once the handshake completed and data may be sent.
+func (c *Conn) synchronized() bool {
+    switch c.state {
+    case StateEstablished, StateFinWait1, StateFinWait2, StateCloseWait, StateClosing, StateLastAck, StateTimeWait:
+        return true
+    }
+    return false
+}
+
+//transmit sends up to n bytes of the send buffer starting at sndNxt and piggybacks
+//the FIN if it follows the data, it returns false if there was nothing to send. Lock has to be held.
+func (c *Conn) transmit(n int) bool {
+    offset := int(c.sndNxt - c.sndBufSeq)
+    if offset > len(c.sendBuf) {
+        //Only the FIN is outstanding and it was sent already
+        return false
+    }
+    remaining := len(c.sendBuf) - offset
+    if n > remaining {
+        n = remaining
+    }
+    if n > c.sndMSS {
+        n = c.sndMSS
+    }
+    flags := byte(FlagACK)
+    if n > 0 && n == remaining {
+        flags |= FlagPSH
+    }
+    seqLen := uint32(n)
+    if c.finQueued && offset + n == len(c.sendBuf) {
+        flags |= FlagFIN
+        seqLen++
+    }
+    if seqLen == 0 {
+        return false
+    }
+    if c.sndNxt == c.sndMax && !c.rttTiming {
+        c.startRTTMeasurement(c.sndNxt + seqLen)
+    }
+    c.sendSegment(flags, c.sndNxt, c.sendBuf[offset:offset + n])
+    c.sndNxt += seqLen
+    if seqGT(c.sndNxt, c.sndMax) {
+        c.sndMax = c.sndNxt
+    }
+    return true
+}
+
+//pathMTUChanged shrinks the segments to the path mtu and resends the data in flight
+//right away instead of waiting for the retransmission timer (RFC 1191 section 6.3), lock has to be held.
+func (c *Conn) pathMTUChanged() {
+    mtu, err := c.layer.ipv4.PathMTU(c.remoteIP)
+    if err != nil {
+        return
+    }
+    mss := mtu - ipv4.HeaderLength - HeaderLength
+    if mss >= c.sndMSS {
+        return
+    }
+    c.sndMSS = mss
+    if !c.synchronized() {
+        return
+    }
+    c.sndNxt = c.sndUna
+    c.rttTiming = false
+    c.output()
+}
+
+//output sends as much of the send buffer as the peers window allows, lock has to be held.
+func (c *Conn) output() {
+    if !c.synchronized() {
+        return
+    }
+    for {
+        inFlight := c.sndNxt - c.sndUna
+        if inFlight >= c.sndWnd {
+            //A FIN needs no window
+            if !(c.finQueued && c.sndNxt == c.finSeq) || !c.transmit(0) {
+                break
+            }
+            continue
+        }
+        if !c.transmit(int(c.sndWnd - inFlight)) {
+            break
+        }
+    }
+    if c.sndUna != c.sndMax {
+        if c.timer == nil {
+            c.startTimer(c.rto)
+        }
+    } else if c.sndWnd == 0 && len(c.sendBuf) > 0 && c.timer == nil {
+        //Zero window, probe it once the persist timer fires
+        c.startTimer(c.rto)
+    }
+}
+
+func (c *Conn) startRTTMeasurement(seq uint32) {
+    c.rttTiming = true
+    c.rttSeq = seq
+    c.rttStart = time.Now()
+}
+
+//updateRTO takes a round trip time sample if ack covers the timed segment (RFC 6298 section 2), lock has to be held.
+func (c *Conn) updateRTO(ack uint32) {
+    if !c.rttTiming || seqLT(ack, c.rttSeq) {
+        return
+    }
+    c.rttTiming = false
+    r := time.Since(c.rttStart)
+    if c.srtt == 0 {
+        c.srtt = r
+        c.rttvar = r / 2
+    } else {
+        delta := c.srtt - r
+        if delta < 0 {
+            delta = -delta
+        }
+        c.rttvar = (3 * c.rttvar + delta) / 4
+        c.srtt = (7 * c.srtt + r) / 8
+    }
+    variance := 4 * c.rttvar
+    if variance < clockGranularity {
+        variance = clockGranularity
+    }
+    c.rto = c.srtt + variance
+    if c.rto < config.TCP.MinRTO {
+        c.rto = config.TCP.MinRTO
+    }
+    if c.rto > config.TCP.MaxRTO {
+        c.rto = config.TCP.MaxRTO
+    }
+}
+
+//startTimer (re)starts the connection timer, lock has to be held.
+func (c *Conn) startTimer(d time.Duration) {
+    c.stopTimer()
+    gen := c.timerGeneration
+    c.timer = time.AfterFunc(d, func() {
+        c.timeout(gen)
+    })
+}
+
+func (c *Conn) stopTimer() {
+    if c.timer != nil {
+        c.timer.Stop()
+        c.timer = nil
+    }
+    //Invalidate a timeout which already fired but did not get the lock yet
+    c.timerGeneration++
+}
+
+//timeout handles the retransmission, persist, FIN-WAIT-2 and TIME-WAIT timer.
+func (c *Conn) timeout(gen uint64) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    if gen != c.timerGeneration {
+        return
+    }
+    c.timer = nil
+    switch c.state {
+    case StateClosed:
+        return
+    case StateFinWait2, StateTimeWait:
+        c.terminate(nil)
+        return
+    }
+
+    probe := c.sndUna == c.sndMax
+    if !probe {
+        c.retransmits++
+        if c.retransmits > config.TCP.MaxRetransmissions {
+            if c.softError != nil {
+                c.abort(c.softError)
+                return
+            }
+            c.abort(ErrTimeout)
+            return
+        }
+    }
+    //Back off the timer and do not measure retransmitted segments (Karn's algorithm)
+    c.rto *= 2
+    if c.rto > config.TCP.MaxRTO {
+        c.rto = config.TCP.MaxRTO
+    }
+    c.rttTiming = false
+
+    switch c.state {
+    case StateSynSent:
+        c.sendSyn()
+    case StateSynReceived:
+        c.sendSynAck()
+    default:
+        //Go back to the first unacknowledged byte, a zero window is probed with a single byte
+        c.sndNxt = c.sndUna
+        wnd := int(c.sndWnd)
+        if wnd == 0 {
+            wnd = 1
+        }
+        c.transmit(wnd)
+        if c.sndUna == c.sndMax {
+            return
+        }
+    }
+    c.startTimer(c.rto)
+}
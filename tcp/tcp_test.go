@@ -0,0 +1,440 @@
+package tcp_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+	"github.com/arcpop/network"
+	"github.com/arcpop/network/config"
+	"github.com/arcpop/network/ip"
+	"github.com/arcpop/network/netdev"
+	"github.com/arcpop/network/tcp"
+)
+
+//segment is a tcp segment seen on a link.
+type segment struct {
+    flags byte
+    seq uint32
+    payload int
+}
+
+//link wraps one end of a pipe and records the tcp segments it transmits, they can be dropped or held back.
+type link struct {
+    netdev.Interface
+    lock sync.Mutex
+    segments []segment
+    drop func(s segment) bool
+    hold bool
+    held [][]byte
+}
+
+func (l *link) TxPacket(pkt []byte) {
+    l.lock.Lock()
+    if binary.BigEndian.Uint16(pkt[12:14]) != 0x0800 || pkt[14 + 9] != ip.IPPROTO_TCP {
+        l.lock.Unlock()
+        l.Interface.TxPacket(pkt)
+        return
+    }
+    ipHdr := pkt[14:]
+    seg := ipHdr[int(ipHdr[0] & 0xF) << 2:binary.BigEndian.Uint16(ipHdr[2:4])]
+    s := segment{
+        flags: seg[13],
+        seq: binary.BigEndian.Uint32(seg[4:8]),
+        payload: len(seg) - int(seg[12] >> 4) << 2,
+    }
+    l.segments = append(l.segments, s)
+    if l.drop != nil && l.drop(s) {
+        l.lock.Unlock()
+        return
+    }
+    if l.hold {
+        l.held = append(l.held, append([]byte(nil), pkt...))
+        l.lock.Unlock()
+        return
+    }
+    l.lock.Unlock()
+    l.Interface.TxPacket(pkt)
+}
+
+//release transmits the held segments and stops holding them back.
+func (l *link) release() {
+    l.lock.Lock()
+    held := l.held
+    l.held = nil
+    l.hold = false
+    l.lock.Unlock()
+    for _, pkt := range held {
+        l.Interface.TxPacket(pkt)
+    }
+}
+
+func (l *link) sent() []segment {
+    l.lock.Lock()
+    defer l.lock.Unlock()
+    return append([]segment(nil), l.segments...)
+}
+
+//newTCPStacks joins two stacks owning 10.0.0.1 and 10.0.0.2 with a pipe, the links are the ends of the stacks.
+//The timers are shortened so the tests do not wait for seconds.
+func newTCPStacks(t *testing.T) (*network.Stack, *network.Stack, *link, *link) {
+    rto, minRTO, msl, finTimeout := config.TCP.InitialRTO, config.TCP.MinRTO, config.TCP.MSL, config.TCP.FinTimeout
+    config.TCP.InitialRTO, config.TCP.MinRTO = 200 * time.Millisecond, 200 * time.Millisecond
+    config.TCP.MSL, config.TCP.FinTimeout = 200 * time.Millisecond, 300 * time.Millisecond
+    t.Cleanup(func() {
+        config.TCP.InitialRTO, config.TCP.MinRTO, config.TCP.MSL, config.TCP.FinTimeout = rto, minRTO, msl, finTimeout
+    })
+    a, b, err := netdev.OpenPipe(netdev.PipeConfig{ Name: "eth0" }, netdev.PipeConfig{ Name: "eth0" })
+    if err != nil {
+        t.Fatal(err)
+    }
+    links := []*link{ { Interface: a }, { Interface: b } }
+    stacks := []*network.Stack{ network.NewStack(), network.NewStack() }
+    for i, s := range stacks {
+        s.Start(context.Background())
+        t.Cleanup(s.Stop)
+        if err := s.AddInterface(links[i]); err != nil {
+            t.Fatal(err)
+        }
+        addr := net.IPNet{ IP: net.IPv4(10, 0, 0, byte(i + 1)).To4(), Mask: net.CIDRMask(24, 32) }
+        if err := s.IPv4.ConfigureInterfaceAddress("eth0", addr); err != nil {
+            t.Fatal(err)
+        }
+    }
+    return stacks[0], stacks[1], links[0], links[1]
+}
+
+//connect opens a connection from the first stack to a listener of the second one.
+func connect(t *testing.T, sa, sb *network.Stack) (*tcp.Conn, *tcp.Conn) {
+    ln, err := sb.TCP.Listen(net.IPv4(10, 0, 0, 2), 80)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { ln.Close() })
+    c, err := sa.TCP.Dial(net.IPv4(10, 0, 0, 2), 80)
+    if err != nil {
+        t.Fatal(err)
+    }
+    s, err := ln.AcceptTCP()
+    if err != nil {
+        t.Fatal(err)
+    }
+    deadline := time.Now().Add(5 * time.Second)
+    c.SetDeadline(deadline)
+    s.SetDeadline(deadline)
+    return c, s
+}
+
+//waitState waits until the connection reached the state.
+func waitState(t *testing.T, c *tcp.Conn, state tcp.State, timeout time.Duration) {
+    deadline := time.Now().Add(timeout)
+    for c.State() != state {
+        if time.Now().After(deadline) {
+            t.Fatalf("connection %v in state %v, want %v", c.LocalAddr(), c.State(), state)
+        }
+        time.Sleep(2 * time.Millisecond)
+    }
+}
+
+func TestHandshake(t *testing.T) {
+    sa, sb, la, lb := newTCPStacks(t)
+    c, s := connect(t, sa, sb)
+    if c.State() != tcp.StateEstablished || s.State() != tcp.StateEstablished {
+        t.Errorf("states %v and %v after the handshake", c.State(), s.State())
+    }
+    if c.RemoteAddr().String() != "10.0.0.2:80" || s.LocalAddr().String() != "10.0.0.2:80" {
+        t.Errorf("client connected to %v, server listens on %v", c.RemoteAddr(), s.LocalAddr())
+    }
+    if c.LocalAddr().String() != s.RemoteAddr().String() {
+        t.Errorf("client at %v, server sees %v", c.LocalAddr(), s.RemoteAddr())
+    }
+    out, in := la.sent(), lb.sent()
+    if len(out) != 2 || len(in) != 1 {
+        t.Fatalf("handshake sent %v and %v", out, in)
+    }
+    if out[0].flags != tcp.FlagSYN || in[0].flags != tcp.FlagSYN | tcp.FlagACK || out[1].flags != tcp.FlagACK {
+        t.Errorf("handshake flags %#x, %#x, %#x", out[0].flags, in[0].flags, out[1].flags)
+    }
+    if out[1].seq != out[0].seq + 1 {
+        t.Errorf("ack sent with sequence %d after syn with %d", out[1].seq, out[0].seq)
+    }
+}
+
+func TestRetransmission(t *testing.T) {
+    sa, sb, la, _ := newTCPStacks(t)
+    c, s := connect(t, sa, sb)
+    var dropped []segment
+    la.lock.Lock()
+    la.drop = func(seg segment) bool {
+        //Drop the first data segment and the first retransmission of it
+        if seg.payload > 0 && len(dropped) < 2 && (len(dropped) == 0 || seg.seq == dropped[0].seq) {
+            dropped = append(dropped, seg)
+            return true
+        }
+        return false
+    }
+    la.lock.Unlock()
+    data := make([]byte, 20000)
+    for i := range data {
+        data[i] = byte(i * 7)
+    }
+    go c.Write(data)
+    buf := make([]byte, len(data))
+    if _, err := io.ReadFull(s, buf); err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(buf, data) {
+        t.Errorf("received data differs")
+    }
+    la.lock.Lock()
+    defer la.lock.Unlock()
+    if len(dropped) != 2 {
+        t.Fatalf("dropped %v, want the first segment twice", dropped)
+    }
+    sent := 0
+    for _, seg := range la.segments {
+        sent += seg.payload
+    }
+    if sent <= len(data) + dropped[0].payload {
+        t.Errorf("sent %d bytes for %d bytes of data with two drops", sent, len(data))
+    }
+}
+
+func TestSimultaneousClose(t *testing.T) {
+    sa, sb, la, lb := newTCPStacks(t)
+    c, s := connect(t, sa, sb)
+    //Both FINs are on the wire before either side sees the other one
+    la.lock.Lock()
+    la.hold = true
+    la.lock.Unlock()
+    lb.lock.Lock()
+    lb.hold = true
+    lb.lock.Unlock()
+    c.Close()
+    s.Close()
+    if c.State() != tcp.StateFinWait1 || s.State() != tcp.StateFinWait1 {
+        t.Fatalf("states %v and %v after closing", c.State(), s.State())
+    }
+    la.release()
+    lb.release()
+    //Both sides go through CLOSING into TIME-WAIT (RFC 9293 figure 13)
+    waitState(t, c, tcp.StateTimeWait, time.Second)
+    waitState(t, s, tcp.StateTimeWait, time.Second)
+    waitState(t, c, tcp.StateClosed, 2 * time.Second)
+    waitState(t, s, tcp.StateClosed, 2 * time.Second)
+    for _, l := range []*link{ la, lb } {
+        fins := 0
+        for _, seg := range l.sent() {
+            if seg.flags & tcp.FlagFIN != 0 {
+                fins++
+            }
+            if seg.flags & tcp.FlagRST != 0 {
+                t.Errorf("reset sent during the close")
+            }
+        }
+        if fins != 1 {
+            t.Errorf("sent %d FINs, want 1", fins)
+        }
+    }
+}
+
+func TestResetRefused(t *testing.T) {
+    sa, _, _, lb := newTCPStacks(t)
+    _, err := sa.TCP.Dial(net.IPv4(10, 0, 0, 2), 81)
+    if err != tcp.ErrConnectionRefused {
+        t.Errorf("dial to a closed port returned %v, want %v", err, tcp.ErrConnectionRefused)
+    }
+    in := lb.sent()
+    if len(in) != 1 || in[0].flags != tcp.FlagRST | tcp.FlagACK {
+        t.Errorf("closed port answered with %v", in)
+    }
+}
+
+func TestResetOnCloseWithUnreadData(t *testing.T) {
+    sa, sb, _, lb := newTCPStacks(t)
+    c, s := connect(t, sa, sb)
+    if _, err := c.Write(make([]byte, 100)); err != nil {
+        t.Fatal(err)
+    }
+    buf := make([]byte, 50)
+    if _, err := io.ReadFull(s, buf); err != nil {
+        t.Fatal(err)
+    }
+    //Closing with unread data resets the connection (RFC 2525 section 2.17)
+    s.Close()
+    if _, err := c.Read(buf); err != tcp.ErrConnectionReset {
+        t.Errorf("read after the reset returned %v, want %v", err, tcp.ErrConnectionReset)
+    }
+    if c.State() != tcp.StateClosed {
+        t.Errorf("state %v after the reset", c.State())
+    }
+    in := lb.sent()
+    if len(in) == 0 || in[len(in) - 1].flags & tcp.FlagRST == 0 {
+        t.Errorf("last segment of the server %v is no reset", in)
+    }
+}
+
+func TestFinWait2Timeout(t *testing.T) {
+    sa, sb, _, _ := newTCPStacks(t)
+    c, s := connect(t, sa, sb)
+    //The peer never closes its side, the orphaned connection is dropped after FinTimeout
+    c.Close()
+    waitState(t, c, tcp.StateFinWait2, time.Second)
+    if s.State() != tcp.StateCloseWait {
+        t.Errorf("peer in state %v, want %v", s.State(), tcp.StateCloseWait)
+    }
+    start := time.Now()
+    waitState(t, c, tcp.StateClosed, 2 * time.Second)
+    if d := time.Since(start); d < config.TCP.FinTimeout / 2 {
+        t.Errorf("connection dropped after %v, FinTimeout is %v", d, config.TCP.FinTimeout)
+    }
+    //Data of the peer is answered with a reset once the connection is gone
+    s.Write([]byte("late"))
+    waitState(t, s, tcp.StateClosed, time.Second)
+    if _, err := s.Read(make([]byte, 10)); err != tcp.ErrConnectionReset {
+        t.Errorf("peer read %v, want %v", err, tcp.ErrConnectionReset)
+    }
+}
+
+func TestFinWait2HalfClose(t *testing.T) {
+    sa, sb, _, _ := newTCPStacks(t)
+    c, s := connect(t, sa, sb)
+    //A half closed connection can still be read from, it waits for the FIN of the peer
+    c.CloseWrite()
+    waitState(t, c, tcp.StateFinWait2, time.Second)
+    time.Sleep(2 * config.TCP.FinTimeout)
+    if c.State() != tcp.StateFinWait2 {
+        t.Fatalf("half closed connection in state %v", c.State())
+    }
+    s.Write([]byte("reply"))
+    s.Close()
+    buf, err := io.ReadAll(c)
+    if err != nil || string(buf) != "reply" {
+        t.Errorf("read %q, %v after the half close", buf, err)
+    }
+    waitState(t, c, tcp.StateTimeWait, time.Second)
+}
+
+func TestSynBacklog(t *testing.T) {
+    backlog := config.TCP.AcceptBacklog
+    config.TCP.AcceptBacklog = 2
+    defer func() {
+        config.TCP.AcceptBacklog = backlog
+    }()
+    sa, sb, _, lb := newTCPStacks(t)
+    ln, err := sb.TCP.Listen(net.IPv4(10, 0, 0, 2), 80)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer ln.Close()
+    //The SYN-ACKs get lost, so the connections of the listener stay half open
+    lb.lock.Lock()
+    lb.drop = func(seg segment) bool {
+        return seg.flags & tcp.FlagSYN != 0
+    }
+    lb.lock.Unlock()
+    ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+    defer cancel()
+    errs := make(chan error, 4)
+    for i := 0; i < cap(errs); i++ {
+        go func() {
+            _, err := sa.TCP.DialContext(ctx, net.IPv4(10, 0, 0, 2), 80)
+            errs <- err
+        }()
+    }
+    time.Sleep(500 * time.Millisecond)
+    lb.lock.Lock()
+    halfOpen := make(map[uint32]bool)
+    for _, seg := range lb.segments {
+        halfOpen[seg.seq] = true
+    }
+    lb.drop = nil
+    lb.lock.Unlock()
+    if len(halfOpen) != config.TCP.AcceptBacklog {
+        t.Errorf("%d half open connections, want %d", len(halfOpen), config.TCP.AcceptBacklog)
+    }
+    //Once the handshakes complete the slots are free for the remaining connections
+    for i := 0; i < cap(errs); i++ {
+        c, err := ln.AcceptTCP()
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer c.Close()
+    }
+    for i := 0; i < cap(errs); i++ {
+        if err := <- errs; err != nil {
+            t.Errorf("dial failed: %v", err)
+        }
+    }
+}
+
+//fragmentationNeeded builds the frame of a fragmentation needed message from 10.0.0.2 to 10.0.0.1 about a
+//segment with the sequence number sent from src to the peer of c.
+func fragmentationNeeded(to, from netdev.Interface, c *tcp.Conn, src net.IP, seq uint32, mtu uint16) []byte {
+    frame := make([]byte, 14 + 20 + 8 + 20 + 8)
+    copy(frame[0:6], to.GetHardwareAddress())
+    copy(frame[6:12], from.GetHardwareAddress())
+    binary.BigEndian.PutUint16(frame[12:14], 0x0800)
+    putHeader := func(buf []byte, length int, df bool, protocol byte, src, dst net.IP) {
+        buf[0] = 0x45
+        binary.BigEndian.PutUint16(buf[2:4], uint16(length))
+        if df {
+            buf[6] = 0x40
+        }
+        buf[8] = 64
+        buf[9] = protocol
+        copy(buf[12:16], src.To4())
+        copy(buf[16:20], dst.To4())
+        binary.BigEndian.PutUint16(buf[10:12], ip.InternetChecksum(buf[:20]))
+    }
+    putHeader(frame[14:], len(frame) - 14, false, ip.IPPROTO_ICMP, net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 1))
+    icmp := frame[34:]
+    icmp[0], icmp[1] = ip.ICMPTypeDestinationUnreachable, ip.ICMPCodeFragmentationNeeded
+    binary.BigEndian.PutUint16(icmp[6:8], mtu)
+    putHeader(icmp[8:], 1500, true, ip.IPPROTO_TCP, src, net.IPv4(10, 0, 0, 2))
+    local, remote := c.LocalAddr().(*net.TCPAddr), c.RemoteAddr().(*net.TCPAddr)
+    binary.BigEndian.PutUint16(icmp[28:30], uint16(local.Port))
+    binary.BigEndian.PutUint16(icmp[30:32], uint16(remote.Port))
+    binary.BigEndian.PutUint32(icmp[32:36], seq)
+    binary.BigEndian.PutUint16(icmp[2:4], ip.InternetChecksum(icmp))
+    return frame
+}
+
+func TestFragmentationNeeded(t *testing.T) {
+    sa, sb, la, lb := newTCPStacks(t)
+    c, _ := connect(t, sa, sb)
+    la.lock.Lock()
+    la.hold = true
+    la.lock.Unlock()
+    c.Write(make([]byte, 1000))
+    sent := la.sent()
+    inFlight := sent[len(sent) - 1].seq
+    peer := net.IPv4(10, 0, 0, 2)
+    pathMTU := func() int {
+        mtu, err := sa.IPv4.PathMTU(peer)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return mtu
+    }
+    //Neither a packet from another host nor a segment outside the window may shrink the path mtu
+    lb.Interface.TxPacket(fragmentationNeeded(la, lb, c, net.IPv4(10, 0, 0, 3), inFlight, 600))
+    lb.Interface.TxPacket(fragmentationNeeded(la, lb, c, net.IPv4(10, 0, 0, 1), inFlight + 100000, 600))
+    time.Sleep(100 * time.Millisecond)
+    if mtu := pathMTU(); mtu != 1500 {
+        t.Errorf("path mtu %d after forged messages, want 1500", mtu)
+    }
+    lb.Interface.TxPacket(fragmentationNeeded(la, lb, c, net.IPv4(10, 0, 0, 1), inFlight, 1400))
+    deadline := time.Now().Add(time.Second)
+    for pathMTU() != 1400 {
+        if time.Now().After(deadline) {
+            t.Fatalf("path mtu %d after a message about a segment in flight, want 1400", pathMTU())
+        }
+        time.Sleep(2 * time.Millisecond)
+    }
+    la.release()
+}
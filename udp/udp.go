@@ -2,7 +2,10 @@ package udp
 
 import (
     "github.com/arcpop/network/conn"
+	"context"
 	"net"
+	"os"
+	"time"
     "sync"
 	"math/rand"
 	"errors"
@@ -10,129 +13,491 @@ import (
 	"github.com/arcpop/network/util"
 	"github.com/arcpop/network/ipv4"
 	"github.com/arcpop/network/ipv6"
+	"github.com/arcpop/network/ip"
+	"github.com/arcpop/network/netdev"
 )
 
-type udpConnection struct {
+type datagram struct {
+    data []byte
+    addr *net.UDPAddr
+}
+
+//Conn is an udp socket implementing net.PacketConn, every read returns exactly one datagram.
+//Sockets created by CreateUDP4 and CreateUDP6 are connected, they only exchange datagrams with their peer
+//and additionally support Read and Write. A socket either uses ipv4 or ipv6.
+type Conn struct {
+    layer *Layer
     lport, rport uint16
-    identification uint16
-    recvQueue chan []byte
-    recvPartialPacket []byte
-    readLock, writeLock sync.Mutex
+    recvQueue chan *datagram
+    writeLock sync.Mutex
     remoteIP, localIP net.IP
     isIPv4 bool
+    //ttl and tos are the hop limit and traffic class of ipv6 sockets
+    ttl, tos byte
+    //broadcast allows sending to broadcast addresses, bcastIface is the interface limited broadcasts are sent through
+    broadcast bool
+    bcastIface netdev.Interface
+    
+    readDeadline, writeDeadline *util.Deadline
+    closeOnce sync.Once
+    closed chan struct{}
+
+    //Pending icmp error of a connected socket, reported once by the next Read or Write
+    errLock sync.Mutex
+    err error
+    errNotify chan struct{}
 }
 
+var _ net.PacketConn = (*Conn)(nil)
+
 var (
     ErrLocalPortAlreadyBound = errors.New("Local port is already bound!")
     ErrInvalidPort = errors.New("Invalid remote port!")
     ErrNoNameResolution = errors.New("No name resolution installed!")
+    ErrMessageTooLong = errors.New("Message too long!")
+    ErrNotConnected = errors.New("Socket is not connected!")
+    ErrAlreadyConnected = errors.New("Socket is already connected!")
+    ErrInvalidAddress = errors.New("Invalid udp address!")
+    ErrBroadcastNotEnabled = errors.New("Sending to a broadcast address is not enabled on the socket!")
 )
 
-var (
-    udpConnections4 map[uint16]*udpConnection
+//Layer holds the udp sockets of one stack.
+type Layer struct {
+    ipv4 *ipv4.Layer
+    ipv6 *ipv6.Layer
+    
+    udpConnections4 map[uint16]*Conn
     udpConnections4Lock sync.RWMutex
-    udpConnections6 map[uint16]*udpConnection
+    udpConnections6 map[uint16]*Conn
     udpConnections6Lock sync.RWMutex
     
     udpRecvQueue4 chan *ipv4.L3Packet
-)
+    udpRecvQueue6 chan *ipv6.L3Packet
+    //identification is the ipv4 identification of the last datagram sent by any socket of this layer
+    identification uint32
+    
+    cancel context.CancelFunc
+    workers sync.WaitGroup
+}
+
+//Default is the layer used by the package level functions.
+var Default = NewLayer(ipv4.Default, ipv6.Default)
+
+//NewLayer creates a udp layer sending through the given ipv4 and ipv6 layers.
+func NewLayer(ip4 *ipv4.Layer, ip6 *ipv6.Layer) *Layer {
+    l := &Layer{
+        ipv4: ip4,
+        ipv6: ip6,
+        udpConnections4: make(map[uint16]*Conn),
+        udpConnections6: make(map[uint16]*Conn),
+        udpRecvQueue4: make(chan *ipv4.L3Packet, config.UDP.RecvQueueSize),
+        udpRecvQueue6: make(chan *ipv6.L3Packet, config.UDP.RecvQueueSize),
+        identification: rand.Uint32(),
+    }
+    ip4.RegisterProtocol(ip.IPPROTO_UDP, l)
+    ip6.RegisterProtocol(ip.IPPROTO_UDP, l)
+    return l
+}
 
 func Start()  {
-    udpConnections4 = make(map[uint16]*udpConnection)
-    udpConnections6 = make(map[uint16]*udpConnection)
-    udpRecvQueue4 = make(chan *ipv4.L3Packet, config.UDP.RecvQueueSize)
+    Default.Start(context.Background())
+}
+
+func Stop()  {
+    Default.Stop()
+}
+
+//Start starts the receive workers, they run until ctx is done or Stop is called.
+func (l *Layer) Start(ctx context.Context)  {
+    ctx, l.cancel = context.WithCancel(ctx)
+    for i := 0; i < config.UDP.NumberOfQueueWorkers; i++ {
+        l.workers.Add(1)
+        go l.udpRecvWorker(ctx)
+    }
+    l.workers.Add(1)
+    go func() {
+        defer l.workers.Done()
+        <- ctx.Done()
+        l.closeConnections()
+    }()
+}
+
+//Stop stops the receive workers and closes all connections, blocked reads return net.ErrClosed.
+func (l *Layer) Stop()  {
+    if l.cancel != nil {
+        l.cancel()
+    }
+    l.workers.Wait()
+    l.closeConnections()
+}
+
+func (l *Layer) closeConnections() {
+    l.udpConnections4Lock.Lock()
+    for _, c := range l.udpConnections4 {
+        c.detach()
+    }
+    l.udpConnections4Lock.Unlock()
+    l.udpConnections6Lock.Lock()
+    for _, c := range l.udpConnections6 {
+        c.detach()
+    }
+    l.udpConnections6Lock.Unlock()
 }
+
+//table returns the sockets of one address family together with the lock guarding them.
+func (l *Layer) table(isIPv4 bool) (map[uint16]*Conn, *sync.RWMutex) {
+    if isIPv4 {
+        return l.udpConnections4, &l.udpConnections4Lock
+    }
+    return l.udpConnections6, &l.udpConnections6Lock
+}
+
 func DialUDP(remoteAddr, localAddr string) (conn.Conn, error) {
     return nil, ErrNoNameResolution
 }
 
 func CreateUDP4(remoteIP net.IP, remotePort, localPort uint16) (conn.Conn, error)  {
+    return Default.CreateUDP4(remoteIP, remotePort, localPort)
+}
+
+//CreateUDP4 creates a socket connected to remoteIP:remotePort, a zero localPort picks a random port.
+func (l *Layer) CreateUDP4(remoteIP net.IP, remotePort, localPort uint16) (conn.Conn, error)  {
     if remotePort == 0 {
         return nil, ErrInvalidPort
     }
     ip4 := remoteIP.To4()
     if ip4 == nil {
-        return nil, ipv6.ErrNotImplemented
+        return nil, ErrInvalidAddress
     }
-    route, err := ipv4.RoutingGetRoute(ip4)
-    if err != nil {
-        return nil, err
+    return l.bind(true, nil, localPort, ip4, remotePort)
+}
+
+func CreateUDP6(remoteIP net.IP, remotePort, localPort uint16) (conn.Conn, error)  {
+    return Default.CreateUDP6(remoteIP, remotePort, localPort)
+}
+
+//CreateUDP6 creates a socket connected to the ipv6 address remoteIP and remotePort, a zero localPort picks a random port.
+func (l *Layer) CreateUDP6(remoteIP net.IP, remotePort, localPort uint16) (conn.Conn, error)  {
+    if remotePort == 0 {
+        return nil, ErrInvalidPort
     }
+    if remoteIP.To4() != nil || remoteIP.To16() == nil {
+        return nil, ErrInvalidAddress
+    }
+    return l.bind(false, nil, localPort, remoteIP.To16(), remotePort)
+}
+
+//ListenUDP4 creates an unconnected socket on the local port with the default layer.
+func ListenUDP4(localIP net.IP, port uint16) (*Conn, error) {
+    return Default.ListenUDP4(localIP, port)
+}
+
+//ListenUDP4 creates an unconnected socket receiving datagrams for localIP and port from any sender.
+//A nil or unspecified localIP accepts datagrams for all local addresses, a zero port picks a random port.
+func (l *Layer) ListenUDP4(localIP net.IP, port uint16) (*Conn, error) {
+    if localIP == nil {
+        localIP = net.IPv4zero
+    }
+    ip4 := localIP.To4()
+    if ip4 == nil {
+        return nil, ErrInvalidAddress
+    }
+    return l.bind(true, ip4, port, nil, 0)
+}
+
+//ListenUDP6 creates an unconnected ipv6 socket on the local port with the default layer.
+func ListenUDP6(localIP net.IP, port uint16) (*Conn, error) {
+    return Default.ListenUDP6(localIP, port)
+}
+
+//ListenUDP6 creates an unconnected ipv6 socket receiving datagrams for localIP and port from any sender.
+//A nil or unspecified localIP accepts datagrams for all local addresses, a zero port picks a random port.
+func (l *Layer) ListenUDP6(localIP net.IP, port uint16) (*Conn, error) {
+    if localIP == nil {
+        localIP = net.IPv6unspecified
+    }
+    if localIP.To4() != nil || localIP.To16() == nil {
+        return nil, ErrInvalidAddress
+    }
+    return l.bind(false, localIP.To16(), port, nil, 0)
+}
+
+//bind creates a socket of the address family and registers it on localPort, a nil remoteIP creates an
+//unconnected socket. A nil localIP is replaced by the source address of the flow to remoteIP.
+func (l *Layer) bind(isIPv4 bool, localIP net.IP, localPort uint16, remoteIP net.IP, remotePort uint16) (*Conn, error) {
+    conns, lock := l.table(isIPv4)
+    lock.Lock()
+    defer lock.Unlock()
     if localPort == 0 {
-        udpConnections4Lock.Lock()
-        localPort := uint16(rand.Uint32() & 0xFFFF);
-        _, ok := udpConnections4[localPort]
-        for ok {
-            localPort = uint16(rand.Uint32() & 0xFFFF);
-            _, ok = udpConnections4[localPort]
-        }
+        localPort = ephemeralPort(conns)
     } else {
-        udpConnections4Lock.Lock()
-        _, ok := udpConnections4[localPort]
+        _, ok := conns[localPort]
         if ok {
-            udpConnections4Lock.Unlock()
             return nil, ErrLocalPortAlreadyBound
         }
     }
-    connection := &udpConnection{
-        rport: remotePort,
+    if localIP == nil {
+        var err error
+        if isIPv4 {
+            localIP, err = l.ipv4.SourceAddressFor(&ipv4.RouteQuery{ Dst: remoteIP, Protocol: ip.IPPROTO_UDP, SrcPort: localPort, DstPort: remotePort })
+        } else {
+            localIP, err = l.ipv6.SourceAddress(remoteIP)
+        }
+        if err != nil {
+            return nil, err
+        }
+    }
+    c := &Conn{
+        layer: l,
         lport: localPort,
-        recvQueue: make(chan []byte, config.UDP.ConnectionRecvQueueSize),
-        remoteIP: make([]byte, 4),
-        localIP: make([]byte, 4),
-        isIPv4: true,
-    }
-    copy(connection.remoteIP, ip4)
-    copy(connection.localIP, route.Iface.GetIPv4Address())
-    return connection, nil
-}
-
-func (u *udpConnection) Read(b []byte) (n int, err error) {
-    u.readLock.Lock()
-    defer u.readLock.Unlock()
-    empty, n := util.Drain(u.recvPartialPacket, b)
-    if empty {
-        u.recvPartialPacket = nil
-        b = b[n:]
-    } else {
-        u.recvPartialPacket = u.recvPartialPacket[n:]
-        return n, nil
+        rport: remotePort,
+        recvQueue: make(chan *datagram, config.UDP.ConnectionRecvQueueSize),
+        localIP: make([]byte, len(localIP)),
+        isIPv4: isIPv4,
+        ttl: byte(config.IPv4.DefaultTTL),
+        readDeadline: util.NewDeadline(),
+        writeDeadline: util.NewDeadline(),
+        closed: make(chan struct{}),
+        errNotify: make(chan struct{}, 1),
+    }
+    if !isIPv4 {
+        c.ttl = byte(config.IPv6.DefaultHopLimit)
+    }
+    copy(c.localIP, localIP)
+    if remoteIP != nil {
+        c.remoteIP = make([]byte, len(remoteIP))
+        copy(c.remoteIP, remoteIP)
+    }
+    conns[localPort] = c
+    return c, nil
+}
+
+//ephemeralPort picks a random local port unused in conns, the lock of conns has to be held.
+func ephemeralPort(conns map[uint16]*Conn) uint16 {
+    for {
+        port := uint16(rand.Uint32() & 0xFFFF)
+        if port == 0 {
+            continue
+        }
+        _, ok := conns[port]
+        if !ok {
+            return port
+        }
+    }
+}
+
+//detach unregisters the socket and wakes up blocked readers, the lock of its table has to be held.
+func (c *Conn) detach() {
+    conns, _ := c.layer.table(c.isIPv4)
+    if conns[c.lport] == c {
+        delete(conns, c.lport)
+    }
+    c.closeOnce.Do(func() {
+        close(c.closed)
+    })
+}
+
+func (c *Conn) isClosed() bool {
+    select {
+        case <- c.closed:
+            return true
+        default:
+            return false
+    }
+}
+
+func (c *Conn) isConnected() bool {
+    return c.rport != 0
+}
+
+//setError records an icmp error for the next Read or Write and wakes up a blocked reader.
+func (c *Conn) setError(err error) {
+    c.errLock.Lock()
+    c.err = err
+    c.errLock.Unlock()
+    select {
+        case c.errNotify <- struct{}{}:
+        default:
+    }
+}
+
+//takeError returns and clears the pending error.
+func (c *Conn) takeError() error {
+    c.errLock.Lock()
+    defer c.errLock.Unlock()
+    err := c.err
+    c.err = nil
+    return err
+}
+
+//ReadFrom reads one datagram into b, the part not fitting into b is discarded.
+//A connected socket returns a pending icmp error like connection refused instead.
+func (c *Conn) ReadFrom(b []byte) (int, net.Addr, error) {
+    if c.isClosed() {
+        return 0, nil, net.ErrClosed
     }
-    i := n
     for {
-        pkt := <- u.recvQueue
-        empty, n := util.Drain(u.recvPartialPacket, b)
-        if empty {
-            u.recvPartialPacket = nil
-            b = b[n:]
-            i += n
-        } else {
-            u.recvPartialPacket = pkt[n:]
-            return i, nil
+        err := c.takeError()
+        if err != nil {
+            return 0, nil, err
+        }
+        select {
+            case d := <- c.recvQueue:
+                return copy(b, d.data), d.addr, nil
+            case <- c.errNotify:
+            case <- c.closed:
+                return 0, nil, net.ErrClosed
+            case <- c.readDeadline.Done():
+                return 0, nil, os.ErrDeadlineExceeded
         }
     }
 }
 
-func (u *udpConnection) Write(b []byte) (n int, err error) {
-    u.writeLock.Lock()
-    defer u.writeLock.Unlock()
-    if u.isIPv4 {
-        pkt := ipv4.AllocatePacket(len(b))
-        copy(pkt.ProtocolData, b[:])
-        header := &ipv4.Header{
-            TargetIP: u.remoteIP,
-            SourceIP: u.localIP,
-            Identification: u.identification,
+//WriteTo sends b as one datagram to addr which has to be a *net.UDPAddr, it fails on connected sockets.
+func (c *Conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+    if c.isConnected() {
+        return 0, ErrAlreadyConnected
+    }
+    ua, ok := addr.(*net.UDPAddr)
+    if !ok || ua.Port <= 0 || ua.Port > 0xFFFF {
+        return 0, ErrInvalidAddress
+    }
+    return c.write(b, ua.IP, uint16(ua.Port))
+}
+
+//Read reads one datagram from the peer into b, the part not fitting into b is discarded.
+func (c *Conn) Read(b []byte) (int, error) {
+    n, _, err := c.ReadFrom(b)
+    return n, err
+}
+
+//Write sends b as one datagram to the peer of a connected socket.
+func (c *Conn) Write(b []byte) (int, error) {
+    if !c.isConnected() {
+        return 0, ErrNotConnected
+    }
+    return c.write(b, c.remoteIP, c.rport)
+}
+
+func (c *Conn) write(b []byte, dstIP net.IP, dstPort uint16) (int, error) {
+    if c.isClosed() {
+        return 0, net.ErrClosed
+    }
+    if c.writeDeadline.Exceeded() {
+        return 0, os.ErrDeadlineExceeded
+    }
+    err := c.takeError()
+    if err != nil {
+        return 0, err
+    }
+    c.writeLock.Lock()
+    defer c.writeLock.Unlock()
+    if c.isIPv4 {
+        dst4 := dstIP.To4()
+        if dst4 == nil {
+            return 0, ErrInvalidAddress
+        }
+        err = c.write4(b, dst4, dstPort)
+    } else {
+        if dstIP.To4() != nil || dstIP.To16() == nil {
+            return 0, ErrInvalidAddress
         }
-        u.identification++
-        pkt.IPHeader = header
-        ipv4.Send(pkt)
-        return len(b), nil
-    } 
-    return 0, ipv6.ErrNotImplemented
+        err = c.write6(b, dstIP.To16(), dstPort)
+    }
+    if err != nil {
+        return 0, err
+    }
+    return len(b), nil
 }
 
+//write4 sends the datagram to an ipv4 destination, writeLock has to be held.
+func (c *Conn) write4(b []byte, dst4 net.IP, dstPort uint16) error {
+    if !c.broadcast && c.layer.ipv4.IsBroadcast(dst4) {
+        return ErrBroadcastNotEnabled
+    }
+    var iface netdev.Interface
+    if dst4.Equal(net.IPv4bcast) {
+        iface = c.bcastIface
+    }
+    src := c.localIP
+    if src.IsUnspecified() && iface != nil {
+        //Hosts without an address send from the unspecified address, like dhcp clients
+        src = netdev.IPv4SourceAddress(iface, dst4)
+    } else if src.IsUnspecified() {
+        var err error
+        src, err = c.layer.ipv4.SourceAddressFor(&ipv4.RouteQuery{ Dst: dst4, Protocol: ip.IPPROTO_UDP, SrcPort: c.lport, DstPort: dstPort })
+        if err != nil {
+            return err
+        }
+    }
+    return c.layer.send4(src, dst4, iface, c.lport, dstPort, c.ttl, c.tos, b)
+}
 
-func udpRecvWorker()  {
-    
-}
\ No newline at end of file
+//write6 sends the datagram to an ipv6 destination, writeLock has to be held.
+func (c *Conn) write6(b []byte, dst net.IP, dstPort uint16) error {
+    src := c.localIP
+    if src.IsUnspecified() {
+        var err error
+        src, err = c.layer.ipv6.SourceAddress(dst)
+        if err != nil {
+            return err
+        }
+    }
+    return c.layer.send6(src, dst, c.lport, dstPort, c.ttl, c.tos, b)
+}
+
+//SetBroadcast allows or forbids sending to the limited broadcast address and the broadcast addresses
+//of the subnets of this host like SO_BROADCAST, it is forbidden by default.
+func (c *Conn) SetBroadcast(on bool) {
+    c.writeLock.Lock()
+    c.broadcast = on
+    c.writeLock.Unlock()
+}
+
+//SetBroadcastInterface selects the interface datagrams to the limited broadcast address are sent through,
+//which is needed while the host has no address or route. With nil the interface is chosen by the routes.
+func (c *Conn) SetBroadcastInterface(iface netdev.Interface) {
+    c.writeLock.Lock()
+    c.bcastIface = iface
+    c.writeLock.Unlock()
+}
+
+//Close unregisters the socket, blocked reads return net.ErrClosed.
+func (c *Conn) Close() error {
+    _, lock := c.layer.table(c.isIPv4)
+    lock.Lock()
+    defer lock.Unlock()
+    if c.isClosed() {
+        return net.ErrClosed
+    }
+    c.detach()
+    return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+    return &net.UDPAddr{ IP: c.localIP, Port: int(c.lport) }
+}
+
+//RemoteAddr returns the peer of a connected socket and nil otherwise.
+func (c *Conn) RemoteAddr() net.Addr {
+    if !c.isConnected() {
+        return nil
+    }
+    return &net.UDPAddr{ IP: c.remoteIP, Port: int(c.rport) }
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+    c.readDeadline.Set(t)
+    c.writeDeadline.Set(t)
+    return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+    c.readDeadline.Set(t)
+    return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+    c.writeDeadline.Set(t)
+    return nil
+}
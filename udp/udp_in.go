@@ -0,0 +1,187 @@
+package udp
+
+import (
+	"context"
+	"encoding/binary"
+	"github.com/arcpop/network/ip"
+	"github.com/arcpop/network/ipv4"
+	"github.com/arcpop/network/ipv6"
+	"log"
+	"net"
+)
+
+const (
+    //HeaderLength is the length of an udp header
+    HeaderLength = 8
+)
+
+//Header represents an udp header
+type Header struct {
+    SourcePort uint16
+    DestinationPort uint16
+    Length uint16
+    Checksum uint16
+}
+
+func parseHeader(buf []byte) *Header {
+    if len(buf) < HeaderLength {
+        return nil
+    }
+    return &Header{
+        SourcePort: binary.BigEndian.Uint16(buf[0:2]),
+        DestinationPort: binary.BigEndian.Uint16(buf[2:4]),
+        Length: binary.BigEndian.Uint16(buf[4:6]),
+        Checksum: binary.BigEndian.Uint16(buf[6:8]),
+    }
+}
+
+//IPv4In queues a received datagram for the receive workers, it is called by the ipv4 layer.
+func (l *Layer) IPv4In(header *ipv4.Header, data []byte) {
+    select {
+    case l.udpRecvQueue4 <- &ipv4.L3Packet{IPHeader: header, ProtocolData: data}:
+    default:
+        log.Println("UDP: Receive queue full, dropping datagram.")
+    }
+}
+
+//IPv6In queues a received datagram for the receive workers, it is called by the ipv6 layer.
+func (l *Layer) IPv6In(header *ipv6.Header, data []byte) {
+    select {
+    case l.udpRecvQueue6 <- &ipv6.L3Packet{IPHeader: header, ProtocolData: data}:
+    default:
+        log.Println("UDP: Receive queue full, dropping datagram.")
+    }
+}
+
+func (l *Layer) udpRecvWorker(ctx context.Context) {
+    defer l.workers.Done()
+    for {
+        select {
+        case <- ctx.Done():
+            return
+        case pkt := <- l.udpRecvQueue4:
+            l.in4(pkt.IPHeader, pkt.ProtocolData)
+        case pkt := <- l.udpRecvQueue6:
+            l.in6(pkt.IPHeader, pkt.ProtocolData)
+        }
+    }
+}
+
+func (l *Layer) in4(ipHdr *ipv4.Header, data []byte) {
+    hdr := parseHeader(data)
+    if hdr == nil {
+        log.Println("UDP: Packet too short!")
+        return
+    }
+    if int(hdr.Length) < HeaderLength || int(hdr.Length) > len(data) {
+        log.Println("UDP: Invalid length field.")
+        return
+    }
+    data = data[:hdr.Length]
+    //A zero checksum means the sender did not compute one
+    if hdr.Checksum != 0 && ipv4.PseudoHeaderChecksum(ipHdr.SourceIP, ipHdr.TargetIP, ip.IPPROTO_UDP, data) != 0 {
+        log.Println("UDP: Checksum mismatch, dropping.")
+        return
+    }
+
+    l.udpConnections4Lock.RLock()
+    defer l.udpConnections4Lock.RUnlock()
+    c, ok := l.udpConnections4[hdr.DestinationPort]
+    if !ok || (!c.localIP.IsUnspecified() && !c.localIP.Equal(ipHdr.TargetIP)) {
+        l.ipv4.SendDestinationUnreachable(ip.ICMPCodePortUnreachable, ipHdr, data)
+        return
+    }
+    c.queue(hdr, ipHdr.SourceIP, data)
+}
+
+func (l *Layer) in6(ipHdr *ipv6.Header, data []byte) {
+    hdr := parseHeader(data)
+    if hdr == nil {
+        log.Println("UDP: Packet too short!")
+        return
+    }
+    if int(hdr.Length) < HeaderLength || int(hdr.Length) > len(data) {
+        log.Println("UDP: Invalid length field.")
+        return
+    }
+    data = data[:hdr.Length]
+    //The checksum is mandatory over ipv6 (RFC 8200 section 8.1)
+    if hdr.Checksum == 0 || ipv6.PseudoHeaderChecksum(ipHdr.SourceIP, ipHdr.TargetIP, ip.IPPROTO_UDP, data) != 0 {
+        log.Println("UDP: Checksum mismatch, dropping.")
+        return
+    }
+
+    l.udpConnections6Lock.RLock()
+    defer l.udpConnections6Lock.RUnlock()
+    c, ok := l.udpConnections6[hdr.DestinationPort]
+    if !ok || (!c.localIP.IsUnspecified() && !c.localIP.Equal(ipHdr.TargetIP)) {
+        l.ipv6.SendDestinationUnreachable(ip.ICMPv6CodePortUnreachable, ipHdr, data)
+        return
+    }
+    c.queue(hdr, ipHdr.SourceIP, data)
+}
+
+//queue hands the datagram from src to the socket, connected sockets only accept datagrams from their peer.
+func (c *Conn) queue(hdr *Header, src net.IP, data []byte) {
+    if c.isConnected() && (c.rport != hdr.SourcePort || !c.remoteIP.Equal(src)) {
+        return
+    }
+    d := &datagram{
+        data: make([]byte, len(data) - HeaderLength),
+        addr: &net.UDPAddr{ IP: make(net.IP, len(src)), Port: int(hdr.SourcePort) },
+    }
+    copy(d.data, data[HeaderLength:])
+    copy(d.addr.IP, src)
+    select {
+    case c.recvQueue <- d:
+    default:
+        log.Println("UDP: Connection receive queue full, dropping datagram.")
+    }
+}
+
+//IPv4Error reports an icmp error to the connected socket which sent the original datagram,
+//unconnected sockets do not get errors just like on linux. It is called by the ipv4 layer.
+func (l *Layer) IPv4Error(err *ipv4.ICMPError, original *ipv4.Header, data []byte) {
+    c := l.sendingConn(true, original.SourceIP, original.TargetIP, data)
+    if c != nil && c.isConnected() {
+        c.setError(err)
+    }
+}
+
+//IPv6Error reports an icmpv6 error to the connected socket which sent the original datagram, it is called
+//by the ipv6 layer. A packet too big message about the datagram of any socket shrinks the path mtu instead.
+func (l *Layer) IPv6Error(err *ipv6.ICMPError, original *ipv6.Header, data []byte) {
+    c := l.sendingConn(false, original.SourceIP, original.TargetIP, data)
+    if c == nil {
+        return
+    }
+    if err.Type == ip.ICMPv6TypePacketTooBig {
+        l.ipv6.UpdatePathMTU(original.TargetIP, int(err.MTU))
+        return
+    }
+    if c.isConnected() {
+        c.setError(err)
+    }
+}
+
+//sendingConn returns the socket which could have sent the datagram starting with data from src to dst.
+func (l *Layer) sendingConn(isIPv4 bool, src, dst net.IP, data []byte) *Conn {
+    hdr := parseHeader(data)
+    if hdr == nil {
+        return nil
+    }
+    conns, lock := l.table(isIPv4)
+    lock.RLock()
+    defer lock.RUnlock()
+    c, ok := conns[hdr.SourcePort]
+    if !ok {
+        return nil
+    }
+    if c.isConnected() && (c.rport != hdr.DestinationPort || !c.remoteIP.Equal(dst)) {
+        return nil
+    }
+    if !c.localIP.IsUnspecified() && !c.localIP.Equal(src) {
+        return nil
+    }
+    return c
+}
@@ -0,0 +1,89 @@
+package udp
+
+import (
+	"encoding/binary"
+	"github.com/arcpop/network/ip"
+	"github.com/arcpop/network/ipv4"
+	"github.com/arcpop/network/ipv6"
+	"github.com/arcpop/network/netdev"
+	"net"
+	"sync/atomic"
+)
+
+const (
+    //MaxPayloadLength is the largest payload fitting into an ipv4 datagram
+    MaxPayloadLength = 0xFFFF - ipv4.HeaderLength - HeaderLength
+    //MaxPayloadLength6 is the largest payload the length field of the udp header can describe,
+    //ipv6 carries it without a jumbogram
+    MaxPayloadLength6 = 0xFFFF - HeaderLength
+)
+
+func (h *Header) put(buf []byte) {
+    binary.BigEndian.PutUint16(buf[0:2], h.SourcePort)
+    binary.BigEndian.PutUint16(buf[2:4], h.DestinationPort)
+    binary.BigEndian.PutUint16(buf[4:6], h.Length)
+    binary.BigEndian.PutUint16(buf[6:8], h.Checksum)
+}
+
+//send4 builds the udp header including the checksum over the ipv4 pseudo header and sends the datagram.
+//iface is the interface a datagram to the limited broadcast address is sent through, nil lets the routes decide.
+//The identification is shared by all sockets, so datagrams of two sockets to one destination never get the same.
+func (l *Layer) send4(srcIP, dstIP net.IP, iface netdev.Interface, srcPort, dstPort uint16, ttl, tos byte, payload []byte) error {
+    if len(payload) > MaxPayloadLength {
+        return ErrMessageTooLong
+    }
+    pkt := ipv4.AllocatePacket(HeaderLength + len(payload))
+    hdr := &Header{
+        SourcePort: srcPort,
+        DestinationPort: dstPort,
+        Length: uint16(HeaderLength + len(payload)),
+    }
+    hdr.put(pkt.ProtocolData)
+    copy(pkt.ProtocolData[HeaderLength:], payload)
+    csum := ipv4.PseudoHeaderChecksum(srcIP, dstIP, ip.IPPROTO_UDP, pkt.ProtocolData)
+    //A computed checksum of zero is transmitted as all ones, zero means no checksum
+    if csum == 0 {
+        csum = 0xFFFF
+    }
+    binary.BigEndian.PutUint16(pkt.ProtocolData[6:8], csum)
+    pkt.IPHeader = &ipv4.Header{
+        TargetIP: dstIP,
+        SourceIP: srcIP,
+        Identification: uint16(atomic.AddUint32(&l.identification, 1)),
+        TTL: ttl,
+        TOS: tos,
+        Protocol: ip.IPPROTO_UDP,
+    }
+    pkt.Iface = iface
+    return l.ipv4.Send(pkt)
+}
+
+//send6 builds the udp header including the checksum over the ipv6 pseudo header and sends the datagram,
+//the ipv6 layer fragments it if it exceeds the mtu of the path.
+func (l *Layer) send6(srcIP, dstIP net.IP, srcPort, dstPort uint16, hopLimit, trafficClass byte, payload []byte) error {
+    if len(payload) > MaxPayloadLength6 {
+        return ErrMessageTooLong
+    }
+    pkt := ipv6.AllocatePacket(HeaderLength + len(payload))
+    hdr := &Header{
+        SourcePort: srcPort,
+        DestinationPort: dstPort,
+        Length: uint16(HeaderLength + len(payload)),
+    }
+    hdr.put(pkt.ProtocolData)
+    copy(pkt.ProtocolData[HeaderLength:], payload)
+    csum := ipv6.PseudoHeaderChecksum(srcIP, dstIP, ip.IPPROTO_UDP, pkt.ProtocolData)
+    //A computed checksum of zero is transmitted as all ones, zero is not allowed over ipv6
+    if csum == 0 {
+        csum = 0xFFFF
+    }
+    binary.BigEndian.PutUint16(pkt.ProtocolData[6:8], csum)
+    pkt.IPHeader = &ipv6.Header{
+        TargetIP: dstIP,
+        SourceIP: srcIP,
+        NextHeader: ip.IPPROTO_UDP,
+        HopLimit: hopLimit,
+        TrafficClass: trafficClass,
+    }
+    return l.ipv6.Send(pkt)
+}
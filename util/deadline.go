@@ -0,0 +1,74 @@
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+//Deadline implements the deadline semantics of net.Conn: the channel returned by Done
+//is closed once the deadline passed, setting a new deadline also affects blocked operations.
+type Deadline struct {
+    lock sync.Mutex
+    timer *time.Timer
+    done chan struct{}
+}
+
+//NewDeadline creates a deadline which is not set.
+func NewDeadline() *Deadline {
+    return &Deadline{ done: make(chan struct{}) }
+}
+
+//Set sets the deadline, the zero time clears it.
+func (d *Deadline) Set(t time.Time) {
+    d.lock.Lock()
+    defer d.lock.Unlock()
+    if d.timer != nil && !d.timer.Stop() {
+        //The timer already fired or is about to, wait for the channel to be closed
+        <- d.done
+    }
+    d.timer = nil
+
+    closed := false
+    select {
+        case <- d.done:
+            closed = true
+        default:
+    }
+    if t.IsZero() {
+        if closed {
+            d.done = make(chan struct{})
+        }
+        return
+    }
+    dur := time.Until(t)
+    if dur <= 0 {
+        if !closed {
+            close(d.done)
+        }
+        return
+    }
+    if closed {
+        d.done = make(chan struct{})
+    }
+    done := d.done
+    d.timer = time.AfterFunc(dur, func() {
+        close(done)
+    })
+}
+
+//Done returns a channel which is closed when the deadline passed.
+func (d *Deadline) Done() <-chan struct{} {
+    d.lock.Lock()
+    defer d.lock.Unlock()
+    return d.done
+}
+
+//Exceeded returns true if the deadline passed.
+func (d *Deadline) Exceeded() bool {
+    select {
+        case <- d.Done():
+            return true
+        default:
+            return false
+    }
+}
@@ -10,11 +10,13 @@ import (
 var ErrNotImplemented = errors.New("Functionality not implemented")
 
 
-//ChannelClosed returns true if the stop channel is closed and false otherwise.
+//ChannelClosed returns true if the stop channel is closed and false otherwise, it never blocks.
 func ChannelClosed(stop chan bool) bool {
     select {
         case _, ok := <- stop:
-            return ok
+            return !ok
+        default:
+            return false
     }
 }
 